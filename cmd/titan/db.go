@@ -2,9 +2,14 @@ package main
 
 import (
 	"errors"
+	"log/slog"
+	"os"
 
 	"github.com/manvalls/titan/database"
+	"github.com/manvalls/titan/database/memory"
 	"github.com/manvalls/titan/database/mysql"
+	"github.com/manvalls/titan/database/postgres"
+	"github.com/manvalls/titan/database/sqlite"
 	"github.com/urfave/cli"
 )
 
@@ -13,14 +18,64 @@ var errDbNotSup = errors.New("Database driver not supported")
 func newDB(c *cli.Context) (database.Db, error) {
 	var db database.Db
 
+	atime, err := database.ParseAtimePolicy(c.String("atime"))
+	if err != nil {
+		return nil, err
+	}
+
 	switch c.String("db-driver") {
 	case "mysql":
-		db = &mysql.Driver{DbURI: c.String("db-uri")}
+		opts := []mysql.Option{
+			mysql.WithCapacity(c.Uint64("quota-bytes"), c.Uint64("quota-inodes")),
+			mysql.WithBlockSize(c.Uint64("block-size")),
+			mysql.WithAtime(atime),
+			mysql.WithDedup(c.Bool("dedup")),
+			mysql.WithReadOnly(c.Bool("read-only")),
+			mysql.WithDeadlockRetries(c.Int("mysql-deadlock-retries")),
+			mysql.WithTablePrefix(c.String("mysql-table-prefix")),
+		}
+
+		if threshold := c.Duration("mysql-slow-threshold"); threshold > 0 {
+			opts = append(opts, mysql.WithLogger(slog.New(slog.NewTextHandler(os.Stderr, nil)), threshold))
+		}
+
+		db = mysql.New(c.String("db-uri"), opts...)
+	case "postgres":
+		db = &postgres.Driver{
+			DbURI:         c.String("db-uri"),
+			Capacity:      c.Uint64("quota-bytes"),
+			InodeCapacity: c.Uint64("quota-inodes"),
+			BlockSize:     c.Uint64("block-size"),
+			Atime:         atime,
+			Dedup:         c.Bool("dedup"),
+			ReadOnly:      c.Bool("read-only"),
+		}
+	case "sqlite":
+		db = &sqlite.Driver{
+			DbURI:         c.String("db-uri"),
+			BusyRetries:   c.Int("sqlite-busy-retries"),
+			ForeignKeys:   c.Bool("sqlite-foreign-keys"),
+			Capacity:      c.Uint64("quota-bytes"),
+			InodeCapacity: c.Uint64("quota-inodes"),
+			BlockSize:     c.Uint64("block-size"),
+			Atime:         atime,
+			Dedup:         c.Bool("dedup"),
+			ReadOnly:      c.Bool("read-only"),
+		}
+	case "memory":
+		db = &memory.Driver{
+			Capacity:      c.Uint64("quota-bytes"),
+			InodeCapacity: c.Uint64("quota-inodes"),
+			BlockSize:     c.Uint64("block-size"),
+			Atime:         atime,
+			Dedup:         c.Bool("dedup"),
+			ReadOnly:      c.Bool("read-only"),
+		}
 	default:
 		return nil, errDbNotSup
 	}
 
-	err := db.Open()
+	err = db.Open()
 	if err != nil {
 		return nil, err
 	}
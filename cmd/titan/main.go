@@ -1,16 +1,30 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"log"
+	"net/http"
 	"os"
 	"time"
 
 	"github.com/manvalls/fuse"
 	"github.com/manvalls/titan"
+	"github.com/manvalls/titan/database"
+	"github.com/manvalls/titan/database/attrcache"
+	"github.com/manvalls/titan/database/casefold"
+	"github.com/manvalls/titan/database/metrics"
+	"github.com/manvalls/titan/database/trash"
+	"github.com/manvalls/titan/gc"
+	"github.com/manvalls/titan/storage/lru"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/urfave/cli"
 )
 
+var errInconsistent = errors.New("The file system is inconsistent")
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "Titan FS"
@@ -32,6 +46,65 @@ func main() {
 			Value:  "root:@/titan",
 			EnvVar: "TITAN_DB_URI",
 		},
+		cli.Uint64Flag{
+			Name:   "quota-bytes",
+			Usage:  "file system capacity in bytes, unlimited if zero",
+			EnvVar: "TITAN_QUOTA_BYTES",
+		},
+		cli.Uint64Flag{
+			Name:   "quota-inodes",
+			Usage:  "file system capacity in inodes, unlimited if zero",
+			EnvVar: "TITAN_QUOTA_INODES",
+		},
+		cli.StringFlag{
+			Name:   "atime",
+			Value:  "relatime",
+			Usage:  "when reads update access times: strictatime, relatime or noatime",
+			EnvVar: "TITAN_ATIME",
+		},
+		cli.Uint64Flag{
+			Name:   "block-size",
+			Usage:  "preferred IO size in bytes reported by statfs, holes of grown files aligning to it",
+			EnvVar: "TITAN_BLOCK_SIZE",
+		},
+		cli.BoolFlag{
+			Name:   "dedup",
+			Usage:  "store identical chunks once, for backup-style workloads",
+			EnvVar: "TITAN_DEDUP",
+		},
+		cli.BoolFlag{
+			Name:   "read-only",
+			Usage:  "refuse every change to the file system, e.g when exporting backups",
+			EnvVar: "TITAN_READ_ONLY",
+		},
+		cli.IntFlag{
+			Name:   "mysql-deadlock-retries",
+			Value:  3,
+			Usage:  "number of retries of MySQL writes aborted by a deadlock",
+			EnvVar: "TITAN_MYSQL_DEADLOCK_RETRIES",
+		},
+		cli.StringFlag{
+			Name:   "mysql-table-prefix",
+			Usage:  "prefix of the MySQL table names, letting several file systems share a database",
+			EnvVar: "TITAN_MYSQL_TABLE_PREFIX",
+		},
+		cli.DurationFlag{
+			Name:   "mysql-slow-threshold",
+			Value:  0,
+			Usage:  "time after which MySQL operations are logged as slow, disabled if zero",
+			EnvVar: "TITAN_MYSQL_SLOW_THRESHOLD",
+		},
+		cli.IntFlag{
+			Name:   "sqlite-busy-retries",
+			Value:  10,
+			Usage:  "number of retries when the SQLite database is busy",
+			EnvVar: "TITAN_SQLITE_BUSY_RETRIES",
+		},
+		cli.BoolFlag{
+			Name:   "sqlite-foreign-keys",
+			Usage:  "enforce foreign keys in the SQLite database",
+			EnvVar: "TITAN_SQLITE_FOREIGN_KEYS",
+		},
 
 		// Storage options
 		cli.StringFlag{
@@ -46,6 +119,30 @@ func main() {
 			Usage:  "storage name",
 			EnvVar: "TITAN_STORAGE_NAME",
 		},
+		cli.StringFlag{
+			Name:   "storage-compression",
+			Value:  "",
+			Usage:  "codec used to compress new chunks: gzip or zstd, disabled if empty",
+			EnvVar: "TITAN_STORAGE_COMPRESSION",
+		},
+		cli.StringFlag{
+			Name:   "storage-encryption-key",
+			Value:  "",
+			Usage:  "base64 encoded 256 bit key used to encrypt chunks, disabled if empty",
+			EnvVar: "TITAN_STORAGE_ENCRYPTION_KEY",
+		},
+		cli.IntFlag{
+			Name:   "storage-retry-attempts",
+			Value:  5,
+			Usage:  "maximum attempts of storage operations failing with transient errors, 1 disables retries",
+			EnvVar: "TITAN_STORAGE_RETRY_ATTEMPTS",
+		},
+		cli.IntFlag{
+			Name:   "storage-retry-buffer",
+			Value:  8 << 20,
+			Usage:  "bytes of each upload kept in memory so that it can be retried, uploads failing after reading more aren't",
+			EnvVar: "TITAN_STORAGE_RETRY_BUFFER",
+		},
 
 		cli.StringFlag{
 			Name:   "s3-bucket",
@@ -83,6 +180,117 @@ func main() {
 			Usage:  "S3 endpoint",
 			EnvVar: "TITAN_S3_ENDPOINT",
 		},
+		cli.BoolFlag{
+			Name:   "s3-force-path-style",
+			Usage:  "use path-style S3 URLs, as required by MinIO",
+			EnvVar: "TITAN_S3_FORCE_PATH_STYLE",
+		},
+
+		cli.StringFlag{
+			Name:   "gcs-bucket",
+			Value:  "titan",
+			Usage:  "GCS bucket",
+			EnvVar: "TITAN_GCS_BUCKET",
+		},
+		cli.StringFlag{
+			Name:   "gcs-project",
+			Value:  "",
+			Usage:  "GCS project the bucket belongs to",
+			EnvVar: "TITAN_GCS_PROJECT",
+		},
+		cli.StringFlag{
+			Name:   "gcs-credentials",
+			Value:  "",
+			Usage:  "path to a GCS JSON key, uses the default credentials if empty",
+			EnvVar: "TITAN_GCS_CREDENTIALS",
+		},
+		cli.StringFlag{
+			Name:   "gcs-prefix",
+			Value:  "",
+			Usage:  "prefix for GCS object names",
+			EnvVar: "TITAN_GCS_PREFIX",
+		},
+
+		cli.StringFlag{
+			Name:   "azblob-account",
+			Value:  "",
+			Usage:  "Azure storage account",
+			EnvVar: "TITAN_AZBLOB_ACCOUNT",
+		},
+		cli.StringFlag{
+			Name:   "azblob-key",
+			Value:  "",
+			Usage:  "Azure storage account key, uses Azure AD default credentials if empty",
+			EnvVar: "TITAN_AZBLOB_KEY",
+		},
+		cli.StringFlag{
+			Name:   "azblob-endpoint",
+			Value:  "",
+			Usage:  "Azure blob service URL, derived from the account if empty",
+			EnvVar: "TITAN_AZBLOB_ENDPOINT",
+		},
+		cli.StringFlag{
+			Name:   "azblob-container",
+			Value:  "titan",
+			Usage:  "Azure blob container",
+			EnvVar: "TITAN_AZBLOB_CONTAINER",
+		},
+		cli.StringFlag{
+			Name:   "azblob-prefix",
+			Value:  "",
+			Usage:  "prefix for Azure blob names",
+			EnvVar: "TITAN_AZBLOB_PREFIX",
+		},
+
+		cli.StringFlag{
+			Name:   "sftp-addr",
+			Value:  "",
+			Usage:  "host:port of the SSH server used by the sftp storage driver",
+			EnvVar: "TITAN_SFTP_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "sftp-user",
+			Value:  "titan",
+			Usage:  "SSH user",
+			EnvVar: "TITAN_SFTP_USER",
+		},
+		cli.StringFlag{
+			Name:   "sftp-password",
+			Value:  "",
+			Usage:  "SSH password",
+			EnvVar: "TITAN_SFTP_PASSWORD",
+		},
+		cli.StringFlag{
+			Name:   "sftp-key",
+			Value:  "",
+			Usage:  "path to the SSH private key",
+			EnvVar: "TITAN_SFTP_KEY",
+		},
+		cli.StringFlag{
+			Name:   "sftp-known-hosts",
+			Value:  "",
+			Usage:  "path to the known_hosts file checking the server host key",
+			EnvVar: "TITAN_SFTP_KNOWN_HOSTS",
+		},
+		cli.StringFlag{
+			Name:   "sftp-root",
+			Value:  "/var/lib/titan",
+			Usage:  "remote folder where chunks are stored",
+			EnvVar: "TITAN_SFTP_ROOT",
+		},
+		cli.IntFlag{
+			Name:   "sftp-connections",
+			Value:  4,
+			Usage:  "SSH connections shared by storage operations",
+			EnvVar: "TITAN_SFTP_CONNECTIONS",
+		},
+
+		cli.StringFlag{
+			Name:   "file-root",
+			Value:  "/var/lib/titan",
+			Usage:  "folder where chunks are stored by the file storage driver",
+			EnvVar: "TITAN_FILE_ROOT",
+		},
 	}
 
 	app.Commands = []cli.Command{
@@ -122,6 +330,133 @@ func main() {
 			},
 		},
 
+		cli.Command{
+			Name:  "migrate",
+			Flags: flags,
+			Action: func(c *cli.Context) error {
+				l := log.New(os.Stderr, "", 0)
+
+				db, err := newDB(c)
+				if err != nil {
+					l.Println(err)
+					return err
+				}
+
+				defer db.Close()
+
+				err = db.Migrate(context.Background())
+				if err != nil {
+					l.Println(err)
+					return err
+				}
+
+				return nil
+			},
+		},
+
+		cli.Command{
+			Name: "fsck",
+			Flags: append(
+				flags,
+				cli.BoolFlag{
+					Name:   "repair",
+					Usage:  "fix wrong reference counts",
+					EnvVar: "TITAN_FSCK_REPAIR",
+				},
+			),
+			Action: func(c *cli.Context) error {
+				l := log.New(os.Stderr, "", 0)
+
+				db, err := newDB(c)
+				if err != nil {
+					l.Println(err)
+					return err
+				}
+
+				defer db.Close()
+
+				report, err := db.Fsck(context.Background(), c.Bool("repair"))
+				if err != nil {
+					l.Println(err)
+					return err
+				}
+
+				for _, m := range report.Refcounts {
+					l.Printf("inode %d has a reference count of %d but %d links\n", m.Inode, m.Refcount, m.Links)
+				}
+
+				for _, link := range report.Dangling {
+					l.Printf("entry %q under inode %d points to inode %d, one of them is missing\n", link.Name, link.Parent, link.Inode)
+				}
+
+				for _, inode := range report.Unreachable {
+					l.Printf("inode %d is unreachable from the root\n", inode)
+				}
+
+				if report.Repaired && len(report.Refcounts) > 0 {
+					l.Printf("fixed %d reference counts\n", len(report.Refcounts))
+				}
+
+				if len(report.Dangling) > 0 || len(report.Unreachable) > 0 || (len(report.Refcounts) > 0 && !report.Repaired) {
+					return errInconsistent
+				}
+
+				return nil
+			},
+		},
+
+		cli.Command{
+			Name:  "export",
+			Flags: flags,
+			Action: func(c *cli.Context) error {
+				l := log.New(os.Stderr, "", 0)
+
+				db, err := newDB(c)
+				if err != nil {
+					l.Println(err)
+					return err
+				}
+
+				defer db.Close()
+
+				w := bufio.NewWriter(os.Stdout)
+				if err = db.Export(context.Background(), w); err == nil {
+					err = w.Flush()
+				}
+
+				if err != nil {
+					l.Println(err)
+					return err
+				}
+
+				return nil
+			},
+		},
+
+		cli.Command{
+			Name:  "import",
+			Flags: flags,
+			Action: func(c *cli.Context) error {
+				l := log.New(os.Stderr, "", 0)
+
+				db, err := newDB(c)
+				if err != nil {
+					l.Println(err)
+					return err
+				}
+
+				defer db.Close()
+
+				err = db.Import(context.Background(), os.Stdin)
+				if err != nil {
+					l.Println(err)
+					return err
+				}
+
+				return nil
+			},
+		},
+
 		cli.Command{
 			Name: "clean",
 			Flags: append(
@@ -138,6 +473,17 @@ func main() {
 					Usage:  "number of parallel workers",
 					EnvVar: "TITAN_CLEAN_WORKERS",
 				},
+				cli.BoolFlag{
+					Name:   "dry-run",
+					Usage:  "only report what would be removed",
+					EnvVar: "TITAN_CLEAN_DRY_RUN",
+				},
+				cli.DurationFlag{
+					Name:   "trash-retention",
+					Value:  0,
+					Usage:  "time unlinked entries are kept in the " + trash.Dir + " directory, disabled if zero",
+					EnvVar: "TITAN_TRASH_RETENTION",
+				},
 			),
 			Action: func(c *cli.Context) error {
 				l := log.New(os.Stderr, "", 0)
@@ -150,26 +496,39 @@ func main() {
 
 				defer db.Close()
 
-				err = db.CleanOrphanInodes(context.Background())
+				st, err := newStorage(c)
 				if err != nil {
 					l.Println(err)
 					return err
 				}
 
-				st, err := newStorage(c)
-				if err != nil {
-					l.Println(err)
-					return err
+				collector := gc.NewCollector()
+				collector.Db = db
+				collector.Storage = st
+
+				if retention := c.Duration("trash-retention"); retention > 0 {
+					collector.Db = trash.WithTrash(db, retention)
+				}
+
+				cfg := gc.Config{
+					GracePeriod: c.Duration("keep-last"),
+					Workers:     c.Int("workers"),
+					Inodes:      true,
 				}
 
-				err = db.CleanOrphanChunks(
-					context.Background(),
-					time.Now().Add(-c.Duration("keep-last")),
-					st,
-					c.Int("workers"),
-				)
+				if c.Bool("dry-run") {
+					report, err := collector.CountGarbage(context.Background(), cfg)
+					if err != nil {
+						l.Println(err)
+						return err
+					}
 
-				return err
+					l.Printf("%d inodes (%d bytes) with %d extended attributes and %d chunks would be removed", report.Inodes, report.Size, report.Xattrs, report.OrphanedChunks)
+					l.Printf("%d orphaned chunks would be removed along with %d objects", report.Chunks, report.Objects)
+					return nil
+				}
+
+				return collector.GarbageCollect(context.Background(), cfg)
 			},
 		},
 
@@ -267,6 +626,78 @@ func main() {
 					Usage:  "enable file capabilities",
 					EnvVar: "TITAN_ENABLE_CAPABILITIES",
 				},
+				cli.Uint64Flag{
+					Name:   "chunk-cache-size",
+					Value:  0,
+					Usage:  "max bytes of chunk contents to keep in memory, disabled if zero",
+					EnvVar: "TITAN_CHUNK_CACHE_SIZE",
+				},
+				cli.DurationFlag{
+					Name:   "chunk-cache-ttl",
+					Value:  10 * time.Minute,
+					Usage:  "time chunk contents are kept in memory",
+					EnvVar: "TITAN_CHUNK_CACHE_TTL",
+				},
+				cli.IntFlag{
+					Name:   "attr-cache-size",
+					Value:  0,
+					Usage:  "max inode attributes and entries to keep in memory, disabled if zero",
+					EnvVar: "TITAN_ATTR_CACHE_SIZE",
+				},
+				cli.DurationFlag{
+					Name:   "attr-cache-ttl",
+					Value:  1 * time.Second,
+					Usage:  "time inode attributes and entries are kept in memory",
+					EnvVar: "TITAN_ATTR_CACHE_TTL",
+				},
+				cli.IntFlag{
+					Name:   "attr-cache-misses",
+					Value:  0,
+					Usage:  "max missing entries to keep in memory, disabled if zero",
+					EnvVar: "TITAN_ATTR_CACHE_MISSES",
+				},
+				cli.DurationFlag{
+					Name:   "attr-cache-miss-ttl",
+					Value:  1 * time.Second,
+					Usage:  "time missing entries are kept in memory",
+					EnvVar: "TITAN_ATTR_CACHE_MISS_TTL",
+				},
+				cli.StringFlag{
+					Name:   "case-fold",
+					Value:  "",
+					Usage:  "folding names are compared with, unicode or ascii, case-sensitive if empty",
+					EnvVar: "TITAN_CASE_FOLD",
+				},
+				cli.DurationFlag{
+					Name:   "trash-retention",
+					Value:  0,
+					Usage:  "time unlinked entries are kept in the " + trash.Dir + " directory, disabled if zero",
+					EnvVar: "TITAN_TRASH_RETENTION",
+				},
+				cli.DurationFlag{
+					Name:   "gc-interval",
+					Value:  0,
+					Usage:  "time between background garbage collections, disabled if zero",
+					EnvVar: "TITAN_GC_INTERVAL",
+				},
+				cli.DurationFlag{
+					Name:   "gc-jitter",
+					Value:  0,
+					Usage:  "maximum random delay added to the gc interval, a tenth of it if zero",
+					EnvVar: "TITAN_GC_JITTER",
+				},
+				cli.DurationFlag{
+					Name:   "gc-grace-period",
+					Value:  1 * time.Hour,
+					Usage:  "time orphaned chunks are kept before being collected",
+					EnvVar: "TITAN_GC_GRACE_PERIOD",
+				},
+				cli.StringFlag{
+					Name:   "metrics-address",
+					Value:  "",
+					Usage:  "address to serve Prometheus metrics at, disabled if empty",
+					EnvVar: "TITAN_METRICS_ADDRESS",
+				},
 			),
 			Action: func(c *cli.Context) error {
 				l := log.New(os.Stderr, "", 0)
@@ -277,8 +708,57 @@ func main() {
 					return err
 				}
 
+				if address := c.String("metrics-address"); address != "" {
+					db, err = metrics.WithMetrics(db, prometheus.DefaultRegisterer)
+					if err != nil {
+						l.Println(err)
+						return err
+					}
+
+					go func() {
+						l.Println(http.ListenAndServe(address, promhttp.Handler()))
+					}()
+				}
+
+				if size, misses := c.Int("attr-cache-size"), c.Int("attr-cache-misses"); size > 0 || misses > 0 {
+					var reg prometheus.Registerer
+					if c.String("metrics-address") != "" {
+						reg = prometheus.DefaultRegisterer
+					}
+
+					cache, err := attrcache.WithAttrCache(db, size, c.Duration("attr-cache-ttl"), reg)
+					if err != nil {
+						l.Println(err)
+						return err
+					}
+
+					cache.MaxMisses = misses
+					cache.MissTTL = c.Duration("attr-cache-miss-ttl")
+					db = cache
+				}
+
+				if name := c.String("case-fold"); name != "" {
+					fold, err := casefold.ParseFolding(name)
+					if err != nil {
+						l.Println(err)
+						return err
+					}
+
+					db = casefold.WithCaseFolding(db, fold)
+				}
+
+				if retention := c.Duration("trash-retention"); retention > 0 {
+					db = trash.WithTrash(db, retention)
+				}
+
 				defer db.Close()
 
+				err = database.PurgeExpired(context.Background(), db)
+				if err != nil {
+					l.Println(err)
+					return err
+				}
+
 				err = db.CleanOrphanInodes(context.Background())
 				if err != nil {
 					l.Println(err)
@@ -291,6 +771,19 @@ func main() {
 					return err
 				}
 
+				if size := c.Uint64("chunk-cache-size"); size > 0 {
+					var reg prometheus.Registerer
+					if c.String("metrics-address") != "" {
+						reg = prometheus.DefaultRegisterer
+					}
+
+					st, err = lru.WithLRU(st, size, c.Duration("chunk-cache-ttl"), reg)
+					if err != nil {
+						l.Println(err)
+						return err
+					}
+				}
+
 				mountPoint := c.String("mount-point")
 				fuse.Unmount(mountPoint)
 				os.MkdirAll(mountPoint, os.ModePerm)
@@ -380,6 +873,26 @@ func main() {
 					return err
 				}
 
+				if interval := c.Duration("gc-interval"); interval > 0 {
+					collector := gc.NewCollector()
+					collector.Db = db
+					collector.Storage = st
+					collector.Interval = interval
+					collector.GracePeriod = c.Duration("gc-grace-period")
+					collector.OnError = func(err error) { l.Println(err) }
+
+					reaper := gc.NewReaper(collector)
+					if jitter := c.Duration("gc-jitter"); jitter > 0 {
+						reaper.Jitter = jitter
+					}
+
+					ctx, cancel := context.WithCancel(context.Background())
+					reaper.Start(ctx)
+
+					defer reaper.Wait()
+					defer cancel()
+				}
+
 				return mfs.Join(context.Background())
 			},
 		},
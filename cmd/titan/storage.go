@@ -1,23 +1,36 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
 
+	gstorage "cloud.google.com/go/storage"
 	"github.com/manvalls/titan/storage"
+	"github.com/manvalls/titan/storage/azblob"
+	"github.com/manvalls/titan/storage/compress"
+	"github.com/manvalls/titan/storage/encrypt"
+	"github.com/manvalls/titan/storage/file"
+	"github.com/manvalls/titan/storage/gcs"
 	"github.com/manvalls/titan/storage/multi"
+	"github.com/manvalls/titan/storage/retry"
 	"github.com/manvalls/titan/storage/s3"
+	"github.com/manvalls/titan/storage/sftp"
 	"github.com/manvalls/titan/storage/zero"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	as3 "github.com/aws/aws-sdk-go/service/s3"
+	aazblob "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
 	"github.com/urfave/cli"
+	"google.golang.org/api/option"
 )
 
 var errStorageNotSup = errors.New("Storage driver not supported")
 
 func newStorage(c *cli.Context) (st storage.Storage, err error) {
 	storageName := c.String("storage-name")
+	classifier := retry.Retryable
 
 	switch c.String("storage-driver") {
 
@@ -36,6 +49,10 @@ func newStorage(c *cli.Context) (st storage.Storage, err error) {
 			config.Endpoint = aws.String(endpoint)
 		}
 
+		if c.Bool("s3-force-path-style") {
+			config.S3ForcePathStyle = aws.Bool(true)
+		}
+
 		session, err := session.NewSession(config)
 		if err != nil {
 			return nil, err
@@ -47,11 +64,112 @@ func newStorage(c *cli.Context) (st storage.Storage, err error) {
 			Client:  as3.New(session),
 		}
 
+	case "gcs":
+		opts := []option.ClientOption{}
+
+		credentials := c.String("gcs-credentials")
+		if credentials != "" {
+			opts = append(opts, option.WithCredentialsFile(credentials))
+		}
+
+		client, err := gstorage.NewClient(context.Background(), opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		classifier = gcs.Retryable
+		st = &gcs.GCS{
+			Storage: storageName,
+			Bucket:  c.String("gcs-bucket"),
+			Project: c.String("gcs-project"),
+			Prefix:  c.String("gcs-prefix"),
+			Client:  client,
+		}
+
+	case "azblob":
+		endpoint := c.String("azblob-endpoint")
+		if endpoint == "" {
+			endpoint = azblob.ServiceURL(c.String("azblob-account"))
+		}
+
+		var client *aazblob.Client
+
+		if key := c.String("azblob-key"); key != "" {
+			client, err = azblob.NewSharedKeyClient(endpoint, c.String("azblob-account"), key)
+		} else {
+			client, err = azblob.NewDefaultCredentialClient(endpoint)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		classifier = azblob.Retryable
+		st = &azblob.AzBlob{
+			Storage:   storageName,
+			Container: c.String("azblob-container"),
+			Prefix:    c.String("azblob-prefix"),
+			Client:    client,
+		}
+
+	case "sftp":
+		config, err := sftp.NewClientConfig(
+			c.String("sftp-user"),
+			c.String("sftp-password"),
+			c.String("sftp-key"),
+			c.String("sftp-known-hosts"),
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		st = &sftp.SFTP{
+			Storage:     storageName,
+			Addr:        c.String("sftp-addr"),
+			Config:      config,
+			Root:        c.String("sftp-root"),
+			Connections: c.Int("sftp-connections"),
+		}
+
+	case "file":
+		st = &file.File{
+			Storage: storageName,
+			Root:    c.String("file-root"),
+		}
+
 	default:
 		return nil, errStorageNotSup
 
 	}
 
+	if attempts := c.Int("storage-retry-attempts"); attempts > 1 {
+		r := retry.WithRetry(st)
+		r.MaxAttempts = attempts
+		r.Classifier = classifier
+		r.MaxBuffer = c.Int("storage-retry-buffer")
+		st = r
+	}
+
+	if codec := c.String("storage-compression"); codec != "" {
+		st, err = compress.WithCompression(st, codec)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if encoded := c.String("storage-encryption-key"); encoded != "" {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+
+		st, err = encrypt.WithEncryption(st, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &multi.Multi{
 		Storages: map[string]storage.Storage{
 			storageName: st,
@@ -0,0 +1,455 @@
+package attrcache
+
+import (
+	"container/list"
+	"context"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// key identifies a cached result, either the attributes of an inode as
+// returned by Get, or the entry found by LookUp under a parent
+type key struct {
+	parent fuseops.InodeID
+	name   string
+	inode  fuseops.InodeID
+}
+
+type entry struct {
+	key     key
+	value   database.Entry
+	missing bool
+	expires time.Time
+}
+
+// Db wraps a database.Db keeping the results of Get and LookUp in memory,
+// evicting the least recently used ones once MaxEntries is exceeded. Results
+// are dropped whenever a mutating method is called for the inodes and the
+// directories they describe, so that a write is seen by every later read.
+// Access times updated by reads may be stale for up to TTL.
+//
+// Up to MaxMisses entries found missing by LookUp are remembered too, for
+// MissTTL, until an entry with the same name is created under the same
+// parent. Misses aren't cached if MaxMisses is zero.
+type Db struct {
+	database.Db
+	MaxEntries int
+	TTL        time.Duration
+	MaxMisses  int
+	MissTTL    time.Duration
+
+	mutex   sync.Mutex
+	epoch   uint64
+	order   *list.List
+	misses  *list.List
+	entries map[key]*list.Element
+	inodes  map[fuseops.InodeID]map[*list.Element]bool
+	parents map[fuseops.InodeID]map[*list.Element]bool
+
+	requests *prometheus.CounterVec
+}
+
+// WithAttrCache wraps the given database so that up to maxEntries results of
+// Get and LookUp are kept in memory for the provided TTL, zero meaning until
+// they're invalidated. If a registerer is provided, cache hits and misses are
+// exposed.
+func WithAttrCache(db database.Db, maxEntries int, ttl time.Duration, reg prometheus.Registerer) (*Db, error) {
+	d := &Db{
+		Db:         db,
+		MaxEntries: maxEntries,
+		TTL:        ttl,
+
+		order:   list.New(),
+		misses:  list.New(),
+		entries: make(map[key]*list.Element),
+		inodes:  make(map[fuseops.InodeID]map[*list.Element]bool),
+		parents: make(map[fuseops.InodeID]map[*list.Element]bool),
+
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "titan_db_cache_requests_total",
+			Help: "Amount of attribute lookups served by the in-memory cache, labeled by result",
+		}, []string{"result"}),
+	}
+
+	if reg != nil {
+		if err := reg.Register(d.requests); err != nil {
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
+
+// get retrieves a cached result, if present and not expired
+func (d *Db) get(k key) (entry, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	el, ok := d.entries[k]
+	if !ok {
+		d.requests.WithLabelValues("miss").Inc()
+		return entry{}, false
+	}
+
+	e := el.Value.(*entry)
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		d.remove(el)
+		d.requests.WithLabelValues("miss").Inc()
+		return entry{}, false
+	}
+
+	if e.missing {
+		d.misses.MoveToFront(el)
+		d.requests.WithLabelValues("negative_hit").Inc()
+	} else {
+		d.order.MoveToFront(el)
+		d.requests.WithLabelValues("hit").Inc()
+	}
+
+	return *e, true
+}
+
+// start returns the epoch a read begins at
+func (d *Db) start() uint64 {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.epoch
+}
+
+// add caches a result, or a missing entry, unless something was invalidated
+// since the given epoch, as it could have been read before the change was
+// committed
+func (d *Db) add(k key, value database.Entry, missing bool, epoch uint64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	order, max, ttl := d.order, d.MaxEntries, d.TTL
+	if missing {
+		order, max, ttl = d.misses, d.MaxMisses, d.MissTTL
+	}
+
+	if epoch != d.epoch || max <= 0 {
+		return
+	}
+
+	if el, ok := d.entries[k]; ok {
+		d.remove(el)
+	}
+
+	e := &entry{key: k, value: value, missing: missing}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+
+	el := order.PushFront(e)
+	d.entries[k] = el
+	if !missing {
+		index(d.inodes, value.ID, el)
+	}
+
+	if k.inode == 0 {
+		index(d.parents, k.parent, el)
+	}
+
+	for order.Len() > max {
+		d.remove(order.Back())
+	}
+}
+
+func index(m map[fuseops.InodeID]map[*list.Element]bool, id fuseops.InodeID, el *list.Element) {
+	if m[id] == nil {
+		m[id] = make(map[*list.Element]bool)
+	}
+
+	m[id][el] = true
+}
+
+func unindex(m map[fuseops.InodeID]map[*list.Element]bool, id fuseops.InodeID, el *list.Element) {
+	delete(m[id], el)
+	if len(m[id]) == 0 {
+		delete(m, id)
+	}
+}
+
+// remove evicts a result, the mutex must be held
+func (d *Db) remove(el *list.Element) {
+	e := el.Value.(*entry)
+
+	if e.missing {
+		d.misses.Remove(el)
+	} else {
+		d.order.Remove(el)
+		unindex(d.inodes, e.value.ID, el)
+	}
+
+	delete(d.entries, e.key)
+	if e.key.inode == 0 {
+		unindex(d.parents, e.key.parent, el)
+	}
+}
+
+// invalidate drops the results describing the given inodes, along with the
+// entries found under the given directories, which are inodes too
+func (d *Db) invalidate(inodes []fuseops.InodeID, dirs ...fuseops.InodeID) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.epoch++
+	for _, inode := range inodes {
+		for el := range d.inodes[inode] {
+			d.remove(el)
+		}
+	}
+
+	for _, dir := range dirs {
+		for el := range d.inodes[dir] {
+			d.remove(el)
+		}
+
+		for el := range d.parents[dir] {
+			d.remove(el)
+		}
+	}
+}
+
+// purge drops every result, for operations changing an unknown amount of
+// inodes
+func (d *Db) purge() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.epoch++
+	d.order.Init()
+	d.misses.Init()
+	d.entries = make(map[key]*list.Element)
+	d.inodes = make(map[fuseops.InodeID]map[*list.Element]bool)
+	d.parents = make(map[fuseops.InodeID]map[*list.Element]bool)
+}
+
+// linked finds the inode an entry points to, if any, so that it can be
+// invalidated once the entry changes
+func (d *Db) linked(ctx context.Context, parent fuseops.InodeID, name string) []fuseops.InodeID {
+	entry, err := d.Db.LookUp(ctx, parent, name)
+	if err != nil {
+		return nil
+	}
+
+	return []fuseops.InodeID{entry.ID}
+}
+
+// TryLock takes the named lock of the wrapped database, if it implements
+// database.Locker
+func (d *Db) TryLock(ctx context.Context, name string) (func(), error) {
+	return database.TryLock(ctx, d.Db, name)
+}
+
+// Get retrieves the attributes of an inode, from memory if possible
+func (d *Db) Get(ctx context.Context, inode fuseops.InodeID) (*database.Inode, error) {
+	k := key{inode: inode}
+	if e, ok := d.get(k); ok {
+		return &e.value.Inode, nil
+	}
+
+	epoch := d.start()
+	i, err := d.Db.Get(ctx, inode)
+	if err != nil {
+		return nil, err
+	}
+
+	d.add(k, database.Entry{Inode: *i}, false, epoch)
+	return i, nil
+}
+
+// LookUp finds an entry given its parent and its name, from memory if
+// possible, failing with ENOENT if it was recently found missing
+func (d *Db) LookUp(ctx context.Context, parent fuseops.InodeID, name string) (*database.Entry, error) {
+	k := key{parent: parent, name: name}
+	if e, ok := d.get(k); ok {
+		if e.missing {
+			return nil, syscall.ENOENT
+		}
+
+		return &e.value, nil
+	}
+
+	epoch := d.start()
+	e, err := d.Db.LookUp(ctx, parent, name)
+	if err == syscall.ENOENT {
+		d.add(k, database.Entry{}, true, epoch)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	d.add(k, *e, false, epoch)
+	return e, nil
+}
+
+// Setup creates the file system, dropping every cached result
+func (d *Db) Setup(ctx context.Context) error {
+	defer d.purge()
+	return d.Db.Setup(ctx)
+}
+
+// Migrate upgrades the schema, dropping every cached result
+func (d *Db) Migrate(ctx context.Context) error {
+	defer d.purge()
+	return d.Db.Migrate(ctx)
+}
+
+// Create creates a new entry, invalidating its parent
+func (d *Db) Create(ctx context.Context, entry database.Entry) (*database.Entry, error) {
+	defer d.invalidate(nil, entry.Parent)
+	return d.Db.Create(ctx, entry)
+}
+
+// Link creates a new entry for an inode, invalidating both
+func (d *Db) Link(ctx context.Context, inode fuseops.InodeID, newParent fuseops.InodeID, newName string) (*database.Entry, error) {
+	defer d.invalidate([]fuseops.InodeID{inode}, newParent)
+	return d.Db.Link(ctx, inode, newParent, newName)
+}
+
+// Forget releases an inode, invalidating it
+func (d *Db) Forget(ctx context.Context, inode fuseops.InodeID) error {
+	defer d.invalidate([]fuseops.InodeID{inode})
+	return d.Db.Forget(ctx, inode)
+}
+
+// ForgetBatch releases several inodes, invalidating them
+func (d *Db) ForgetBatch(ctx context.Context, inodes []fuseops.InodeID) error {
+	defer d.invalidate(inodes)
+	return d.Db.ForgetBatch(ctx, inodes)
+}
+
+// CleanOrphanInodes removes the inodes without links, dropping every cached
+// result
+func (d *Db) CleanOrphanInodes(ctx context.Context) error {
+	defer d.purge()
+	return d.Db.CleanOrphanInodes(ctx)
+}
+
+// Fsck checks the file system, dropping every cached result when repairing
+func (d *Db) Fsck(ctx context.Context, repair bool) (*database.FsckReport, error) {
+	if repair {
+		defer d.purge()
+	}
+
+	return d.Db.Fsck(ctx, repair)
+}
+
+// Import recreates the contents of a dump, dropping every cached result
+func (d *Db) Import(ctx context.Context, r io.Reader) error {
+	defer d.purge()
+	return d.Db.Import(ctx, r)
+}
+
+// Unlink removes an entry, invalidating its parent and the inode it pointed to
+func (d *Db) Unlink(ctx context.Context, parent fuseops.InodeID, name string) error {
+	defer d.invalidate(d.linked(ctx, parent, name), parent)
+	return d.Db.Unlink(ctx, parent, name)
+}
+
+// RemoveTree removes an entry along with every entry below it, dropping every
+// cached result
+func (d *Db) RemoveTree(ctx context.Context, parent fuseops.InodeID, name string, recursive bool) error {
+	defer d.purge()
+	return d.Db.RemoveTree(ctx, parent, name, recursive)
+}
+
+// Snapshot copies a directory tree, invalidating the destination parent
+func (d *Db) Snapshot(ctx context.Context, srcInode fuseops.InodeID, dstParent fuseops.InodeID, dstName string) (*database.Entry, error) {
+	defer d.invalidate(nil, dstParent)
+	return d.Db.Snapshot(ctx, srcInode, dstParent, dstName)
+}
+
+// Rename moves an entry, invalidating both parents along with the inodes
+// both entries pointed to
+func (d *Db) Rename(ctx context.Context, oldParent fuseops.InodeID, oldName string, newParent fuseops.InodeID, newName string, flags uint32) error {
+	inodes := append(d.linked(ctx, oldParent, oldName), d.linked(ctx, newParent, newName)...)
+	defer d.invalidate(inodes, oldParent, newParent)
+	return d.Db.Rename(ctx, oldParent, oldName, newParent, newName, flags)
+}
+
+// Touch changes the attributes of an inode, invalidating it
+func (d *Db) Touch(ctx context.Context, inode fuseops.InodeID, size *uint64, mode *os.FileMode, atime *time.Time, mtime *time.Time, uid *uint32, gid *uint32) (*database.Inode, error) {
+	defer d.invalidate([]fuseops.InodeID{inode})
+	return d.Db.Touch(ctx, inode, size, mode, atime, mtime, uid, gid)
+}
+
+// Truncate changes the size of a file, invalidating it
+func (d *Db) Truncate(ctx context.Context, inode fuseops.InodeID, size uint64) error {
+	defer d.invalidate([]fuseops.InodeID{inode})
+	return d.Db.Truncate(ctx, inode, size)
+}
+
+// SetImmutable changes whether an inode is immutable, invalidating it
+func (d *Db) SetImmutable(ctx context.Context, inode fuseops.InodeID, uid uint32, immutable bool, retainUntil *time.Time) error {
+	defer d.invalidate([]fuseops.InodeID{inode})
+	return d.Db.SetImmutable(ctx, inode, uid, immutable, retainUntil)
+}
+
+// ChownTree changes the owner and group of a whole tree, dropping every
+// cached result
+func (d *Db) ChownTree(ctx context.Context, inode fuseops.InodeID, uid *uint32, gid *uint32, fromUid *uint32) error {
+	defer d.purge()
+	return d.Db.ChownTree(ctx, inode, uid, gid, fromUid)
+}
+
+// ChmodTree changes the permissions of a whole tree, dropping every cached
+// result
+func (d *Db) ChmodTree(ctx context.Context, inode fuseops.InodeID, dirMode os.FileMode, fileMode os.FileMode) error {
+	defer d.purge()
+	return d.Db.ChmodTree(ctx, inode, dirMode, fileMode)
+}
+
+// AddChunk adds a chunk to an inode, invalidating it
+func (d *Db) AddChunk(ctx context.Context, inode fuseops.InodeID, flags uint32, chunk database.Chunk) error {
+	defer d.invalidate([]fuseops.InodeID{inode})
+	return d.Db.AddChunk(ctx, inode, flags, chunk)
+}
+
+// CopyRange shares a range of chunks between inodes, invalidating the
+// destination
+func (d *Db) CopyRange(ctx context.Context, srcInode fuseops.InodeID, srcOffset uint64, dstInode fuseops.InodeID, dstOffset uint64, length uint64) (uint64, error) {
+	defer d.invalidate([]fuseops.InodeID{dstInode})
+	return d.Db.CopyRange(ctx, srcInode, srcOffset, dstInode, dstOffset, length)
+}
+
+// Fallocate manipulates the allocated space of an inode, invalidating it
+func (d *Db) Fallocate(ctx context.Context, inode fuseops.InodeID, offset uint64, length uint64, mode uint32) error {
+	defer d.invalidate([]fuseops.InodeID{inode})
+	return d.Db.Fallocate(ctx, inode, offset, length, mode)
+}
+
+// RemoveXattr removes an extended attribute, invalidating its inode
+func (d *Db) RemoveXattr(ctx context.Context, inode fuseops.InodeID, attr string) error {
+	defer d.invalidate([]fuseops.InodeID{inode})
+	return d.Db.RemoveXattr(ctx, inode, attr)
+}
+
+// SetXattr sets an extended attribute, invalidating its inode
+func (d *Db) SetXattr(ctx context.Context, inode fuseops.InodeID, attr string, value []byte, flags uint32) error {
+	defer d.invalidate([]fuseops.InodeID{inode})
+	return d.Db.SetXattr(ctx, inode, attr, value, flags)
+}
+
+// SwapXattr replaces an extended attribute holding the expected value,
+// invalidating its inode
+func (d *Db) SwapXattr(ctx context.Context, inode fuseops.InodeID, attr string, expected []byte, value []byte) (bool, error) {
+	defer d.invalidate([]fuseops.InodeID{inode})
+	return d.Db.SwapXattr(ctx, inode, attr, expected, value)
+}
+
+// SetAllXattr replaces every extended attribute of an inode, invalidating it
+func (d *Db) SetAllXattr(ctx context.Context, inode fuseops.InodeID, attrs map[string][]byte) error {
+	defer d.invalidate([]fuseops.InodeID{inode})
+	return d.Db.SetAllXattr(ctx, inode, attrs)
+}
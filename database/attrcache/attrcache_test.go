@@ -0,0 +1,478 @@
+package attrcache
+
+import (
+	"context"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database"
+	"github.com/manvalls/titan/database/dbtest"
+	"github.com/manvalls/titan/database/memory"
+	"github.com/manvalls/titan/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// counting counts the reads reaching the wrapped database
+type counting struct {
+	database.Db
+
+	mutex sync.Mutex
+	reads int
+
+	// lookedUp, if set, runs right after every LookUp reaches the database
+	lookedUp func()
+}
+
+func (c *counting) Get(ctx context.Context, inode fuseops.InodeID) (*database.Inode, error) {
+	c.mutex.Lock()
+	c.reads++
+	c.mutex.Unlock()
+	return c.Db.Get(ctx, inode)
+}
+
+func (c *counting) LookUp(ctx context.Context, parent fuseops.InodeID, name string) (*database.Entry, error) {
+	c.mutex.Lock()
+	c.reads++
+	c.mutex.Unlock()
+
+	entry, err := c.Db.LookUp(ctx, parent, name)
+	if c.lookedUp != nil {
+		c.lookedUp()
+	}
+
+	return entry, err
+}
+
+func (c *counting) count() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.reads
+}
+
+func getTestDb(t *testing.T, maxEntries int, ttl time.Duration) (*Db, *counting) {
+	m := &memory.Driver{}
+	if err := m.Setup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &counting{Db: m}
+	d, err := WithAttrCache(c, maxEntries, ttl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d, c
+}
+
+func TestDriver(t *testing.T) {
+	d, _ := getTestDb(t, 1000, time.Minute)
+	d.MaxMisses = 1000
+	dbtest.Run(t, d)
+}
+
+func TestHits(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewRegistry()
+
+	m := &memory.Driver{}
+	if err := m.Setup(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &counting{Db: m}
+	d, err := WithAttrCache(c, 10, time.Minute, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := dbtest.Mkfile(t, d, fuseops.RootInodeID)
+
+	for i := 0; i < 3; i++ {
+		inode, err := d.Get(ctx, file.ID)
+		assert.Nil(t, err)
+		assert.Equal(t, file.ID, inode.ID)
+
+		entry, err := d.LookUp(ctx, fuseops.RootInodeID, file.Name)
+		assert.Nil(t, err)
+		assert.Equal(t, file.ID, entry.ID)
+	}
+
+	assert.Equal(t, 2, c.count())
+	assert.Equal(t, float64(4), testutil.ToFloat64(d.requests.WithLabelValues("hit")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(d.requests.WithLabelValues("miss")))
+
+	_, err = d.LookUp(ctx, fuseops.RootInodeID, "missing")
+	assert.Equal(t, syscall.ENOENT, err)
+
+	_, err = d.LookUp(ctx, fuseops.RootInodeID, "missing")
+	assert.Equal(t, syscall.ENOENT, err)
+	assert.Equal(t, 4, c.count())
+
+	families, err := reg.Gather()
+	assert.Nil(t, err)
+	assert.Len(t, families, 1)
+}
+
+func TestCopies(t *testing.T) {
+	ctx := context.Background()
+	d, _ := getTestDb(t, 10, time.Minute)
+	file := dbtest.Mkfile(t, d, fuseops.RootInodeID)
+
+	inode, err := d.Get(ctx, file.ID)
+	assert.Nil(t, err)
+	inode.Size = 100
+
+	inode, err = d.Get(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), inode.Size)
+}
+
+func TestTTL(t *testing.T) {
+	ctx := context.Background()
+	d, c := getTestDb(t, 10, 10*time.Millisecond)
+
+	_, err := d.Get(ctx, fuseops.RootInodeID)
+	assert.Nil(t, err)
+
+	time.Sleep(20 * time.Millisecond)
+
+	_, err = d.Get(ctx, fuseops.RootInodeID)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, c.count())
+}
+
+func TestEviction(t *testing.T) {
+	ctx := context.Background()
+	d, c := getTestDb(t, 2, time.Minute)
+
+	files := []*database.Entry{
+		dbtest.Mkfile(t, d, fuseops.RootInodeID),
+		dbtest.Mkfile(t, d, fuseops.RootInodeID),
+		dbtest.Mkfile(t, d, fuseops.RootInodeID),
+	}
+
+	for _, file := range files {
+		_, err := d.Get(ctx, file.ID)
+		assert.Nil(t, err)
+	}
+
+	_, err := d.Get(ctx, files[2].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, c.count())
+
+	_, err = d.Get(ctx, files[0].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, c.count())
+}
+
+func TestDisabled(t *testing.T) {
+	ctx := context.Background()
+	d, c := getTestDb(t, 0, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		_, err := d.Get(ctx, fuseops.RootInodeID)
+		assert.Nil(t, err)
+	}
+
+	assert.Equal(t, 2, c.count())
+}
+
+// assertFresh reads an inode both by id and through the given entry, which
+// must be seen as it's currently stored
+func assertFresh(t *testing.T, d *Db, parent fuseops.InodeID, name string) {
+	ctx := context.Background()
+
+	entry, err := d.LookUp(ctx, parent, name)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	stored, err := d.Db.LookUp(ctx, parent, name)
+	assert.Nil(t, err)
+	assert.Equal(t, stored, entry)
+
+	inode, err := d.Get(ctx, entry.ID)
+	assert.Nil(t, err)
+
+	fresh, err := d.Db.Get(ctx, entry.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, fresh, inode)
+}
+
+// prime caches the attributes of an inode along with its entry
+func prime(t *testing.T, d *Db, parent fuseops.InodeID, name string) {
+	entry, err := d.LookUp(context.Background(), parent, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = d.Get(context.Background(), entry.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInvalidation(t *testing.T) {
+	ctx := context.Background()
+	later := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	link := func(d *Db, dir fuseops.InodeID, file *database.Entry) {
+		if _, err := d.Db.Link(ctx, file.ID, dir, "link"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		setup  func(d *Db, dir fuseops.InodeID, file *database.Entry)
+		mutate func(d *Db, dir fuseops.InodeID, file *database.Entry) error
+	}{
+		{"Touch", nil, func(d *Db, dir fuseops.InodeID, file *database.Entry) error {
+			size := uint64(42)
+			mode := os.FileMode(0600)
+			_, err := d.Touch(ctx, file.ID, &size, &mode, &later, &later, nil, nil)
+			return err
+		}},
+		{"Truncate", nil, func(d *Db, dir fuseops.InodeID, file *database.Entry) error {
+			return d.Truncate(ctx, file.ID, 42)
+		}},
+		{"AddChunk", nil, func(d *Db, dir fuseops.InodeID, file *database.Entry) error {
+			return d.AddChunk(ctx, file.ID, 0, database.Chunk{
+				Inode: file.ID,
+				Chunk: storage.Chunk{Storage: "test", Key: "a", Size: 10},
+			})
+		}},
+		{"CopyRange", nil, func(d *Db, dir fuseops.InodeID, file *database.Entry) error {
+			src := dbtest.Mkfile(t, d, dir)
+			dbtest.AddChunk(t, d, src.ID, 0, "a", 0, 10)
+			_, err := d.CopyRange(ctx, src.ID, 0, file.ID, 5, 10)
+			return err
+		}},
+		{"Fallocate", nil, func(d *Db, dir fuseops.InodeID, file *database.Entry) error {
+			return d.Fallocate(ctx, file.ID, 0, 10, 0)
+		}},
+		{"SetXattr", nil, func(d *Db, dir fuseops.InodeID, file *database.Entry) error {
+			return d.SetXattr(ctx, file.ID, "user.a", []byte("a"), 0)
+		}},
+		{"Link", nil, func(d *Db, dir fuseops.InodeID, file *database.Entry) error {
+			_, err := d.Link(ctx, file.ID, dir, "link")
+			return err
+		}},
+		{"UnlinkLink", link, func(d *Db, dir fuseops.InodeID, file *database.Entry) error {
+			return d.Unlink(ctx, dir, "link")
+		}},
+		{"RenameOverLink", link, func(d *Db, dir fuseops.InodeID, file *database.Entry) error {
+			other := dbtest.Mkfile(t, d, dir)
+			return d.Rename(ctx, dir, other.Name, dir, "link", 0)
+		}},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			d, _ := getTestDb(t, 100, time.Hour)
+			dir := dbtest.Mkdir(t, d, fuseops.RootInodeID)
+			file := dbtest.Mkfile(t, d, dir)
+
+			if test.setup != nil {
+				test.setup(d, dir, file)
+			}
+
+			prime(t, d, dir, file.Name)
+
+			before, err := d.Db.Get(ctx, file.ID)
+			assert.Nil(t, err)
+
+			assert.Nil(t, test.mutate(d, dir, file))
+
+			after, err := d.Db.Get(ctx, file.ID)
+			assert.Nil(t, err)
+			assert.NotEqual(t, before, after, "the mutation should change the stored attributes")
+
+			assertFresh(t, d, dir, file.Name)
+		})
+	}
+}
+
+func TestInvalidateDir(t *testing.T) {
+	ctx := context.Background()
+	d, _ := getTestDb(t, 100, time.Hour)
+	dir := create(t, d, fuseops.RootInodeID, os.ModeDir|0755)
+
+	prime(t, d, fuseops.RootInodeID, dir.Name)
+
+	sub := create(t, d, dir.ID, os.ModeDir|0755)
+	assertFresh(t, d, fuseops.RootInodeID, dir.Name)
+
+	inode, err := d.Get(ctx, dir.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(3), inode.Nlink)
+
+	prime(t, d, dir.ID, sub.Name)
+	assert.Nil(t, d.Rename(ctx, dir.ID, sub.Name, fuseops.RootInodeID, "moved", 0))
+
+	_, err = d.LookUp(ctx, dir.ID, sub.Name)
+	assert.Equal(t, syscall.ENOENT, err)
+	assertFresh(t, d, fuseops.RootInodeID, dir.Name)
+	assertFresh(t, d, fuseops.RootInodeID, "moved")
+
+	prime(t, d, fuseops.RootInodeID, "moved")
+	assert.Nil(t, d.Unlink(ctx, fuseops.RootInodeID, "moved"))
+
+	_, err = d.LookUp(ctx, fuseops.RootInodeID, "moved")
+	assert.Equal(t, syscall.ENOENT, err)
+
+	inode, err = d.Get(ctx, sub.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0), inode.Nlink)
+}
+
+func create(t *testing.T, db database.Db, parent fuseops.InodeID, mode os.FileMode) *database.Entry {
+	name, err := storage.Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := db.Create(context.Background(), database.Entry{
+		Parent: parent,
+		Name:   name,
+		Inode:  database.Inode{InodeAttributes: fuseops.InodeAttributes{Mode: mode}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return entry
+}
+
+func TestMisses(t *testing.T) {
+	ctx := context.Background()
+	d, c := getTestDb(t, 0, 0)
+	d.MaxMisses = 10
+
+	for i := 0; i < 3; i++ {
+		_, err := d.LookUp(ctx, fuseops.RootInodeID, "missing")
+		assert.Equal(t, syscall.ENOENT, err)
+	}
+
+	assert.Equal(t, 1, c.count())
+	assert.Equal(t, float64(2), testutil.ToFloat64(d.requests.WithLabelValues("negative_hit")))
+
+	_, err := d.LookUp(ctx, fuseops.RootInodeID+1000, "missing")
+	assert.Equal(t, syscall.ENOENT, err)
+	assert.Equal(t, 2, c.count())
+}
+
+func TestMissInvalidation(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		mutate func(d *Db, dir fuseops.InodeID) error
+	}{
+		{"Create", func(d *Db, dir fuseops.InodeID) error {
+			_, err := d.Create(ctx, database.Entry{
+				Parent: dir,
+				Name:   "missing",
+				Inode:  database.Inode{InodeAttributes: fuseops.InodeAttributes{Mode: 0644}},
+			})
+
+			return err
+		}},
+		{"Link", func(d *Db, dir fuseops.InodeID) error {
+			file := dbtest.Mkfile(t, d, fuseops.RootInodeID)
+			_, err := d.Link(ctx, file.ID, dir, "missing")
+			return err
+		}},
+		{"Rename", func(d *Db, dir fuseops.InodeID) error {
+			file := dbtest.Mkfile(t, d, fuseops.RootInodeID)
+			return d.Rename(ctx, fuseops.RootInodeID, file.Name, dir, "missing", 0)
+		}},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			d, _ := getTestDb(t, 100, time.Hour)
+			d.MaxMisses = 100
+			d.MissTTL = time.Hour
+			dir := dbtest.Mkdir(t, d, fuseops.RootInodeID)
+
+			_, err := d.LookUp(ctx, dir, "missing")
+			assert.Equal(t, syscall.ENOENT, err)
+
+			assert.Nil(t, test.mutate(d, dir))
+			assertFresh(t, d, dir, "missing")
+		})
+	}
+}
+
+func TestMissRace(t *testing.T) {
+	ctx := context.Background()
+	d, c := getTestDb(t, 0, 0)
+	d.MaxMisses = 10
+
+	c.lookedUp = func() {
+		c.lookedUp = nil
+		if _, err := d.Create(ctx, database.Entry{
+			Parent: fuseops.RootInodeID,
+			Name:   "missing",
+			Inode:  database.Inode{InodeAttributes: fuseops.InodeAttributes{Mode: 0644}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := d.LookUp(ctx, fuseops.RootInodeID, "missing")
+	assert.Equal(t, syscall.ENOENT, err)
+
+	entry, err := d.LookUp(ctx, fuseops.RootInodeID, "missing")
+	assert.Nil(t, err)
+	assert.Equal(t, "missing", entry.Name)
+}
+
+func TestMissTTL(t *testing.T) {
+	ctx := context.Background()
+	d, c := getTestDb(t, 0, 0)
+	d.MaxMisses = 10
+	d.MissTTL = 10 * time.Millisecond
+
+	_, err := d.LookUp(ctx, fuseops.RootInodeID, "missing")
+	assert.Equal(t, syscall.ENOENT, err)
+
+	time.Sleep(20 * time.Millisecond)
+
+	_, err = d.LookUp(ctx, fuseops.RootInodeID, "missing")
+	assert.Equal(t, syscall.ENOENT, err)
+	assert.Equal(t, 2, c.count())
+}
+
+func TestMissEviction(t *testing.T) {
+	ctx := context.Background()
+	d, c := getTestDb(t, 10, time.Minute)
+	d.MaxMisses = 2
+
+	for _, name := range []string{"a", "b", "c", "c"} {
+		_, err := d.LookUp(ctx, fuseops.RootInodeID, name)
+		assert.Equal(t, syscall.ENOENT, err)
+	}
+
+	assert.Equal(t, 3, c.count())
+
+	_, err := d.Get(ctx, fuseops.RootInodeID)
+	assert.Nil(t, err)
+
+	_, err = d.LookUp(ctx, fuseops.RootInodeID, "a")
+	assert.Equal(t, syscall.ENOENT, err)
+	assert.Equal(t, 5, c.count())
+
+	_, err = d.Get(ctx, fuseops.RootInodeID)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, c.count())
+}
@@ -0,0 +1,57 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/manvalls/fuse/fuseops"
+)
+
+// AuditOp is the kind of operation reported to an AuditHook
+type AuditOp string
+
+// Operations reported to an AuditHook
+const (
+	AuditCreate   AuditOp = "create"
+	AuditLink     AuditOp = "link"
+	AuditUnlink   AuditOp = "unlink"
+	AuditRename   AuditOp = "rename"
+	AuditTouch    AuditOp = "touch"
+	AuditSetXattr AuditOp = "setxattr"
+	AuditAddChunk AuditOp = "addchunk"
+)
+
+// AuditEvent describes a mutating operation on an inode, owned by the given
+// user and group
+type AuditEvent struct {
+	Op    AuditOp
+	Inode fuseops.InodeID
+	Uid   uint32
+	Gid   uint32
+	Time  time.Time
+}
+
+// AuditHook is notified of mutating operations once they're committed, so
+// that rolled back ones are never reported. It's called by the goroutine
+// running the operation, which waits for it, but never while holding a
+// transaction open.
+type AuditHook interface {
+	Audit(ctx context.Context, event AuditEvent)
+}
+
+type nopAuditHook struct{}
+
+func (h nopAuditHook) Audit(ctx context.Context, event AuditEvent) {}
+
+// NopAuditHook ignores every event, drivers behave as if using it when no
+// hook is set
+var NopAuditHook AuditHook = nopAuditHook{}
+
+// Audit reports an operation on the given inode to the hook, if any
+func Audit(ctx context.Context, hook AuditHook, op AuditOp, inode fuseops.InodeID, uid uint32, gid uint32) {
+	if hook == nil {
+		return
+	}
+
+	hook.Audit(ctx, AuditEvent{Op: op, Inode: inode, Uid: uid, Gid: gid, Time: time.Now()})
+}
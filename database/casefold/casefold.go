@@ -0,0 +1,211 @@
+package casefold
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"syscall"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database"
+)
+
+// Folding tells whether two names match once their case is folded
+type Folding func(a, b string) bool
+
+// Unicode matches names under the simple Unicode case folding
+func Unicode(a, b string) bool {
+	return strings.EqualFold(a, b)
+}
+
+// ASCII matches names ignoring the case of ASCII letters alone, comparing
+// the rest of the bytes as they are
+func ASCII(a, b string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := 0; i < len(a); i++ {
+		if lower(a[i]) != lower(b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func lower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+
+	return c
+}
+
+var errFolding = errors.New("Unknown case folding")
+
+// ParseFolding returns the folding with the given name
+func ParseFolding(name string) (Folding, error) {
+	switch name {
+	case "unicode":
+		return Unicode, nil
+	case "ascii":
+		return ASCII, nil
+	default:
+		return nil, errFolding
+	}
+}
+
+// Db wraps a database.Db so that names matching once their case is folded
+// refer to the same entry. Entries keep the name they were created with,
+// while creating one whose name collides with an existing entry fails with
+// EEXIST. Names are looked up as given first, the directory being scanned
+// when that fails, so that misses take longer on large directories. That
+// scan isn't atomic with the operations relying on it, the kernel serializing
+// the changes to a directory, so that several mounts creating colliding names
+// at once could still succeed.
+type Db struct {
+	database.Db
+	Fold Folding
+}
+
+// WithCaseFolding wraps the given database so that names are compared with
+// the given folding
+func WithCaseFolding(db database.Db, fold Folding) *Db {
+	return &Db{Db: db, Fold: fold}
+}
+
+// TryLock takes the named lock of the wrapped database, if it implements
+// database.Locker
+func (d *Db) TryLock(ctx context.Context, name string) (func(), error) {
+	return database.TryLock(ctx, d.Db, name)
+}
+
+// resolve finds the name of the entry of the given parent matching the given
+// one once folded, failing with ENOENT if there's none
+func (d *Db) resolve(ctx context.Context, parent fuseops.InodeID, name string) (string, error) {
+	if _, err := d.Db.LookUp(ctx, parent, name); err != syscall.ENOENT {
+		return name, err
+	}
+
+	children, err := d.Db.Children(ctx, parent)
+	if err != nil {
+		return "", err
+	}
+
+	for _, child := range *children {
+		if d.Fold(child.Name, name) {
+			return child.Name, nil
+		}
+	}
+
+	return "", syscall.ENOENT
+}
+
+// vacant fails with EEXIST if the given name collides with an entry of the
+// given parent
+func (d *Db) vacant(ctx context.Context, parent fuseops.InodeID, name string) error {
+	_, err := d.resolve(ctx, parent, name)
+	switch err {
+	case nil:
+		return syscall.EEXIST
+	case syscall.ENOENT:
+		return nil
+	default:
+		return err
+	}
+}
+
+// LookUp finds the entry of a parent whose name matches the given one
+func (d *Db) LookUp(ctx context.Context, parent fuseops.InodeID, name string) (*database.Entry, error) {
+	entry, err := d.Db.LookUp(ctx, parent, name)
+	if err != syscall.ENOENT {
+		return entry, err
+	}
+
+	stored, err := d.resolve(ctx, parent, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.Db.LookUp(ctx, parent, stored)
+}
+
+// Create creates a new entry, unless its name collides with an existing one
+func (d *Db) Create(ctx context.Context, entry database.Entry) (*database.Entry, error) {
+	if err := d.vacant(ctx, entry.Parent, entry.Name); err != nil {
+		return nil, err
+	}
+
+	return d.Db.Create(ctx, entry)
+}
+
+// Link creates a new entry for an inode, unless its name collides with an
+// existing one
+func (d *Db) Link(ctx context.Context, inode fuseops.InodeID, newParent fuseops.InodeID, newName string) (*database.Entry, error) {
+	if err := d.vacant(ctx, newParent, newName); err != nil {
+		return nil, err
+	}
+
+	return d.Db.Link(ctx, inode, newParent, newName)
+}
+
+// Snapshot copies a directory tree, unless the name of the copy collides with
+// an existing entry
+func (d *Db) Snapshot(ctx context.Context, srcInode fuseops.InodeID, dstParent fuseops.InodeID, dstName string) (*database.Entry, error) {
+	if err := d.vacant(ctx, dstParent, dstName); err != nil {
+		return nil, err
+	}
+
+	return d.Db.Snapshot(ctx, srcInode, dstParent, dstName)
+}
+
+// Unlink removes the entry whose name matches the given one
+func (d *Db) Unlink(ctx context.Context, parent fuseops.InodeID, name string) error {
+	stored, err := d.resolve(ctx, parent, name)
+	if err != nil {
+		return err
+	}
+
+	return d.Db.Unlink(ctx, parent, stored)
+}
+
+// RemoveTree removes the entry whose name matches the given one along with
+// every entry below it
+func (d *Db) RemoveTree(ctx context.Context, parent fuseops.InodeID, name string, recursive bool) error {
+	stored, err := d.resolve(ctx, parent, name)
+	if err != nil {
+		return err
+	}
+
+	return d.Db.RemoveTree(ctx, parent, stored, recursive)
+}
+
+// Rename moves the entry whose name matches the old one, replacing the one
+// matching the new name. The moved entry takes the new name as given, so that
+// an entry can be renamed changing only its case.
+func (d *Db) Rename(ctx context.Context, oldParent fuseops.InodeID, oldName string, newParent fuseops.InodeID, newName string, flags uint32) error {
+	oldStored, err := d.resolve(ctx, oldParent, oldName)
+	if err != nil {
+		return err
+	}
+
+	newStored, err := d.resolve(ctx, newParent, newName)
+	if err == syscall.ENOENT || (err == nil && oldParent == newParent && oldStored == newStored && flags&database.RenameExchange == 0) {
+		return d.Db.Rename(ctx, oldParent, oldStored, newParent, newName, flags)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err = d.Db.Rename(ctx, oldParent, oldStored, newParent, newStored, flags); err != nil {
+		return err
+	}
+
+	if flags&database.RenameExchange != 0 || newStored == newName {
+		return nil
+	}
+
+	return d.Db.Rename(ctx, newParent, newStored, newParent, newName, 0)
+}
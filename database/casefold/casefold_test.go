@@ -0,0 +1,173 @@
+package casefold
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database"
+	"github.com/manvalls/titan/database/dbtest"
+	"github.com/manvalls/titan/database/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestDb(t *testing.T, fold Folding) *Db {
+	m := &memory.Driver{}
+	if err := m.Setup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return WithCaseFolding(m, fold)
+}
+
+func create(t *testing.T, db database.Db, parent fuseops.InodeID, name string) *database.Entry {
+	entry, err := db.Create(context.Background(), database.Entry{
+		Parent: parent,
+		Name:   name,
+		Inode:  database.Inode{InodeAttributes: fuseops.InodeAttributes{Mode: 0644}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return entry
+}
+
+// names lists the names of the children of a directory
+func names(t *testing.T, db database.Db, dir fuseops.InodeID) []string {
+	children, err := db.Children(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := make([]string, 0, len(*children))
+	for _, child := range *children {
+		result = append(result, child.Name)
+	}
+
+	return result
+}
+
+func TestDriver(t *testing.T) {
+	dbtest.Run(t, getTestDb(t, Unicode))
+}
+
+func TestFolding(t *testing.T) {
+	assert.True(t, Unicode("File.TXT", "file.txt"))
+	assert.True(t, Unicode("ÉTÉ", "été"))
+	assert.True(t, Unicode("Σ", "ς"))
+	assert.False(t, Unicode("a", "b"))
+
+	assert.True(t, ASCII("File.TXT", "file.txt"))
+	assert.False(t, ASCII("ÉTÉ", "été"))
+	assert.False(t, ASCII("a", "ab"))
+
+	fold, err := ParseFolding("ascii")
+	assert.Nil(t, err)
+	assert.True(t, fold("ABC", "abc"))
+
+	_, err = ParseFolding("none")
+	assert.Equal(t, errFolding, err)
+}
+
+func TestLookUp(t *testing.T) {
+	ctx := context.Background()
+	d := getTestDb(t, Unicode)
+	dir := dbtest.Mkdir(t, d, fuseops.RootInodeID)
+	file := create(t, d, dir, "File.txt")
+
+	for _, name := range []string{"File.txt", "file.txt", "FILE.TXT"} {
+		entry, err := d.LookUp(ctx, dir, name)
+		if assert.Nil(t, err, name) {
+			assert.Equal(t, file.ID, entry.ID)
+			assert.Equal(t, "File.txt", entry.Name)
+		}
+	}
+
+	_, err := d.LookUp(ctx, dir, "file.txt.bak")
+	assert.Equal(t, syscall.ENOENT, err)
+}
+
+func TestCollisions(t *testing.T) {
+	ctx := context.Background()
+	d := getTestDb(t, Unicode)
+	dir := dbtest.Mkdir(t, d, fuseops.RootInodeID)
+	file := create(t, d, dir, "File.txt")
+
+	_, err := d.Create(ctx, database.Entry{
+		Parent: dir,
+		Name:   "FILE.txt",
+		Inode:  database.Inode{InodeAttributes: fuseops.InodeAttributes{Mode: 0644}},
+	})
+
+	assert.Equal(t, syscall.EEXIST, err)
+
+	_, err = d.Link(ctx, file.ID, dir, "file.TXT")
+	assert.Equal(t, syscall.EEXIST, err)
+	assert.Equal(t, []string{"File.txt"}, names(t, d, dir))
+
+	a := getTestDb(t, ASCII)
+	create(t, a, fuseops.RootInodeID, "été")
+	create(t, a, fuseops.RootInodeID, "ÉTÉ")
+
+	_, err = a.LookUp(ctx, fuseops.RootInodeID, "ÉTé")
+	assert.Equal(t, syscall.ENOENT, err)
+}
+
+func TestUnlink(t *testing.T) {
+	ctx := context.Background()
+	d := getTestDb(t, Unicode)
+	dir := dbtest.Mkdir(t, d, fuseops.RootInodeID)
+	create(t, d, dir, "File.txt")
+
+	assert.Nil(t, d.Unlink(ctx, dir, "FILE.TXT"))
+	assert.Empty(t, names(t, d, dir))
+	assert.Equal(t, syscall.ENOENT, d.Unlink(ctx, dir, "file.txt"))
+}
+
+func TestRenameCase(t *testing.T) {
+	ctx := context.Background()
+	d := getTestDb(t, Unicode)
+	dir := dbtest.Mkdir(t, d, fuseops.RootInodeID)
+	file := create(t, d, dir, "File.txt")
+
+	assert.Nil(t, d.Rename(ctx, dir, "File.txt", dir, "file.txt", 0))
+	assert.Equal(t, []string{"file.txt"}, names(t, d, dir))
+
+	assert.Nil(t, d.Rename(ctx, dir, "FILE.TXT", dir, "File.TXT", database.RenameNoReplace))
+	assert.Equal(t, []string{"File.TXT"}, names(t, d, dir))
+
+	entry, err := d.LookUp(ctx, dir, "file.txt")
+	if assert.Nil(t, err) {
+		assert.Equal(t, file.ID, entry.ID)
+		assert.Equal(t, "File.TXT", entry.Name)
+	}
+}
+
+func TestRenameOver(t *testing.T) {
+	ctx := context.Background()
+	d := getTestDb(t, Unicode)
+	dir := dbtest.Mkdir(t, d, fuseops.RootInodeID)
+	first := create(t, d, dir, "first")
+	second := create(t, d, dir, "second")
+
+	assert.Equal(t, syscall.EEXIST, d.Rename(ctx, dir, "FIRST", dir, "Second", database.RenameNoReplace))
+
+	assert.Nil(t, d.Rename(ctx, dir, "FIRST", dir, "Second", database.RenameExchange))
+
+	entry, err := d.LookUp(ctx, dir, "second")
+	if assert.Nil(t, err) {
+		assert.Equal(t, first.ID, entry.ID)
+		assert.Equal(t, "second", entry.Name)
+	}
+
+	assert.Nil(t, d.Rename(ctx, dir, "First", dir, "SECOND", 0))
+	assert.Equal(t, []string{"SECOND"}, names(t, d, dir))
+
+	entry, err = d.LookUp(ctx, dir, "second")
+	if assert.Nil(t, err) {
+		assert.Equal(t, second.ID, entry.ID)
+	}
+}
@@ -0,0 +1,22 @@
+package database
+
+import (
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+)
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// NewChecksum returns a hash computing the CRC-32C checksum of the data of
+// chunks, to be hex encoded into their Checksum
+func NewChecksum() hash.Hash32 {
+	return crc32.New(checksumTable)
+}
+
+// Checksum returns the hex encoded CRC-32C checksum of the given data
+func Checksum(data []byte) string {
+	h := NewChecksum()
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,38 @@
+package database
+
+// MergeChunks finds the runs of the given chunks, sorted by inode offset,
+// which could be represented as a single chunk, being contiguous both within
+// the inode and within the same object. The first chunk of every run grows
+// to cover the whole run, losing its hash, while the rest of them are to be
+// removed. It returns the chunks which grew along with the ids of the
+// removed ones. Holes, having no object, are left as they are. Drivers can
+// implement their CompactChunks method with it.
+func MergeChunks(chunks []Chunk) ([]Chunk, []uint64) {
+	grown := make([]Chunk, 0)
+	removed := make([]uint64, 0)
+
+	for i := 0; i < len(chunks); {
+		head := chunks[i]
+		j := i + 1
+
+		for ; j < len(chunks) && !head.IsHole(); j++ {
+			c := chunks[j]
+			if c.Storage != head.Storage || c.Key != head.Key || c.InodeOffset != head.InodeOffset+head.Size || c.ObjectOffset != head.ObjectOffset+head.Size {
+				break
+			}
+
+			head.Size += c.Size
+			head.Hash = ""
+			head.Checksum = ""
+			removed = append(removed, c.ID)
+		}
+
+		if j > i+1 {
+			grown = append(grown, head)
+		}
+
+		i = j
+	}
+
+	return grown, removed
+}
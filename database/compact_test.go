@@ -0,0 +1,39 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/manvalls/titan/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeChunks(t *testing.T) {
+	chunk := func(id uint64, inodeOffset uint64, key string, objectOffset uint64, size uint64) Chunk {
+		return Chunk{
+			ID:          id,
+			InodeOffset: inodeOffset,
+			Chunk:       storage.Chunk{Storage: "test", Key: key, ObjectOffset: objectOffset, Size: size},
+			Hash:        "hash",
+		}
+	}
+
+	grown, removed := MergeChunks([]Chunk{
+		chunk(1, 0, "a", 0, 10),
+		chunk(2, 10, "a", 10, 10),
+		chunk(3, 20, "a", 20, 5),
+		chunk(4, 25, "b", 25, 5),
+		chunk(5, 30, "", 0, 10),
+		chunk(6, 40, "", 10, 10),
+		chunk(7, 60, "b", 30, 10),
+	})
+
+	merged := chunk(1, 0, "a", 0, 25)
+	merged.Hash = ""
+
+	assert.Equal(t, []Chunk{merged}, grown)
+	assert.Equal(t, []uint64{2, 3}, removed)
+
+	grown, removed = MergeChunks(nil)
+	assert.Empty(t, grown)
+	assert.Empty(t, removed)
+}
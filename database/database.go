@@ -2,6 +2,8 @@ package database
 
 import (
 	"context"
+	"errors"
+	"io"
 	"os"
 	"time"
 
@@ -9,34 +11,193 @@ import (
 	"github.com/manvalls/titan/storage"
 )
 
+// ErrReferenced is returned when an inode can't be removed because an entry
+// still references it
+var ErrReferenced = errors.New("Inode is still referenced")
+
 // Db contains methods for interacting with
 // the underlying database
 type Db interface {
 	Open() error
 	Close() error
+	Ping(ctx context.Context) error
 
 	Setup(ctx context.Context) error
+	Migrate(ctx context.Context) error
 	Stats(ctx context.Context) (*Stats, error)
+	FsStats(ctx context.Context) (*FsStats, error)
+	SubtreeStats(ctx context.Context, inode fuseops.InodeID) (*SubtreeStats, error)
+	SetQuota(ctx context.Context, uid *uint32, gid *uint32, bytes uint64, inodes uint64) error
+	GetQuota(ctx context.Context, uid *uint32, gid *uint32) (*Quota, error)
 	Create(ctx context.Context, entry Entry) (*Entry, error)
+	CreateAnonymous(ctx context.Context, mode os.FileMode, uid uint32, gid uint32) (*Inode, error)
+	Link(ctx context.Context, inode fuseops.InodeID, newParent fuseops.InodeID, newName string) (*Entry, error)
 	Forget(ctx context.Context, inode fuseops.InodeID) error
+	ForgetBatch(ctx context.Context, inodes []fuseops.InodeID) error
 	CleanOrphanInodes(ctx context.Context) error
 	CleanOrphanChunks(ctx context.Context, threshold time.Time, st storage.Storage, workers int) error
+	CountOrphans(ctx context.Context, threshold time.Time) (*OrphanReport, error)
+	Fsck(ctx context.Context, repair bool) (*FsckReport, error)
+	VerifyChunks(ctx context.Context, st storage.Storage, inode fuseops.InodeID) ([]uint64, error)
+	VerifyAllChunks(ctx context.Context, st storage.Storage) ([]uint64, error)
+	Export(ctx context.Context, w io.Writer) error
+	Import(ctx context.Context, r io.Reader) error
 
 	Unlink(ctx context.Context, parent fuseops.InodeID, name string) error
-	Rename(ctx context.Context, oldParent fuseops.InodeID, oldName string, newParent fuseops.InodeID, newName string) error
+	RemoveTree(ctx context.Context, parent fuseops.InodeID, name string, recursive bool) error
+	Snapshot(ctx context.Context, srcInode fuseops.InodeID, dstParent fuseops.InodeID, dstName string) (*Entry, error)
+	Rename(ctx context.Context, oldParent fuseops.InodeID, oldName string, newParent fuseops.InodeID, newName string, flags uint32) error
 
 	LookUp(ctx context.Context, parent fuseops.InodeID, name string) (*Entry, error)
 	Get(ctx context.Context, inode fuseops.InodeID) (*Inode, error)
+	Statx(ctx context.Context, inode fuseops.InodeID) (*Statx, error)
+	ReadLink(ctx context.Context, inode fuseops.InodeID) (string, error)
+	Paths(ctx context.Context, inode fuseops.InodeID) (*[]string, error)
 	Touch(ctx context.Context, inode fuseops.InodeID, size *uint64, mode *os.FileMode, atime *time.Time, mtime *time.Time, uid *uint32, gid *uint32) (*Inode, error)
+	Truncate(ctx context.Context, inode fuseops.InodeID, size uint64) error
+	SetImmutable(ctx context.Context, inode fuseops.InodeID, uid uint32, immutable bool, retainUntil *time.Time) error
+	ChownTree(ctx context.Context, inode fuseops.InodeID, uid *uint32, gid *uint32, fromUid *uint32) error
+	ChmodTree(ctx context.Context, inode fuseops.InodeID, dirMode os.FileMode, fileMode os.FileMode) error
 
 	AddChunk(ctx context.Context, inode fuseops.InodeID, flags uint32, chunk Chunk) error
+	CopyRange(ctx context.Context, srcInode fuseops.InodeID, srcOffset uint64, dstInode fuseops.InodeID, dstOffset uint64, length uint64) (uint64, error)
+	Fallocate(ctx context.Context, inode fuseops.InodeID, offset uint64, length uint64, mode uint32) error
 	Chunks(ctx context.Context, inode fuseops.InodeID) (*[]Chunk, error)
+	ChunksInRange(ctx context.Context, inode fuseops.InodeID, offset uint64, length uint64) (*[]Chunk, error)
+	ChunksByStorage(ctx context.Context, storageName string, afterID uint64, limit int) (*[]Chunk, error)
+	MigrateChunk(ctx context.Context, id uint64, newStorage string, newKey string) error
+	CompactChunks(ctx context.Context, inode fuseops.InodeID) error
+	Defragment(ctx context.Context, st storage.Storage, inode fuseops.InodeID, targetObjectSize uint64) error
+	RetierInode(ctx context.Context, st storage.Storage, inode fuseops.InodeID, target string) error
 	Children(ctx context.Context, inode fuseops.InodeID) (*[]Child, error)
+	ChildCount(ctx context.Context, inode fuseops.InodeID) (uint64, error)
+	ChildrenPage(ctx context.Context, inode fuseops.InodeID, afterName string, limit int) (*[]Child, error)
+	ChildrenPlus(ctx context.Context, inode fuseops.InodeID) (*[]Entry, error)
 
 	ListXattr(ctx context.Context, inode fuseops.InodeID) (*[]string, error)
 	RemoveXattr(ctx context.Context, inode fuseops.InodeID, attr string) error
 	GetXattr(ctx context.Context, inode fuseops.InodeID, attr string) (*[]byte, error)
+	GetXattrSize(ctx context.Context, inode fuseops.InodeID, attr string) (uint64, error)
 	SetXattr(ctx context.Context, inode fuseops.InodeID, attr string, value []byte, flags uint32) error
+	SwapXattr(ctx context.Context, inode fuseops.InodeID, attr string, expected []byte, value []byte) (bool, error)
+	GetAllXattr(ctx context.Context, inode fuseops.InodeID) (map[string][]byte, error)
+	SetAllXattr(ctx context.Context, inode fuseops.InodeID, attrs map[string][]byte) error
+
+	GetLock(ctx context.Context, inode fuseops.InodeID, owner uint64, start uint64, length uint64, lockType LockType) (*Lock, error)
+	SetLock(ctx context.Context, inode fuseops.InodeID, owner uint64, start uint64, length uint64, lockType LockType) error
+	ClearLocks(ctx context.Context, owner uint64) error
+}
+
+// Flags changing the behaviour of Rename, matching the ones of renameat2
+const (
+	// RenameNoReplace makes Rename fail with EEXIST if the destination exists
+	RenameNoReplace = 1 << 0
+
+	// RenameExchange atomically swaps the source and the destination, which
+	// must both exist
+	RenameExchange = 1 << 1
+
+	// RenameEmpty makes Rename fail with ENOTEMPTY if the source is a
+	// directory with children. It isn't part of renameat2, hence the high bit,
+	// and can't be combined with RenameExchange
+	RenameEmpty = 1 << 31
+
+	// RenameMutable makes Rename fail with EPERM if the source is immutable,
+	// so that it can stand for Unlink. It isn't part of renameat2 either.
+	RenameMutable = 1 << 30
+)
+
+// Flags changing the behaviour of SetXattr, matching the ones of setxattr
+const (
+	// XattrCreate makes SetXattr fail with EEXIST if the attribute exists
+	XattrCreate = 1 << 0
+
+	// XattrReplace makes SetXattr fail with ENODATA if the attribute doesn't
+	// exist
+	XattrReplace = 1 << 1
+)
+
+// ModePermissions are the bits of modes changed by chmod, which leaves the
+// type of inodes untouched
+const ModePermissions = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// InodeImmutable is the flag of inodes which can't be written, truncated,
+// unlinked nor replaced, optionally until a retention date
+const InodeImmutable = 1 << 0
+
+// InodeAnonymous is the flag of the inodes created by CreateAnonymous which
+// weren't linked yet. They're held by the handle that created them, so that
+// CleanOrphanInodes leaves them alone until AnonymousTimeout passes, and
+// removed by Forget once it's closed.
+const InodeAnonymous = 1 << 1
+
+// AnonymousTimeout is the time after which anonymous inodes left unchanged are
+// deemed leaked, e.g by a client which crashed before forgetting them, so that
+// CleanOrphanInodes removes them
+const AnonymousTimeout = 24 * time.Hour
+
+// IsImmutable tells whether an inode with the given flags and retention date
+// is immutable at the given time
+func IsImmutable(flags uint32, retainUntil *time.Time, now time.Time) bool {
+	return flags&InodeImmutable != 0 && (retainUntil == nil || now.Before(*retainUntil))
+}
+
+// RemoveBatchSize is the maximum amount of objects CleanOrphanChunks removes
+// from the storage at once
+const RemoveBatchSize = 1000
+
+// Modes of Fallocate, matching the ones of fallocate
+const (
+	// FallocKeepSize makes Fallocate leave the size of the inode unchanged
+	FallocKeepSize = 0x01
+
+	// FallocPunchHole makes Fallocate turn the range into a hole, orphaning
+	// the chunks within it. It must be combined with FallocKeepSize.
+	FallocPunchHole = 0x02
+
+	// FallocZeroRange makes Fallocate replace any data within the range with
+	// zeros instead of preserving it
+	FallocZeroRange = 0x10
+)
+
+// Limits of extended attributes, SetXattr fails with ERANGE for longer names
+// and with E2BIG for bigger values
+const (
+	MaxXattrNameSize  = 255
+	MaxXattrValueSize = 4096
+)
+
+// AtimePolicy controls when reading an inode updates its access time,
+// mirroring the strictatime, relatime and noatime mount options
+type AtimePolicy int
+
+// Access time policies
+const (
+	// StrictAtime updates the access time on every read
+	StrictAtime AtimePolicy = iota
+
+	// RelAtime only updates the access time if it isn't newer than the
+	// modification or change times, or if it's older than a day
+	RelAtime
+
+	// NoAtime never updates the access time on reads
+	NoAtime
+)
+
+var errAtimePolicy = errors.New("Unknown atime policy")
+
+// ParseAtimePolicy returns the policy named after the given mount option
+func ParseAtimePolicy(name string) (AtimePolicy, error) {
+	switch name {
+	case "strictatime":
+		return StrictAtime, nil
+	case "relatime":
+		return RelAtime, nil
+	case "noatime":
+		return NoAtime, nil
+	default:
+		return StrictAtime, errAtimePolicy
+	}
 }
 
 // Entry represents an entry of the file system
@@ -48,8 +209,15 @@ type Entry struct {
 
 // Inode represents a file system inode
 type Inode struct {
-	ID      fuseops.InodeID
+	ID fuseops.InodeID
+
+	// SymLink holds the target of a symbolic link when creating it, it's not
+	// filled by Get nor LookUp, use ReadLink instead
 	SymLink string
+
+	// Rdev holds the device number of character and block devices
+	Rdev uint32
+
 	fuseops.InodeAttributes
 }
 
@@ -59,6 +227,108 @@ type Stats struct {
 	Size   uint64
 }
 
+// SubtreeStats contain information about the usage of an inode along with
+// every inode below it
+type SubtreeStats struct {
+	Stats
+
+	// Allocated is the amount of bytes held by chunks with data, leaving out
+	// holes so that sparse files are accounted for
+	Allocated uint64
+}
+
+// DefaultCapacity is the amount of bytes and inodes reported as total when
+// no quota is configured
+const DefaultCapacity = 1 << 48
+
+// FsStats contain information about file system usage relative to its capacity
+type FsStats struct {
+	Stats
+
+	TotalInodes uint64
+	FreeInodes  uint64
+	TotalSize   uint64
+	FreeSize    uint64
+
+	// BlockSize is the preferred size of IO operations, zero if the driver
+	// has none
+	BlockSize uint64
+}
+
+// NewFsStats computes the free space left given the usage stats and the
+// configured capacity, zero meaning there's no quota
+func NewFsStats(stats Stats, size uint64, inodes uint64) *FsStats {
+	if size == 0 {
+		size = DefaultCapacity
+	}
+
+	if inodes == 0 {
+		inodes = DefaultCapacity
+	}
+
+	fsStats := &FsStats{
+		Stats:       stats,
+		TotalInodes: inodes,
+		TotalSize:   size,
+	}
+
+	if stats.Inodes < inodes {
+		fsStats.FreeInodes = inodes - stats.Inodes
+	}
+
+	if stats.Size < size {
+		fsStats.FreeSize = size - stats.Size
+	}
+
+	return fsStats
+}
+
+// ZeroFill returns the chunks filling the given range of an inode with
+// zeros, split so that the ones past the first chunk start at a multiple of
+// blockSize, aligning holes to it. A zero blockSize leaves the range whole.
+func ZeroFill(start uint64, end uint64, blockSize uint64) []Chunk {
+	chunks := make([]Chunk, 0, 2)
+	if start >= end {
+		return chunks
+	}
+
+	if blockSize > 0 && start%blockSize != 0 {
+		if boundary := start - start%blockSize + blockSize; boundary < end {
+			chunks = append(chunks, Chunk{
+				InodeOffset: start,
+				Chunk:       storage.Chunk{Storage: ZeroStorage, Size: boundary - start},
+			})
+
+			start = boundary
+		}
+	}
+
+	return append(chunks, Chunk{
+		InodeOffset: start,
+		Chunk:       storage.Chunk{Storage: ZeroStorage, Size: end - start},
+	})
+}
+
+// Quota contains the limits and usage of a user or a group, a zero limit
+// meaning there's no limit
+type Quota struct {
+	Bytes  uint64
+	Inodes uint64
+
+	UsedBytes  uint64
+	UsedInodes uint64
+}
+
+// Exceeds checks whether adding the given amount of bytes and inodes to the
+// current usage would go over the limits
+func (q Quota) Exceeds(bytes int64, inodes int64) bool {
+	return exceeds(q.Bytes, q.UsedBytes, bytes) || exceeds(q.Inodes, q.UsedInodes, inodes)
+}
+
+func exceeds(limit uint64, used uint64, delta int64) bool {
+	return limit != 0 && delta > 0 && used+uint64(delta) > limit
+}
+
 // Chunk contains information about the location of a particular piece
 // of binary data
 type Chunk struct {
@@ -74,6 +344,71 @@ type Chunk struct {
 
 	// Chunk points to the relevant storage chunk
 	storage.Chunk
+
+	// Hash is the hex encoded SHA-256 of the data of this chunk, if known,
+	// allowing drivers to deduplicate it
+	Hash string
+
+	// Checksum is the hex encoded CRC-32C of the data of this chunk, if known,
+	// allowing readers to detect corrupted objects
+	Checksum string
+}
+
+// ZeroStorage is the storage of the chunks filling holes with zeros
+const ZeroStorage = "zero"
+
+// IsHole tells whether the chunk reads as zeros, having no object or being
+// held by ZeroStorage
+func (c Chunk) IsHole() bool {
+	return c.Key == "" || c.Storage == ZeroStorage
+}
+
+// Hole is a range of an inode reading as zeros
+type Hole struct {
+	Offset uint64
+	Size   uint64
+}
+
+// Holes returns the ranges of an inode of the given size reading as zeros,
+// given its chunks sorted by inode offset: the ones of holes along with the
+// gaps between chunks, adjacent ranges being merged
+func Holes(chunks []Chunk, size uint64) []Hole {
+	holes := make([]Hole, 0)
+	position := uint64(0)
+
+	add := func(start uint64, end uint64) {
+		if end > size {
+			end = size
+		}
+
+		if start >= end {
+			return
+		}
+
+		if n := len(holes); n > 0 && holes[n-1].Offset+holes[n-1].Size == start {
+			holes[n-1].Size += end - start
+			return
+		}
+
+		holes = append(holes, Hole{Offset: start, Size: end - start})
+	}
+
+	for _, c := range chunks {
+		if c.InodeOffset > position {
+			add(position, c.InodeOffset)
+		}
+
+		if c.IsHole() {
+			add(c.InodeOffset, c.InodeOffset+c.Size)
+		}
+
+		if end := c.InodeOffset + c.Size; end > position {
+			position = end
+		}
+	}
+
+	add(position, size)
+	return holes
 }
 
 // Child represents a child entry within a directory
@@ -0,0 +1,57 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/manvalls/titan/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZeroFill(t *testing.T) {
+	ranges := func(chunks []Chunk) [][2]uint64 {
+		result := make([][2]uint64, 0)
+		for _, c := range chunks {
+			assert.Equal(t, "zero", c.Storage)
+			result = append(result, [2]uint64{c.InodeOffset, c.Size})
+		}
+
+		return result
+	}
+
+	assert.Equal(t, [][2]uint64{{100, 9900}}, ranges(ZeroFill(100, 10000, 0)))
+	assert.Equal(t, [][2]uint64{{100, 3996}, {4096, 5904}}, ranges(ZeroFill(100, 10000, 4096)))
+	assert.Equal(t, [][2]uint64{{4096, 5904}}, ranges(ZeroFill(4096, 10000, 4096)))
+	assert.Equal(t, [][2]uint64{{100, 900}}, ranges(ZeroFill(100, 1000, 4096)))
+	assert.Empty(t, ZeroFill(100, 100, 4096))
+}
+
+func TestHoles(t *testing.T) {
+	chunk := func(offset uint64, key string, size uint64) Chunk {
+		c := Chunk{InodeOffset: offset, Chunk: storage.Chunk{Storage: "test", Key: key, Size: size}}
+		if key == "" {
+			c.Storage = ZeroStorage
+		}
+
+		return c
+	}
+
+	assert.Equal(t, []Hole{}, Holes(nil, 0))
+	assert.Equal(t, []Hole{{Offset: 0, Size: 100}}, Holes(nil, 100))
+	assert.Equal(t, []Hole{}, Holes([]Chunk{chunk(0, "a", 100)}, 100))
+
+	assert.Equal(t, []Hole{{Offset: 10, Size: 30}, {Offset: 50, Size: 50}}, Holes([]Chunk{
+		chunk(0, "a", 10),
+		chunk(10, "", 20),
+		chunk(40, "b", 10),
+		chunk(60, "", 10),
+	}, 100))
+
+	assert.Equal(t, []Hole{{Offset: 10, Size: 10}}, Holes([]Chunk{
+		chunk(0, "a", 10),
+		chunk(10, "", 50),
+	}, 20))
+
+	assert.True(t, chunk(0, "", 10).IsHole())
+	assert.False(t, chunk(0, "a", 10).IsHole())
+	assert.True(t, Chunk{Chunk: storage.Chunk{Storage: ZeroStorage, Key: "a"}}.IsHole())
+}
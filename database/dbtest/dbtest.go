@@ -0,0 +1,4287 @@
+package dbtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database"
+	"github.com/manvalls/titan/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// Run runs the shared test suite against an already set up database, so that
+// every driver behaves in the same way
+func Run(t *testing.T, db database.Db) {
+	tests := []struct {
+		name string
+		test func(*testing.T, database.Db, fuseops.InodeID)
+	}{
+		{"CreateAndLookUp", testCreateAndLookUp},
+		{"CreateUnderFile", testCreateUnderFile},
+		{"CreateDuplicate", testCreateDuplicate},
+		{"CreateSpecial", testCreateSpecial},
+		{"CreateWithTimes", testCreateWithTimes},
+		{"DirNlink", testDirNlink},
+		{"CreateAnonymous", testCreateAnonymous},
+		{"ForgetAnonymous", testForgetAnonymous},
+		{"CleanAnonymous", testCleanAnonymous},
+		{"Link", testLink},
+		{"LinkDir", testLinkDir},
+		{"LinkUnderFile", testLinkUnderFile},
+		{"ReadLink", testReadLink},
+		{"Unlink", testUnlink},
+		{"UnlinkNotEmpty", testUnlinkNotEmpty},
+		{"UnlinkMissing", testUnlinkMissing},
+		{"Paths", testPaths},
+		{"RemoveTree", testRemoveTree},
+		{"RemoveTreeNotRecursive", testRemoveTreeNotRecursive},
+		{"Rename", testRename},
+		{"RenameOverFile", testRenameOverFile},
+		{"RenameOverLinkedFile", testRenameOverLinkedFile},
+		{"RenameOverNonEmptyDir", testRenameOverNonEmptyDir},
+		{"RenameOverMissing", testRenameOverMissing},
+		{"RenameIntoChild", testRenameIntoChild},
+		{"RenameIntoGrandchild", testRenameIntoGrandchild},
+		{"RenameIntoSibling", testRenameIntoSibling},
+		{"RenameNoReplace", testRenameNoReplace},
+		{"RenameExchange", testRenameExchange},
+		{"RenameExchangeMissing", testRenameExchangeMissing},
+		{"RenameExchangeIntoChild", testRenameExchangeIntoChild},
+		{"RenameInvalidFlags", testRenameInvalidFlags},
+		{"RenameEmpty", testRenameEmpty},
+		{"RenameMutable", testRenameMutable},
+		{"Forget", testForget},
+		{"ForgetBatch", testForgetBatch},
+		{"TouchSize", testTouchSize},
+		{"TouchStraddlingChunk", testTouchStraddlingChunk},
+		{"Truncate", testTruncate},
+		{"Statx", testStatx},
+		{"Holes", testHoles},
+		{"TruncateToZero", testTruncateToZero},
+		{"Immutable", testImmutable},
+		{"ImmutableRetention", testImmutableRetention},
+		{"AddChunk", testAddChunk},
+		{"AddChunkAppend", testAddChunkAppend},
+		{"AddChunkFullyCover", testAddChunkFullyCover},
+		{"AddChunkPartialOverlap", testAddChunkPartialOverlap},
+		{"AddChunkInside", testAddChunkInside},
+		{"AddChunkCancel", testAddChunkCancel},
+		{"AddChunkConcurrent", testAddChunkConcurrent},
+		{"CopyRange", testCopyRange},
+		{"Snapshot", testSnapshot},
+		{"SnapshotErrors", testSnapshotErrors},
+		{"VerifyChunks", testVerifyChunks},
+		{"ChunkETags", testChunkETags},
+		{"ChunkChecksums", testChunkChecksums},
+		{"CleanSharedObjects", testCleanSharedObjects},
+		{"CountOrphans", testCountOrphans},
+		{"CleanConcurrently", testCleanConcurrently},
+		{"CleanInBatches", testCleanInBatches},
+		{"CleanRemoveError", testCleanRemoveError},
+		{"Fallocate", testFallocate},
+		{"PunchHole", testPunchHole},
+		{"MigrateChunk", testMigrateChunk},
+		{"CompactChunks", testCompactChunks},
+		{"Defragment", testDefragment},
+		{"RetierInode", testRetierInode},
+		{"ChunksInRange", testChunksInRange},
+		{"Children", testChildren},
+		{"ChildCount", testChildCount},
+		{"ChildrenPage", testChildrenPage},
+		{"ChildrenPlus", testChildrenPlus},
+		{"Xattr", testXattr},
+		{"Locks", testLocks},
+		{"XattrLimits", testXattrLimits},
+		{"XattrSize", testXattrSize},
+		{"AllXattr", testAllXattr},
+		{"SwapXattr", testSwapXattr},
+		{"SwapXattrUnchanged", testSwapXattrUnchanged},
+		{"QuotaInodes", testQuotaInodes},
+		{"QuotaBytes", testQuotaBytes},
+		{"QuotaUsage", testQuotaUsage},
+		{"QuotaOwner", testQuotaOwner},
+		{"ChownTree", testChownTree},
+		{"ChmodTree", testChmodTree},
+		{"SubtreeStats", testSubtreeStats},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, db, Mkdir(t, db, fuseops.RootInodeID))
+		})
+	}
+}
+
+// Mkdir creates a new uniquely named directory under the given parent
+func Mkdir(t testing.TB, db database.Db, parent fuseops.InodeID) fuseops.InodeID {
+	return create(t, db, parent, os.ModeDir|0755).ID
+}
+
+// Mkfile creates a new uniquely named regular file under the given parent
+func Mkfile(t testing.TB, db database.Db, parent fuseops.InodeID) *database.Entry {
+	return create(t, db, parent, 0644)
+}
+
+func create(t testing.TB, db database.Db, parent fuseops.InodeID, mode os.FileMode) *database.Entry {
+	name, err := storage.Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := db.Create(context.Background(), database.Entry{
+		Parent: parent,
+		Name:   name,
+		Inode: database.Inode{
+			InodeAttributes: fuseops.InodeAttributes{
+				Mode: mode,
+			},
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return entry
+}
+
+func testCreateAndLookUp(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+
+	entry, err := db.LookUp(ctx, dir, file.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, file.ID, entry.ID)
+	assert.Equal(t, os.FileMode(0644), entry.Mode)
+	assert.Equal(t, uint32(1), entry.Nlink)
+
+	inode, err := db.Get(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, file.ID, inode.ID)
+
+	_, err = db.LookUp(ctx, dir, "missing")
+	assert.Equal(t, syscall.ENOENT, err)
+}
+
+func testCreateUnderFile(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	file := Mkfile(t, db, dir)
+
+	_, err := db.Create(context.Background(), database.Entry{
+		Parent: file.ID,
+		Name:   "child",
+		Inode: database.Inode{
+			InodeAttributes: fuseops.InodeAttributes{
+				Mode: 0644,
+			},
+		},
+	})
+
+	assert.Equal(t, syscall.ENOTDIR, err)
+}
+
+func testCreateSpecial(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+
+	nodes := []struct {
+		mode os.FileMode
+		rdev uint32
+	}{
+		{os.ModeNamedPipe | 0644, 0},
+		{os.ModeSocket | 0755, 0},
+		{os.ModeDevice | os.ModeCharDevice | 0666, 1<<8 | 3},
+		{os.ModeDevice | 0660, 8<<8 | 1},
+	}
+
+	for _, node := range nodes {
+		name, err := storage.Key()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entry, err := db.Create(ctx, database.Entry{
+			Parent: dir,
+			Name:   name,
+			Inode: database.Inode{
+				Rdev: node.rdev,
+				InodeAttributes: fuseops.InodeAttributes{
+					Mode: node.mode,
+				},
+			},
+		})
+
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		assert.Equal(t, node.mode, entry.Mode)
+		assert.Equal(t, node.rdev, entry.Rdev)
+
+		inode, err := db.Get(ctx, entry.ID)
+		assert.Nil(t, err)
+		assert.Equal(t, node.mode, inode.Mode)
+		assert.Equal(t, node.rdev, inode.Rdev)
+
+		found, err := db.LookUp(ctx, dir, name)
+		assert.Nil(t, err)
+		assert.Equal(t, node.mode, found.Mode)
+		assert.Equal(t, node.rdev, found.Rdev)
+	}
+}
+
+func testCreateWithTimes(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	crtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	mtime := time.Date(2002, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	name, err := storage.Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := db.Create(ctx, database.Entry{
+		Parent: dir,
+		Name:   name,
+		Inode: database.Inode{
+			InodeAttributes: fuseops.InodeAttributes{
+				Mode:   0644,
+				Crtime: crtime,
+				Mtime:  mtime,
+			},
+		},
+	})
+
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	inode, err := db.Get(ctx, entry.ID)
+	assert.Nil(t, err)
+	assert.True(t, crtime.Equal(inode.Crtime), "expected %v, got %v", crtime, inode.Crtime)
+	assert.True(t, mtime.Equal(inode.Mtime), "expected %v, got %v", mtime, inode.Mtime)
+	assert.WithinDuration(t, time.Now(), inode.Ctime, time.Minute, "missing times should be the current one")
+	assert.WithinDuration(t, time.Now(), inode.Atime, time.Minute)
+}
+
+func testDirNlink(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	parent := create(t, db, dir, os.ModeDir|0755)
+
+	assertNlink := func(nlink uint32) {
+		inode, err := db.Get(ctx, parent.ID)
+		assert.Nil(t, err)
+		assert.Equal(t, nlink, inode.Nlink)
+
+		entry, err := db.LookUp(ctx, dir, parent.Name)
+		assert.Nil(t, err)
+		assert.Equal(t, nlink, entry.Nlink)
+
+		entries, err := db.ChildrenPlus(ctx, dir)
+		assert.Nil(t, err)
+		for _, e := range *entries {
+			if e.ID == parent.ID {
+				assert.Equal(t, nlink, e.Nlink)
+			}
+		}
+	}
+
+	assertNlink(2)
+
+	// Files don't count, only the ".." entries of subdirectories do
+	Mkfile(t, db, parent.ID)
+	assertNlink(2)
+
+	child := Mkdir(t, db, parent.ID)
+	assertNlink(3)
+
+	Mkdir(t, db, parent.ID)
+	assertNlink(4)
+
+	Mkdir(t, db, child)
+	assertNlink(4)
+
+	inode, err := db.Get(ctx, child)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(3), inode.Nlink)
+}
+
+func testCreateDuplicate(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+
+	stats, err := db.Stats(ctx)
+	assert.Nil(t, err)
+
+	_, err = db.Create(ctx, database.Entry{
+		Parent: dir,
+		Name:   file.Name,
+		Inode: database.Inode{
+			InodeAttributes: fuseops.InodeAttributes{
+				Mode: 0644,
+			},
+		},
+	})
+
+	assert.Equal(t, syscall.EEXIST, err)
+
+	_, err = db.Link(ctx, file.ID, dir, file.Name)
+	assert.Equal(t, syscall.EEXIST, err)
+
+	newStats, err := db.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, stats, newStats)
+
+	inode, err := db.Get(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), inode.Nlink)
+}
+
+func testCreateAnonymous(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+
+	stats, err := db.Stats(ctx)
+	assert.Nil(t, err)
+
+	inode, err := db.CreateAnonymous(ctx, 0644, 1000, 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0644), inode.Mode)
+	assert.Equal(t, uint32(1000), inode.Uid)
+	assert.Equal(t, uint32(0), inode.Nlink)
+
+	newStats, err := db.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, stats.Inodes+1, newStats.Inodes)
+
+	key, err := storage.Key()
+	assert.Nil(t, err)
+
+	AddChunk(t, db, inode.ID, 0, key, 0, 10)
+
+	entry, err := db.Link(ctx, inode.ID, dir, "anonymous")
+	assert.Nil(t, err)
+	assert.Equal(t, inode.ID, entry.ID)
+	assert.Equal(t, uint32(1), entry.Nlink)
+
+	// Once linked, closing the handle holding it doesn't remove it
+	assert.Nil(t, db.Forget(ctx, inode.ID))
+
+	entry, err = db.LookUp(ctx, dir, "anonymous")
+	assert.Nil(t, err)
+	assert.Equal(t, inode.ID, entry.ID)
+	assert.Equal(t, uint64(10), entry.Size)
+
+	AssertLayout(t, db, inode.ID, []Layout{{key, 0, 0, 10}})
+
+	_, err = db.CreateAnonymous(ctx, os.ModeDir|0755, 1000, 1000)
+	assert.Equal(t, syscall.EINVAL, err)
+}
+
+func testForgetAnonymous(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+
+	stats, err := db.Stats(ctx)
+	assert.Nil(t, err)
+
+	forgotten, err := db.CreateAnonymous(ctx, 0644, 1000, 1000)
+	assert.Nil(t, err)
+
+	key, err := storage.Key()
+	assert.Nil(t, err)
+
+	AddChunk(t, db, forgotten.ID, 0, key, 0, 10)
+	assert.Nil(t, db.Forget(ctx, forgotten.ID))
+
+	_, err = db.Get(ctx, forgotten.ID)
+	assert.Equal(t, syscall.ENOENT, err)
+
+	newStats, err := db.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, stats.Inodes, newStats.Inodes)
+	assert.Equal(t, stats.Size, newStats.Size)
+}
+
+func testCleanAnonymous(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+
+	held, err := db.CreateAnonymous(ctx, 0644, 1000, 1000)
+	assert.Nil(t, err)
+
+	// Until linked, inodes are held by the handle that created them
+	assert.Nil(t, db.CleanOrphanInodes(ctx))
+
+	_, err = db.Get(ctx, held.ID)
+	assert.Nil(t, err, "anonymous inodes should survive until forgotten")
+
+	report, err := db.CountOrphans(ctx, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), report.Inodes, "anonymous inodes shouldn't be counted as orphans")
+
+	entry, err := db.Link(ctx, held.ID, dir, "held")
+	assert.Nil(t, err)
+	assert.Equal(t, held.ID, entry.ID)
+
+	// Once linked, they're collected like any other inode
+	assert.Nil(t, db.Unlink(ctx, dir, "held"))
+	assert.Nil(t, db.CleanOrphanInodes(ctx))
+
+	_, err = db.Get(ctx, held.ID)
+	assert.Equal(t, syscall.ENOENT, err)
+}
+
+func testLink(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+
+	entry, err := db.Link(ctx, file.ID, dir, "link")
+	assert.Nil(t, err)
+	assert.Equal(t, file.ID, entry.ID)
+	assert.Equal(t, uint32(2), entry.Nlink)
+
+	inode, err := db.Get(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), inode.Nlink)
+
+	entry, err = db.LookUp(ctx, dir, "link")
+	assert.Nil(t, err)
+	assert.Equal(t, file.ID, entry.ID)
+}
+
+func testLinkDir(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	child := Mkdir(t, db, dir)
+
+	_, err := db.Link(ctx, child, dir, "link")
+	assert.Equal(t, syscall.EPERM, err)
+
+	_, err = db.LookUp(ctx, dir, "link")
+	assert.Equal(t, syscall.ENOENT, err)
+}
+
+func testLinkUnderFile(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+	parent := Mkfile(t, db, dir)
+
+	_, err := db.Link(ctx, file.ID, parent.ID, "link")
+	assert.Equal(t, syscall.ENOTDIR, err)
+
+	inode, err := db.Get(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), inode.Nlink)
+}
+
+func testReadLink(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+
+	link, err := db.Create(ctx, database.Entry{
+		Parent: dir,
+		Name:   "link",
+		Inode: database.Inode{
+			SymLink: "target",
+			InodeAttributes: fuseops.InodeAttributes{
+				Mode: os.ModeSymlink | 0777,
+			},
+		},
+	})
+
+	assert.Nil(t, err)
+
+	target, err := db.ReadLink(ctx, link.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "target", target)
+
+	inode, err := db.Get(ctx, link.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "", inode.SymLink)
+
+	_, err = db.ReadLink(ctx, file.ID)
+	assert.Equal(t, syscall.EINVAL, err)
+
+	_, err = db.ReadLink(ctx, 0)
+	assert.Equal(t, syscall.ENOENT, err)
+}
+
+func testUnlink(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+
+	assert.Nil(t, db.Unlink(ctx, dir, file.Name))
+
+	_, err := db.LookUp(ctx, dir, file.Name)
+	assert.Equal(t, syscall.ENOENT, err)
+
+	inode, err := db.Get(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0), inode.Nlink)
+}
+
+func testUnlinkNotEmpty(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	child := Mkdir(t, db, dir)
+	Mkfile(t, db, child)
+
+	children, err := db.Children(ctx, dir)
+	assert.Nil(t, err)
+	assert.Len(t, *children, 1)
+
+	assert.Equal(t, syscall.ENOTEMPTY, db.Unlink(ctx, dir, (*children)[0].Name))
+}
+
+func testUnlinkMissing(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	assert.Equal(t, syscall.ENOENT, db.Unlink(context.Background(), dir, "missing"))
+}
+
+func testPaths(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+
+	paths, err := db.Paths(ctx, fuseops.RootInodeID)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/"}, *paths)
+
+	paths, err = db.Paths(ctx, dir)
+	assert.Nil(t, err)
+	if !assert.Len(t, *paths, 1) {
+		return
+	}
+
+	root := (*paths)[0]
+	child := create(t, db, dir, os.ModeDir|0755)
+	file := Mkfile(t, db, child.ID)
+
+	paths, err = db.Paths(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{root + "/" + child.Name + "/" + file.Name}, *paths)
+
+	_, err = db.Link(ctx, file.ID, dir, "a-link")
+	assert.Nil(t, err)
+
+	paths, err = db.Paths(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{root + "/" + child.Name + "/" + file.Name, root + "/a-link"}, *paths)
+
+	assert.Nil(t, db.Unlink(ctx, child.ID, file.Name))
+	assert.Nil(t, db.Unlink(ctx, dir, "a-link"))
+
+	_, err = db.Paths(ctx, file.ID)
+	assert.Equal(t, syscall.ENOENT, err)
+}
+
+func testRemoveTree(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	st := &removals{keys: make(map[string]int)}
+
+	top := create(t, db, dir, os.ModeDir|0755)
+	files := make([]*database.Entry, 0)
+	keys := make([]string, 0)
+
+	// A chain of 100 nested directories holding 9 files each, 1000 entries
+	// in total
+	parent := top.ID
+	for i := 0; i < 100; i++ {
+		if i > 0 {
+			parent = Mkdir(t, db, parent)
+		}
+
+		for j := 0; j < 9; j++ {
+			key, err := storage.Key()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			file := Mkfile(t, db, parent)
+			AddChunk(t, db, file.ID, 0, key, 0, 10)
+			files = append(files, file)
+			keys = append(keys, key)
+		}
+	}
+
+	// Files linked from outside the tree survive it, while those linked
+	// twice within it are removed once
+	_, err := db.Link(ctx, files[0].ID, dir, "survivor")
+	assert.Nil(t, err)
+
+	_, err = db.Link(ctx, files[len(files)-1].ID, top.ID, "twice")
+	assert.Nil(t, err)
+
+	stats, err := db.Stats(ctx)
+	assert.Nil(t, err)
+
+	assert.Equal(t, syscall.ENOTEMPTY, db.RemoveTree(ctx, dir, top.Name, false))
+	assert.Nil(t, db.RemoveTree(ctx, dir, top.Name, true))
+
+	_, err = db.LookUp(ctx, dir, top.Name)
+	assert.Equal(t, syscall.ENOENT, err)
+
+	_, err = db.Get(ctx, parent)
+	assert.Equal(t, syscall.ENOENT, err)
+
+	inode, err := db.Get(ctx, files[0].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), inode.Nlink)
+
+	newStats, err := db.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, stats.Inodes-999, newStats.Inodes)
+	assert.Equal(t, stats.Size-8990, newStats.Size)
+
+	assert.Nil(t, db.CleanOrphanChunks(ctx, time.Now().Add(time.Hour), st, 4))
+	assert.Equal(t, 0, st.count(keys[0]))
+
+	for _, key := range keys[1:] {
+		assert.Equal(t, 1, st.count(key))
+	}
+
+	assert.Equal(t, syscall.ENOENT, db.RemoveTree(ctx, dir, top.Name, true))
+}
+
+func testRemoveTreeNotRecursive(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+
+	file := Mkfile(t, db, dir)
+	assert.Nil(t, db.RemoveTree(ctx, dir, file.Name, false))
+
+	_, err := db.Get(ctx, file.ID)
+	assert.Equal(t, syscall.ENOENT, err, "inodes left without links should be removed")
+
+	empty := create(t, db, dir, os.ModeDir|0755)
+	assert.Nil(t, db.RemoveTree(ctx, dir, empty.Name, false))
+
+	// Immutable inodes keep the whole tree from being removed
+	top := create(t, db, dir, os.ModeDir|0755)
+	file = Mkfile(t, db, Mkdir(t, db, top.ID))
+	assert.Nil(t, db.SetImmutable(ctx, file.ID, 0, true, nil))
+
+	assert.Equal(t, syscall.EPERM, db.RemoveTree(ctx, dir, top.Name, true))
+
+	_, err = db.LookUp(ctx, dir, top.Name)
+	assert.Nil(t, err)
+}
+
+func testRename(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+	other := Mkdir(t, db, dir)
+
+	assert.Nil(t, db.Rename(ctx, dir, file.Name, other, "renamed", 0))
+
+	_, err := db.LookUp(ctx, dir, file.Name)
+	assert.Equal(t, syscall.ENOENT, err)
+
+	entry, err := db.LookUp(ctx, other, "renamed")
+	assert.Nil(t, err)
+	assert.Equal(t, file.ID, entry.ID)
+
+	assert.Equal(t, syscall.ENOENT, db.Rename(ctx, dir, "missing", other, "missing", 0))
+}
+
+func testRenameOverFile(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	st := &removals{keys: make(map[string]int)}
+
+	key, err := storage.Key()
+	assert.Nil(t, err)
+
+	file := Mkfile(t, db, dir)
+	target := Mkfile(t, db, dir)
+	AddChunk(t, db, target.ID, 0, key, 0, 10)
+
+	stats, err := db.Stats(ctx)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Rename(ctx, dir, file.Name, dir, target.Name, 0))
+
+	entry, err := db.LookUp(ctx, dir, target.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, file.ID, entry.ID)
+	assert.Equal(t, uint32(1), entry.Nlink)
+
+	// The replaced inode has no links left, so it's removed along with its
+	// chunks
+	_, err = db.Get(ctx, target.ID)
+	assert.Equal(t, syscall.ENOENT, err)
+
+	newStats, err := db.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, stats.Inodes-1, newStats.Inodes)
+	assert.Equal(t, stats.Size-10, newStats.Size)
+
+	assert.Nil(t, db.CleanOrphanChunks(ctx, time.Now().Add(time.Hour), st, 1))
+	assert.Equal(t, 1, st.count(key))
+}
+
+func testRenameOverLinkedFile(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+	target := Mkfile(t, db, dir)
+	AddChunk(t, db, target.ID, 0, "a", 0, 10)
+
+	_, err := db.Link(ctx, target.ID, dir, target.Name+"-link")
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Rename(ctx, dir, file.Name, dir, target.Name, 0))
+
+	inode, err := db.Get(ctx, target.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), inode.Nlink)
+
+	AssertLayout(t, db, target.ID, []Layout{
+		{"a", 0, 0, 10},
+	})
+}
+
+func testRenameOverNonEmptyDir(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+	target := create(t, db, dir, os.ModeDir|0755)
+	Mkfile(t, db, target.ID)
+
+	assert.Equal(t, syscall.ENOTEMPTY, db.Rename(ctx, dir, file.Name, dir, target.Name, 0))
+
+	entry, err := db.LookUp(ctx, dir, file.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, file.ID, entry.ID)
+
+	entry, err = db.LookUp(ctx, dir, target.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, target.ID, entry.ID)
+	assert.Equal(t, uint32(2), entry.Nlink)
+}
+
+func testRenameOverMissing(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+
+	assert.Nil(t, db.Rename(ctx, dir, file.Name, dir, "missing", 0))
+
+	entry, err := db.LookUp(ctx, dir, "missing")
+	assert.Nil(t, err)
+	assert.Equal(t, file.ID, entry.ID)
+}
+
+func testRenameIntoChild(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	moved := create(t, db, dir, os.ModeDir|0755)
+	child := Mkdir(t, db, moved.ID)
+
+	assert.Equal(t, syscall.EINVAL, db.Rename(ctx, dir, moved.Name, child, "moved", 0))
+	assert.Equal(t, syscall.EINVAL, db.Rename(ctx, dir, moved.Name, moved.ID, "moved", 0))
+
+	entry, err := db.LookUp(ctx, dir, moved.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, moved.ID, entry.ID)
+}
+
+func testRenameIntoGrandchild(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	moved := create(t, db, dir, os.ModeDir|0755)
+	grandchild := Mkdir(t, db, Mkdir(t, db, moved.ID))
+
+	assert.Equal(t, syscall.EINVAL, db.Rename(ctx, dir, moved.Name, grandchild, "moved", 0))
+
+	entry, err := db.LookUp(ctx, dir, moved.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, moved.ID, entry.ID)
+}
+
+func testRenameIntoSibling(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	moved := create(t, db, dir, os.ModeDir|0755)
+	sibling := Mkdir(t, db, dir)
+
+	assert.Nil(t, db.Rename(ctx, dir, moved.Name, sibling, "moved", 0))
+
+	entry, err := db.LookUp(ctx, sibling, "moved")
+	assert.Nil(t, err)
+	assert.Equal(t, moved.ID, entry.ID)
+}
+
+func testRenameNoReplace(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+	target := Mkfile(t, db, dir)
+
+	assert.Equal(t, syscall.EEXIST, db.Rename(ctx, dir, file.Name, dir, target.Name, database.RenameNoReplace))
+
+	entry, err := db.LookUp(ctx, dir, target.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, target.ID, entry.ID)
+
+	assert.Nil(t, db.Rename(ctx, dir, file.Name, dir, "renamed", database.RenameNoReplace))
+
+	entry, err = db.LookUp(ctx, dir, "renamed")
+	assert.Nil(t, err)
+	assert.Equal(t, file.ID, entry.ID)
+}
+
+func testRenameExchange(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+	other := Mkdir(t, db, dir)
+	target := Mkfile(t, db, other)
+
+	assert.Nil(t, db.Rename(ctx, dir, file.Name, other, target.Name, database.RenameExchange))
+
+	entry, err := db.LookUp(ctx, dir, file.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, target.ID, entry.ID)
+	assert.Equal(t, uint32(1), entry.Nlink)
+
+	entry, err = db.LookUp(ctx, other, target.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, file.ID, entry.ID)
+	assert.Equal(t, uint32(1), entry.Nlink)
+}
+
+func testRenameExchangeMissing(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+
+	assert.Equal(t, syscall.ENOENT, db.Rename(ctx, dir, file.Name, dir, "missing", database.RenameExchange))
+	assert.Equal(t, syscall.ENOENT, db.Rename(ctx, dir, "missing", dir, file.Name, database.RenameExchange))
+
+	entry, err := db.LookUp(ctx, dir, file.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, file.ID, entry.ID)
+}
+
+func testRenameExchangeIntoChild(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	moved := create(t, db, dir, os.ModeDir|0755)
+	child := Mkfile(t, db, moved.ID)
+
+	assert.Equal(t, syscall.EINVAL, db.Rename(ctx, moved.ID, child.Name, dir, moved.Name, database.RenameExchange))
+	assert.Equal(t, syscall.EINVAL, db.Rename(ctx, dir, moved.Name, moved.ID, child.Name, database.RenameExchange))
+}
+
+func testRenameInvalidFlags(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+
+	assert.Equal(t, syscall.EINVAL, db.Rename(ctx, dir, file.Name, dir, "renamed", database.RenameNoReplace|database.RenameExchange))
+	assert.Equal(t, syscall.EINVAL, db.Rename(ctx, dir, file.Name, dir, "renamed", 1<<2))
+	assert.Equal(t, syscall.EINVAL, db.Rename(ctx, dir, file.Name, dir, "renamed", database.RenameEmpty|database.RenameExchange))
+}
+
+func testRenameEmpty(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	full := create(t, db, dir, os.ModeDir|0755)
+	Mkfile(t, db, full.ID)
+	empty := create(t, db, dir, os.ModeDir|0755)
+	file := Mkfile(t, db, dir)
+
+	assert.Equal(t, syscall.ENOTEMPTY, db.Rename(ctx, dir, full.Name, dir, "full", database.RenameEmpty))
+
+	entry, err := db.LookUp(ctx, dir, full.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, full.ID, entry.ID)
+
+	assert.Nil(t, db.Rename(ctx, dir, empty.Name, dir, "empty", database.RenameEmpty))
+	assert.Nil(t, db.Rename(ctx, dir, file.Name, dir, "file", database.RenameNoReplace|database.RenameEmpty))
+
+	entry, err = db.LookUp(ctx, dir, "file")
+	assert.Nil(t, err)
+	assert.Equal(t, file.ID, entry.ID)
+}
+
+func testRenameMutable(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+	assert.Nil(t, db.SetImmutable(ctx, file.ID, 0, true, nil))
+
+	assert.Equal(t, syscall.EPERM, db.Rename(ctx, dir, file.Name, dir, "renamed", database.RenameMutable))
+
+	entry, err := db.LookUp(ctx, dir, file.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, file.ID, entry.ID)
+
+	assert.Nil(t, db.Rename(ctx, dir, file.Name, dir, "renamed", 0))
+	assert.Nil(t, db.SetImmutable(ctx, file.ID, 0, false, nil))
+}
+
+func testForget(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+
+	assert.Nil(t, db.Forget(ctx, file.ID))
+	_, err := db.Get(ctx, file.ID)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Unlink(ctx, dir, file.Name))
+	assert.Nil(t, db.Forget(ctx, file.ID))
+	_, err = db.Get(ctx, file.ID)
+	assert.Equal(t, syscall.ENOENT, err)
+}
+
+func testForgetBatch(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	linked := make([]*database.Entry, 3)
+	unlinked := make([]*database.Entry, 3)
+	inodes := make([]fuseops.InodeID, 0, 6)
+
+	for i := range linked {
+		linked[i] = Mkfile(t, db, dir)
+		unlinked[i] = Mkfile(t, db, dir)
+		AddChunk(t, db, unlinked[i].ID, 0, "a", 0, 10)
+		assert.Nil(t, db.SetXattr(ctx, unlinked[i].ID, "user.test", []byte("value"), 0))
+		assert.Nil(t, db.Unlink(ctx, dir, unlinked[i].Name))
+		inodes = append(inodes, linked[i].ID, unlinked[i].ID)
+	}
+
+	stats, err := db.Stats(ctx)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.ForgetBatch(ctx, inodes))
+
+	for i := range linked {
+		_, err = db.Get(ctx, linked[i].ID)
+		assert.Nil(t, err)
+
+		_, err = db.Get(ctx, unlinked[i].ID)
+		assert.Equal(t, syscall.ENOENT, err)
+	}
+
+	newStats, err := db.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, stats.Inodes-3, newStats.Inodes)
+	assert.Equal(t, stats.Size-30, newStats.Size)
+
+	assert.Nil(t, db.ForgetBatch(ctx, inodes))
+	assert.Nil(t, db.ForgetBatch(ctx, nil))
+
+	newStats, err = db.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, stats.Inodes-3, newStats.Inodes)
+	assert.Equal(t, stats.Size-30, newStats.Size)
+}
+
+func testTouchSize(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+
+	size := uint64(100)
+	inode, err := db.Touch(ctx, file.ID, &size, nil, nil, nil, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, size, inode.Size)
+
+	chunks, err := db.Chunks(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Len(t, *chunks, 1)
+	assert.Equal(t, "zero", (*chunks)[0].Storage)
+	assert.Equal(t, size, (*chunks)[0].Size)
+
+	size = 40
+	inode, err = db.Touch(ctx, file.ID, &size, nil, nil, nil, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, size, inode.Size)
+
+	chunks, err = db.Chunks(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Len(t, *chunks, 1)
+	assert.Equal(t, size, (*chunks)[0].Size)
+}
+
+func testTouchStraddlingChunk(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+
+	AddChunk(t, db, file.ID, 0, "a", 0, 10)
+	AddChunk(t, db, file.ID, 0, "b", 10, 10)
+
+	stats, err := db.Stats(ctx)
+	assert.Nil(t, err)
+
+	size := uint64(15)
+	_, err = db.Touch(ctx, file.ID, &size, nil, nil, nil, nil, nil)
+	assert.Nil(t, err)
+
+	AssertLayout(t, db, file.ID, []Layout{
+		{"a", 0, 0, 10},
+		{"b", 0, 10, 5},
+	})
+
+	newStats, err := db.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, stats.Size-5, newStats.Size)
+
+	size = 5
+	_, err = db.Touch(ctx, file.ID, &size, nil, nil, nil, nil, nil)
+	assert.Nil(t, err)
+
+	AssertLayout(t, db, file.ID, []Layout{
+		{"a", 0, 0, 5},
+	})
+
+	newStats, err = db.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, stats.Size-15, newStats.Size)
+}
+
+// Layout describes an inode chunk as (storage key, object offset, inode offset, size)
+type Layout struct {
+	Key          string
+	ObjectOffset uint64
+	InodeOffset  uint64
+	Size         uint64
+}
+
+// AssertLayout checks that the chunks of the given inode match the provided layout
+func AssertLayout(t *testing.T, db database.Db, inode fuseops.InodeID, expected []Layout) {
+	chunks, err := db.Chunks(context.Background(), inode)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	layout := make([]Layout, 0, len(*chunks))
+	for _, c := range *chunks {
+		layout = append(layout, Layout{c.Key, c.ObjectOffset, c.InodeOffset, c.Size})
+	}
+
+	assert.Equal(t, expected, layout)
+}
+
+// assertImmutable checks that the given file can't be written nor removed
+func assertImmutable(t *testing.T, db database.Db, dir fuseops.InodeID, file *database.Entry) {
+	ctx := context.Background()
+	size := uint64(5)
+
+	_, err := db.Touch(ctx, file.ID, &size, nil, nil, nil, nil, nil)
+	assert.Equal(t, syscall.EPERM, err)
+	assert.Equal(t, syscall.EPERM, db.Truncate(ctx, file.ID, size))
+
+	err = db.AddChunk(ctx, file.ID, 0, database.Chunk{
+		Inode: file.ID,
+		Chunk: storage.Chunk{Storage: "test", Key: "b", Size: 10},
+	})
+
+	assert.Equal(t, syscall.EPERM, err)
+	assert.Equal(t, syscall.EPERM, db.Unlink(ctx, dir, file.Name))
+
+	other := Mkfile(t, db, dir)
+	assert.Equal(t, syscall.EPERM, db.Rename(ctx, dir, other.Name, dir, file.Name, 0))
+
+	inode, err := db.Get(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), inode.Size)
+}
+
+func testImmutable(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+
+	file, err := createOwned(t, db, dir, 1000, 1000)
+	assert.Nil(t, err)
+	AddChunk(t, db, file.ID, 0, "a", 0, 10)
+
+	assert.Equal(t, syscall.EPERM, db.SetImmutable(ctx, file.ID, 1001, true, nil))
+	assert.Equal(t, syscall.ENOENT, db.SetImmutable(ctx, fuseops.InodeID(1<<40), 0, true, nil))
+	assert.Nil(t, db.SetImmutable(ctx, file.ID, 1000, true, nil))
+	assertImmutable(t, db, dir, file)
+
+	// Attributes other than the size can still be changed
+	mode := os.FileMode(0600)
+	_, err = db.Touch(ctx, file.ID, nil, &mode, nil, nil, nil, nil)
+	assert.Nil(t, err)
+
+	assert.Equal(t, syscall.EPERM, db.SetImmutable(ctx, file.ID, 1001, false, nil))
+	assert.Nil(t, db.SetImmutable(ctx, file.ID, 0, false, nil))
+
+	AddChunk(t, db, file.ID, 0, "b", 10, 10)
+	assert.Nil(t, db.Truncate(ctx, file.ID, 5))
+	assert.Nil(t, db.Unlink(ctx, dir, file.Name))
+}
+
+func testImmutableRetention(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+
+	file := Mkfile(t, db, dir)
+	AddChunk(t, db, file.ID, 0, "a", 0, 10)
+
+	retainUntil := time.Now().Add(time.Second)
+	assert.Nil(t, db.SetImmutable(ctx, file.ID, 0, true, &retainUntil))
+	assertImmutable(t, db, dir, file)
+
+	// The retention can be extended, but neither shortened nor cleared
+	earlier := retainUntil.Add(-time.Hour)
+	assert.Equal(t, syscall.EPERM, db.SetImmutable(ctx, file.ID, 0, true, &earlier))
+	assert.Equal(t, syscall.EPERM, db.SetImmutable(ctx, file.ID, 0, false, nil))
+
+	retainUntil = retainUntil.Add(time.Second)
+	assert.Nil(t, db.SetImmutable(ctx, file.ID, 0, true, &retainUntil))
+
+	time.Sleep(time.Until(retainUntil) + time.Second)
+
+	AddChunk(t, db, file.ID, 0, "b", 10, 10)
+	assert.Nil(t, db.Truncate(ctx, file.ID, 5))
+	assert.Nil(t, db.Unlink(ctx, dir, file.Name))
+
+	// Retentions already past don't make inodes immutable
+	file = Mkfile(t, db, dir)
+	assert.Nil(t, db.SetImmutable(ctx, file.ID, 0, true, &earlier))
+	assert.Nil(t, db.Unlink(ctx, dir, file.Name))
+}
+
+// AddChunk adds a chunk with the given key, inode offset and size
+func AddChunk(t *testing.T, db database.Db, inode fuseops.InodeID, flags uint32, key string, offset uint64, size uint64) {
+	err := db.AddChunk(context.Background(), inode, flags, database.Chunk{
+		Inode:       inode,
+		InodeOffset: offset,
+		Chunk: storage.Chunk{
+			Storage: "test",
+			Key:     key,
+			Size:    size,
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testStatx(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	size := uint64(1 << 20)
+
+	dense := Mkfile(t, db, dir)
+	AddChunk(t, db, dense.ID, 0, "dense", 0, size)
+
+	sparse := Mkfile(t, db, dir)
+	AddChunk(t, db, sparse.ID, 0, "sparse", 0, 4096)
+	AddChunk(t, db, sparse.ID, 0, "sparse", size-4096, 4096)
+	assert.Nil(t, db.Fallocate(ctx, sparse.ID, 4096, 4096, database.FallocZeroRange|database.FallocKeepSize))
+
+	statx, err := db.Statx(ctx, dense.ID)
+	if assert.Nil(t, err) {
+		assert.Equal(t, size, statx.Size)
+		assert.Equal(t, size/512, statx.Blocks)
+		assert.Equal(t, uint32(database.MaxBlockSize), statx.BlockSize)
+	}
+
+	inode, err := db.Get(ctx, sparse.ID)
+	assert.Nil(t, err)
+
+	statx, err = db.Statx(ctx, sparse.ID)
+	if assert.Nil(t, err) {
+		assert.Equal(t, size, statx.Size)
+		assert.Equal(t, uint64(8192/512), statx.Blocks, "holes shouldn't count as allocated")
+		assert.Equal(t, uint32(4096), statx.BlockSize)
+		assert.NotZero(t, statx.Mask&database.StatxBtime)
+		assert.Equal(t, inode.Crtime.Unix(), statx.Crtime.Unix())
+	}
+
+	statx, err = db.Statx(ctx, dir)
+	if assert.Nil(t, err) {
+		assert.Zero(t, statx.Blocks)
+		assert.True(t, statx.Mode.IsDir())
+	}
+
+	_, err = db.Statx(ctx, 1<<40)
+	assert.Equal(t, syscall.ENOENT, err)
+}
+
+func testHoles(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+
+	AddChunk(t, db, file.ID, 0, "a", 0, 10)
+
+	size := uint64(100)
+	_, err := db.Touch(ctx, file.ID, &size, nil, nil, nil, nil, nil)
+	assert.Nil(t, err)
+
+	AddChunk(t, db, file.ID, 0, "b", 100, 10)
+
+	chunks, err := db.Chunks(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Len(t, *chunks, 3)
+
+	holes := 0
+	for _, c := range *chunks {
+		if c.IsHole() {
+			holes++
+			assert.Equal(t, uint64(10), c.InodeOffset)
+			assert.Equal(t, uint64(90), c.Size)
+		} else {
+			assert.NotEqual(t, database.ZeroStorage, c.Storage)
+		}
+	}
+
+	assert.Equal(t, 1, holes)
+
+	sort.Slice(*chunks, func(i, j int) bool {
+		return (*chunks)[i].InodeOffset < (*chunks)[j].InodeOffset
+	})
+
+	assert.Equal(t, []database.Hole{{Offset: 10, Size: 90}}, database.Holes(*chunks, 110))
+}
+
+func testTruncate(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+
+	AddChunk(t, db, file.ID, 0, "a", 0, 10)
+	AddChunk(t, db, file.ID, 0, "b", 10, 10)
+
+	stats, err := db.Stats(ctx)
+	assert.Nil(t, err)
+
+	assertSize := func(size uint64) {
+		i, err := db.Get(ctx, file.ID)
+		assert.Nil(t, err)
+		assert.Equal(t, size, i.Size)
+
+		newStats, err := db.Stats(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, stats.Size+size-20, newStats.Size)
+	}
+
+	// Shrinking straddling the boundary between a and b
+	assert.Nil(t, db.Truncate(ctx, file.ID, 7))
+	AssertLayout(t, db, file.ID, []Layout{
+		{"a", 0, 0, 7},
+	})
+
+	assertSize(7)
+
+	// Growing fills the new space with zeros
+	assert.Nil(t, db.Truncate(ctx, file.ID, 30))
+	AssertLayout(t, db, file.ID, []Layout{
+		{"a", 0, 0, 7},
+		{"", 0, 7, 23},
+	})
+
+	assertSize(30)
+
+	assert.Nil(t, db.Truncate(ctx, file.ID, 30))
+	assertSize(30)
+
+	assert.Nil(t, db.Truncate(ctx, file.ID, 0))
+	AssertLayout(t, db, file.ID, []Layout{})
+	assertSize(0)
+
+	assert.Equal(t, syscall.EISDIR, db.Truncate(ctx, dir, 0))
+	assert.Equal(t, syscall.ENOENT, db.Truncate(ctx, fuseops.InodeID(1<<40), 0))
+}
+
+func testTruncateToZero(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+
+	for i := uint64(0); i < 500; i++ {
+		AddChunk(t, db, file.ID, 0, fmt.Sprintf("chunk-%v", i), i*10, 10)
+	}
+
+	size := uint64(6000)
+	_, err := db.Touch(ctx, file.ID, &size, nil, nil, nil, nil, nil)
+	assert.Nil(t, err)
+
+	chunks, err := db.Chunks(ctx, file.ID)
+	assert.Nil(t, err)
+
+	stats, err := db.Stats(ctx)
+	assert.Nil(t, err)
+
+	threshold := time.Now().Add(time.Hour)
+	report, err := db.CountOrphans(ctx, threshold)
+	assert.Nil(t, err)
+
+	size = 0
+	inode, err := db.Touch(ctx, file.ID, &size, nil, nil, nil, nil, nil)
+	assert.Nil(t, err)
+	assert.Zero(t, inode.Size)
+	AssertLayout(t, db, file.ID, []Layout{})
+
+	newStats, err := db.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, stats.Size-6000, newStats.Size)
+
+	newReport, err := db.CountOrphans(ctx, threshold)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Chunks+uint64(len(*chunks)), newReport.Chunks)
+}
+
+func testAddChunk(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	file := Mkfile(t, db, dir)
+
+	AddChunk(t, db, file.ID, 0, "a", 0, 10)
+	AddChunk(t, db, file.ID, 0, "b", 5, 2)
+	AddChunk(t, db, file.ID, 0, "c", 15, 5)
+
+	AssertLayout(t, db, file.ID, []Layout{
+		{"a", 0, 0, 5},
+		{"b", 0, 5, 2},
+		{"a", 7, 7, 3},
+		{"", 0, 10, 5},
+		{"c", 0, 15, 5},
+	})
+
+	inode, err := db.Get(context.Background(), file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(20), inode.Size)
+}
+
+func testAddChunkAppend(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	file := Mkfile(t, db, dir)
+
+	AddChunk(t, db, file.ID, 0, "a", 0, 10)
+	AddChunk(t, db, file.ID, syscall.O_APPEND, "b", 0, 5)
+
+	AssertLayout(t, db, file.ID, []Layout{
+		{"a", 0, 0, 10},
+		{"b", 0, 10, 5},
+	})
+}
+
+func testAddChunkFullyCover(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	file := Mkfile(t, db, dir)
+
+	AddChunk(t, db, file.ID, 0, "a", 2, 3)
+	AddChunk(t, db, file.ID, 0, "b", 5, 3)
+	AddChunk(t, db, file.ID, 0, "c", 0, 10)
+
+	AssertLayout(t, db, file.ID, []Layout{
+		{"c", 0, 0, 10},
+	})
+}
+
+func testAddChunkPartialOverlap(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	file := Mkfile(t, db, dir)
+
+	AddChunk(t, db, file.ID, 0, "a", 0, 10)
+	AddChunk(t, db, file.ID, 0, "b", 10, 10)
+	AddChunk(t, db, file.ID, 0, "c", 5, 10)
+
+	AssertLayout(t, db, file.ID, []Layout{
+		{"a", 0, 0, 5},
+		{"c", 0, 5, 10},
+		{"b", 5, 15, 5},
+	})
+
+	inode, err := db.Get(context.Background(), file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(20), inode.Size)
+}
+
+func testAddChunkInside(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+
+	// Every byte of every object is different, so that reading from the
+	// wrong object offset is noticed
+	objects := map[string][]byte{"a": make([]byte, 30), "b": make([]byte, 5), "c": make([]byte, 5)}
+	for key, object := range objects {
+		for i := range object {
+			object[i] = key[0] + byte(i)*3
+		}
+	}
+
+	expected := make([]byte, 30)
+	write := func(key string, offset uint64) {
+		AddChunk(t, db, file.ID, 0, key, offset, uint64(len(objects[key])))
+		copy(expected[offset:], objects[key])
+	}
+
+	write("a", 0)
+	stats, err := db.Stats(ctx)
+	assert.Nil(t, err)
+
+	write("b", 10)
+	AssertLayout(t, db, file.ID, []Layout{
+		{"a", 0, 0, 10},
+		{"b", 0, 10, 5},
+		{"a", 15, 15, 15},
+	})
+
+	// Within the tail of a, which doesn't start at the beginning of the object
+	write("c", 20)
+	AssertLayout(t, db, file.ID, []Layout{
+		{"a", 0, 0, 10},
+		{"b", 0, 10, 5},
+		{"a", 15, 15, 5},
+		{"c", 0, 20, 5},
+		{"a", 25, 25, 5},
+	})
+
+	chunks, err := db.Chunks(ctx, file.ID)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	result := make([]byte, 0, 30)
+	for _, c := range *chunks {
+		assert.Equal(t, uint64(len(result)), c.InodeOffset)
+		result = append(result, objects[c.Key][c.ObjectOffset:c.ObjectOffset+c.Size]...)
+	}
+
+	assert.Equal(t, expected, result)
+
+	inode, err := db.Get(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(30), inode.Size)
+
+	newStats, err := db.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, stats.Size, newStats.Size)
+}
+
+func testAddChunkCancel(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	file := Mkfile(t, db, dir)
+	layout := make([]Layout, 0, 1000)
+
+	for i := uint64(0); i < 500; i++ {
+		AddChunk(t, db, file.ID, 0, "a", i*10, 5)
+
+		// Holes are filled with zero chunks, which have an empty key
+		if i > 0 {
+			layout = append(layout, Layout{"", 0, i*10 - 5, 5})
+		}
+
+		layout = append(layout, Layout{"a", 0, i * 10, 5})
+	}
+
+	AssertLayout(t, db, file.ID, layout)
+
+	// Cancel the context at increasingly later points, every failed attempt
+	// must leave the chunks untouched
+	for timeout := 50 * time.Microsecond; ; timeout += timeout / 2 {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := db.AddChunk(ctx, file.ID, 0, database.Chunk{
+			Inode: file.ID,
+			Chunk: storage.Chunk{Storage: "test", Key: "b", Size: 5000},
+		})
+
+		cancel()
+
+		if err == nil {
+			break
+		}
+
+		AssertLayout(t, db, file.ID, layout)
+	}
+
+	AssertLayout(t, db, file.ID, []Layout{{"b", 0, 0, 5000}})
+}
+
+func testAddChunkConcurrent(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+
+	type write struct {
+		offset uint64
+		size   uint64
+	}
+
+	writes := make(map[string]write)
+	random := rand.New(rand.NewSource(1))
+	for w := 0; w < 8; w++ {
+		for i := 0; i < 25; i++ {
+			writes[fmt.Sprintf("%d-%d", w, i)] = write{uint64(random.Intn(1000)), uint64(50 + random.Intn(150))}
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, len(writes))
+
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < 25; i++ {
+				key := fmt.Sprintf("%d-%d", w, i)
+				errs <- db.AddChunk(ctx, file.ID, 0, database.Chunk{
+					Inode:       file.ID,
+					InodeOffset: writes[key].offset,
+					Chunk:       storage.Chunk{Storage: "test", Key: key, Size: writes[key].size},
+				})
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	size := uint64(0)
+	for _, wr := range writes {
+		if wr.offset+wr.size > size {
+			size = wr.offset + wr.size
+		}
+	}
+
+	for err := range errs {
+		assert.Nil(t, err)
+	}
+
+	inode, err := db.Get(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, size, inode.Size)
+
+	chunks, err := db.Chunks(ctx, file.ID)
+	assert.Nil(t, err)
+
+	offset := uint64(0)
+	for _, c := range *chunks {
+		assert.Equal(t, offset, c.InodeOffset, "chunks should neither overlap nor leave gaps")
+		offset += c.Size
+
+		if c.Key == "" {
+			continue
+		}
+
+		wr := writes[c.Key]
+		assert.True(t, c.InodeOffset >= wr.offset && c.InodeOffset+c.Size <= wr.offset+wr.size, "chunks should stay within their write")
+		assert.Equal(t, c.InodeOffset-wr.offset, c.ObjectOffset)
+	}
+
+	assert.Equal(t, size, offset)
+}
+
+func testCopyRange(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	src := Mkfile(t, db, dir)
+	dst := Mkfile(t, db, dir)
+
+	// The source has zero chunks between a and b, and after being grown
+	AddChunk(t, db, src.ID, 0, "a", 0, 10)
+	AddChunk(t, db, src.ID, 0, "b", 20, 10)
+	AddChunk(t, db, src.ID, 0, "c", 30, 10)
+	size := uint64(50)
+	_, err := db.Touch(ctx, src.ID, &size, nil, nil, nil, nil, nil)
+	assert.Nil(t, err)
+
+	AddChunk(t, db, dst.ID, 0, "d", 0, 100)
+
+	copied, err := db.CopyRange(ctx, src.ID, 5, dst.ID, 10, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(45), copied)
+
+	AssertLayout(t, db, dst.ID, []Layout{
+		{"d", 0, 0, 10},
+		{"a", 5, 10, 5},
+		{"", 0, 15, 10},
+		{"b", 0, 25, 10},
+		{"c", 0, 35, 10},
+		{"", 0, 45, 10},
+		{"d", 55, 55, 45},
+	})
+
+	inode, err := db.Get(ctx, dst.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(100), inode.Size)
+
+	empty := Mkfile(t, db, dir)
+	copied, err = db.CopyRange(ctx, src.ID, 0, empty.ID, 5, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), copied)
+
+	AssertLayout(t, db, empty.ID, []Layout{
+		{"", 0, 0, 5},
+		{"a", 0, 5, 10},
+	})
+
+	inode, err = db.Get(ctx, empty.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(15), inode.Size)
+
+	copied, err = db.CopyRange(ctx, src.ID, 50, dst.ID, 0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), copied)
+
+	AssertLayout(t, db, src.ID, []Layout{
+		{"a", 0, 0, 10},
+		{"", 0, 10, 10},
+		{"b", 0, 20, 10},
+		{"c", 0, 30, 10},
+		{"", 0, 40, 10},
+	})
+
+	_, err = db.CopyRange(ctx, src.ID, 0, dir, 0, 10)
+	assert.Equal(t, syscall.EISDIR, err)
+}
+func testSnapshot(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	st := &removals{keys: make(map[string]int)}
+
+	keys := make([]string, 3)
+	for i := range keys {
+		key, err := storage.Key()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys[i] = key
+	}
+
+	src := Mkdir(t, db, dir)
+	sub := create(t, db, src, os.ModeDir|0755)
+	file := Mkfile(t, db, src)
+	linked := Mkfile(t, db, sub.ID)
+
+	AddChunk(t, db, file.ID, 0, keys[0], 0, 10)
+	AddChunk(t, db, linked.ID, 0, keys[1], 0, 20)
+	assert.Nil(t, db.SetXattr(ctx, file.ID, "user.a", []byte("1"), 0))
+
+	_, err := db.Link(ctx, linked.ID, src, "link")
+	assert.Nil(t, err)
+
+	snapshot, err := db.Snapshot(ctx, src, dir, "snapshot")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.NotEqual(t, src, snapshot.ID)
+	assert.True(t, snapshot.Mode.IsDir())
+
+	lookUp := func(parent fuseops.InodeID, name string) *database.Entry {
+		entry, err := db.LookUp(ctx, parent, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return entry
+	}
+
+	copiedFile := lookUp(snapshot.ID, file.Name)
+	copiedSub := lookUp(snapshot.ID, sub.Name)
+	copiedLinked := lookUp(copiedSub.ID, linked.Name)
+
+	assert.NotEqual(t, file.ID, copiedFile.ID)
+	assert.Equal(t, uint64(10), copiedFile.Size)
+	assert.Equal(t, copiedLinked.ID, lookUp(snapshot.ID, "link").ID, "hard links within the tree should be kept")
+
+	// The original is changed in every possible way
+	AddChunk(t, db, file.ID, 0, keys[2], 0, 10)
+	assert.Nil(t, db.SetXattr(ctx, file.ID, "user.a", []byte("2"), 0))
+	assert.Nil(t, db.Unlink(ctx, sub.ID, linked.Name))
+	assert.Nil(t, db.Unlink(ctx, src, "link"))
+	assert.Nil(t, db.Forget(ctx, linked.ID))
+	Mkfile(t, db, src)
+
+	assert.Nil(t, db.CleanOrphanChunks(ctx, time.Now().Add(time.Hour), st, 1))
+	assert.Equal(t, 0, st.count(keys[0]), "objects referenced by the snapshot should be kept")
+	assert.Equal(t, 0, st.count(keys[1]), "objects referenced by the snapshot should be kept")
+
+	AssertLayout(t, db, copiedFile.ID, []Layout{{keys[0], 0, 0, 10}})
+	AssertLayout(t, db, copiedLinked.ID, []Layout{{keys[1], 0, 0, 20}})
+
+	value, err := db.GetXattr(ctx, copiedFile.ID, "user.a")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), *value)
+
+	children, err := db.Children(ctx, snapshot.ID)
+	assert.Nil(t, err)
+	assert.Len(t, *children, 3)
+
+	inode, err := db.Get(ctx, copiedLinked.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(20), inode.Size)
+}
+
+func testSnapshotErrors(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	src := create(t, db, dir, os.ModeDir|0755)
+	sub := Mkdir(t, db, src.ID)
+	file := Mkfile(t, db, src.ID)
+
+	_, err := db.Snapshot(ctx, file.ID, dir, "snapshot")
+	assert.Equal(t, syscall.ENOTDIR, err)
+
+	_, err = db.Snapshot(ctx, src.ID, file.ID, "snapshot")
+	assert.Equal(t, syscall.ENOTDIR, err)
+
+	_, err = db.Snapshot(ctx, src.ID, src.ID, "snapshot")
+	assert.Equal(t, syscall.EINVAL, err)
+
+	_, err = db.Snapshot(ctx, src.ID, sub, "snapshot")
+	assert.Equal(t, syscall.EINVAL, err)
+
+	_, err = db.Snapshot(ctx, src.ID, dir, src.Name)
+	assert.Equal(t, syscall.EEXIST, err)
+
+	children, err := db.Children(ctx, sub)
+	assert.Nil(t, err)
+	assert.Empty(t, *children)
+}
+
+// objects is a storage which holds every object but the missing ones
+type objects struct {
+	missing map[string]bool
+	checks  int
+}
+
+func (o *objects) Setup() error {
+	return nil
+}
+
+func (o *objects) GetChunk(reader io.Reader) (*storage.Chunk, error) {
+	return nil, syscall.ENOSYS
+}
+
+func (o *objects) GetReadCloser(chunk storage.Chunk) (io.ReadCloser, error) {
+	return nil, syscall.ENOSYS
+}
+
+func (o *objects) Remove(chunk storage.Chunk) error {
+	return syscall.ENOSYS
+}
+
+func (o *objects) Exists(chunk storage.Chunk) (bool, error) {
+	o.checks++
+	return !o.missing[chunk.Key], nil
+}
+
+func testVerifyChunks(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	keys := make([]string, 3)
+
+	for i := range keys {
+		key, err := storage.Key()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys[i] = key
+	}
+
+	st := &objects{missing: map[string]bool{keys[1]: true, keys[2]: true}}
+	first := Mkfile(t, db, dir)
+	second := Mkfile(t, db, dir)
+
+	AddChunk(t, db, first.ID, 0, keys[0], 0, 10)
+	AddChunk(t, db, first.ID, 0, keys[1], 10, 10)
+	AddChunk(t, db, first.ID, 0, keys[0], 20, 10)
+	AddChunk(t, db, second.ID, 0, keys[2], 0, 10)
+
+	size := uint64(50)
+	_, err := db.Touch(ctx, first.ID, &size, nil, nil, nil, nil, nil)
+	assert.Nil(t, err)
+
+	ids := make(map[string][]uint64)
+	for _, inode := range []fuseops.InodeID{first.ID, second.ID} {
+		chunks, err := db.Chunks(ctx, inode)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, chunk := range *chunks {
+			ids[chunk.Key] = append(ids[chunk.Key], chunk.ID)
+		}
+	}
+
+	missing, err := db.VerifyChunks(ctx, st, first.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, ids[keys[1]], missing)
+	assert.Equal(t, 2, st.checks)
+
+	missing, err = db.VerifyChunks(ctx, st, second.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, ids[keys[2]], missing)
+
+	missing, err = db.VerifyAllChunks(ctx, st)
+	assert.Nil(t, err)
+	assert.Subset(t, missing, append(ids[keys[1]], ids[keys[2]]...))
+	for _, id := range ids[keys[0]] {
+		assert.NotContains(t, missing, id)
+	}
+
+	missing, err = db.VerifyChunks(ctx, st, dir)
+	assert.Nil(t, err)
+	assert.Empty(t, missing)
+}
+
+// tagged is a storage which tags every object it stores with the amount of
+// times it was written, as object storages do with ETags
+type tagged struct {
+	etags map[string]int
+}
+
+func (g *tagged) Setup() error {
+	return nil
+}
+
+func (g *tagged) GetChunk(reader io.Reader) (*storage.Chunk, error) {
+	key, err := storage.Key()
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := io.Copy(ioutil.Discard, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	g.etags[key] = 1
+	return &storage.Chunk{Storage: "test", Key: key, Size: uint64(size), ETag: "1", Version: "v1"}, nil
+}
+
+func (g *tagged) GetReadCloser(chunk storage.Chunk) (io.ReadCloser, error) {
+	return nil, syscall.ENOSYS
+}
+
+func (g *tagged) Remove(chunk storage.Chunk) error {
+	delete(g.etags, chunk.Key)
+	return nil
+}
+
+func (g *tagged) ETag(chunk storage.Chunk) (string, bool, error) {
+	etag, ok := g.etags[chunk.Key]
+	if !ok {
+		return "", false, nil
+	}
+
+	return strconv.Itoa(etag), true, nil
+}
+
+func testChunkChecksums(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+	copied := Mkfile(t, db, dir)
+	trimmed := Mkfile(t, db, dir)
+
+	err := db.AddChunk(ctx, file.ID, 0, database.Chunk{
+		Inode:    file.ID,
+		Chunk:    storage.Chunk{Storage: "test", Key: "checksum", Size: 10},
+		Checksum: "0123abcd",
+	})
+
+	assert.Nil(t, err)
+
+	checksums := func(inode fuseops.InodeID) []string {
+		chunks, err := db.Chunks(ctx, inode)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result := make([]string, 0, len(*chunks))
+		for _, c := range *chunks {
+			result = append(result, c.Checksum)
+		}
+
+		return result
+	}
+
+	assert.Equal(t, []string{"0123abcd"}, checksums(file.ID))
+
+	_, err = db.CopyRange(ctx, file.ID, 0, copied.ID, 0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"0123abcd"}, checksums(copied.ID), "chunks copied whole should keep their checksum")
+
+	_, err = db.CopyRange(ctx, file.ID, 2, trimmed.ID, 0, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{""}, checksums(trimmed.ID))
+
+	err = db.AddChunk(ctx, file.ID, 0, database.Chunk{
+		Inode:       file.ID,
+		InodeOffset: 4,
+		Chunk:       storage.Chunk{Storage: "test", Key: "overwrite", Size: 2},
+		Checksum:    "4567cdef",
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"", "4567cdef", ""}, checksums(file.ID), "trimmed chunks should forget their checksum")
+}
+
+func testChunkETags(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	st := &tagged{etags: make(map[string]int)}
+	file := Mkfile(t, db, dir)
+	copied := Mkfile(t, db, dir)
+
+	object, err := st.GetChunk(strings.NewReader("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AddChunk(ctx, file.ID, 0, database.Chunk{Inode: file.ID, Chunk: *object})
+	assert.Nil(t, err)
+
+	chunks, err := db.Chunks(ctx, file.ID)
+	assert.Nil(t, err)
+	if assert.Len(t, *chunks, 1) {
+		assert.Equal(t, "1", (*chunks)[0].ETag)
+		assert.Equal(t, "v1", (*chunks)[0].Version)
+	}
+
+	_, err = db.CopyRange(ctx, file.ID, 6, copied.ID, 0, 5)
+	assert.Nil(t, err)
+
+	chunks, err = db.Chunks(ctx, copied.ID)
+	assert.Nil(t, err)
+	if assert.Len(t, *chunks, 1) {
+		assert.Equal(t, "1", (*chunks)[0].ETag)
+		assert.Equal(t, "v1", (*chunks)[0].Version)
+	}
+
+	missing, err := db.VerifyChunks(ctx, st, file.ID)
+	assert.Nil(t, err)
+	assert.Empty(t, missing)
+
+	st.etags[object.Key]++
+
+	missing, err = db.VerifyChunks(ctx, st, copied.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{(*chunks)[0].ID}, missing, "overwritten objects should be reported")
+
+	chunks, err = db.Chunks(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Nil(t, db.MigrateChunk(ctx, (*chunks)[0].ID, "test", object.Key+"-copy"))
+	st.etags[object.Key+"-copy"] = 1
+
+	chunks, err = db.Chunks(ctx, file.ID)
+	assert.Nil(t, err)
+	if assert.Len(t, *chunks, 1) {
+		assert.Empty(t, (*chunks)[0].ETag, "migrated chunks should forget the ETag of their previous object")
+		assert.Empty(t, (*chunks)[0].Version)
+	}
+
+	missing, err = db.VerifyChunks(ctx, st, file.ID)
+	assert.Nil(t, err)
+	assert.Empty(t, missing)
+}
+
+// removals is a storage which only records the objects removed from it
+type removals struct {
+	mutex   sync.Mutex
+	keys    map[string]int
+	batches []int
+	err     error
+}
+
+func (r *removals) Setup() error {
+	return nil
+}
+
+func (r *removals) GetChunk(reader io.Reader) (*storage.Chunk, error) {
+	return nil, syscall.ENOSYS
+}
+
+func (r *removals) GetReadCloser(chunk storage.Chunk) (io.ReadCloser, error) {
+	return nil, syscall.ENOSYS
+}
+
+func (r *removals) Remove(chunk storage.Chunk) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.err != nil {
+		return r.err
+	}
+
+	r.keys[chunk.Key]++
+	return nil
+}
+
+// total returns the amount of objects removed
+func (r *removals) total() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	total := 0
+	for _, count := range r.keys {
+		total += count
+	}
+
+	return total
+}
+
+func (r *removals) RemoveBatch(chunks []storage.Chunk) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.err != nil {
+		return r.err
+	}
+
+	r.batches = append(r.batches, len(chunks))
+	for _, chunk := range chunks {
+		r.keys[chunk.Key]++
+	}
+
+	return nil
+}
+
+func (r *removals) count(key string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.keys[key]
+}
+
+func testCleanSharedObjects(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	st := &removals{keys: make(map[string]int)}
+	threshold := time.Now().Add(time.Hour)
+
+	shared, err := storage.Key()
+	assert.Nil(t, err)
+
+	lonely, err := storage.Key()
+	assert.Nil(t, err)
+
+	first := Mkfile(t, db, dir)
+	second := Mkfile(t, db, dir)
+
+	AddChunk(t, db, first.ID, 0, shared, 0, 10)
+	AddChunk(t, db, second.ID, 0, shared, 0, 5)
+	AddChunk(t, db, second.ID, 0, shared, 5, 5)
+	AddChunk(t, db, second.ID, 0, lonely, 10, 10)
+
+	assert.Nil(t, db.Unlink(ctx, dir, second.Name))
+	assert.Nil(t, db.Forget(ctx, second.ID))
+
+	assert.Nil(t, db.CleanOrphanChunks(ctx, threshold, st, 2))
+	assert.Equal(t, 1, st.count(lonely))
+	assert.Equal(t, 0, st.count(shared), "objects referenced by live chunks should be kept")
+
+	AssertLayout(t, db, first.ID, []Layout{
+		{shared, 0, 0, 10},
+	})
+
+	assert.Nil(t, db.Unlink(ctx, dir, first.Name))
+	assert.Nil(t, db.Forget(ctx, first.ID))
+
+	assert.Nil(t, db.CleanOrphanChunks(ctx, threshold, st, 2))
+	assert.Equal(t, 1, st.count(shared), "objects should be removed once")
+	assert.Equal(t, 1, st.count(lonely))
+}
+
+func testCleanConcurrently(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	st := &removals{keys: make(map[string]int)}
+	keys := make([]string, 0)
+
+	for i := 0; i < 50; i++ {
+		file := Mkfile(t, db, dir)
+
+		for j := 0; j < 50; j++ {
+			key, err := storage.Key()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			AddChunk(t, db, file.ID, 0, key, uint64(j*10), 10)
+			keys = append(keys, key)
+		}
+
+		// Objects shared by several chunks are removed once as well
+		AddChunk(t, db, file.ID, 0, keys[len(keys)-1], 500, 10)
+
+		assert.Nil(t, db.Unlink(ctx, dir, file.Name))
+		assert.Nil(t, db.Forget(ctx, file.ID))
+	}
+
+	threshold := time.Now().Add(time.Hour)
+	wg := sync.WaitGroup{}
+	errs := make([]error, 2)
+
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = db.CleanOrphanChunks(ctx, threshold, st, 2)
+		}(i)
+	}
+
+	wg.Wait()
+	assert.Equal(t, []error{nil, nil}, errs)
+
+	for _, key := range keys {
+		assert.Equal(t, 1, st.count(key))
+	}
+
+	report, err := db.CountOrphans(ctx, threshold)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), report.Chunks)
+}
+
+func testCountOrphans(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	st := &removals{keys: make(map[string]int)}
+	threshold := time.Now().Add(time.Hour)
+
+	shared, err := storage.Key()
+	assert.Nil(t, err)
+
+	live := Mkfile(t, db, dir)
+	AddChunk(t, db, live.ID, 0, shared, 0, 10)
+
+	for i := 0; i < 3; i++ {
+		key, err := storage.Key()
+		assert.Nil(t, err)
+
+		file := Mkfile(t, db, dir)
+		AddChunk(t, db, file.ID, 0, key, 0, 10)
+		AddChunk(t, db, file.ID, 0, shared, 10, 10)
+		assert.Nil(t, db.SetXattr(ctx, file.ID, "user.test", []byte("value"), 0))
+		assert.Nil(t, db.Unlink(ctx, dir, file.Name))
+	}
+
+	report, err := db.CountOrphans(ctx, threshold)
+	assert.Nil(t, err)
+	assert.True(t, report.Inodes >= 3)
+	assert.True(t, report.Size >= 60)
+	assert.True(t, report.Xattrs >= 3)
+	assert.True(t, report.OrphanedChunks >= 6)
+
+	stats, err := db.Stats(ctx)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.CleanOrphanInodes(ctx))
+
+	newStats, err := db.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, stats.Inodes-report.Inodes, newStats.Inodes)
+	assert.Equal(t, stats.Size-report.Size, newStats.Size)
+
+	newReport, err := db.CountOrphans(ctx, threshold)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), newReport.Inodes)
+	assert.Equal(t, uint64(0), newReport.Xattrs)
+	assert.Equal(t, uint64(0), newReport.OrphanedChunks)
+	assert.Equal(t, report.Chunks+report.OrphanedChunks, newReport.Chunks)
+
+	// Objects still referenced by live chunks are not counted
+	assert.True(t, newReport.Objects >= 3)
+	assert.True(t, newReport.Objects < newReport.Chunks)
+
+	assert.Nil(t, db.CleanOrphanChunks(ctx, threshold, st, 2))
+	assert.Equal(t, int(newReport.Objects), st.total())
+	assert.Equal(t, 0, st.count(shared))
+
+	newReport, err = db.CountOrphans(ctx, threshold)
+	assert.Nil(t, err)
+	assert.Equal(t, database.OrphanReport{}, *newReport)
+}
+
+func testCleanInBatches(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	st := &removals{keys: make(map[string]int)}
+	keys := make([]string, 0)
+
+	for i := 0; i < 100; i++ {
+		file := Mkfile(t, db, dir)
+
+		for j := 0; j < 25; j++ {
+			key, err := storage.Key()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			AddChunk(t, db, file.ID, 0, key, uint64(j*10), 10)
+			keys = append(keys, key)
+		}
+
+		assert.Nil(t, db.Unlink(ctx, dir, file.Name))
+		assert.Nil(t, db.Forget(ctx, file.ID))
+	}
+
+	assert.Nil(t, db.CleanOrphanChunks(ctx, time.Now().Add(time.Hour), st, 4))
+
+	for _, key := range keys {
+		assert.Equal(t, 1, st.count(key))
+	}
+
+	total := 0
+	partial := 0
+
+	for _, size := range st.batches {
+		assert.True(t, size <= database.RemoveBatchSize)
+		total += size
+
+		if size < database.RemoveBatchSize {
+			partial++
+		}
+	}
+
+	assert.True(t, total >= len(keys))
+	assert.True(t, partial <= 1, "every batch but the last one should be full")
+}
+
+func testCleanRemoveError(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	st := &removals{keys: make(map[string]int), err: syscall.EIO}
+	threshold := time.Now().Add(time.Hour)
+
+	key, err := storage.Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := Mkfile(t, db, dir)
+	AddChunk(t, db, file.ID, 0, key, 0, 10)
+	assert.Nil(t, db.Unlink(ctx, dir, file.Name))
+	assert.Nil(t, db.Forget(ctx, file.ID))
+
+	assert.Equal(t, syscall.EIO, db.CleanOrphanChunks(ctx, threshold, st, 2))
+	assert.Equal(t, 0, st.count(key))
+
+	// The chunk was kept, so its object is removed once the storage recovers
+	st.err = nil
+	assert.Nil(t, db.CleanOrphanChunks(ctx, threshold, st, 2))
+	assert.Equal(t, 1, st.count(key))
+
+	assert.Nil(t, db.CleanOrphanChunks(ctx, threshold, st, 2))
+	assert.Equal(t, 1, st.count(key))
+}
+
+func testFallocate(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+
+	assertSize := func(inode fuseops.InodeID, size uint64) {
+		i, err := db.Get(ctx, inode)
+		assert.Nil(t, err)
+		assert.Equal(t, size, i.Size)
+	}
+
+	grown := Mkfile(t, db, dir)
+	AddChunk(t, db, grown.ID, 0, "a", 0, 10)
+
+	assert.Nil(t, db.Fallocate(ctx, grown.ID, 20, 10, 0))
+	AssertLayout(t, db, grown.ID, []Layout{
+		{"a", 0, 0, 10},
+		{"", 0, 10, 20},
+	})
+
+	assertSize(grown.ID, 30)
+
+	assert.Nil(t, db.Fallocate(ctx, grown.ID, 25, 20, database.FallocKeepSize))
+	AssertLayout(t, db, grown.ID, []Layout{
+		{"a", 0, 0, 10},
+		{"", 0, 10, 20},
+	})
+
+	assertSize(grown.ID, 30)
+
+	holed := Mkfile(t, db, dir)
+	AddChunk(t, db, holed.ID, 0, "a", 0, 10)
+	AddChunk(t, db, holed.ID, 0, "b", 20, 10)
+
+	assert.Nil(t, db.Fallocate(ctx, holed.ID, 12, 5, 0))
+	assert.Nil(t, db.Fallocate(ctx, holed.ID, 0, 30, 0))
+	AssertLayout(t, db, holed.ID, []Layout{
+		{"a", 0, 0, 10},
+		{"", 0, 10, 10},
+		{"b", 0, 20, 10},
+	})
+
+	assertSize(holed.ID, 30)
+
+	assert.Nil(t, db.Fallocate(ctx, holed.ID, 5, 20, database.FallocZeroRange))
+	assert.Nil(t, db.Fallocate(ctx, holed.ID, 28, 10, database.FallocZeroRange|database.FallocKeepSize))
+	AssertLayout(t, db, holed.ID, []Layout{
+		{"a", 0, 0, 5},
+		{"", 0, 5, 20},
+		{"b", 5, 25, 3},
+		{"", 0, 28, 2},
+	})
+
+	assertSize(holed.ID, 30)
+
+	assert.Equal(t, syscall.EINVAL, db.Fallocate(ctx, grown.ID, 0, 0, 0))
+	assert.Equal(t, syscall.EOPNOTSUPP, db.Fallocate(ctx, grown.ID, 0, 10, 0x04))
+	assert.Equal(t, syscall.EISDIR, db.Fallocate(ctx, dir, 0, 10, 0))
+}
+
+func testPunchHole(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	punch := database.FallocPunchHole | database.FallocKeepSize
+
+	file := Mkfile(t, db, dir)
+	AddChunk(t, db, file.ID, 0, "a", 0, 10)
+	AddChunk(t, db, file.ID, 0, "b", 10, 10)
+	AddChunk(t, db, file.ID, 0, "c", 20, 10)
+	AddChunk(t, db, file.ID, 0, "d", 40, 20)
+
+	before, err := db.Stats(ctx)
+	assert.Nil(t, err)
+
+	// Fully containing b
+	assert.Nil(t, db.Fallocate(ctx, file.ID, 10, 10, uint32(punch)))
+	AssertLayout(t, db, file.ID, []Layout{
+		{"a", 0, 0, 10},
+		{"", 0, 10, 10},
+		{"c", 0, 20, 10},
+		{"", 0, 30, 10},
+		{"d", 0, 40, 20},
+	})
+
+	// Splitting d on both ends
+	assert.Nil(t, db.Fallocate(ctx, file.ID, 45, 10, uint32(punch)))
+	AssertLayout(t, db, file.ID, []Layout{
+		{"a", 0, 0, 10},
+		{"", 0, 10, 10},
+		{"c", 0, 20, 10},
+		{"", 0, 30, 10},
+		{"d", 0, 40, 5},
+		{"", 0, 45, 10},
+		{"d", 15, 55, 5},
+	})
+
+	// Across the gap between c and d
+	assert.Nil(t, db.Fallocate(ctx, file.ID, 25, 18, uint32(punch)))
+	AssertLayout(t, db, file.ID, []Layout{
+		{"a", 0, 0, 10},
+		{"", 0, 10, 10},
+		{"c", 0, 20, 5},
+		{"", 0, 25, 18},
+		{"d", 3, 43, 2},
+		{"", 0, 45, 10},
+		{"d", 15, 55, 5},
+	})
+
+	inode, err := db.Get(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(60), inode.Size)
+
+	after, err := db.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, before.Size, after.Size, "stats track the logical size, which is kept")
+
+	assert.Equal(t, syscall.EOPNOTSUPP, db.Fallocate(ctx, file.ID, 0, 10, database.FallocPunchHole))
+	assert.Equal(t, syscall.EOPNOTSUPP, db.Fallocate(ctx, file.ID, 0, 10, uint32(punch|database.FallocZeroRange)))
+}
+
+func testCompactChunks(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+
+	add := func(inodeOffset uint64, key string, objectOffset uint64, size uint64) {
+		err := db.AddChunk(ctx, file.ID, 0, database.Chunk{
+			Inode:       file.ID,
+			InodeOffset: inodeOffset,
+			Chunk: storage.Chunk{
+				Storage:      "test",
+				Key:          key,
+				ObjectOffset: objectOffset,
+				Size:         size,
+			},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := uint64(0); i < 100; i++ {
+		add(i*10, "a", i*10, 10)
+	}
+
+	add(1000, "b", 0, 10)
+	add(1010, "b", 10, 10)
+	add(1020, "a", 1000, 10)
+	add(1040, "a", 1030, 10)
+	add(1050, "a", 1045, 10)
+
+	orphans, err := db.CountOrphans(ctx, time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.CompactChunks(ctx, file.ID))
+
+	chunks, err := db.Chunks(ctx, file.ID)
+	assert.Nil(t, err)
+
+	type mapping struct {
+		inodeOffset  uint64
+		key          string
+		objectOffset uint64
+		size         uint64
+	}
+
+	// drivers may keep holes as chunks without a key
+	found := make([]mapping, 0)
+	for _, c := range *chunks {
+		if c.Key != "" {
+			found = append(found, mapping{c.InodeOffset, c.Key, c.ObjectOffset, c.Size})
+		}
+	}
+
+	assert.Equal(t, []mapping{
+		{0, "a", 0, 1000},
+		{1000, "b", 0, 20},
+		{1020, "a", 1000, 10},
+		{1040, "a", 1030, 10},
+		{1050, "a", 1045, 10},
+	}, found)
+
+	inode, err := db.Get(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1060), inode.Size)
+
+	after, err := db.CountOrphans(ctx, time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, orphans, after, "compacting should leave the stored objects untouched")
+
+	assert.Nil(t, db.CompactChunks(ctx, file.ID))
+
+	again, err := db.Chunks(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, chunks, again)
+
+	assert.Equal(t, syscall.ENOENT, db.CompactChunks(ctx, 1<<40))
+}
+
+// blobs is a storage holding its objects in memory
+type blobs struct {
+	data map[string][]byte
+
+	// name is the storage of the stored objects, test if empty
+	name string
+
+	// stored is called whenever an object is stored
+	stored func()
+}
+
+func (b *blobs) Setup() error {
+	return nil
+}
+
+func (b *blobs) GetChunk(reader io.Reader) (*storage.Chunk, error) {
+	key, err := storage.Key()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	b.data[key] = data
+	if b.stored != nil {
+		b.stored()
+	}
+
+	name := b.name
+	if name == "" {
+		name = "test"
+	}
+
+	return &storage.Chunk{Storage: name, Key: key, Size: uint64(len(data))}, nil
+}
+
+func (b *blobs) GetReadCloser(chunk storage.Chunk) (io.ReadCloser, error) {
+	data, ok := b.data[chunk.Key]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+
+	return io.NopCloser(bytes.NewReader(data[chunk.ObjectOffset : chunk.ObjectOffset+chunk.Size])), nil
+}
+
+func (b *blobs) Remove(chunk storage.Chunk) error {
+	delete(b.data, chunk.Key)
+	return nil
+}
+
+func (b *blobs) Exists(chunk storage.Chunk) (bool, error) {
+	_, ok := b.data[chunk.Key]
+	return ok, nil
+}
+
+// tiers stores objects at the blobs of their storage name, the ones of other
+// storages being ignored, and new ones at the hot blobs unless told otherwise
+type tiers map[string]*blobs
+
+func (t tiers) Setup() error {
+	return nil
+}
+
+func (t tiers) GetChunk(reader io.Reader) (*storage.Chunk, error) {
+	return t.GetChunkAt("hot", reader)
+}
+
+func (t tiers) GetChunkAt(name string, reader io.Reader) (*storage.Chunk, error) {
+	b, ok := t[name]
+	if !ok {
+		return nil, storage.ErrNotTiered
+	}
+
+	return b.GetChunk(reader)
+}
+
+func (t tiers) GetReadCloser(chunk storage.Chunk) (io.ReadCloser, error) {
+	b, ok := t[chunk.Storage]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+
+	return b.GetReadCloser(chunk)
+}
+
+func (t tiers) Remove(chunk storage.Chunk) error {
+	if b, ok := t[chunk.Storage]; ok {
+		return b.Remove(chunk)
+	}
+
+	return nil
+}
+
+// read returns the contents of a file stored in the given storage
+func (b *blobs) read(t *testing.T, db database.Db, inode fuseops.InodeID) []byte {
+	chunks, err := db.Chunks(context.Background(), inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := make([]byte, 0)
+	for _, c := range *chunks {
+		if c.Key == "" {
+			continue
+		}
+
+		rc, err := b.GetReadCloser(c.Chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, _ := io.ReadAll(rc)
+		result = append(result, data...)
+	}
+
+	return result
+}
+
+// objectKeys lists the keys of the chunks of a file, skipping holes
+func objectKeys(t *testing.T, db database.Db, inode fuseops.InodeID) []string {
+	chunks, err := db.Chunks(context.Background(), inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := make([]string, 0)
+	for _, c := range *chunks {
+		if c.Key != "" {
+			result = append(result, c.Key)
+		}
+	}
+
+	return result
+}
+
+func testDefragment(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	st := &blobs{data: make(map[string][]byte)}
+	file := Mkfile(t, db, dir)
+
+	content := make([]byte, 0, 1000)
+	for i := 0; i < 100; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 10)
+		content = append(content, data...)
+
+		chunk, err := st.GetChunk(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		AddChunk(t, db, file.ID, 0, chunk.Key, uint64(i*10), 10)
+	}
+
+	assert.Nil(t, db.Defragment(ctx, st, file.ID, 256))
+
+	defragmented := objectKeys(t, db, file.ID)
+	assert.Len(t, defragmented, 4)
+	assert.Equal(t, content, st.read(t, db, file.ID))
+
+	inode, err := db.Get(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1000), inode.Size)
+
+	stored := len(st.data)
+	assert.Nil(t, db.Defragment(ctx, st, file.ID, 256))
+	assert.Equal(t, defragmented, objectKeys(t, db, file.ID))
+	assert.Equal(t, stored, len(st.data), "defragmenting again should store nothing")
+
+	changed := Mkfile(t, db, dir)
+	for i := 0; i < 3; i++ {
+		chunk, err := st.GetChunk(bytes.NewReader([]byte("0123456789")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		AddChunk(t, db, changed.ID, 0, chunk.Key, uint64(i*10), 10)
+	}
+
+	before := objectKeys(t, db, changed.ID)
+	stored = len(st.data)
+
+	st.stored = func() {
+		st.stored = nil
+		chunk, err := st.GetChunk(bytes.NewReader([]byte("abcdefghij")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		AddChunk(t, db, changed.ID, 0, chunk.Key, 10, 10)
+	}
+
+	assert.Nil(t, db.Defragment(ctx, st, changed.ID, 256))
+
+	after := objectKeys(t, db, changed.ID)
+	assert.Equal(t, []string{before[0], after[1], before[2]}, after, "a file changed meanwhile should be left as it is")
+	assert.Equal(t, stored+1, len(st.data), "the object of a discarded run should be removed")
+	assert.Equal(t, []byte("0123456789abcdefghij0123456789"), st.read(t, db, changed.ID))
+
+	assert.Equal(t, syscall.ENOENT, db.Defragment(ctx, st, 1<<40, 256))
+}
+
+func testRetierInode(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	hot := &blobs{data: make(map[string][]byte), name: "hot"}
+	cold := &blobs{data: make(map[string][]byte), name: "cold"}
+	st := tiers{"hot": hot, "cold": cold}
+
+	file := Mkfile(t, db, dir)
+	content := make([]byte, 0, 50)
+	for i := 0; i < 5; i++ {
+		data := bytes.Repeat([]byte{byte(i + 1)}, 10)
+		content = append(content, data...)
+
+		chunk, err := st.GetChunk(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.AddChunk(ctx, file.ID, 0, database.Chunk{Inode: file.ID, InodeOffset: uint64(i * 10), Chunk: *chunk})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	size := uint64(80)
+	_, err := db.Touch(ctx, file.ID, &size, nil, nil, nil, nil, nil)
+	assert.Nil(t, err)
+	content = append(content, make([]byte, 30)...)
+
+	assert.Nil(t, db.RetierInode(ctx, st, file.ID, "cold"))
+
+	chunks, err := db.Chunks(ctx, file.ID)
+	assert.Nil(t, err)
+	for _, c := range *chunks {
+		if !c.IsHole() {
+			assert.Equal(t, "cold", c.Storage)
+		}
+	}
+
+	assert.Len(t, cold.data, 5)
+	assert.Len(t, hot.data, 5, "old objects should be kept until collected")
+
+	assert.Nil(t, db.CleanOrphanChunks(ctx, time.Now().Add(time.Hour), st, 1))
+	assert.Len(t, hot.data, 0, "old objects should be orphaned")
+	assert.Equal(t, content[:50], cold.read(t, db, file.ID))
+
+	inode, err := db.Get(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, size, inode.Size)
+
+	assert.Nil(t, db.RetierInode(ctx, st, file.ID, "cold"))
+	assert.Len(t, cold.data, 5, "retiering again should store nothing")
+
+	assert.Equal(t, storage.ErrNotTiered, db.RetierInode(ctx, cold, file.ID, "archive"), "storages which aren't tiered should only store objects at themselves")
+	assert.Len(t, cold.data, 5, "objects stored at the wrong storage should be removed")
+
+	assert.Equal(t, syscall.ENOENT, db.RetierInode(ctx, st, 1<<40, "cold"))
+}
+
+func testMigrateChunk(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	st := &removals{keys: make(map[string]int)}
+
+	from, err := storage.Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	to, err := storage.Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := Mkfile(t, db, dir)
+	keys := make([]string, 3)
+
+	for i := range keys {
+		if keys[i], err = storage.Key(); err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.AddChunk(ctx, file.ID, 0, database.Chunk{
+			Inode:       file.ID,
+			InodeOffset: uint64(i * 10),
+			Chunk:       storage.Chunk{Storage: from, Key: keys[i], Size: 10},
+		})
+
+		assert.Nil(t, err)
+	}
+
+	chunks := make([]database.Chunk, 0)
+	after := uint64(0)
+
+	for {
+		page, err := db.ChunksByStorage(ctx, from, after, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(*page) == 0 {
+			break
+		}
+
+		assert.True(t, len(*page) <= 2)
+		chunks = append(chunks, *page...)
+		after = (*page)[len(*page)-1].ID
+	}
+
+	if !assert.Len(t, chunks, 3) {
+		return
+	}
+
+	for i, chunk := range chunks {
+		assert.Equal(t, file.ID, chunk.Inode)
+		assert.Equal(t, from, chunk.Storage)
+		assert.Equal(t, keys[i], chunk.Key)
+		assert.Equal(t, uint64(i*10), chunk.InodeOffset)
+	}
+
+	assert.Nil(t, db.MigrateChunk(ctx, chunks[0].ID, to, "d"))
+
+	migrated, err := db.Chunks(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, to, (*migrated)[0].Storage)
+	assert.Equal(t, "d", (*migrated)[0].Key)
+	assert.Equal(t, uint64(0), (*migrated)[0].InodeOffset)
+	assert.Equal(t, uint64(10), (*migrated)[0].Size)
+	assert.Equal(t, from, (*migrated)[1].Storage)
+
+	remaining, err := db.ChunksByStorage(ctx, from, 0, 10)
+	assert.Nil(t, err)
+	assert.Len(t, *remaining, 2)
+
+	assert.Nil(t, db.CleanOrphanChunks(ctx, time.Now().Add(time.Hour), st, 1))
+	assert.Equal(t, 1, st.count(keys[0]), "the previous object should be orphaned")
+
+	assert.Nil(t, db.Unlink(ctx, dir, file.Name))
+	assert.Nil(t, db.Forget(ctx, file.ID))
+
+	assert.Equal(t, syscall.ENOENT, db.MigrateChunk(ctx, chunks[1].ID, to, "e"), "orphaned chunks should not be migrated")
+
+	_, err = db.ChunksByStorage(ctx, from, 0, 0)
+	assert.Equal(t, syscall.EINVAL, err)
+}
+
+func testChunksInRange(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	file := Mkfile(t, db, dir)
+
+	AddChunk(t, db, file.ID, 0, "a", 0, 10)
+	AddChunk(t, db, file.ID, 0, "b", 10, 10)
+	AddChunk(t, db, file.ID, 0, "c", 25, 5)
+
+	assertRange := func(offset uint64, length uint64, expected []Layout) {
+		chunks, err := db.ChunksInRange(context.Background(), file.ID, offset, length)
+		if !assert.Nil(t, err) {
+			return
+		}
+
+		layout := make([]Layout, 0, len(*chunks))
+		for _, c := range *chunks {
+			layout = append(layout, Layout{c.Key, c.ObjectOffset, c.InodeOffset, c.Size})
+		}
+
+		assert.Equal(t, expected, layout)
+	}
+
+	assertRange(2, 5, []Layout{
+		{"a", 0, 0, 10},
+	})
+
+	assertRange(5, 25, []Layout{
+		{"a", 0, 0, 10},
+		{"b", 0, 10, 10},
+		{"", 0, 20, 5},
+		{"c", 0, 25, 5},
+	})
+
+	assertRange(21, 2, []Layout{
+		{"", 0, 20, 5},
+	})
+
+	assertRange(30, 10, []Layout{})
+}
+
+func testChildCount(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+
+	empty := Mkdir(t, db, dir)
+	files := Mkdir(t, db, dir)
+	mixed := Mkdir(t, db, dir)
+
+	for i := 0; i < 3; i++ {
+		Mkfile(t, db, files)
+	}
+
+	file := Mkfile(t, db, mixed)
+	Mkdir(t, db, mixed)
+	_, err := db.Link(ctx, file.ID, mixed, "link")
+	assert.Nil(t, err)
+
+	for _, parent := range []fuseops.InodeID{empty, files, mixed, dir} {
+		children, err := db.Children(ctx, parent)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		count, err := db.ChildCount(ctx, parent)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(len(*children)), count)
+	}
+
+	count, err := db.ChildCount(ctx, files)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), count)
+
+	count, err = db.ChildCount(ctx, 1<<40)
+	assert.Nil(t, err)
+	assert.Zero(t, count)
+}
+
+func testChildren(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	file := Mkfile(t, db, dir)
+	child := Mkdir(t, db, dir)
+
+	children, err := db.Children(context.Background(), dir)
+	assert.Nil(t, err)
+
+	inodes := make([]fuseops.InodeID, 0)
+	for _, c := range *children {
+		inodes = append(inodes, c.Inode)
+
+		if c.Inode == child {
+			assert.True(t, c.Mode.IsDir())
+		}
+	}
+
+	expected := []fuseops.InodeID{file.ID, child}
+	sort.Slice(inodes, func(i, j int) bool { return inodes[i] < inodes[j] })
+	sort.Slice(expected, func(i, j int) bool { return expected[i] < expected[j] })
+	assert.Equal(t, expected, inodes)
+}
+
+func testChildrenPage(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	expected := make(map[string]fuseops.InodeID)
+
+	for i := 0; i < 10000; i++ {
+		file := Mkfile(t, db, dir)
+		expected[file.Name] = file.ID
+	}
+
+	seen := make(map[string]bool)
+	after := ""
+
+	for {
+		page, err := db.ChildrenPage(ctx, dir, after, 500)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(*page) == 0 {
+			break
+		}
+
+		assert.True(t, len(*page) <= 500)
+
+		for _, child := range *page {
+			assert.True(t, child.Name > after, "children should be sorted by name")
+			assert.False(t, seen[child.Name], "children should not be repeated")
+			assert.Equal(t, expected[child.Name], child.Inode)
+
+			seen[child.Name] = true
+			after = child.Name
+		}
+	}
+
+	assert.Equal(t, len(expected), len(seen))
+
+	_, err := db.ChildrenPage(ctx, dir, "", 0)
+	assert.Equal(t, syscall.EINVAL, err)
+}
+
+func testChildrenPlus(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+
+	file := Mkfile(t, db, dir)
+	AddChunk(t, db, file.ID, 0, "a", 0, 10)
+	assert.Nil(t, db.Unlink(ctx, dir, file.Name))
+	file = Mkfile(t, db, dir)
+	AddChunk(t, db, file.ID, 0, "b", 0, 20)
+
+	child := Mkdir(t, db, dir)
+	_, err := db.Link(ctx, file.ID, child, "link")
+	assert.Nil(t, err)
+
+	entries, err := db.ChildrenPlus(ctx, dir)
+	assert.Nil(t, err)
+	assert.Len(t, *entries, 2)
+
+	for _, entry := range *entries {
+		assert.Equal(t, dir, entry.Parent)
+
+		found, err := db.LookUp(ctx, dir, entry.Name)
+		assert.Nil(t, err)
+		assert.Equal(t, found.ID, entry.ID)
+
+		inode, err := db.Get(ctx, entry.ID)
+		assert.Nil(t, err)
+		assert.Equal(t, inode.InodeAttributes, entry.InodeAttributes)
+	}
+}
+
+func testLocks(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+	other := Mkfile(t, db, dir)
+
+	// owners get a high bit set, as the ones the kernel hands out may
+	first := uint64(1<<63 | 1)
+	second := uint64(1<<63 | 2)
+	third := uint64(1<<63 | 3)
+
+	assert.Nil(t, db.SetLock(ctx, file.ID, first, 0, 100, database.LockWrite))
+	assert.Equal(t, syscall.EAGAIN, db.SetLock(ctx, file.ID, second, 50, 10, database.LockWrite))
+	assert.Equal(t, syscall.EAGAIN, db.SetLock(ctx, file.ID, second, 99, 0, database.LockRead))
+	assert.Nil(t, db.SetLock(ctx, file.ID, second, 100, 10, database.LockWrite))
+	assert.Nil(t, db.SetLock(ctx, other.ID, second, 0, 0, database.LockWrite))
+
+	conflict, err := db.GetLock(ctx, file.ID, second, 0, 0, database.LockRead)
+	assert.Nil(t, err)
+	assert.Equal(t, &database.Lock{Inode: file.ID, Owner: first, Start: 0, Length: 100, Type: database.LockWrite}, conflict)
+
+	conflict, err = db.GetLock(ctx, file.ID, first, 0, 100, database.LockWrite)
+	assert.Nil(t, err)
+	assert.Nil(t, conflict, "owners never conflict with themselves")
+
+	// shared locks are compatible with each other but not with exclusive ones
+	assert.Nil(t, db.SetLock(ctx, file.ID, first, 0, 100, database.LockRead))
+	assert.Nil(t, db.SetLock(ctx, file.ID, third, 50, 10, database.LockRead))
+	assert.Equal(t, syscall.EAGAIN, db.SetLock(ctx, file.ID, third, 50, 60, database.LockWrite))
+	assert.Equal(t, syscall.EAGAIN, db.SetLock(ctx, file.ID, first, 55, 1, database.LockWrite))
+
+	conflict, err = db.GetLock(ctx, file.ID, second, 0, 100, database.LockRead)
+	assert.Nil(t, err)
+	assert.Nil(t, conflict)
+
+	// unlocking part of a range keeps the rest of it locked
+	assert.Nil(t, db.SetLock(ctx, file.ID, third, 0, 0, database.LockUnlock))
+	assert.Nil(t, db.SetLock(ctx, file.ID, first, 20, 10, database.LockUnlock))
+	assert.Nil(t, db.SetLock(ctx, file.ID, third, 20, 10, database.LockWrite))
+	assert.Equal(t, syscall.EAGAIN, db.SetLock(ctx, file.ID, third, 10, 11, database.LockWrite))
+	assert.Equal(t, syscall.EAGAIN, db.SetLock(ctx, file.ID, third, 29, 2, database.LockWrite))
+
+	conflict, err = db.GetLock(ctx, file.ID, third, 95, 5, database.LockWrite)
+	assert.Nil(t, err)
+	assert.Equal(t, &database.Lock{Inode: file.ID, Owner: first, Start: 30, Length: 70, Type: database.LockRead}, conflict)
+
+	// releasing every lock of an owner lets the rest take them
+	assert.Nil(t, db.ClearLocks(ctx, first))
+	assert.Nil(t, db.SetLock(ctx, file.ID, third, 0, 20, database.LockWrite))
+	assert.Equal(t, syscall.EAGAIN, db.SetLock(ctx, file.ID, third, 100, 1, database.LockRead))
+
+	assert.Nil(t, db.ClearLocks(ctx, second))
+
+	conflict, err = db.GetLock(ctx, other.ID, first, 0, 0, database.LockWrite)
+	assert.Nil(t, err)
+	assert.Nil(t, conflict)
+
+	conflict, err = db.GetLock(ctx, file.ID, first, 0, 0, database.LockWrite)
+	assert.Nil(t, err)
+	if assert.NotNil(t, conflict) {
+		assert.Equal(t, third, conflict.Owner)
+	}
+
+	assert.Nil(t, db.ClearLocks(ctx, third))
+	assert.Equal(t, syscall.ENOENT, db.SetLock(ctx, 1<<40, first, 0, 0, database.LockRead))
+	assert.Equal(t, syscall.EINVAL, db.SetLock(ctx, file.ID, first, 0, 0, database.LockType(10)))
+}
+
+func testXattr(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+
+	assert.Nil(t, db.SetXattr(ctx, file.ID, "user.a", []byte("1"), 0))
+	assert.Equal(t, syscall.EEXIST, db.SetXattr(ctx, file.ID, "user.a", []byte("2"), database.XattrCreate))
+	assert.Equal(t, syscall.ENODATA, db.SetXattr(ctx, file.ID, "user.b", []byte("2"), database.XattrReplace))
+	assert.Equal(t, syscall.EINVAL, db.SetXattr(ctx, file.ID, "user.a", []byte("2"), database.XattrCreate|database.XattrReplace))
+	assert.Equal(t, syscall.EINVAL, db.SetXattr(ctx, file.ID, "user.a", []byte("2"), 1<<2))
+	assert.Nil(t, db.SetXattr(ctx, file.ID, "user.b", []byte("4"), database.XattrCreate))
+	assert.Nil(t, db.SetXattr(ctx, file.ID, "user.a", []byte("3"), database.XattrReplace))
+
+	value, err := db.GetXattr(ctx, file.ID, "user.a")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("3"), *value)
+
+	value, err = db.GetXattr(ctx, file.ID, "user.b")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("4"), *value)
+	assert.Nil(t, db.RemoveXattr(ctx, file.ID, "user.b"))
+
+	keys, err := db.ListXattr(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"user.a"}, *keys)
+
+	assert.Nil(t, db.RemoveXattr(ctx, file.ID, "user.a"))
+	_, err = db.GetXattr(ctx, file.ID, "user.a")
+	assert.Equal(t, syscall.ENODATA, err)
+}
+
+func testXattrLimits(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+
+	name := "user." + strings.Repeat("a", database.MaxXattrNameSize-5)
+	value := make([]byte, database.MaxXattrValueSize)
+
+	assert.Nil(t, db.SetXattr(ctx, file.ID, name, value, 0))
+	assert.Equal(t, syscall.ERANGE, db.SetXattr(ctx, file.ID, name+"a", value, 0))
+	assert.Equal(t, syscall.E2BIG, db.SetXattr(ctx, file.ID, name, append(value, 0), 0))
+
+	stored, err := db.GetXattr(ctx, file.ID, name)
+	assert.Nil(t, err)
+	assert.Equal(t, value, *stored)
+
+	keys, err := db.ListXattr(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{name}, *keys)
+}
+
+func testXattrSize(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+
+	assert.Nil(t, db.SetXattr(ctx, file.ID, "user.a", []byte("hello"), 0))
+	assert.Nil(t, db.SetXattr(ctx, file.ID, "user.b", []byte{}, 0))
+
+	size, err := db.GetXattrSize(ctx, file.ID, "user.a")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(5), size)
+
+	size, err = db.GetXattrSize(ctx, file.ID, "user.b")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), size)
+
+	_, err = db.GetXattrSize(ctx, file.ID, "user.missing")
+	assert.Equal(t, syscall.ENODATA, err)
+}
+
+func testAllXattr(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+
+	attrs, err := db.GetAllXattr(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Empty(t, attrs)
+
+	assert.Nil(t, db.SetXattr(ctx, file.ID, "user.old", []byte("0"), 0))
+
+	expected := map[string][]byte{
+		"user.a":         []byte("1"),
+		"user.b":         []byte("22"),
+		"security.label": []byte("label"),
+	}
+
+	assert.Nil(t, db.SetAllXattr(ctx, file.ID, expected))
+
+	attrs, err = db.GetAllXattr(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, attrs)
+
+	_, err = db.GetXattr(ctx, file.ID, "user.old")
+	assert.Equal(t, syscall.ENODATA, err)
+
+	// A failed replace leaves the previous set untouched
+	name := "user." + strings.Repeat("a", database.MaxXattrNameSize)
+	assert.Equal(t, syscall.ERANGE, db.SetAllXattr(ctx, file.ID, map[string][]byte{"user.c": []byte("3"), name: []byte("4")}))
+
+	attrs, err = db.GetAllXattr(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, attrs)
+
+	assert.Nil(t, db.SetAllXattr(ctx, file.ID, map[string][]byte{"user.b": []byte("3")}))
+
+	attrs, err = db.GetAllXattr(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]byte{"user.b": []byte("3")}, attrs)
+
+	assert.Nil(t, db.SetAllXattr(ctx, file.ID, nil))
+
+	keys, err := db.ListXattr(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Empty(t, *keys)
+}
+
+func testSwapXattr(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+
+	assertValue := func(expected string) {
+		value, err := db.GetXattr(ctx, file.ID, "user.lock")
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(expected), *value)
+	}
+
+	// A nil expected value only creates the attribute if it's missing
+	swapped, err := db.SwapXattr(ctx, file.ID, "user.lock", nil, []byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, swapped)
+	assertValue("a")
+
+	swapped, err = db.SwapXattr(ctx, file.ID, "user.lock", nil, []byte("b"))
+	assert.Nil(t, err)
+	assert.False(t, swapped)
+	assertValue("a")
+
+	swapped, err = db.SwapXattr(ctx, file.ID, "user.lock", []byte("b"), []byte("c"))
+	assert.Nil(t, err)
+	assert.False(t, swapped, "mismatching values should be kept")
+	assertValue("a")
+
+	swapped, err = db.SwapXattr(ctx, file.ID, "user.lock", []byte("a"), []byte("c"))
+	assert.Nil(t, err)
+	assert.True(t, swapped)
+	assertValue("c")
+
+	swapped, err = db.SwapXattr(ctx, file.ID, "user.missing", []byte("a"), []byte("b"))
+	assert.Nil(t, err)
+	assert.False(t, swapped)
+
+	_, err = db.GetXattr(ctx, file.ID, "user.missing")
+	assert.Equal(t, syscall.ENODATA, err)
+
+	_, err = db.SwapXattr(ctx, file.ID, "user.lock", []byte("c"), make([]byte, database.MaxXattrValueSize+1))
+	assert.Equal(t, syscall.E2BIG, err)
+	assertValue("c")
+}
+
+func testSwapXattrUnchanged(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	file := Mkfile(t, db, dir)
+
+	assert.Nil(t, db.SetXattr(ctx, file.ID, "user.lock", []byte("a"), 0))
+
+	// Swapping a value with itself succeeds as long as it matches
+	swapped, err := db.SwapXattr(ctx, file.ID, "user.lock", []byte("a"), []byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, swapped)
+
+	swapped, err = db.SwapXattr(ctx, file.ID, "user.lock", []byte("b"), []byte("b"))
+	assert.Nil(t, err)
+	assert.False(t, swapped)
+
+	// Concurrent swaps from the same value only succeed once
+	wg := sync.WaitGroup{}
+	results := make([]bool, 10)
+
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = db.SwapXattr(ctx, file.ID, "user.lock", []byte("a"), []byte{byte('b' + i)})
+		}(i)
+	}
+
+	wg.Wait()
+
+	successes := 0
+	for _, swapped := range results {
+		if swapped {
+			successes++
+		}
+	}
+
+	assert.Equal(t, 1, successes)
+}
+
+func createOwned(t *testing.T, db database.Db, parent fuseops.InodeID, uid uint32, gid uint32) (*database.Entry, error) {
+	name, err := storage.Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db.Create(context.Background(), database.Entry{
+		Parent: parent,
+		Name:   name,
+		Inode: database.Inode{
+			InodeAttributes: fuseops.InodeAttributes{
+				Mode: 0644,
+				Uid:  uid,
+				Gid:  gid,
+			},
+		},
+	})
+}
+
+func testQuotaInodes(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	uid := uint32(1001)
+
+	assert.Nil(t, db.SetQuota(ctx, &uid, nil, 0, 2))
+
+	for i := 0; i < 2; i++ {
+		_, err := createOwned(t, db, dir, uid, 0)
+		assert.Nil(t, err)
+	}
+
+	_, err := createOwned(t, db, dir, uid, 0)
+	assert.Equal(t, syscall.EDQUOT, err)
+
+	quota, err := db.GetQuota(ctx, &uid, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, database.Quota{Inodes: 2, UsedInodes: 2}, *quota)
+}
+
+func testQuotaBytes(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	gid := uint32(1002)
+
+	assert.Nil(t, db.SetQuota(ctx, nil, &gid, 100, 0))
+
+	file, err := createOwned(t, db, dir, 0, gid)
+	assert.Nil(t, err)
+
+	AddChunk(t, db, file.ID, 0, "a", 0, 60)
+
+	err = db.AddChunk(ctx, file.ID, 0, database.Chunk{
+		Inode:       file.ID,
+		InodeOffset: 60,
+		Chunk:       storage.Chunk{Storage: "test", Key: "b", Size: 50},
+	})
+
+	assert.Equal(t, syscall.EDQUOT, err)
+	AssertLayout(t, db, file.ID, []Layout{{"a", 0, 0, 60}})
+
+	AddChunk(t, db, file.ID, 0, "c", 0, 100)
+
+	quota, err := db.GetQuota(ctx, nil, &gid)
+	assert.Nil(t, err)
+	assert.Equal(t, database.Quota{Bytes: 100, UsedBytes: 100, UsedInodes: 1}, *quota)
+}
+
+func testQuotaUsage(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	uid := uint32(1003)
+
+	first, err := createOwned(t, db, dir, uid, 0)
+	assert.Nil(t, err)
+	AddChunk(t, db, first.ID, 0, "a", 0, 10)
+
+	assert.Nil(t, db.SetQuota(ctx, &uid, nil, 1000, 10))
+
+	second, err := createOwned(t, db, dir, uid, 0)
+	assert.Nil(t, err)
+	AddChunk(t, db, second.ID, 0, "b", 0, 20)
+
+	quota, err := db.GetQuota(ctx, &uid, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(30), quota.UsedBytes)
+	assert.Equal(t, uint64(2), quota.UsedInodes)
+
+	assert.Nil(t, db.Unlink(ctx, dir, first.Name))
+	assert.Nil(t, db.Forget(ctx, first.ID))
+
+	assert.Nil(t, db.Unlink(ctx, dir, second.Name))
+	assert.Nil(t, db.CleanOrphanInodes(ctx))
+
+	quota, err = db.GetQuota(ctx, &uid, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), quota.UsedBytes)
+	assert.Equal(t, uint64(0), quota.UsedInodes)
+}
+
+func testQuotaOwner(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	from := uint32(1004)
+	to := uint32(1005)
+
+	assert.Nil(t, db.SetQuota(ctx, &from, nil, 0, 0))
+	assert.Nil(t, db.SetQuota(ctx, &to, nil, 0, 0))
+
+	file, err := createOwned(t, db, dir, from, 0)
+	assert.Nil(t, err)
+	AddChunk(t, db, file.ID, 0, "a", 0, 10)
+
+	_, err = db.Touch(ctx, file.ID, nil, nil, nil, nil, &to, nil)
+	assert.Nil(t, err)
+
+	quota, err := db.GetQuota(ctx, &from, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, database.Quota{}, *quota)
+
+	quota, err = db.GetQuota(ctx, &to, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, database.Quota{UsedBytes: 10, UsedInodes: 1}, *quota)
+
+	_, err = db.GetQuota(ctx, &from, &to)
+	assert.Equal(t, syscall.EINVAL, err)
+
+	missing := uint32(1006)
+	_, err = db.GetQuota(ctx, &missing, nil)
+	assert.Equal(t, syscall.ENOENT, err)
+}
+
+func testChownTree(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	from, other, to := uint32(1007), uint32(1008), uint32(1009)
+	group := uint32(1010)
+
+	assert.Nil(t, db.SetQuota(ctx, &from, nil, 0, 0))
+	assert.Nil(t, db.SetQuota(ctx, &to, nil, 0, 0))
+
+	mkdir := func(parent fuseops.InodeID) *database.Entry {
+		name, err := storage.Key()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entry, err := db.Create(ctx, database.Entry{
+			Parent: parent,
+			Name:   name,
+			Inode: database.Inode{
+				InodeAttributes: fuseops.InodeAttributes{Mode: os.ModeDir | 0755, Uid: from},
+			},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return entry
+	}
+
+	top := mkdir(dir)
+	sub := mkdir(top.ID)
+
+	file, err := createOwned(t, db, sub.ID, from, 0)
+	assert.Nil(t, err)
+	AddChunk(t, db, file.ID, 0, "a", 0, 10)
+
+	foreign, err := createOwned(t, db, sub.ID, other, 0)
+	assert.Nil(t, err)
+	AddChunk(t, db, foreign.ID, 0, "b", 0, 20)
+
+	_, err = db.Link(ctx, file.ID, top.ID, "link")
+	assert.Nil(t, err)
+
+	before, err := db.Get(ctx, file.ID)
+	assert.Nil(t, err)
+
+	// Times may be stored with a resolution of a second
+	time.Sleep(time.Second)
+
+	assert.Nil(t, db.ChownTree(ctx, top.ID, &to, &group, &from))
+
+	for _, id := range []fuseops.InodeID{top.ID, sub.ID, file.ID} {
+		inode, err := db.Get(ctx, id)
+		assert.Nil(t, err)
+		assert.Equal(t, to, inode.Uid)
+		assert.Equal(t, group, inode.Gid)
+		assert.True(t, inode.Ctime.After(before.Ctime), "the ctime should advance")
+	}
+
+	inode, err := db.Get(ctx, foreign.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, other, inode.Uid, "inodes owned by another user should be left alone")
+	assert.Equal(t, uint32(0), inode.Gid)
+
+	quota, err := db.GetQuota(ctx, &from, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, database.Quota{}, *quota)
+
+	quota, err = db.GetQuota(ctx, &to, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, database.Quota{UsedBytes: 10, UsedInodes: 3}, *quota, "hard links should be counted once")
+
+	assert.Nil(t, db.ChownTree(ctx, sub.ID, &other, nil, nil))
+
+	for _, id := range []fuseops.InodeID{sub.ID, file.ID, foreign.ID} {
+		inode, err := db.Get(ctx, id)
+		assert.Nil(t, err)
+		assert.Equal(t, other, inode.Uid)
+	}
+
+	inode, err = db.Get(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, group, inode.Gid, "nil groups should be left unchanged")
+
+	inode, err = db.Get(ctx, top.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, to, inode.Uid)
+
+	quota, err = db.GetQuota(ctx, &to, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, database.Quota{UsedInodes: 1}, *quota)
+}
+
+func testChmodTree(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	top := create(t, db, dir, os.ModeDir|0700)
+	sub := create(t, db, top.ID, os.ModeDir|0755)
+	file := create(t, db, sub.ID, 0600|os.ModeSetuid)
+	fifo := create(t, db, sub.ID, os.ModeNamedPipe|0644)
+
+	link, err := db.Create(ctx, database.Entry{
+		Parent: top.ID,
+		Name:   "link",
+		Inode: database.Inode{
+			SymLink:         "target",
+			InodeAttributes: fuseops.InodeAttributes{Mode: os.ModeSymlink | 0777},
+		},
+	})
+
+	assert.Nil(t, err)
+
+	// Times may be stored with a resolution of a second
+	time.Sleep(time.Second)
+
+	assert.Nil(t, db.ChmodTree(ctx, top.ID, os.ModeDir|0750, os.ModeSymlink|0640))
+
+	modes := map[fuseops.InodeID]os.FileMode{
+		top.ID:  os.ModeDir | 0750,
+		sub.ID:  os.ModeDir | 0750,
+		file.ID: 0640,
+		fifo.ID: os.ModeNamedPipe | 0644,
+		link.ID: os.ModeSymlink | 0777,
+	}
+
+	for id, mode := range modes {
+		inode, err := db.Get(ctx, id)
+		assert.Nil(t, err)
+		assert.Equal(t, mode, inode.Mode)
+	}
+
+	inode, err := db.Get(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.True(t, inode.Ctime.After(file.Ctime), "the ctime should advance")
+
+	assert.Nil(t, db.ChmodTree(ctx, file.ID, 0700, 0444))
+
+	inode, err = db.Get(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0444), inode.Mode)
+}
+
+// FsStats checks the free space reported by a freshly set up database with
+// a quota of 1GiB
+func FsStats(t *testing.T, db database.Db) {
+	ctx := context.Background()
+	dir := Mkdir(t, db, fuseops.RootInodeID)
+
+	AddChunk(t, db, Mkfile(t, db, dir).ID, 0, "a", 0, 200<<20)
+	AddChunk(t, db, Mkfile(t, db, dir).ID, 0, "b", 0, 400<<20)
+
+	stats, err := db.FsStats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1<<30), stats.TotalSize)
+	assert.Equal(t, uint64(600<<20), stats.Size)
+	assert.Equal(t, uint64(1<<30-600<<20), stats.FreeSize)
+	assert.Equal(t, uint64(database.DefaultCapacity), stats.TotalInodes)
+	assert.Equal(t, uint64(database.DefaultCapacity-4), stats.FreeInodes)
+}
+
+// BlockSize checks that the block size the driver was configured with is
+// reported along with the stats, and that the zeros filling grown files are
+// aligned to it
+func BlockSize(t *testing.T, db database.Db, blockSize uint64) {
+	ctx := context.Background()
+
+	stats, err := db.FsStats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, blockSize, stats.BlockSize)
+
+	file := Mkfile(t, db, fuseops.RootInodeID)
+	AddChunk(t, db, file.ID, 0, "a", 0, 100)
+
+	size := 2*blockSize + 10
+	_, err = db.Touch(ctx, file.ID, &size, nil, nil, nil, nil, nil)
+	assert.Nil(t, err)
+	AddChunk(t, db, file.ID, 0, "b", 3*blockSize+10, 10)
+
+	chunks, err := db.Chunks(ctx, file.ID)
+	assert.Nil(t, err)
+
+	offsets := make([]uint64, 0)
+	for _, c := range *chunks {
+		offsets = append(offsets, c.InodeOffset)
+	}
+
+	assert.Equal(t, []uint64{0, 100, blockSize, size, 3 * blockSize, 3*blockSize + 10}, offsets)
+}
+
+// LeakedAnonymous checks that CleanOrphanInodes removes the anonymous inodes
+// left unchanged for longer than database.AnonymousTimeout, e.g by a crash,
+// while keeping the ones still held
+func LeakedAnonymous(t *testing.T, db database.Db, conn *sql.DB) {
+	ctx := context.Background()
+
+	held, err := db.CreateAnonymous(ctx, 0644, 1000, 1000)
+	assert.Nil(t, err)
+
+	leaked, err := db.CreateAnonymous(ctx, 0644, 1000, 1000)
+	assert.Nil(t, err)
+	AddChunk(t, db, leaked.ID, 0, "leaked", 0, 10)
+
+	if _, err = conn.Exec(fmt.Sprintf("UPDATE inodes SET ctime = '2000-01-01 00:00:00' WHERE id = %d", leaked.ID)); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := db.CountOrphans(ctx, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), report.Inodes)
+	assert.Equal(t, uint64(1), report.OrphanedChunks)
+
+	assert.Nil(t, db.CleanOrphanInodes(ctx))
+
+	_, err = db.Get(ctx, leaked.ID)
+	assert.Equal(t, syscall.ENOENT, err, "leaked anonymous inodes should be collected")
+
+	_, err = db.Get(ctx, held.ID)
+	assert.Nil(t, err, "anonymous inodes still held should survive")
+	assert.Nil(t, db.Forget(ctx, held.ID))
+}
+
+// StatsUnderflow checks that forgetting inodes never makes the stats go
+// below zero bytes or below the root inode, even if they drifted or the same
+// inode is forgotten concurrently
+func StatsUnderflow(t *testing.T, db database.Db, conn *sql.DB) {
+	ctx := context.Background()
+	dir := Mkdir(t, db, fuseops.RootInodeID)
+
+	first := Mkfile(t, db, dir)
+	second := Mkfile(t, db, dir)
+	AddChunk(t, db, first.ID, 0, "a", 0, 10)
+	AddChunk(t, db, second.ID, 0, "b", 0, 10)
+	assert.Nil(t, db.Unlink(ctx, dir, first.Name))
+	assert.Nil(t, db.Unlink(ctx, dir, second.Name))
+
+	if _, err := conn.Exec("UPDATE stats SET size = 5, inodes = 2"); err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = db.Forget(ctx, first.ID)
+		}(i)
+	}
+
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			assert.Equal(t, syscall.ENOENT, err)
+		}
+	}
+
+	stats, err := db.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, database.Stats{Inodes: 1, Size: 0}, *stats)
+
+	assert.Nil(t, db.ForgetBatch(ctx, []fuseops.InodeID{second.ID}))
+
+	stats, err = db.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, database.Stats{Inodes: 1, Size: 0}, *stats)
+
+	// Neither does shrinking files
+	third := Mkfile(t, db, dir)
+	AddChunk(t, db, third.ID, 0, "c", 0, 10)
+
+	if _, err := conn.Exec("UPDATE stats SET size = 5"); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, db.Truncate(ctx, third.ID, 2))
+
+	stats, err = db.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), stats.Size)
+}
+
+// ForgetRace checks that inodes whose refcount missed an entry pointing to
+// them, as a Link racing a Forget could leave, are kept when forgotten
+func ForgetRace(t *testing.T, db database.Db, conn *sql.DB) {
+	ctx := context.Background()
+	dir := Mkdir(t, db, fuseops.RootInodeID)
+	file := Mkfile(t, db, dir)
+	other := Mkfile(t, db, dir)
+	AddChunk(t, db, file.ID, 0, "a", 0, 10)
+
+	if _, err := conn.Exec(fmt.Sprintf("UPDATE inodes SET refcount = 0 WHERE id IN (%d, %d)", file.ID, other.ID)); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, db.Forget(ctx, file.ID))
+	assert.Nil(t, db.ForgetBatch(ctx, []fuseops.InodeID{other.ID}))
+
+	for _, entry := range []*database.Entry{file, other} {
+		found, err := db.LookUp(ctx, dir, entry.Name)
+		if assert.Nil(t, err) {
+			assert.Equal(t, entry.ID, found.ID)
+		}
+	}
+
+	chunks, err := db.Chunks(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Len(t, *chunks, 1)
+
+	racing := Mkfile(t, db, dir)
+	assert.Nil(t, db.Unlink(ctx, dir, racing.Name))
+
+	wg := sync.WaitGroup{}
+	var forgetErr, linkErr error
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		forgetErr = db.Forget(ctx, racing.ID)
+	}()
+
+	go func() {
+		defer wg.Done()
+		_, linkErr = db.Link(ctx, racing.ID, dir, "racing")
+	}()
+
+	wg.Wait()
+	assert.Nil(t, forgetErr)
+
+	if linkErr != nil {
+		assert.Equal(t, syscall.ENOENT, linkErr)
+		return
+	}
+
+	found, err := db.LookUp(ctx, dir, "racing")
+	if assert.Nil(t, err) {
+		assert.Equal(t, racing.ID, found.ID)
+	}
+}
+
+// Fsck checks that a corrupted reference count and a detached directory
+// cycle are reported, and that repairing fixes the reference count
+func Fsck(t *testing.T, db database.Db, conn *sql.DB) {
+	ctx := context.Background()
+
+	report, err := db.Fsck(ctx, false)
+	assert.Nil(t, err)
+	assert.True(t, report.Clean())
+
+	dir := Mkdir(t, db, fuseops.RootInodeID)
+	file := Mkfile(t, db, dir)
+	first := Mkdir(t, db, dir)
+	second := Mkdir(t, db, first)
+	nested := Mkfile(t, db, second)
+
+	exec := func(query string) {
+		if _, err := conn.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exec(fmt.Sprintf("UPDATE inodes SET refcount = 3 WHERE id = %d", file.ID))
+	exec(fmt.Sprintf("UPDATE entries SET parent = %d WHERE inode = %d", second, first))
+
+	expected := []database.RefcountMismatch{{Inode: file.ID, Refcount: 3, Links: 1}}
+	unreachable := []fuseops.InodeID{first, second, nested.ID}
+
+	report, err = db.Fsck(ctx, false)
+	assert.Nil(t, err)
+	assert.False(t, report.Repaired)
+	assert.Equal(t, expected, report.Refcounts)
+	assert.Equal(t, unreachable, report.Unreachable)
+	assert.Len(t, report.Dangling, 0)
+
+	report, err = db.Fsck(ctx, true)
+	assert.Nil(t, err)
+	assert.True(t, report.Repaired)
+	assert.Equal(t, expected, report.Refcounts)
+
+	inode, err := db.Get(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), inode.Nlink)
+
+	report, err = db.Fsck(ctx, false)
+	assert.Nil(t, err)
+	assert.Len(t, report.Refcounts, 0)
+	assert.Equal(t, unreachable, report.Unreachable)
+}
+
+// Dedup checks that chunks holding data which is already stored point to the
+// existing object, expecting deduplication to be enabled in the driver
+func Dedup(t *testing.T, db database.Db) {
+	ctx := context.Background()
+	st := &removals{keys: make(map[string]int)}
+
+	block := bytes.Repeat([]byte("t"), 64*1024)
+	sum := sha256.Sum256(block)
+	hash := hex.EncodeToString(sum[:])
+
+	first := Mkfile(t, db, fuseops.RootInodeID)
+	second := Mkfile(t, db, fuseops.RootInodeID)
+	third := Mkfile(t, db, fuseops.RootInodeID)
+
+	keys := make([]string, 3)
+	for i, inode := range []fuseops.InodeID{first.ID, second.ID, third.ID} {
+		key, err := storage.Key()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		chunk := database.Chunk{
+			Inode: inode,
+			Chunk: storage.Chunk{Storage: "test", Key: key, Size: uint64(len(block))},
+			Hash:  hash,
+		}
+
+		if inode == third.ID {
+			chunk.Hash = strings.Repeat("0", len(hash))
+		}
+
+		assert.Nil(t, db.AddChunk(ctx, inode, 0, chunk))
+		keys[i] = key
+	}
+
+	AssertLayout(t, db, first.ID, []Layout{{keys[0], 0, 0, uint64(len(block))}})
+	AssertLayout(t, db, second.ID, []Layout{{keys[0], 0, 0, uint64(len(block))}})
+	AssertLayout(t, db, third.ID, []Layout{{keys[2], 0, 0, uint64(len(block))}})
+
+	assert.Nil(t, db.CleanOrphanChunks(ctx, time.Now().Add(time.Hour), st, 1))
+	assert.Equal(t, 0, st.count(keys[0]))
+	assert.Equal(t, 1, st.count(keys[1]), "the duplicated object should be removed")
+	assert.Equal(t, 0, st.count(keys[2]))
+}
+
+// Atime checks that reads honour the atime policy, which is changed through
+// the given pointer to the policy of the driver
+func Atime(t *testing.T, db database.Db, conn *sql.DB, policy *database.AtimePolicy) {
+	ctx := context.Background()
+	file := Mkfile(t, db, fuseops.RootInodeID)
+
+	recent := time.Now().UTC().Add(-time.Hour).Format("2006-01-02 15:04:05")
+	set := func(atime string, mtime string) {
+		query := fmt.Sprintf("UPDATE inodes SET atime = '%s', mtime = '%s', ctime = '%s' WHERE id = %d", atime, mtime, mtime, file.ID)
+		if _, err := conn.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	updated := func(read func() error) bool {
+		assert.Nil(t, read())
+		inode, err := db.Get(ctx, file.ID)
+		assert.Nil(t, err)
+		return time.Since(inode.Atime) < 30*time.Minute
+	}
+
+	chunks := func() error {
+		_, err := db.Chunks(ctx, file.ID)
+		return err
+	}
+
+	children := func() error {
+		_, err := db.Children(ctx, file.ID)
+		return err
+	}
+
+	*policy = database.NoAtime
+	set("2000-01-01 00:00:00", "2000-01-02 00:00:00")
+	assert.False(t, updated(chunks), "noatime should never update the access time")
+	assert.False(t, updated(children), "noatime should never update the access time")
+
+	*policy = database.RelAtime
+	set(recent, "2000-01-01 00:00:00")
+	assert.False(t, updated(chunks), "relatime should keep a recent access time newer than the modification time")
+
+	set("2000-01-01 00:00:00", "2000-01-02 00:00:00")
+	assert.True(t, updated(chunks), "relatime should update an access time older than the modification time")
+
+	set("2000-01-02 00:00:00", "2000-01-01 00:00:00")
+	assert.True(t, updated(children), "relatime should update an access time older than a day")
+
+	*policy = database.StrictAtime
+	set(recent, "2000-01-01 00:00:00")
+	assert.True(t, updated(chunks), "strictatime should always update the access time")
+}
+
+// Migrate checks that a database set up at the first schema version is
+// brought up to the given one, and that migrating again is a no-op
+func Migrate(t *testing.T, db database.Db, conn *sql.DB, version int) {
+	ctx := context.Background()
+
+	current := func() int {
+		var v int
+		if err := conn.QueryRow("SELECT version FROM schema_version").Scan(&v); err != nil {
+			t.Fatal(err)
+		}
+
+		return v
+	}
+
+	quotas := func() error {
+		rows, err := conn.Query("SELECT kind, id, bytes, inodes, usedbytes, usedinodes FROM quotas")
+		if err != nil {
+			return err
+		}
+
+		return rows.Close()
+	}
+
+	assert.Equal(t, 1, current())
+	assert.NotNil(t, quotas())
+
+	assert.Nil(t, db.Migrate(ctx))
+	assert.Equal(t, version, current())
+	assert.Nil(t, quotas())
+
+	assert.Nil(t, db.Migrate(ctx))
+	assert.Equal(t, version, current())
+
+	uid := uint32(1000)
+	assert.Nil(t, db.SetQuota(ctx, &uid, nil, 1<<20, 10))
+
+	quota, err := db.GetQuota(ctx, &uid, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1<<20), quota.Bytes)
+
+	device, err := db.Create(ctx, database.Entry{
+		Parent: fuseops.RootInodeID,
+		Name:   "device",
+		Inode: database.Inode{
+			Rdev: 1<<8 | 3,
+			InodeAttributes: fuseops.InodeAttributes{
+				Mode: os.ModeDevice | os.ModeCharDevice | 0666,
+			},
+		},
+	})
+
+	if assert.Nil(t, err) {
+		inode, err := db.Get(ctx, device.ID)
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(1<<8|3), inode.Rdev)
+
+		assert.Nil(t, db.SetImmutable(ctx, device.ID, 0, true, nil))
+		assert.Equal(t, syscall.EPERM, db.Unlink(ctx, fuseops.RootInodeID, "device"))
+	}
+}
+
+type auditLog struct {
+	mutex  sync.Mutex
+	events []database.AuditEvent
+}
+
+func (l *auditLog) Audit(ctx context.Context, event database.AuditEvent) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.events = append(l.events, event)
+}
+
+func (l *auditLog) take() []database.AuditEvent {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	events := l.events
+	l.events = nil
+	return events
+}
+
+// Audit checks that committed operations are reported to the audit hook,
+// which is set through the given pointer to the hook of the driver, and that
+// failed ones aren't
+func Audit(t *testing.T, db database.Db, hook *database.AuditHook) {
+	ctx := context.Background()
+	log := &auditLog{}
+
+	*hook = log
+	defer func() { *hook = nil }()
+
+	start := time.Now()
+	dir := create(t, db, fuseops.RootInodeID, os.ModeDir|0755)
+	file, err := createOwned(t, db, dir.ID, 1001, 1002)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Link(ctx, file.ID, dir.ID, "link")
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Unlink(ctx, dir.ID, file.Name))
+	end := time.Now()
+
+	events := log.take()
+	for i := range events {
+		assert.False(t, events[i].Time.Before(start) || events[i].Time.After(end), "events should be timestamped when reported")
+		events[i].Time = time.Time{}
+	}
+
+	assert.Equal(t, []database.AuditEvent{
+		{Op: database.AuditCreate, Inode: dir.ID},
+		{Op: database.AuditCreate, Inode: file.ID, Uid: 1001, Gid: 1002},
+		{Op: database.AuditLink, Inode: file.ID, Uid: 1001, Gid: 1002},
+		{Op: database.AuditUnlink, Inode: file.ID, Uid: 1001, Gid: 1002},
+	}, events)
+
+	Mkfile(t, db, dir.ID)
+	log.take()
+
+	_, err = db.Create(ctx, database.Entry{
+		Parent: fuseops.RootInodeID,
+		Name:   dir.Name,
+		Inode: database.Inode{
+			InodeAttributes: fuseops.InodeAttributes{Mode: 0644},
+		},
+	})
+
+	assert.Equal(t, syscall.EEXIST, err)
+
+	_, err = db.Link(ctx, file.ID, dir.ID, "link")
+	assert.Equal(t, syscall.EEXIST, err)
+
+	assert.Equal(t, syscall.ENOTEMPTY, db.Unlink(ctx, fuseops.RootInodeID, dir.Name))
+	assert.Empty(t, log.take(), "rolled back operations shouldn't be reported")
+}
+
+// ReadOnly checks that every mutation fails with EROFS once the driver is
+// made read-only through the given pointer, reads still working
+func ReadOnly(t *testing.T, db database.Db, readOnly *bool) {
+	ctx := context.Background()
+	now := time.Now()
+	size := uint64(5)
+
+	dir := create(t, db, fuseops.RootInodeID, os.ModeDir|0755)
+	file := Mkfile(t, db, dir.ID)
+	AddChunk(t, db, file.ID, 0, "a", 0, 10)
+	assert.Nil(t, db.SetXattr(ctx, file.ID, "user.a", []byte("1"), 0))
+
+	unlinked := Mkfile(t, db, dir.ID)
+	assert.Nil(t, db.Unlink(ctx, dir.ID, unlinked.Name))
+
+	*readOnly = true
+	defer func() { *readOnly = false }()
+
+	assert.Equal(t, syscall.EROFS, db.Setup(ctx))
+	assert.Equal(t, syscall.EROFS, db.Migrate(ctx))
+	assert.Equal(t, syscall.EROFS, db.SetQuota(ctx, &file.Uid, nil, 1, 1))
+	assert.Equal(t, syscall.EROFS, db.Forget(ctx, unlinked.ID))
+	assert.Equal(t, syscall.EROFS, db.ForgetBatch(ctx, []fuseops.InodeID{file.ID, unlinked.ID}))
+	assert.Equal(t, syscall.EROFS, db.CleanOrphanInodes(ctx))
+	assert.Equal(t, syscall.EROFS, db.CleanOrphanChunks(ctx, now, &removals{keys: make(map[string]int)}, 1))
+	assert.Equal(t, syscall.EROFS, db.Unlink(ctx, dir.ID, file.Name))
+	assert.Equal(t, syscall.EROFS, db.RemoveTree(ctx, fuseops.RootInodeID, dir.Name, true))
+	assert.Equal(t, syscall.EROFS, db.Rename(ctx, dir.ID, file.Name, dir.ID, "renamed", 0))
+	assert.Equal(t, syscall.EROFS, db.Truncate(ctx, file.ID, 0))
+	assert.Equal(t, syscall.EROFS, db.SetImmutable(ctx, file.ID, file.Uid, true, nil))
+	assert.Equal(t, syscall.EROFS, db.AddChunk(ctx, file.ID, 0, database.Chunk{Chunk: storage.Chunk{Storage: "test", Key: "b", Size: 10}}))
+	assert.Equal(t, syscall.EROFS, db.Fallocate(ctx, file.ID, 0, 20, 0))
+	assert.Equal(t, syscall.EROFS, db.RemoveXattr(ctx, file.ID, "user.a"))
+	assert.Equal(t, syscall.EROFS, db.SetXattr(ctx, file.ID, "user.a", []byte("2"), 0))
+	assert.Equal(t, syscall.EROFS, db.SetAllXattr(ctx, file.ID, map[string][]byte{"user.b": []byte("2")}))
+
+	_, err := db.Create(ctx, database.Entry{Parent: dir.ID, Name: "new"})
+	assert.Equal(t, syscall.EROFS, err)
+
+	_, err = db.CreateAnonymous(ctx, 0644, 0, 0)
+	assert.Equal(t, syscall.EROFS, err)
+
+	_, err = db.Link(ctx, file.ID, dir.ID, "link")
+	assert.Equal(t, syscall.EROFS, err)
+
+	_, err = db.Snapshot(ctx, dir.ID, fuseops.RootInodeID, "snapshot")
+	assert.Equal(t, syscall.EROFS, err)
+
+	_, err = db.Touch(ctx, file.ID, &size, nil, nil, nil, nil, nil)
+	assert.Equal(t, syscall.EROFS, err)
+
+	_, err = db.CopyRange(ctx, file.ID, 0, file.ID, 10, 10)
+	assert.Equal(t, syscall.EROFS, err)
+
+	_, err = db.SwapXattr(ctx, file.ID, "user.a", []byte("1"), []byte("2"))
+	assert.Equal(t, syscall.EROFS, err)
+
+	_, err = db.Fsck(ctx, true)
+	assert.Equal(t, syscall.EROFS, err)
+
+	assert.Nil(t, db.Forget(ctx, file.ID), "forgetting linked inodes removes nothing")
+
+	inode, err := db.Get(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), inode.Size)
+
+	entry, err := db.LookUp(ctx, dir.ID, file.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, file.ID, entry.ID)
+
+	children, err := db.Children(ctx, dir.ID)
+	assert.Nil(t, err)
+	assert.Len(t, *children, 1)
+
+	AssertLayout(t, db, file.ID, []Layout{{"a", 0, 0, 10}})
+
+	keys, err := db.ListXattr(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"user.a"}, *keys)
+
+	value, err := db.GetXattr(ctx, file.ID, "user.a")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), *value)
+
+	_, err = db.Stats(ctx)
+	assert.Nil(t, err)
+
+	_, err = db.Fsck(ctx, false)
+	assert.Nil(t, err)
+
+	*readOnly = false
+	assert.Nil(t, db.Forget(ctx, unlinked.ID))
+}
+
+// dumped holds what a dump is expected to preserve about an inode
+type dumped struct {
+	Mode   os.FileMode
+	Uid    uint32
+	Gid    uint32
+	Size   uint64
+	Nlink  uint32
+	Rdev   uint32
+	Mtime  int64
+	Target string
+	Layout []Layout
+	Xattrs map[string][]byte
+}
+
+// tree describes every inode reachable from the root, keyed by path
+func tree(t *testing.T, db database.Db) map[string]dumped {
+	ctx := context.Background()
+	nodes := make(map[string]dumped)
+
+	describe := func(path string, inode database.Inode) {
+		node := dumped{
+			Mode:  inode.Mode,
+			Uid:   inode.Uid,
+			Gid:   inode.Gid,
+			Size:  inode.Size,
+			Nlink: inode.Nlink,
+			Rdev:  inode.Rdev,
+			Mtime: inode.Mtime.Unix(),
+		}
+
+		var err error
+		if inode.Mode&os.ModeSymlink != 0 {
+			node.Target, err = db.ReadLink(ctx, inode.ID)
+			assert.Nil(t, err)
+		}
+
+		chunks, err := db.Chunks(ctx, inode.ID)
+		assert.Nil(t, err)
+		for _, c := range *chunks {
+			node.Layout = append(node.Layout, Layout{c.Key, c.ObjectOffset, c.InodeOffset, c.Size})
+		}
+
+		node.Xattrs, err = db.GetAllXattr(ctx, inode.ID)
+		assert.Nil(t, err)
+		nodes[path] = node
+	}
+
+	root, err := db.Get(ctx, fuseops.RootInodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	describe("/", *root)
+
+	var walk func(dir fuseops.InodeID, path string)
+	walk = func(dir fuseops.InodeID, path string) {
+		children, err := db.ChildrenPlus(ctx, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, child := range *children {
+			describe(path+child.Name, child.Inode)
+			if child.Mode.IsDir() {
+				walk(child.ID, path+child.Name+"/")
+			}
+		}
+	}
+
+	walk(fuseops.RootInodeID, "/")
+	return nodes
+}
+
+// Dump checks that a file system exported from src and imported into dst,
+// which must be freshly set up, keeps its structure
+func Dump(t *testing.T, src database.Db, dst database.Db) {
+	ctx := context.Background()
+	mtime := time.Date(2002, 3, 4, 5, 6, 7, 0, time.UTC)
+	mkdir := func(parent fuseops.InodeID, name string, inode database.Inode) *database.Entry {
+		entry, err := src.Create(ctx, database.Entry{Parent: parent, Name: name, Inode: inode})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return entry
+	}
+
+	docs := mkdir(fuseops.RootInodeID, "docs", database.Inode{InodeAttributes: fuseops.InodeAttributes{Mode: os.ModeDir | 0750, Uid: 1001, Gid: 1002}})
+	nested := mkdir(docs.ID, "nested", database.Inode{InodeAttributes: fuseops.InodeAttributes{Mode: os.ModeDir | 0755}})
+	file := mkdir(nested.ID, "file\xff", database.Inode{InodeAttributes: fuseops.InodeAttributes{Mode: 0640, Uid: 1001, Mtime: mtime}})
+	mkdir(docs.ID, "link", database.Inode{SymLink: "nested/file", InodeAttributes: fuseops.InodeAttributes{Mode: os.ModeSymlink | 0777}})
+	mkdir(fuseops.RootInodeID, "tty", database.Inode{Rdev: 0x0501, InodeAttributes: fuseops.InodeAttributes{Mode: os.ModeDevice | os.ModeCharDevice | 0620}})
+
+	AddChunk(t, src, file.ID, 0, "a", 0, 10)
+	AddChunk(t, src, file.ID, 0, "b", 20, 10)
+
+	size := uint64(50)
+	_, err := src.Touch(ctx, file.ID, &size, nil, nil, &mtime, nil, nil)
+	assert.Nil(t, err)
+
+	_, err = src.Link(ctx, file.ID, fuseops.RootInodeID, "hardlink")
+	assert.Nil(t, err)
+
+	assert.Nil(t, src.SetXattr(ctx, file.ID, "user.b", []byte("2"), 0))
+	assert.Nil(t, src.SetXattr(ctx, file.ID, "user.a", []byte{0, 1}, 0))
+	assert.Nil(t, src.SetXattr(ctx, fuseops.RootInodeID, "user.root", []byte("yes"), 0))
+
+	_, err = src.Touch(ctx, docs.ID, nil, nil, nil, &mtime, nil, nil)
+	assert.Nil(t, err)
+
+	var dump bytes.Buffer
+	if err = src.Export(ctx, &dump); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, dst.Import(ctx, bytes.NewReader(dump.Bytes())))
+	assert.Equal(t, tree(t, src), tree(t, dst))
+
+	dir, err := dst.LookUp(ctx, fuseops.RootInodeID, "docs")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	dir, err = dst.LookUp(ctx, dir.ID, "nested")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	copied, err := dst.LookUp(ctx, dir.ID, "file\xff")
+	assert.Nil(t, err)
+
+	linked, err := dst.LookUp(ctx, fuseops.RootInodeID, "hardlink")
+	assert.Nil(t, err)
+	assert.Equal(t, copied.ID, linked.ID)
+
+	assert.Equal(t, syscall.EEXIST, dst.Import(ctx, bytes.NewReader(dump.Bytes())))
+	assert.NotNil(t, dst.Import(ctx, strings.NewReader(`{"version":2}`)))
+}
+
+// TryLock checks that the named locks taken by a client of a database can't
+// be taken by another one until they're released
+func TryLock(t *testing.T, a database.Locker, b database.Locker) {
+	ctx := context.Background()
+
+	release, err := a.TryLock(ctx, "test")
+	assert.Nil(t, err)
+	if !assert.NotNil(t, release) {
+		return
+	}
+
+	other, err := b.TryLock(ctx, "test")
+	assert.Nil(t, err)
+	assert.Nil(t, other, "locks should be held by a single client")
+
+	other, err = b.TryLock(ctx, "other")
+	assert.Nil(t, err)
+	if assert.NotNil(t, other, "locks of other names should be free") {
+		other()
+	}
+
+	release()
+
+	other, err = b.TryLock(ctx, "test")
+	assert.Nil(t, err)
+	if assert.NotNil(t, other, "released locks should be free") {
+		other()
+	}
+}
+
+func testSubtreeStats(t *testing.T, db database.Db, dir fuseops.InodeID) {
+	ctx := context.Background()
+	top := Mkdir(t, db, dir)
+	sub := Mkdir(t, db, top)
+	files := []fuseops.InodeID{Mkfile(t, db, top).ID, Mkfile(t, db, sub).ID, Mkfile(t, db, sub).ID}
+
+	for i, file := range files {
+		err := db.AddChunk(ctx, file, 0, database.Chunk{
+			Inode: file,
+			Chunk: storage.Chunk{Storage: "test", Key: "subtree", Size: uint64(i+1) * 10},
+		})
+
+		assert.Nil(t, err)
+	}
+
+	// Hard links are counted once
+	_, err := db.Link(ctx, files[0], sub, "link")
+	assert.Nil(t, err)
+
+	var size uint64
+	for _, id := range append([]fuseops.InodeID{top, sub}, files...) {
+		inode, err := db.Get(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		size += inode.Size
+	}
+
+	stats, err := db.SubtreeStats(ctx, top)
+	if assert.Nil(t, err) {
+		assert.Equal(t, uint64(5), stats.Inodes)
+		assert.Equal(t, size, stats.Size)
+		assert.Equal(t, uint64(60), stats.Allocated)
+	}
+
+	stats, err = db.SubtreeStats(ctx, sub)
+	if assert.Nil(t, err) {
+		assert.Equal(t, uint64(4), stats.Inodes)
+		assert.Equal(t, uint64(60), stats.Size)
+	}
+
+	// Holes of sparse files take no room
+	sparse := Mkfile(t, db, sub).ID
+	err = db.AddChunk(ctx, sparse, 0, database.Chunk{
+		Inode:       sparse,
+		InodeOffset: 100,
+		Chunk:       storage.Chunk{Storage: "test", Key: "sparse", Size: 10},
+	})
+
+	assert.Nil(t, err)
+	assert.Nil(t, db.Truncate(ctx, sparse, 1000))
+
+	stats, err = db.SubtreeStats(ctx, sparse)
+	if assert.Nil(t, err) {
+		assert.Equal(t, uint64(1), stats.Inodes)
+		assert.Equal(t, uint64(1000), stats.Size)
+		assert.Equal(t, uint64(10), stats.Allocated)
+	}
+
+	_, err = db.SubtreeStats(ctx, fuseops.InodeID(1<<40))
+	assert.Equal(t, syscall.ENOENT, err)
+}
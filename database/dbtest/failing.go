@@ -0,0 +1,158 @@
+package dbtest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database"
+	"github.com/stretchr/testify/assert"
+)
+
+// ErrInterrupted is the error failing connections return in the middle of
+// every result set
+var ErrInterrupted = errors.New("connection interrupted")
+
+// FailingDB opens a database whose queries return a single row and then
+// fail, as a connection dropping in the middle of a result set would.
+// Statements not returning rows succeed without doing anything.
+func FailingDB() *sql.DB {
+	return sql.OpenDB(failingConnector{})
+}
+
+// RowsErrors checks that errors found while iterating over results are
+// reported instead of returning the rows read so far. The given database
+// should be backed by FailingDB.
+func RowsErrors(t *testing.T, db database.Db) {
+	ctx := context.Background()
+
+	chunks, err := db.Chunks(ctx, fuseops.RootInodeID)
+	assert.Equal(t, ErrInterrupted, err)
+	assert.Nil(t, chunks)
+
+	children, err := db.Children(ctx, fuseops.RootInodeID)
+	assert.Equal(t, ErrInterrupted, err)
+	assert.Nil(t, children)
+
+	keys, err := db.ListXattr(ctx, fuseops.RootInodeID)
+	assert.Equal(t, ErrInterrupted, err)
+	assert.Nil(t, keys)
+}
+
+type failingConnector struct{}
+
+func (c failingConnector) Connect(context.Context) (driver.Conn, error) {
+	return failingConn{}, nil
+}
+
+func (c failingConnector) Driver() driver.Driver {
+	return failingDriver{}
+}
+
+type failingDriver struct{}
+
+func (d failingDriver) Open(name string) (driver.Conn, error) {
+	return failingConn{}, nil
+}
+
+type failingConn struct{}
+
+func (c failingConn) Prepare(query string) (driver.Stmt, error) {
+	return failingStmt{query}, nil
+}
+
+func (c failingConn) Close() error {
+	return nil
+}
+
+func (c failingConn) Begin() (driver.Tx, error) {
+	return failingTx{}, nil
+}
+
+type failingTx struct{}
+
+func (tx failingTx) Commit() error {
+	return nil
+}
+
+func (tx failingTx) Rollback() error {
+	return nil
+}
+
+type failingStmt struct {
+	query string
+}
+
+func (s failingStmt) Close() error {
+	return nil
+}
+
+func (s failingStmt) NumInput() int {
+	return -1
+}
+
+func (s failingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(0), nil
+}
+
+func (s failingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &failingRows{columns: selectedColumns(s.query)}, nil
+}
+
+// selectedColumns counts the columns selected by a query, ignoring the
+// commas found within parentheses
+func selectedColumns(query string) int {
+	start := strings.Index(query, "SELECT ") + len("SELECT ")
+	end := strings.Index(query, " FROM ")
+	if start < len("SELECT ") || end < start {
+		return 1
+	}
+
+	columns := 1
+	depth := 0
+
+	for _, c := range query[start:end] {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				columns++
+			}
+		}
+	}
+
+	return columns
+}
+
+type failingRows struct {
+	columns int
+	read    bool
+}
+
+func (r *failingRows) Columns() []string {
+	return make([]string, r.columns)
+}
+
+func (r *failingRows) Close() error {
+	return nil
+}
+
+func (r *failingRows) Next(dest []driver.Value) error {
+	if r.read {
+		return ErrInterrupted
+	}
+
+	r.read = true
+	for i := range dest {
+		dest[i] = int64(1)
+	}
+
+	return nil
+}
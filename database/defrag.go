@@ -0,0 +1,164 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"sort"
+
+	"github.com/manvalls/titan/storage"
+)
+
+// ChunkReplacer atomically replaces the given chunks of an inode with a
+// single chunk covering the same bytes, orphaning the replaced ones. It
+// returns false, leaving everything untouched, if any of them changed since
+// they were read.
+type ChunkReplacer func(ctx context.Context, old []Chunk, chunk Chunk) (bool, error)
+
+// Defragment rewrites the chunks read from the given rows, made of an id, an
+// inode, a storage, a key, an object offset, an inode offset and a size, as
+// DefragmentList does. Rows are always closed.
+func Defragment(ctx context.Context, rows *sql.Rows, st storage.Storage, targetObjectSize uint64, replace ChunkReplacer) error {
+	chunks := make([]Chunk, 0)
+
+	for rows.Next() {
+		chunk := Chunk{}
+		if err := rows.Scan(&chunk.ID, &chunk.Inode, &chunk.Storage, &chunk.Key, &chunk.ObjectOffset, &chunk.InodeOffset, &chunk.Size); err != nil {
+			rows.Close()
+			return err
+		}
+
+		chunks = append(chunks, chunk)
+	}
+
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return DefragmentList(ctx, chunks, st, targetObjectSize, replace)
+}
+
+// DefragmentList concatenates the data of runs of the given chunks of an
+// inode, contiguous within it, into new objects of up to targetObjectSize
+// bytes, which then replace them. Every run is replaced on its own once its
+// object is stored, so that an interrupted defragmentation leaves the inode
+// partly defragmented, and running it again carries on where it stopped.
+// Runs changed meanwhile are skipped, their new object being removed. Holes
+// and chunks of targetObjectSize bytes or more are left as they are. Drivers
+// can implement their Defragment method with it.
+func DefragmentList(ctx context.Context, chunks []Chunk, st storage.Storage, targetObjectSize uint64, replace ChunkReplacer) error {
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].InodeOffset < chunks[j].InodeOffset
+	})
+
+	for _, run := range defragRuns(chunks, targetObjectSize) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		size := uint64(0)
+		for _, c := range run {
+			size += c.Size
+		}
+
+		object, err := st.GetChunk(&chunksReader{st: st, chunks: run})
+		if err != nil {
+			return err
+		}
+
+		if object.Size != size {
+			st.Remove(*object)
+			return io.ErrUnexpectedEOF
+		}
+
+		replaced, err := replace(ctx, run, Chunk{
+			Inode:       run[0].Inode,
+			InodeOffset: run[0].InodeOffset,
+			Chunk:       *object,
+		})
+
+		if err != nil || !replaced {
+			st.Remove(*object)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// defragRuns groups the given chunks, sorted by inode offset, into the runs
+// worth rewriting as a single object, made of more than one chunk
+func defragRuns(chunks []Chunk, targetObjectSize uint64) [][]Chunk {
+	runs := make([][]Chunk, 0)
+	run := make([]Chunk, 0)
+	size := uint64(0)
+
+	flush := func() {
+		if len(run) > 1 {
+			runs = append(runs, run)
+		}
+
+		run = make([]Chunk, 0)
+		size = 0
+	}
+
+	for _, c := range chunks {
+		if c.IsHole() || c.Size >= targetObjectSize {
+			flush()
+			continue
+		}
+
+		if len(run) > 0 {
+			last := run[len(run)-1]
+			if c.InodeOffset != last.InodeOffset+last.Size || size+c.Size > targetObjectSize {
+				flush()
+			}
+		}
+
+		run = append(run, c)
+		size += c.Size
+	}
+
+	flush()
+	return runs
+}
+
+// chunksReader reads the data of several chunks one after the other
+type chunksReader struct {
+	st      storage.Storage
+	chunks  []Chunk
+	current io.ReadCloser
+}
+
+func (r *chunksReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+
+			rc, err := r.st.GetReadCloser(r.chunks[0].Chunk)
+			if err != nil {
+				return 0, err
+			}
+
+			r.current = rc
+		}
+
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			r.chunks = r.chunks[1:]
+			err = nil
+		}
+
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
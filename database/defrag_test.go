@@ -0,0 +1,38 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/manvalls/titan/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefragRuns(t *testing.T) {
+	chunk := func(id uint64, inodeOffset uint64, key string, size uint64) Chunk {
+		return Chunk{
+			ID:          id,
+			InodeOffset: inodeOffset,
+			Chunk:       storage.Chunk{Storage: "test", Key: key, Size: size},
+		}
+	}
+
+	chunks := []Chunk{
+		chunk(1, 0, "a", 10),
+		chunk(2, 10, "b", 10),
+		chunk(3, 20, "c", 15),
+		chunk(4, 35, "d", 10),
+		chunk(5, 45, "", 10),
+		chunk(6, 55, "e", 10),
+		chunk(7, 65, "f", 40),
+		chunk(8, 105, "g", 10),
+		chunk(9, 120, "h", 10),
+		chunk(10, 130, "i", 10),
+	}
+
+	assert.Equal(t, [][]Chunk{
+		chunks[0:3],
+		chunks[8:10],
+	}, defragRuns(chunks, 40))
+
+	assert.Empty(t, defragRuns(chunks, 10))
+}
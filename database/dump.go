@@ -0,0 +1,367 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/storage"
+)
+
+// DumpVersion is the version of the dumps written by Export
+const DumpVersion = 1
+
+var errDumpVersion = errors.New("Unsupported dump version")
+var errDumpMalformed = errors.New("Malformed dump")
+
+// DumpInode holds the attributes of an inode within a dump
+type DumpInode struct {
+	ID     fuseops.InodeID `json:"id"`
+	Mode   os.FileMode     `json:"mode"`
+	Uid    uint32          `json:"uid"`
+	Gid    uint32          `json:"gid"`
+	Size   uint64          `json:"size"`
+	Rdev   uint32          `json:"rdev,omitempty"`
+	Target []byte          `json:"target,omitempty"`
+	Atime  time.Time       `json:"atime"`
+	Mtime  time.Time       `json:"mtime"`
+	Ctime  time.Time       `json:"ctime"`
+	Crtime time.Time       `json:"crtime"`
+}
+
+// DumpEntry links an inode to a directory within a dump. Names are kept as
+// bytes, as they aren't required to be valid UTF-8.
+type DumpEntry struct {
+	Parent fuseops.InodeID `json:"parent"`
+	Name   []byte          `json:"name"`
+	Inode  fuseops.InodeID `json:"inode"`
+}
+
+// DumpChunk holds a chunk of an inode within a dump
+type DumpChunk struct {
+	Inode        fuseops.InodeID `json:"inode"`
+	InodeOffset  uint64          `json:"inodeOffset"`
+	Storage      string          `json:"storage"`
+	Key          string          `json:"key"`
+	ObjectOffset uint64          `json:"objectOffset"`
+	Size         uint64          `json:"size"`
+	Hash         string          `json:"hash,omitempty"`
+	Checksum     string          `json:"checksum,omitempty"`
+}
+
+// DumpXattr holds an extended attribute of an inode within a dump
+type DumpXattr struct {
+	Inode fuseops.InodeID `json:"inode"`
+	Name  []byte          `json:"name"`
+	Value []byte          `json:"value"`
+}
+
+// DumpRecord is a line of a dump, only one of its fields being set
+type DumpRecord struct {
+	Version int        `json:"version,omitempty"`
+	Inode   *DumpInode `json:"inode,omitempty"`
+	Entry   *DumpEntry `json:"entry,omitempty"`
+	Chunk   *DumpChunk `json:"chunk,omitempty"`
+	Xattr   *DumpXattr `json:"xattr,omitempty"`
+}
+
+// Export writes a portable dump of the file system reachable from the root
+// of the given database to w, as newline delimited JSON records. It starts
+// with the version and the root inode, followed by every directory in
+// breadth first order, their entries sorted by name. An inode is written
+// right before its first entry, followed by its chunks and its extended
+// attributes, while later entries pointing to it are hard links. Holes and
+// anonymous inodes are left out, as are immutability flags. Drivers can
+// implement their Export method with it.
+func Export(ctx context.Context, db Db, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(DumpRecord{Version: DumpVersion}); err != nil {
+		return err
+	}
+
+	root, err := db.Get(ctx, fuseops.RootInodeID)
+	if err != nil {
+		return err
+	}
+
+	if err = exportInode(ctx, db, enc, root, nil); err != nil {
+		return err
+	}
+
+	seen := map[fuseops.InodeID]bool{root.ID: true}
+	dirs := []fuseops.InodeID{root.ID}
+
+	for len(dirs) > 0 {
+		dir := dirs[0]
+		dirs = dirs[1:]
+
+		children, err := db.ChildrenPlus(ctx, dir)
+		if err != nil {
+			return err
+		}
+
+		sort.Slice(*children, func(i, j int) bool {
+			return (*children)[i].Name < (*children)[j].Name
+		})
+
+		for _, child := range *children {
+			entry := &DumpEntry{Parent: dir, Name: []byte(child.Name), Inode: child.ID}
+
+			if seen[child.ID] {
+				if err = enc.Encode(DumpRecord{Entry: entry}); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			seen[child.ID] = true
+			if err = exportInode(ctx, db, enc, &child.Inode, entry); err != nil {
+				return err
+			}
+
+			if child.Mode.IsDir() {
+				dirs = append(dirs, child.ID)
+			}
+		}
+	}
+
+	return nil
+}
+
+// exportInode writes an inode along with its first entry, if any, its chunks
+// and its extended attributes
+func exportInode(ctx context.Context, db Db, enc *json.Encoder, inode *Inode, entry *DumpEntry) error {
+	record := &DumpInode{
+		ID:     inode.ID,
+		Mode:   inode.Mode,
+		Uid:    inode.Uid,
+		Gid:    inode.Gid,
+		Size:   inode.Size,
+		Rdev:   inode.Rdev,
+		Atime:  inode.Atime,
+		Mtime:  inode.Mtime,
+		Ctime:  inode.Ctime,
+		Crtime: inode.Crtime,
+	}
+
+	if inode.Mode&os.ModeSymlink != 0 {
+		target, err := db.ReadLink(ctx, inode.ID)
+		if err != nil {
+			return err
+		}
+
+		record.Target = []byte(target)
+	}
+
+	if err := enc.Encode(DumpRecord{Inode: record}); err != nil {
+		return err
+	}
+
+	if entry != nil {
+		if err := enc.Encode(DumpRecord{Entry: entry}); err != nil {
+			return err
+		}
+	}
+
+	if inode.Mode.IsRegular() {
+		chunks, err := db.Chunks(ctx, inode.ID)
+		if err != nil {
+			return err
+		}
+
+		for _, chunk := range *chunks {
+			if chunk.IsHole() {
+				continue
+			}
+
+			err = enc.Encode(DumpRecord{Chunk: &DumpChunk{
+				Inode:        inode.ID,
+				InodeOffset:  chunk.InodeOffset,
+				Storage:      chunk.Storage,
+				Key:          chunk.Key,
+				ObjectOffset: chunk.ObjectOffset,
+				Size:         chunk.Size,
+				Hash:         chunk.Hash,
+				Checksum:     chunk.Checksum,
+			}})
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	attrs, err := db.GetAllXattr(ctx, inode.ID)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err = enc.Encode(DumpRecord{Xattr: &DumpXattr{Inode: inode.ID, Name: []byte(name), Value: attrs[name]}}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// importedInode is an inode found within a dump, along with the id it was
+// given once created
+type importedInode struct {
+	DumpInode
+	newID   fuseops.InodeID
+	created bool
+}
+
+// Import recreates the contents of a dump written by Export within the
+// given database, below its root. Inodes are given new ids, entries and
+// chunks being remapped accordingly, and the root inode takes the
+// attributes of the dumped one. Times are restored once everything is in
+// place, keeping track of every imported inode until then. Drivers can
+// implement their Import method with it.
+func Import(ctx context.Context, db Db, r io.Reader) error {
+	dec := json.NewDecoder(r)
+
+	record := DumpRecord{}
+	if err := dec.Decode(&record); err != nil {
+		return err
+	}
+
+	if record.Version != DumpVersion {
+		return errDumpVersion
+	}
+
+	inodes := make(map[fuseops.InodeID]*importedInode)
+	order := make([]*importedInode, 0)
+
+	for {
+		record = DumpRecord{}
+		if err := dec.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		switch {
+		case record.Inode != nil:
+			in := &importedInode{DumpInode: *record.Inode}
+			if len(inodes) == 0 {
+				in.newID = fuseops.RootInodeID
+				in.created = true
+
+				mode := in.Mode
+				if _, err := db.Touch(ctx, in.newID, nil, &mode, nil, nil, &in.Uid, &in.Gid); err != nil {
+					return err
+				}
+			}
+
+			inodes[in.ID] = in
+			order = append(order, in)
+
+		case record.Entry != nil:
+			in, parent := inodes[record.Entry.Inode], inodes[record.Entry.Parent]
+			if in == nil || parent == nil || !parent.created {
+				return errDumpMalformed
+			}
+
+			if in.created {
+				if _, err := db.Link(ctx, in.newID, parent.newID, string(record.Entry.Name)); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			entry, err := db.Create(ctx, Entry{
+				Parent: parent.newID,
+				Name:   string(record.Entry.Name),
+				Inode: Inode{
+					SymLink: string(in.Target),
+					Rdev:    in.Rdev,
+					InodeAttributes: fuseops.InodeAttributes{
+						Mode:   in.Mode,
+						Uid:    in.Uid,
+						Gid:    in.Gid,
+						Atime:  in.Atime,
+						Mtime:  in.Mtime,
+						Ctime:  in.Ctime,
+						Crtime: in.Crtime,
+					},
+				},
+			})
+
+			if err != nil {
+				return err
+			}
+
+			in.newID = entry.ID
+			in.created = true
+
+		case record.Chunk != nil:
+			in := inodes[record.Chunk.Inode]
+			if in == nil || !in.created {
+				return errDumpMalformed
+			}
+
+			err := db.AddChunk(ctx, in.newID, 0, Chunk{
+				Inode:       in.newID,
+				InodeOffset: record.Chunk.InodeOffset,
+				Chunk: storage.Chunk{
+					Storage:      record.Chunk.Storage,
+					Key:          record.Chunk.Key,
+					ObjectOffset: record.Chunk.ObjectOffset,
+					Size:         record.Chunk.Size,
+				},
+				Hash:     record.Chunk.Hash,
+				Checksum: record.Chunk.Checksum,
+			})
+
+			if err != nil {
+				return err
+			}
+
+		case record.Xattr != nil:
+			in := inodes[record.Xattr.Inode]
+			if in == nil || !in.created {
+				return errDumpMalformed
+			}
+
+			if err := db.SetXattr(ctx, in.newID, string(record.Xattr.Name), record.Xattr.Value, 0); err != nil {
+				return err
+			}
+
+		default:
+			return errDumpMalformed
+		}
+	}
+
+	for _, in := range order {
+		if !in.created {
+			return errDumpMalformed
+		}
+
+		var size *uint64
+		if in.Mode.IsRegular() {
+			size = &in.Size
+		}
+
+		if _, err := db.Touch(ctx, in.newID, size, nil, &in.Atime, &in.Mtime, nil, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
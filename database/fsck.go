@@ -0,0 +1,101 @@
+package database
+
+import (
+	"sort"
+
+	"github.com/manvalls/fuse/fuseops"
+)
+
+// Link is an entry of the file system as stored, without the attributes of
+// the inode it points to
+type Link struct {
+	Parent fuseops.InodeID
+	Name   string
+	Inode  fuseops.InodeID
+}
+
+// RefcountMismatch describes an inode whose stored reference count doesn't
+// match the amount of entries pointing to it
+type RefcountMismatch struct {
+	Inode    fuseops.InodeID
+	Refcount uint64
+	Links    uint64
+}
+
+// FsckReport lists the problems found while checking the file system
+type FsckReport struct {
+	// Refcounts lists the inodes with a wrong reference count, they're fixed
+	// when repairing
+	Refcounts []RefcountMismatch
+
+	// Dangling lists the entries whose parent or inode doesn't exist
+	Dangling []Link
+
+	// Unreachable lists the inodes which are still referenced but can't be
+	// reached from the root
+	Unreachable []fuseops.InodeID
+
+	// Repaired is set if the reference counts were fixed
+	Repaired bool
+}
+
+// Clean checks whether no problem was found
+func (r FsckReport) Clean() bool {
+	return len(r.Refcounts) == 0 && len(r.Dangling) == 0 && len(r.Unreachable) == 0
+}
+
+// NewFsckReport checks the given reference counts, keyed by inode, against
+// the stored entries. The root is expected to hold an extra reference.
+func NewFsckReport(refcounts map[fuseops.InodeID]uint64, links []Link) *FsckReport {
+	report := &FsckReport{
+		Refcounts:   make([]RefcountMismatch, 0),
+		Dangling:    make([]Link, 0),
+		Unreachable: make([]fuseops.InodeID, 0),
+	}
+
+	counts := map[fuseops.InodeID]uint64{fuseops.RootInodeID: 1}
+	children := make(map[fuseops.InodeID][]fuseops.InodeID)
+
+	for _, link := range links {
+		counts[link.Inode]++
+
+		_, parentOk := refcounts[link.Parent]
+		_, inodeOk := refcounts[link.Inode]
+		if !parentOk || !inodeOk {
+			report.Dangling = append(report.Dangling, link)
+			continue
+		}
+
+		children[link.Parent] = append(children[link.Parent], link.Inode)
+	}
+
+	reachable := map[fuseops.InodeID]bool{fuseops.RootInodeID: true}
+	pending := []fuseops.InodeID{fuseops.RootInodeID}
+
+	for len(pending) > 0 {
+		inode := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		for _, child := range children[inode] {
+			if !reachable[child] {
+				reachable[child] = true
+				pending = append(pending, child)
+			}
+		}
+	}
+
+	for inode, refcount := range refcounts {
+		if refcount != counts[inode] {
+			report.Refcounts = append(report.Refcounts, RefcountMismatch{inode, refcount, counts[inode]})
+		}
+
+		if refcount > 0 && !reachable[inode] {
+			report.Unreachable = append(report.Unreachable, inode)
+		}
+	}
+
+	sort.Slice(report.Refcounts, func(i, j int) bool { return report.Refcounts[i].Inode < report.Refcounts[j].Inode })
+	sort.Slice(report.Unreachable, func(i, j int) bool { return report.Unreachable[i] < report.Unreachable[j] })
+
+	return report
+}
@@ -0,0 +1,26 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFsckReport(t *testing.T) {
+	report := NewFsckReport(map[fuseops.InodeID]uint64{1: 1, 2: 1, 3: 1, 4: 1, 7: 0}, []Link{
+		{1, "dir", 2},
+		{2, "file", 3},
+		{2, "missing", 5},
+		{4, "loop", 4},
+		{6, "orphan", 3},
+	})
+
+	assert.Equal(t, []RefcountMismatch{{Inode: 3, Refcount: 1, Links: 2}}, report.Refcounts)
+	assert.Equal(t, []Link{{2, "missing", 5}, {6, "orphan", 3}}, report.Dangling)
+	assert.Equal(t, []fuseops.InodeID{4}, report.Unreachable)
+	assert.False(t, report.Clean())
+
+	report = NewFsckReport(map[fuseops.InodeID]uint64{1: 1, 2: 1}, []Link{{1, "file", 2}})
+	assert.True(t, report.Clean())
+}
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/manvalls/titan/storage"
+)
+
+// HealthKey is the key of the object looked up by HealthCheck to reach the
+// storage, which needn't exist
+const HealthKey = "titan-health-check"
+
+// ComponentHealth is the status of a component of the file system
+type ComponentHealth struct {
+	Healthy bool
+	Latency time.Duration
+	Err     error
+}
+
+// Health is the status of the database and the storage of a file system
+type Health struct {
+	Database ComponentHealth
+	Storage  ComponentHealth
+}
+
+// Healthy tells whether every component is healthy
+func (h Health) Healthy() bool {
+	return h.Database.Healthy && h.Storage.Healthy
+}
+
+// HealthCheck pings the database and looks up the HealthKey object at the
+// storage at once, reporting as unhealthy the components which fail or don't
+// answer before the context is done
+func HealthCheck(ctx context.Context, db Db, st storage.Storage) Health {
+	dbHealth := make(chan ComponentHealth, 1)
+	go func() {
+		dbHealth <- checkHealth(ctx, func() error {
+			return db.Ping(ctx)
+		})
+	}()
+
+	stHealth := checkHealth(ctx, func() error {
+		_, err := storage.Exists(st, storage.Chunk{Key: HealthKey})
+		return err
+	})
+
+	return Health{
+		Database: <-dbHealth,
+		Storage:  stHealth,
+	}
+}
+
+// checkHealth runs the given check, giving up once the context is done
+func checkHealth(ctx context.Context, check func() error) ComponentHealth {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- check()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	return ComponentHealth{
+		Healthy: err == nil,
+		Latency: time.Since(start),
+		Err:     err,
+	}
+}
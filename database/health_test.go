@@ -0,0 +1,74 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/manvalls/titan/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+type pingDb struct {
+	Db
+	err error
+}
+
+func (d pingDb) Ping(ctx context.Context) error {
+	return d.err
+}
+
+type existsStorage struct {
+	storage.Storage
+	err   error
+	block chan struct{}
+}
+
+func (s existsStorage) GetReadCloser(chunk storage.Chunk) (io.ReadCloser, error) {
+	return nil, errors.New("unexpected read")
+}
+
+func (s existsStorage) Exists(chunk storage.Chunk) (bool, error) {
+	if s.block != nil {
+		<-s.block
+	}
+
+	return false, s.err
+}
+
+func TestHealthCheck(t *testing.T) {
+	health := HealthCheck(context.Background(), pingDb{}, existsStorage{})
+	assert.True(t, health.Healthy())
+	assert.True(t, health.Database.Healthy)
+	assert.True(t, health.Storage.Healthy)
+
+	dbErr := errors.New("connection refused")
+	health = HealthCheck(context.Background(), pingDb{err: dbErr}, existsStorage{})
+	assert.False(t, health.Healthy())
+	assert.False(t, health.Database.Healthy)
+	assert.Equal(t, dbErr, health.Database.Err)
+	assert.True(t, health.Storage.Healthy)
+
+	stErr := errors.New("access denied")
+	health = HealthCheck(context.Background(), pingDb{}, existsStorage{err: stErr})
+	assert.False(t, health.Healthy())
+	assert.True(t, health.Database.Healthy)
+	assert.False(t, health.Storage.Healthy)
+	assert.Equal(t, stErr, health.Storage.Err)
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	health := HealthCheck(ctx, pingDb{}, existsStorage{block: block})
+	assert.True(t, health.Database.Healthy)
+	assert.False(t, health.Storage.Healthy)
+	assert.Equal(t, context.DeadlineExceeded, health.Storage.Err)
+	assert.True(t, health.Storage.Latency >= 50*time.Millisecond)
+}
@@ -0,0 +1,174 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	gomath "math"
+
+	"github.com/manvalls/fuse/fuseops"
+)
+
+// LockType is the type of an advisory lock
+type LockType uint32
+
+// Types of advisory locks, matching the ones of fcntl
+const (
+	// LockUnlock releases the locks held over a range
+	LockUnlock LockType = iota
+
+	// LockRead is a shared lock, which many owners may hold at once
+	LockRead
+
+	// LockWrite is an exclusive lock, conflicting with any other one
+	LockWrite
+)
+
+// Lock is an advisory lock held over a byte range of an inode
+type Lock struct {
+	Inode fuseops.InodeID
+
+	// Owner identifies the holder of the lock among every client of the file
+	// system, so that clients must pick owners not colliding with the ones of
+	// the rest of them
+	Owner uint64
+
+	// Start is the first locked byte, Length being the amount of locked ones
+	// or zero if the lock reaches the end of the file however it grows
+	Start  uint64
+	Length uint64
+
+	Type LockType
+}
+
+// End returns the first byte past the locked range
+func (l Lock) End() uint64 {
+	end := l.Start + l.Length
+	if l.Length == 0 || end < l.Start || end > gomath.MaxInt64 {
+		return gomath.MaxInt64
+	}
+
+	return end
+}
+
+// Valid tells whether the lock has a known type and a range which can be
+// stored
+func (l Lock) Valid() bool {
+	return l.Type <= LockWrite && l.Start < gomath.MaxInt64
+}
+
+// Conflicts tells whether the lock prevents the given one from being taken
+func (l Lock) Conflicts(other Lock) bool {
+	return l.Owner != other.Owner &&
+		l.Start < other.End() && other.Start < l.End() &&
+		(l.Type == LockWrite || other.Type == LockWrite)
+}
+
+// Conflicting returns the first of the given locks preventing the given one
+// from being taken, if any
+func Conflicting(held []Lock, lock Lock) *Lock {
+	if lock.Type == LockUnlock {
+		return nil
+	}
+
+	for _, l := range held {
+		if l.Conflicts(lock) {
+			return &l
+		}
+	}
+
+	return nil
+}
+
+// Release returns the parts of the given locks, overlapping the given one,
+// lying outside of its range, which remain held once it's taken or released
+func Release(held []Lock, lock Lock) []Lock {
+	remaining := make([]Lock, 0)
+	for _, l := range held {
+		if l.Start < lock.Start {
+			before := l
+			before.Length = lock.Start - l.Start
+			remaining = append(remaining, before)
+		}
+
+		if l.End() > lock.End() {
+			after := l
+			after.Start = lock.End()
+			if l.Length != 0 {
+				after.Length = l.End() - lock.End()
+			}
+
+			remaining = append(remaining, after)
+		}
+	}
+
+	return remaining
+}
+
+// ScanLocks reads the locks of an inode from the given rows, made of an
+// owner, a start, an end and a type. Owners are stored as signed integers,
+// so that they fit in the columns of every database. Rows are always closed.
+func ScanLocks(rows *sql.Rows, inode fuseops.InodeID) ([]Lock, error) {
+	locks := make([]Lock, 0)
+
+	for rows.Next() {
+		var owner int64
+		var end uint64
+
+		lock := Lock{Inode: inode}
+		if err := rows.Scan(&owner, &lock.Start, &end, &lock.Type); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		lock.Owner = uint64(owner)
+		if end < gomath.MaxInt64 {
+			lock.Length = end - lock.Start
+		}
+
+		locks = append(locks, lock)
+	}
+
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return locks, nil
+}
+
+// Locker is implemented by drivers able to hold named locks shared by every
+// client of the database, e.g so that a single one of them runs a task at once
+type Locker interface {
+	// TryLock takes the named lock unless another client holds it, returning
+	// the function releasing it, or nil if it's held elsewhere. Locks are
+	// released too once the client disconnects.
+	TryLock(ctx context.Context, name string) (func(), error)
+}
+
+// TryLock takes the named lock of the given database if it implements
+// Locker, the lock being always granted otherwise
+func TryLock(ctx context.Context, db Db, name string) (func(), error) {
+	if l, ok := db.(Locker); ok {
+		return l.TryLock(ctx, name)
+	}
+
+	return func() {}, nil
+}
+
+// Expirer is implemented by databases holding entries which expire on their
+// own, e.g the trash, so that garbage collections remove them. Removing them
+// must be safe while the file system is mounted.
+type Expirer interface {
+	// PurgeExpired removes the entries whose time has passed
+	PurgeExpired(ctx context.Context) error
+}
+
+// PurgeExpired removes the expired entries of the given database if it
+// implements Expirer, doing nothing otherwise
+func PurgeExpired(ctx context.Context, db Db) error {
+	if e, ok := db.(Expirer); ok {
+		return e.PurgeExpired(ctx)
+	}
+
+	return nil
+}
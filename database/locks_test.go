@@ -0,0 +1,40 @@
+package database
+
+import (
+	gomath "math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelease(t *testing.T) {
+	held := []Lock{
+		{Owner: 1, Start: 0, Length: 100, Type: LockRead},
+		{Owner: 1, Start: 150, Length: 0, Type: LockWrite},
+	}
+
+	assert.Equal(t, []Lock{
+		{Owner: 1, Start: 0, Length: 20, Type: LockRead},
+		{Owner: 1, Start: 30, Length: 70, Type: LockRead},
+	}, Release(held[:1], Lock{Owner: 1, Start: 20, Length: 10}))
+
+	assert.Equal(t, []Lock{
+		{Owner: 1, Start: 0, Length: 50, Type: LockRead},
+		{Owner: 1, Start: 200, Length: 0, Type: LockWrite},
+	}, Release(held, Lock{Owner: 1, Start: 50, Length: 150}))
+
+	assert.Empty(t, Release(held, Lock{Owner: 1, Start: 0, Length: 0}))
+}
+
+func TestConflicts(t *testing.T) {
+	write := Lock{Owner: 1, Start: 10, Length: 10, Type: LockWrite}
+
+	assert.True(t, write.Conflicts(Lock{Owner: 2, Start: 19, Length: 0, Type: LockRead}))
+	assert.False(t, write.Conflicts(Lock{Owner: 2, Start: 20, Length: 0, Type: LockWrite}))
+	assert.False(t, write.Conflicts(Lock{Owner: 1, Start: 10, Length: 10, Type: LockWrite}))
+	assert.False(t, Lock{Owner: 1, Type: LockRead}.Conflicts(Lock{Owner: 2, Type: LockRead}))
+
+	assert.Equal(t, uint64(gomath.MaxInt64), Lock{Start: 10}.End())
+	assert.Equal(t, uint64(gomath.MaxInt64), Lock{Start: 10, Length: gomath.MaxUint64}.End())
+	assert.False(t, Lock{Type: LockWrite + 1}.Valid())
+}
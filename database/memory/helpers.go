@@ -0,0 +1,752 @@
+package memory
+
+import (
+	"context"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database"
+	"github.com/manvalls/titan/math"
+	"github.com/manvalls/titan/storage"
+)
+
+// inode is a stored inode, whose Nlink holds the amount of entries pointing
+// to it just like the refcount column of SQL drivers
+type inode struct {
+	database.Inode
+
+	flags       uint32
+	retainUntil *time.Time
+
+	links  map[entry]bool
+	chunks map[uint64]*chunk
+	xattrs map[string][]byte
+	locks  []database.Lock
+}
+
+// entry is the location of a link to an inode
+type entry struct {
+	parent fuseops.InodeID
+	name   string
+}
+
+// chunk is a stored chunk, orphaned if it doesn't belong to any inode
+type chunk struct {
+	database.Chunk
+	orphanDate time.Time
+}
+
+func newInode(attrs database.Inode) *inode {
+	return &inode{
+		Inode:  attrs,
+		links:  make(map[entry]bool),
+		chunks: make(map[uint64]*chunk),
+		xattrs: make(map[string][]byte),
+	}
+}
+
+// attributes returns a copy of the stored attributes
+func (in *inode) attributes() database.Inode {
+	return in.Inode
+}
+
+// immutable tells whether the inode is immutable at the given time
+func (in *inode) immutable(now time.Time) bool {
+	return database.IsImmutable(in.flags, in.retainUntil, now)
+}
+
+// orphan tells whether the inode has no links left and isn't held by the
+// handle that created it anonymously, unless it's deemed leaked at the given
+// time, so that CleanOrphanInodes removes it
+func (in *inode) orphan(now time.Time) bool {
+	return in.Nlink == 0 && (in.flags&database.InodeAnonymous == 0 || in.Ctime.Before(now.Add(-database.AnonymousTimeout)))
+}
+
+// chunksInRange lists the chunks of the inode overlapping the given range,
+// sorted by their offset
+func (in *inode) chunksInRange(start uint64, end uint64) []*chunk {
+	chunks := make([]*chunk, 0)
+	for _, c := range in.chunks {
+		if c.InodeOffset < end && c.InodeOffset+c.Size > start {
+			chunks = append(chunks, c)
+		}
+	}
+
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].InodeOffset < chunks[j].InodeOffset
+	})
+
+	return chunks
+}
+
+// orphaned tells whether the chunk was orphaned before the given threshold
+func (c *chunk) orphaned(threshold time.Time) bool {
+	return c.Inode == 0 && c.orphanDate.Before(threshold)
+}
+
+// now returns the current time as stored by the driver
+func now() time.Time {
+	return time.Now().In(time.UTC)
+}
+
+// timeOrNow returns the given time in UTC, or the current one if it's the
+// zero time
+func timeOrNow(t time.Time, current time.Time) time.Time {
+	if t.IsZero() {
+		return current
+	}
+
+	return t.In(time.UTC)
+}
+
+// zeroChunk returns a chunk filling the given range of an inode with zeros
+func zeroChunk(offset uint64, size uint64) database.Chunk {
+	return database.Chunk{
+		InodeOffset: offset,
+		Chunk:       storage.Chunk{Storage: database.ZeroStorage, Size: size},
+	}
+}
+
+// growth computes the amount of bytes the inode grows by when writing the
+// given chunk
+func growth(in *inode, chunk database.Chunk) int64 {
+	return int64(math.Max(in.Size, chunk.InodeOffset+chunk.Size) - in.Size)
+}
+
+// begin takes the lock for a write, failing if the context is already done
+// as starting a transaction would
+func (d *Driver) begin(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	return nil
+}
+
+// commit releases the lock taken by begin, reporting the operations audited
+// while holding it once it's no longer held
+func (d *Driver) commit(ctx context.Context) {
+	events := d.events
+	d.events = nil
+	d.mutex.Unlock()
+
+	for _, e := range events {
+		database.Audit(ctx, d.AuditHook, e.Op, e.Inode, e.Uid, e.Gid)
+	}
+}
+
+// audit records an operation on the given inode to be reported by commit
+func (d *Driver) audit(op database.AuditOp, in *inode) {
+	if d.AuditHook == nil {
+		return
+	}
+
+	d.events = append(d.events, database.AuditEvent{Op: op, Inode: in.ID, Uid: in.Uid, Gid: in.Gid})
+}
+
+// reset replaces the file system with one holding just the root
+func (d *Driver) reset() {
+	t := now()
+
+	root := newInode(database.Inode{
+		ID: fuseops.RootInodeID,
+		InodeAttributes: fuseops.InodeAttributes{
+			Mode:   os.ModeDir | 0777,
+			Nlink:  1,
+			Atime:  t,
+			Mtime:  t,
+			Ctime:  t,
+			Crtime: t,
+		},
+	})
+
+	d.inodes = map[fuseops.InodeID]*inode{fuseops.RootInodeID: root}
+	d.entries = make(map[fuseops.InodeID]map[string]fuseops.InodeID)
+	d.chunks = make(map[uint64]*chunk)
+	d.quotas = make(map[quotaOwner]*database.Quota)
+	d.stats = database.Stats{Inodes: 1}
+	d.lastInode = fuseops.RootInodeID
+	d.lastChunk = 0
+}
+
+// checkDir fails with ENOENT if the given inode doesn't exist, and with
+// ENOTDIR if it's not a directory
+func (d *Driver) checkDir(id fuseops.InodeID) error {
+	in := d.inodes[id]
+	if in == nil {
+		return syscall.ENOENT
+	}
+
+	if !in.Mode.IsDir() {
+		return syscall.ENOTDIR
+	}
+
+	return nil
+}
+
+// createInode adds a new inode with the given attributes and reference
+// count, updating the stats and the quotas of its owners
+func (d *Driver) createInode(attrs database.Inode, refcount uint32) (*inode, error) {
+	if err := d.checkQuota(attrs.Uid, attrs.Gid, 0, 1); err != nil {
+		return nil, err
+	}
+
+	d.addUsage(attrs.Uid, attrs.Gid, 0, 1)
+	d.stats.Inodes++
+	d.lastInode++
+
+	t := now()
+	in := newInode(database.Inode{
+		ID:      d.lastInode,
+		SymLink: attrs.SymLink,
+		Rdev:    attrs.Rdev,
+		InodeAttributes: fuseops.InodeAttributes{
+			Mode:   attrs.Mode,
+			Uid:    attrs.Uid,
+			Gid:    attrs.Gid,
+			Nlink:  refcount,
+			Atime:  timeOrNow(attrs.Atime, t),
+			Mtime:  timeOrNow(attrs.Mtime, t),
+			Ctime:  timeOrNow(attrs.Ctime, t),
+			Crtime: timeOrNow(attrs.Crtime, t),
+		},
+	})
+
+	d.inodes[in.ID] = in
+	return in, nil
+}
+
+// copyInode adds a new inode with the attributes, chunks and extended
+// attributes of the given one, sharing its storage objects
+func (d *Driver) copyInode(in *inode, refcount uint32) (*inode, error) {
+	copied, err := d.createInode(in.attributes(), refcount)
+	if err != nil {
+		return nil, err
+	}
+
+	copied.Size = in.Size
+	d.addUsage(in.Uid, in.Gid, int64(in.Size), 0)
+	d.stats.Size += in.Size
+
+	for _, c := range in.chunks {
+		d.insertChunk(copied, c.Chunk)
+	}
+
+	for key, value := range in.xattrs {
+		copied.xattrs[key] = append([]byte{}, value...)
+	}
+
+	return copied, nil
+}
+
+// stat returns the attributes of an inode as reported to the file system.
+// Directories still linked count their entry, their own "." entry and the
+// ".." entries of their subdirectories.
+func (d *Driver) stat(in *inode) database.Inode {
+	result := in.attributes()
+	result.SymLink = ""
+
+	if in.Mode.IsDir() && in.Nlink > 0 {
+		result.Nlink = 2
+		for _, child := range d.entries[in.ID] {
+			if c := d.inodes[child]; c != nil && c.Mode.IsDir() {
+				result.Nlink++
+			}
+		}
+	}
+
+	return result
+}
+
+// names lists the names of the entries under the given parent, sorted
+func (d *Driver) names(parent fuseops.InodeID) []string {
+	names := make([]string, 0, len(d.entries[parent]))
+	for name := range d.entries[parent] {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// linkEntry adds an entry pointing to the given inode, leaving its
+// reference count untouched
+func (d *Driver) linkEntry(parent fuseops.InodeID, name string, id fuseops.InodeID) {
+	if d.entries[parent] == nil {
+		d.entries[parent] = make(map[string]fuseops.InodeID)
+	}
+
+	d.entries[parent][name] = id
+	if in := d.inodes[id]; in != nil {
+		in.links[entry{parent, name}] = true
+	}
+}
+
+// unlinkEntry removes an entry, if it exists, leaving the reference count
+// of the inode it points to untouched
+func (d *Driver) unlinkEntry(parent fuseops.InodeID, name string) {
+	id, ok := d.entries[parent][name]
+	if !ok {
+		return
+	}
+
+	delete(d.entries[parent], name)
+	if len(d.entries[parent]) == 0 {
+		delete(d.entries, parent)
+	}
+
+	if in := d.inodes[id]; in != nil {
+		delete(in.links, entry{parent, name})
+	}
+}
+
+// unlink removes an entry, failing if it's a non-empty directory or an
+// immutable inode, and returns the inode it pointed to
+func (d *Driver) unlink(parent fuseops.InodeID, name string) (fuseops.InodeID, error) {
+	id, ok := d.entries[parent][name]
+	if !ok {
+		return 0, syscall.ENOENT
+	}
+
+	if len(d.entries[id]) > 0 {
+		return 0, syscall.ENOTEMPTY
+	}
+
+	in := d.inodes[id]
+	if in != nil && in.immutable(time.Now()) {
+		return 0, syscall.EPERM
+	}
+
+	d.unlinkEntry(parent, name)
+	if in != nil {
+		in.Nlink--
+	}
+
+	return id, nil
+}
+
+// forget removes those of the given inodes which have no links left,
+// orphaning their chunks and updating the stats and the quotas of their
+// owners
+func (d *Driver) forget(inodes []fuseops.InodeID) {
+	total := database.Stats{}
+
+	for _, id := range inodes {
+		in := d.inodes[id]
+		if in == nil || in.Nlink != 0 {
+			continue
+		}
+
+		for _, c := range in.chunks {
+			d.orphanChunk(c)
+		}
+
+		delete(d.inodes, id)
+		d.addUsage(in.Uid, in.Gid, -int64(in.Size), -1)
+
+		total.Inodes++
+		total.Size += in.Size
+	}
+
+	// the stats are clamped so that a drifted counter never underflows,
+	// the root being always counted
+	d.stats.Size -= math.Min(d.stats.Size, total.Size)
+	d.stats.Inodes -= math.Min(d.stats.Inodes-1, total.Inodes)
+}
+
+// checkForget fails with EROFS if forgetting any of the given inodes would
+// remove it, as read-only drivers can't
+func (d *Driver) checkForget(inodes []fuseops.InodeID) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, id := range inodes {
+		if in := d.inodes[id]; in != nil && in.Nlink == 0 {
+			return syscall.EROFS
+		}
+	}
+
+	return nil
+}
+
+// isAncestor checks whether the given inode is the provided directory or
+// one of its ancestors
+func (d *Driver) isAncestor(inode fuseops.InodeID, dir fuseops.InodeID) bool {
+	for dir != inode {
+		if dir == fuseops.RootInodeID {
+			return false
+		}
+
+		in := d.inodes[dir]
+		if in == nil || len(in.links) == 0 {
+			return false
+		}
+
+		for link := range in.links {
+			dir = link.parent
+			break
+		}
+	}
+
+	return true
+}
+
+// touchAtime updates the access time of an inode being read according to
+// the atime policy of the driver
+func (d *Driver) touchAtime(in *inode) {
+	if d.ReadOnly {
+		return
+	}
+
+	t := now()
+
+	switch d.Atime {
+	case database.NoAtime:
+	case database.RelAtime:
+		if !in.Atime.After(in.Mtime) || !in.Atime.After(in.Ctime) || in.Atime.Before(t.Add(-24*time.Hour)) {
+			in.Atime = t
+		}
+	default:
+		in.Atime = t
+	}
+}
+
+// insertChunk adds a new chunk to the given inode
+func (d *Driver) insertChunk(in *inode, c database.Chunk) {
+	d.lastChunk++
+	c.ID = d.lastChunk
+	c.Inode = in.ID
+
+	stored := &chunk{Chunk: c}
+	d.chunks[c.ID] = stored
+	in.chunks[c.ID] = stored
+}
+
+// liveChunks lists the live chunks of the given inode, or of every inode if
+// it's zero, sorted by id. The lock is held just while listing them, so that
+// their objects can be checked without blocking other operations.
+func (d *Driver) liveChunks(inode fuseops.InodeID) []database.Chunk {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	chunks := make([]database.Chunk, 0)
+	for _, c := range d.chunks {
+		if c.Inode != 0 && (inode == 0 || c.Inode == inode) {
+			chunks = append(chunks, c.Chunk)
+		}
+	}
+
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].ID < chunks[j].ID
+	})
+
+	return chunks
+}
+
+// orphanChunk takes a chunk out of its inode, so that its object is
+// eventually removed
+func (d *Driver) orphanChunk(c *chunk) {
+	if in := d.inodes[c.Inode]; in != nil {
+		delete(in.chunks, c.ID)
+	}
+
+	c.Inode = 0
+	c.ObjectOffset = 0
+	c.InodeOffset = 0
+	c.Size = 0
+	c.orphanDate = now()
+}
+
+// replaceChunks replaces the given chunks of an inode with a new one, as
+// long as none of them changed
+func (d *Driver) replaceChunks(ctx context.Context, old []database.Chunk, c database.Chunk) (bool, error) {
+	if err := d.begin(ctx); err != nil {
+		return false, err
+	}
+
+	defer d.mutex.Unlock()
+
+	in := d.inodes[c.Inode]
+	if in == nil {
+		return false, syscall.ENOENT
+	}
+
+	stored := make([]*chunk, 0, len(old))
+	for _, o := range old {
+		s := in.chunks[o.ID]
+		if s == nil || s.Chunk != o {
+			return false, nil
+		}
+
+		stored = append(stored, s)
+	}
+
+	for _, s := range stored {
+		d.orphanChunk(s)
+	}
+
+	d.insertChunk(in, c)
+	return true, nil
+}
+
+// orphanObject adds an orphaned chunk pointing to the given object, so that
+// it's removed once no chunk references it
+func (d *Driver) orphanObject(storageName string, key string) {
+	d.lastChunk++
+	d.chunks[d.lastChunk] = &chunk{
+		Chunk: database.Chunk{
+			ID:    d.lastChunk,
+			Chunk: storage.Chunk{Storage: storageName, Key: key},
+		},
+		orphanDate: now(),
+	}
+}
+
+// orphanObjects lists the objects of the chunks orphaned before a threshold
+// which no live chunk references anymore
+func (d *Driver) orphanObjects(threshold time.Time) []storage.Chunk {
+	live := make(map[storage.Chunk]bool)
+	for _, c := range d.chunks {
+		if c.Inode != 0 {
+			live[storage.Chunk{Storage: c.Storage, Key: c.Key}] = true
+		}
+	}
+
+	objects := make([]storage.Chunk, 0)
+	for _, c := range d.chunks {
+		object := storage.Chunk{Storage: c.Storage, Key: c.Key}
+		if c.orphaned(threshold) && !live[object] {
+			live[object] = true
+			objects = append(objects, object)
+		}
+	}
+
+	return objects
+}
+
+// truncate resizes an inode, filling the new space with zeros when growing
+// it, and trimming or orphaning the chunks past the new size when shrinking
+// it. The stats are updated, but not the quotas of its owners.
+func (d *Driver) truncate(in *inode, size uint64) {
+	if size > in.Size {
+		for _, c := range database.ZeroFill(in.Size, size, d.BlockSize) {
+			d.insertChunk(in, c)
+		}
+
+		d.stats.Size += size - in.Size
+		in.Size = size
+		return
+	}
+
+	var freed uint64
+	for _, c := range in.chunks {
+		if c.InodeOffset+c.Size <= size {
+			continue
+		}
+
+		if c.InodeOffset < size {
+			freed += c.Size - (size - c.InodeOffset)
+			c.Size = size - c.InodeOffset
+			c.Hash = ""
+			c.Checksum = ""
+		} else {
+			freed += c.Size
+			d.orphanChunk(c)
+		}
+	}
+
+	d.stats.Size -= math.Min(d.stats.Size, freed)
+	in.Size = size
+}
+
+// writeChunk adds a chunk to an inode, trimming or orphaning the chunks it
+// overlaps and filling any hole before it with zeros. The stats and the
+// quotas of its owners are updated, which must have been checked before.
+func (d *Driver) writeChunk(in *inode, c database.Chunk) {
+	end := c.InodeOffset + c.Size
+	tails := make([]database.Chunk, 0)
+
+	if in.Size < c.InodeOffset {
+		for _, zero := range database.ZeroFill(in.Size, c.InodeOffset, d.BlockSize) {
+			d.insertChunk(in, zero)
+		}
+	}
+
+	for _, old := range in.chunksInRange(c.InodeOffset, end) {
+		if old.InodeOffset >= c.InodeOffset && old.InodeOffset+old.Size <= end {
+			d.orphanChunk(old)
+			continue
+		}
+
+		var newInodeOffset, newInodeEnd uint64
+
+		// The chunk lies within old, whose tail is kept as a new chunk
+		// pointing further into the same object, while old itself is trimmed
+		// down to its head below
+		if old.InodeOffset < c.InodeOffset && old.InodeOffset+old.Size > end {
+			tails = append(tails, database.Chunk{
+				InodeOffset: end,
+				Chunk: storage.Chunk{
+					Storage:      old.Storage,
+					Key:          old.Key,
+					ObjectOffset: old.ObjectOffset + end - old.InodeOffset,
+					Size:         old.InodeOffset + old.Size - end,
+				},
+			})
+		}
+
+		if old.InodeOffset < c.InodeOffset {
+			newInodeOffset = old.InodeOffset
+			newInodeEnd = c.InodeOffset
+		} else {
+			newInodeOffset = end
+			newInodeEnd = old.InodeOffset + old.Size
+		}
+
+		old.ObjectOffset += newInodeOffset - old.InodeOffset
+		old.InodeOffset = newInodeOffset
+		old.Size = newInodeEnd - old.InodeOffset
+		old.Hash = ""
+		old.Checksum = ""
+	}
+
+	d.insertChunk(in, c)
+	for _, tail := range tails {
+		d.insertChunk(in, tail)
+	}
+
+	if newInodeSize := math.Max(in.Size, end); newInodeSize != in.Size {
+		d.addUsage(in.Uid, in.Gid, int64(newInodeSize-in.Size), 0)
+		d.stats.Size += newInodeSize - in.Size
+		in.Size = newInodeSize
+	}
+}
+
+// dedup points the given chunk to an object already holding the same data,
+// if any, orphaning the object it pointed to so that it's eventually removed
+func (d *Driver) dedup(c *database.Chunk) {
+	var existing *chunk
+	for _, stored := range d.chunks {
+		if stored.Inode != 0 && stored.Hash == c.Hash && stored.Size == c.Size && (existing == nil || stored.ID < existing.ID) {
+			existing = stored
+		}
+	}
+
+	if existing == nil || existing.Storage == c.Storage && existing.Key == c.Key {
+		return
+	}
+
+	d.orphanObject(c.Storage, c.Key)
+	c.Chunk = storage.Chunk{
+		Storage:      existing.Storage,
+		Key:          existing.Key,
+		ObjectOffset: existing.ObjectOffset,
+		Size:         c.Size,
+	}
+}
+
+// Kinds of owners a quota may apply to
+const (
+	userQuota  = 0
+	groupQuota = 1
+)
+
+// quotaOwner is a user or a group a quota applies to
+type quotaOwner struct {
+	kind int
+	id   uint32
+}
+
+// owns tells whether the given inode counts towards the quota of the owner
+func (o quotaOwner) owns(in *inode) bool {
+	if o.kind == userQuota {
+		return in.Uid == o.id
+	}
+
+	return in.Gid == o.id
+}
+
+// quotaOwners lists the owners among the provided user and group
+func quotaOwners(uid *uint32, gid *uint32) []quotaOwner {
+	owners := make([]quotaOwner, 0, 2)
+
+	if uid != nil {
+		owners = append(owners, quotaOwner{userQuota, *uid})
+	}
+
+	if gid != nil {
+		owners = append(owners, quotaOwner{groupQuota, *gid})
+	}
+
+	return owners
+}
+
+// checkQuota fails with EDQUOT if adding the given amount of bytes and
+// inodes to the usage of the provided user or group would exceed its limits
+func (d *Driver) checkQuota(uid uint32, gid uint32, bytes int64, inodes int64) error {
+	for _, owner := range quotaOwners(&uid, &gid) {
+		if quota := d.quotas[owner]; quota != nil && quota.Exceeds(bytes, inodes) {
+			return syscall.EDQUOT
+		}
+	}
+
+	return nil
+}
+
+// checkCopyQuota fails with EDQUOT if copying the given inodes would exceed
+// the limits of any of their owners
+func (d *Driver) checkCopyQuota(inodes []*inode) error {
+	usage := make(map[quotaOwner]*database.Quota)
+
+	for _, in := range inodes {
+		for _, owner := range quotaOwners(&in.Uid, &in.Gid) {
+			if usage[owner] == nil {
+				usage[owner] = &database.Quota{}
+			}
+
+			usage[owner].UsedBytes += in.Size
+			usage[owner].UsedInodes++
+		}
+	}
+
+	for owner, used := range usage {
+		if quota := d.quotas[owner]; quota != nil && quota.Exceeds(int64(used.UsedBytes), int64(used.UsedInodes)) {
+			return syscall.EDQUOT
+		}
+	}
+
+	return nil
+}
+
+// addUsage adds the given amount of bytes and inodes to the usage of the
+// provided user and group
+func (d *Driver) addUsage(uid uint32, gid uint32, bytes int64, inodes int64) {
+	for _, owner := range quotaOwners(&uid, &gid) {
+		if quota := d.quotas[owner]; quota != nil {
+			quota.UsedBytes = uint64(int64(quota.UsedBytes) + bytes)
+			quota.UsedInodes = uint64(int64(quota.UsedInodes) + inodes)
+		}
+	}
+}
+
+// subtree lists the given inode along with every inode below it, each of them
+// once
+func (d *Driver) subtree(id fuseops.InodeID) []*inode {
+	visited := map[fuseops.InodeID]bool{id: true}
+	inodes := []*inode{d.inodes[id]}
+
+	for i := 0; i < len(inodes); i++ {
+		for _, child := range d.entries[inodes[i].ID] {
+			if !visited[child] {
+				visited[child] = true
+				inodes = append(inodes, d.inodes[child])
+			}
+		}
+	}
+
+	return inodes
+}
@@ -0,0 +1,1844 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"io"
+	gomath "math"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database"
+	"github.com/manvalls/titan/math"
+	"github.com/manvalls/titan/storage"
+)
+
+// Driver implements the Db interface keeping the whole file system in
+// memory, which makes it suitable for tests and local development. Every
+// operation holds a single lock, so that they never see each other halfway.
+// Nothing survives the process.
+type Driver struct {
+	// Capacity is the amount of bytes reported as the size of the file
+	// system, zero meaning there's no quota
+	Capacity uint64
+
+	// InodeCapacity is the amount of inodes reported as available to the file
+	// system, zero meaning there's no quota
+	InodeCapacity uint64
+
+	// BlockSize is the preferred size of IO operations reported by FsStats,
+	// the zeros filling grown files being split so that holes align to it
+	BlockSize uint64
+
+	// Atime controls when reads update the access time of inodes
+	Atime database.AtimePolicy
+
+	// Dedup makes chunks whose data is already stored point to the existing
+	// object, orphaning the new one
+	Dedup bool
+
+	// AuditHook is notified of the mutating operations once done, none being
+	// reported if it's nil
+	AuditHook database.AuditHook
+
+	// ReadOnly makes every mutation fail with EROFS without changing
+	// anything, reads leaving access times untouched too
+	ReadOnly bool
+
+	mutex     sync.Mutex
+	inodes    map[fuseops.InodeID]*inode
+	entries   map[fuseops.InodeID]map[string]fuseops.InodeID
+	chunks    map[uint64]*chunk
+	quotas    map[quotaOwner]*database.Quota
+	stats     database.Stats
+	lastInode fuseops.InodeID
+	lastChunk uint64
+	events    []database.AuditEvent
+}
+
+// Open creates an empty file system, unless it was already created
+func (d *Driver) Open() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.inodes == nil {
+		d.reset()
+	}
+
+	return nil
+}
+
+// Ping always succeeds, there's nothing to connect to
+func (d *Driver) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// Close does nothing, the file system is kept until the driver is released
+func (d *Driver) Close() error {
+	return nil
+}
+
+// Setup replaces the file system with an empty one
+func (d *Driver) Setup(ctx context.Context) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return err
+	}
+
+	defer d.mutex.Unlock()
+
+	d.reset()
+	return nil
+}
+
+// Migrate does nothing, the file system is always kept up to date
+func (d *Driver) Migrate(ctx context.Context) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	return nil
+}
+
+// Stats retrieves the file system stats
+func (d *Driver) Stats(ctx context.Context) (*database.Stats, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	stats := d.stats
+	return &stats, nil
+}
+
+// FsStats retrieves the file system stats relative to its capacity
+func (d *Driver) FsStats(ctx context.Context) (*database.FsStats, error) {
+	stats, err := d.Stats(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	fsStats := database.NewFsStats(*stats, d.Capacity, d.InodeCapacity)
+	fsStats.BlockSize = d.BlockSize
+	return fsStats, nil
+}
+
+// SubtreeStats retrieves the amount of inodes and bytes of an inode along
+// with every inode below it, each of them counted once
+func (d *Driver) SubtreeStats(ctx context.Context, inode fuseops.InodeID) (*database.SubtreeStats, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.inodes[inode] == nil {
+		return nil, syscall.ENOENT
+	}
+
+	stats := database.SubtreeStats{}
+	for _, in := range d.subtree(inode) {
+		stats.Inodes++
+		stats.Size += in.Size
+
+		for _, c := range in.chunks {
+			if !c.IsHole() {
+				stats.Allocated += c.Size
+			}
+		}
+	}
+
+	return &stats, nil
+}
+
+// SetQuota sets the limits of the given user and group, computing their
+// current usage if they had no quota yet
+func (d *Driver) SetQuota(ctx context.Context, uid *uint32, gid *uint32, bytes uint64, inodes uint64) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return err
+	}
+
+	defer d.mutex.Unlock()
+
+	for _, owner := range quotaOwners(uid, gid) {
+		quota := d.quotas[owner]
+		if quota == nil {
+			quota = &database.Quota{}
+			for _, in := range d.inodes {
+				if owner.owns(in) {
+					quota.UsedBytes += in.Size
+					quota.UsedInodes++
+				}
+			}
+
+			d.quotas[owner] = quota
+		}
+
+		quota.Bytes = bytes
+		quota.Inodes = inodes
+	}
+
+	return nil
+}
+
+// GetQuota retrieves the limits and usage of either the given user or group
+func (d *Driver) GetQuota(ctx context.Context, uid *uint32, gid *uint32) (*database.Quota, error) {
+	owners := quotaOwners(uid, gid)
+	if len(owners) != 1 {
+		return nil, syscall.EINVAL
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	quota := d.quotas[owners[0]]
+	if quota == nil {
+		return nil, syscall.ENOENT
+	}
+
+	result := *quota
+	return &result, nil
+}
+
+// Create creates a new inode under the given parent. Its times are set to
+// the current time unless given, e.g when restoring a backup.
+func (d *Driver) Create(ctx context.Context, entry database.Entry) (*database.Entry, error) {
+	if d.ReadOnly {
+		return nil, syscall.EROFS
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return nil, err
+	}
+
+	defer d.commit(ctx)
+
+	if err := d.checkDir(entry.Parent); err != nil {
+		return nil, err
+	}
+
+	if _, ok := d.entries[entry.Parent][entry.Name]; ok {
+		return nil, syscall.EEXIST
+	}
+
+	in, err := d.createInode(entry.Inode, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	d.linkEntry(entry.Parent, entry.Name, in.ID)
+
+	entry.Inode = in.attributes()
+	d.audit(database.AuditCreate, in)
+	return &entry, nil
+}
+
+// CreateAnonymous creates a new regular file without any links, as an
+// O_TMPFILE open would. It's kept alive by the handle opening it and can be
+// given a name with Link, being removed by Forget otherwise.
+func (d *Driver) CreateAnonymous(ctx context.Context, mode os.FileMode, uid uint32, gid uint32) (*database.Inode, error) {
+	if d.ReadOnly {
+		return nil, syscall.EROFS
+	}
+
+	if !mode.IsRegular() {
+		return nil, syscall.EINVAL
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return nil, err
+	}
+
+	defer d.mutex.Unlock()
+
+	in, err := d.createInode(database.Inode{InodeAttributes: fuseops.InodeAttributes{Mode: mode, Uid: uid, Gid: gid}}, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	in.flags |= database.InodeAnonymous
+
+	result := in.attributes()
+	return &result, nil
+}
+
+// Link creates a new hard link to the given inode
+func (d *Driver) Link(ctx context.Context, inode fuseops.InodeID, newParent fuseops.InodeID, newName string) (*database.Entry, error) {
+	if d.ReadOnly {
+		return nil, syscall.EROFS
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return nil, err
+	}
+
+	defer d.commit(ctx)
+
+	if err := d.checkDir(newParent); err != nil {
+		return nil, err
+	}
+
+	in := d.inodes[inode]
+	if in == nil {
+		return nil, syscall.ENOENT
+	}
+
+	if in.Mode.IsDir() {
+		return nil, syscall.EPERM
+	}
+
+	if _, ok := d.entries[newParent][newName]; ok {
+		return nil, syscall.EEXIST
+	}
+
+	d.linkEntry(newParent, newName, inode)
+	in.Nlink++
+	in.flags &^= database.InodeAnonymous
+	d.audit(database.AuditLink, in)
+
+	return &database.Entry{Parent: newParent, Name: newName, Inode: in.attributes()}, nil
+}
+
+// Forget checks if an inode has any links and removes it if not
+func (d *Driver) Forget(ctx context.Context, inode fuseops.InodeID) error {
+	if d.ReadOnly {
+		return d.checkForget([]fuseops.InodeID{inode})
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return err
+	}
+
+	defer d.mutex.Unlock()
+
+	if d.inodes[inode] == nil {
+		return syscall.ENOENT
+	}
+
+	d.forget([]fuseops.InodeID{inode})
+	return nil
+}
+
+// ForgetBatch removes, at once, those of the given inodes which have no
+// links left
+func (d *Driver) ForgetBatch(ctx context.Context, inodes []fuseops.InodeID) error {
+	if d.ReadOnly {
+		return d.checkForget(inodes)
+	}
+
+	if len(inodes) == 0 {
+		return nil
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return err
+	}
+
+	defer d.mutex.Unlock()
+
+	d.forget(inodes)
+	return nil
+}
+
+// CountOrphans reports what CleanOrphanInodes and CleanOrphanChunks, given
+// the same threshold, would remove without removing anything
+func (d *Driver) CountOrphans(ctx context.Context, threshold time.Time) (*database.OrphanReport, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	report := &database.OrphanReport{}
+	now := time.Now()
+
+	for _, in := range d.inodes {
+		if in.orphan(now) {
+			report.Inodes++
+			report.Size += in.Size
+			report.Xattrs += uint64(len(in.xattrs))
+			report.OrphanedChunks += uint64(len(in.chunks))
+		}
+	}
+
+	for _, c := range d.chunks {
+		if c.orphaned(threshold) {
+			report.Chunks++
+		}
+	}
+
+	report.Objects = uint64(len(d.orphanObjects(threshold)))
+	return report, nil
+}
+
+// CleanOrphanInodes removes all orphan inodes and chunks
+func (d *Driver) CleanOrphanInodes(ctx context.Context) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return err
+	}
+
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	orphans := make([]fuseops.InodeID, 0)
+	for id, in := range d.inodes {
+		if in.orphan(now) {
+			orphans = append(orphans, id)
+		}
+	}
+
+	d.forget(orphans)
+
+	// Both the stats and the quotas are recomputed, fixing any drift
+	d.stats = database.Stats{}
+	for _, quota := range d.quotas {
+		quota.UsedBytes = 0
+		quota.UsedInodes = 0
+	}
+
+	for _, in := range d.inodes {
+		d.stats.Inodes++
+		d.stats.Size += in.Size
+
+		for owner, quota := range d.quotas {
+			if owner.owns(in) {
+				quota.UsedBytes += in.Size
+				quota.UsedInodes++
+			}
+		}
+	}
+
+	return nil
+}
+
+// CleanOrphanChunks removes orphaned chunks. Concurrent cleanups run one
+// after the other, as the lock is held while removing their objects.
+func (d *Driver) CleanOrphanChunks(ctx context.Context, threshold time.Time, st storage.Storage, workers int) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return err
+	}
+
+	defer d.mutex.Unlock()
+
+	// Chunks are only deleted if all of their objects could be removed
+	if err := database.RemoveObjectList(d.orphanObjects(threshold), st, workers); err != nil {
+		return err
+	}
+
+	for id, c := range d.chunks {
+		if c.orphaned(threshold) {
+			delete(d.chunks, id)
+		}
+	}
+
+	return nil
+}
+
+// Fsck checks the reference count of every inode against the entries
+// pointing to it, also looking for dangling entries and unreachable inodes.
+// If repair is set, reference counts are fixed.
+func (d *Driver) Fsck(ctx context.Context, repair bool) (*database.FsckReport, error) {
+	if repair && d.ReadOnly {
+		return nil, syscall.EROFS
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return nil, err
+	}
+
+	defer d.mutex.Unlock()
+
+	refcounts := make(map[fuseops.InodeID]uint64)
+	for id, in := range d.inodes {
+		refcounts[id] = uint64(in.Nlink)
+	}
+
+	links := make([]database.Link, 0)
+	for parent, names := range d.entries {
+		for name, inode := range names {
+			links = append(links, database.Link{Parent: parent, Name: name, Inode: inode})
+		}
+	}
+
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].Parent != links[j].Parent {
+			return links[i].Parent < links[j].Parent
+		}
+
+		return links[i].Name < links[j].Name
+	})
+
+	report := database.NewFsckReport(refcounts, links)
+
+	if repair {
+		for _, mismatch := range report.Refcounts {
+			if in := d.inodes[mismatch.Inode]; in != nil {
+				in.Nlink = uint32(mismatch.Links)
+			}
+		}
+
+		report.Repaired = true
+	}
+
+	return report, nil
+}
+
+// VerifyChunks checks that the objects of the chunks of an inode are still
+// stored, returning the ids of the chunks whose object is missing or no
+// longer has the ETag it had when it was stored
+func (d *Driver) VerifyChunks(ctx context.Context, st storage.Storage, inode fuseops.InodeID) ([]uint64, error) {
+	return database.MissingObjectList(ctx, d.liveChunks(inode), st)
+}
+
+// VerifyAllChunks checks the objects of every live chunk as VerifyChunks
+// does, which may take long on big file systems
+func (d *Driver) VerifyAllChunks(ctx context.Context, st storage.Storage) ([]uint64, error) {
+	return database.MissingObjectList(ctx, d.liveChunks(0), st)
+}
+
+// Export writes a portable dump of the file system to w
+func (d *Driver) Export(ctx context.Context, w io.Writer) error {
+	return database.Export(ctx, d, w)
+}
+
+// Import recreates the contents of a dump below the root, giving new ids to
+// the imported inodes
+func (d *Driver) Import(ctx context.Context, r io.Reader) error {
+	return database.Import(ctx, d, r)
+}
+
+// Unlink removes an entry from the file system
+func (d *Driver) Unlink(ctx context.Context, parent fuseops.InodeID, name string) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return err
+	}
+
+	defer d.commit(ctx)
+
+	id, err := d.unlink(parent, name)
+	if err != nil {
+		return err
+	}
+
+	if in := d.inodes[id]; in != nil {
+		d.audit(database.AuditUnlink, in)
+	}
+
+	return nil
+}
+
+// RemoveTree removes an entry at once along with, if it's a directory,
+// every entry below it. Non-empty directories are only removed if recursive
+// is set, failing with ENOTEMPTY otherwise. Unlike Unlink, inodes left
+// without links are removed right away, orphaning their chunks.
+func (d *Driver) RemoveTree(ctx context.Context, parent fuseops.InodeID, name string, recursive bool) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return err
+	}
+
+	defer d.mutex.Unlock()
+
+	root, ok := d.entries[parent][name]
+	if !ok {
+		return syscall.ENOENT
+	}
+
+	now := time.Now()
+	immutable := false
+	entries := 0
+
+	// Inodes are mapped to the amount of links removed from them, which is
+	// only greater than one for files hard linked within the tree
+	links := make(map[fuseops.InodeID]uint32)
+	dirs := make([]fuseops.InodeID, 0)
+
+	for pending := []fuseops.InodeID{root}; len(pending) > 0; {
+		id := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		in := d.inodes[id]
+		if in == nil {
+			continue
+		}
+
+		immutable = immutable || in.immutable(now)
+		entries++
+		links[id]++
+
+		if in.Mode.IsDir() && links[id] == 1 {
+			dirs = append(dirs, id)
+			for _, child := range d.entries[id] {
+				pending = append(pending, child)
+			}
+		}
+	}
+
+	if entries > 1 && !recursive {
+		return syscall.ENOTEMPTY
+	}
+
+	if immutable {
+		return syscall.EPERM
+	}
+
+	d.unlinkEntry(parent, name)
+	for _, dir := range dirs {
+		for child := range d.entries[dir] {
+			d.unlinkEntry(dir, child)
+		}
+	}
+
+	inodes := make([]fuseops.InodeID, 0, len(links))
+	for id, count := range links {
+		d.inodes[id].Nlink -= count
+		inodes = append(inodes, id)
+	}
+
+	d.forget(inodes)
+	return nil
+}
+
+// Snapshot copies the directory tree rooted at srcInode to a new entry of
+// dstParent without duplicating any data, the copied chunks referencing the
+// same storage objects as the original ones. Files hard linked within the
+// tree are still linked together in the copy.
+func (d *Driver) Snapshot(ctx context.Context, srcInode fuseops.InodeID, dstParent fuseops.InodeID, dstName string) (*database.Entry, error) {
+	if d.ReadOnly {
+		return nil, syscall.EROFS
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return nil, err
+	}
+
+	defer d.mutex.Unlock()
+
+	src := d.inodes[srcInode]
+	if src == nil {
+		return nil, syscall.ENOENT
+	}
+
+	if err := d.checkDir(dstParent); err != nil {
+		return nil, err
+	}
+
+	if !src.Mode.IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+
+	if d.isAncestor(srcInode, dstParent) {
+		return nil, syscall.EINVAL
+	}
+
+	if _, ok := d.entries[dstParent][dstName]; ok {
+		return nil, syscall.EEXIST
+	}
+
+	// The whole tree is listed first so that quotas are checked before
+	// copying anything
+	inodes := []*inode{src}
+	links := map[fuseops.InodeID]uint32{srcInode: 1}
+
+	for i := 0; i < len(inodes); i++ {
+		for _, child := range d.entries[inodes[i].ID] {
+			if in := d.inodes[child]; in != nil && links[child] == 0 {
+				inodes = append(inodes, in)
+			}
+
+			links[child]++
+		}
+	}
+
+	if err := d.checkCopyQuota(inodes); err != nil {
+		return nil, err
+	}
+
+	copies := make(map[fuseops.InodeID]fuseops.InodeID)
+	for _, in := range inodes {
+		copied, err := d.copyInode(in, links[in.ID])
+		if err != nil {
+			return nil, err
+		}
+
+		copies[in.ID] = copied.ID
+	}
+
+	for _, in := range inodes {
+		for name, child := range d.entries[in.ID] {
+			if copied, ok := copies[child]; ok {
+				d.linkEntry(copies[in.ID], name, copied)
+			}
+		}
+	}
+
+	d.linkEntry(dstParent, dstName, copies[srcInode])
+	return &database.Entry{Parent: dstParent, Name: dstName, Inode: d.inodes[copies[srcInode]].attributes()}, nil
+}
+
+// Rename renames an entry, replacing the destination unless told otherwise
+// by the provided flags. A replaced inode left without links is removed
+// right away, orphaning its chunks.
+func (d *Driver) Rename(ctx context.Context, oldParent fuseops.InodeID, oldName string, newParent fuseops.InodeID, newName string, flags uint32) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if flags&^(database.RenameNoReplace|database.RenameExchange|database.RenameEmpty|database.RenameMutable) != 0 || flags&database.RenameExchange != 0 && flags != database.RenameExchange {
+		return syscall.EINVAL
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return err
+	}
+
+	defer d.commit(ctx)
+
+	inode, ok := d.entries[oldParent][oldName]
+	if !ok {
+		return syscall.ENOENT
+	}
+
+	in := d.inodes[inode]
+	if in == nil {
+		return syscall.ENOENT
+	}
+
+	if err := d.checkDir(newParent); err != nil {
+		return err
+	}
+
+	if in.Mode.IsDir() && d.isAncestor(inode, newParent) {
+		return syscall.EINVAL
+	}
+
+	if flags&database.RenameMutable != 0 && in.immutable(time.Now()) {
+		return syscall.EPERM
+	}
+
+	if flags&database.RenameEmpty != 0 && in.Mode.IsDir() && len(d.entries[inode]) > 0 {
+		return syscall.ENOTEMPTY
+	}
+
+	target, exists := d.entries[newParent][newName]
+
+	if flags&database.RenameExchange != 0 {
+		if !exists {
+			return syscall.ENOENT
+		}
+
+		if t := d.inodes[target]; t != nil && t.Mode.IsDir() && d.isAncestor(target, oldParent) {
+			return syscall.EINVAL
+		}
+
+		d.unlinkEntry(oldParent, oldName)
+		d.unlinkEntry(newParent, newName)
+		d.linkEntry(oldParent, oldName, target)
+		d.linkEntry(newParent, newName, inode)
+		d.audit(database.AuditRename, in)
+		return nil
+	}
+
+	if oldParent == newParent && oldName == newName {
+		d.audit(database.AuditRename, in)
+		return nil
+	}
+
+	if exists {
+		if flags&database.RenameNoReplace != 0 {
+			return syscall.EEXIST
+		}
+
+		// The replaced inode is removed right away if it has no links left
+		replaced, err := d.unlink(newParent, newName)
+		if err != nil {
+			return err
+		}
+
+		d.forget([]fuseops.InodeID{replaced})
+	}
+
+	d.unlinkEntry(oldParent, oldName)
+	d.linkEntry(newParent, newName, inode)
+	d.audit(database.AuditRename, in)
+	return nil
+}
+
+// LookUp finds the entry located under the specified parent with the specified name
+func (d *Driver) LookUp(ctx context.Context, parent fuseops.InodeID, name string) (*database.Entry, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	in := d.inodes[d.entries[parent][name]]
+	if in == nil {
+		return nil, syscall.ENOENT
+	}
+
+	return &database.Entry{Parent: parent, Name: name, Inode: d.stat(in)}, nil
+}
+
+// Get retrieves the stats of a particular inode
+func (d *Driver) Get(ctx context.Context, inode fuseops.InodeID) (*database.Inode, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	in := d.inodes[inode]
+	if in == nil {
+		return nil, syscall.ENOENT
+	}
+
+	result := d.stat(in)
+	return &result, nil
+}
+
+// Statx retrieves the attributes of an inode along with its birth time and
+// the amount of blocks actually holding its data
+func (d *Driver) Statx(ctx context.Context, inode fuseops.InodeID) (*database.Statx, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	in := d.inodes[inode]
+	if in == nil {
+		return nil, syscall.ENOENT
+	}
+
+	var chunks, size uint64
+	for _, c := range in.chunks {
+		if c.Key != "" {
+			chunks++
+			size += c.Size
+		}
+	}
+
+	return database.NewStatx(d.stat(in), chunks, size), nil
+}
+
+// Paths retrieves the full paths reaching the given inode, several of them
+// if it's hard linked, failing with ENOENT if there's none
+func (d *Driver) Paths(ctx context.Context, inode fuseops.InodeID) (*[]string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	links := make([]database.Link, 0)
+	visited := make(map[fuseops.InodeID]bool)
+
+	for pending := []fuseops.InodeID{inode}; len(pending) > 0; {
+		id := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		in := d.inodes[id]
+		if in == nil || visited[id] {
+			continue
+		}
+
+		visited[id] = true
+		for l := range in.links {
+			links = append(links, database.Link{Parent: l.parent, Name: l.name, Inode: id})
+			pending = append(pending, l.parent)
+		}
+	}
+
+	paths := database.JoinPaths(inode, links)
+	if len(paths) == 0 {
+		return nil, syscall.ENOENT
+	}
+
+	return &paths, nil
+}
+
+// ReadLink retrieves the target of a symbolic link
+func (d *Driver) ReadLink(ctx context.Context, inode fuseops.InodeID) (string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	in := d.inodes[inode]
+	if in == nil {
+		return "", syscall.ENOENT
+	}
+
+	if in.Mode&os.ModeSymlink == 0 {
+		return "", syscall.EINVAL
+	}
+
+	return in.SymLink, nil
+}
+
+// Touch changes the stats of a file
+func (d *Driver) Touch(ctx context.Context, inode fuseops.InodeID, size *uint64, mode *os.FileMode, atime *time.Time, mtime *time.Time, uid *uint32, gid *uint32) (*database.Inode, error) {
+	if d.ReadOnly {
+		return nil, syscall.EROFS
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return nil, err
+	}
+
+	defer d.commit(ctx)
+
+	in := d.inodes[inode]
+	if in == nil {
+		return nil, syscall.ENOENT
+	}
+
+	original := in.Inode
+
+	if size != nil && *size != in.Size {
+		if in.immutable(time.Now()) {
+			return nil, syscall.EPERM
+		}
+
+		d.truncate(in, *size)
+	}
+
+	if mode != nil {
+		in.Mode = *mode
+	}
+
+	if atime != nil {
+		in.Atime = atime.In(time.UTC)
+	}
+
+	if mtime != nil {
+		in.Mtime = mtime.In(time.UTC)
+	}
+
+	if uid != nil {
+		in.Uid = *uid
+	}
+
+	if gid != nil {
+		in.Gid = *gid
+	}
+
+	if original.Uid != in.Uid || original.Gid != in.Gid {
+		d.addUsage(original.Uid, original.Gid, -int64(original.Size), -1)
+		d.addUsage(in.Uid, in.Gid, int64(in.Size), 1)
+	} else {
+		d.addUsage(in.Uid, in.Gid, int64(in.Size)-int64(original.Size), 0)
+	}
+
+	in.Ctime = now()
+
+	d.audit(database.AuditTouch, in)
+
+	result := in.attributes()
+	return &result, nil
+}
+
+// Truncate changes the size of a file, filling it with zeros when growing it
+func (d *Driver) Truncate(ctx context.Context, inode fuseops.InodeID, size uint64) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return err
+	}
+
+	defer d.mutex.Unlock()
+
+	in := d.inodes[inode]
+	if in == nil {
+		return syscall.ENOENT
+	}
+
+	if in.Mode.IsDir() {
+		return syscall.EISDIR
+	}
+
+	if size == in.Size {
+		return nil
+	}
+
+	if in.immutable(time.Now()) {
+		return syscall.EPERM
+	}
+
+	original := in.Size
+	d.truncate(in, size)
+	d.addUsage(in.Uid, in.Gid, int64(in.Size)-int64(original), 0)
+
+	in.Mtime = now()
+	in.Ctime = in.Mtime
+	return nil
+}
+
+// SetImmutable sets or clears the immutable flag of an inode on behalf of
+// the given user, who must be either its owner or root. If a retention date
+// is given the flag clears by itself once it passes, and until then it can
+// neither be cleared nor have its retention shortened.
+func (d *Driver) SetImmutable(ctx context.Context, inode fuseops.InodeID, uid uint32, immutable bool, retainUntil *time.Time) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return err
+	}
+
+	defer d.mutex.Unlock()
+
+	in := d.inodes[inode]
+	if in == nil {
+		return syscall.ENOENT
+	}
+
+	if uid != 0 && uid != in.Uid {
+		return syscall.EPERM
+	}
+
+	if in.retainUntil != nil && in.immutable(time.Now()) && (!immutable || retainUntil != nil && retainUntil.Before(*in.retainUntil)) {
+		return syscall.EPERM
+	}
+
+	in.retainUntil = nil
+	if immutable {
+		in.flags |= database.InodeImmutable
+		if retainUntil != nil {
+			until := retainUntil.In(time.UTC)
+			in.retainUntil = &until
+		}
+	} else {
+		in.flags &^= database.InodeImmutable
+	}
+
+	in.Ctime = now()
+	return nil
+}
+
+// ChownTree changes the owner and group of an inode and of every inode below
+// it at once, leaving them unchanged where nil. If fromUid is given, only the
+// inodes owned by that user are changed.
+func (d *Driver) ChownTree(ctx context.Context, inode fuseops.InodeID, uid *uint32, gid *uint32, fromUid *uint32) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return err
+	}
+
+	defer d.mutex.Unlock()
+
+	if d.inodes[inode] == nil {
+		return syscall.ENOENT
+	}
+
+	ctime := now()
+	for _, in := range d.subtree(inode) {
+		if fromUid != nil && in.Uid != *fromUid {
+			continue
+		}
+
+		d.addUsage(in.Uid, in.Gid, -int64(in.Size), -1)
+
+		if uid != nil {
+			in.Uid = *uid
+		}
+
+		if gid != nil {
+			in.Gid = *gid
+		}
+
+		d.addUsage(in.Uid, in.Gid, int64(in.Size), 1)
+		in.Ctime = ctime
+	}
+
+	return nil
+}
+
+// ChmodTree changes the permissions of an inode and of every inode below it
+// at once, directories taking the ones of dirMode and regular files the ones
+// of fileMode. Only the bits within database.ModePermissions change, the type
+// of inodes and any other kind of inode being left alone.
+func (d *Driver) ChmodTree(ctx context.Context, inode fuseops.InodeID, dirMode os.FileMode, fileMode os.FileMode) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return err
+	}
+
+	defer d.mutex.Unlock()
+
+	if d.inodes[inode] == nil {
+		return syscall.ENOENT
+	}
+
+	ctime := now()
+	for _, in := range d.subtree(inode) {
+		mode := fileMode
+		if in.Mode.IsDir() {
+			mode = dirMode
+		} else if !in.Mode.IsRegular() {
+			continue
+		}
+
+		in.Mode = in.Mode&^database.ModePermissions | mode&database.ModePermissions
+		in.Ctime = ctime
+	}
+
+	return nil
+}
+
+// AddChunk adds a chunk to the given inode
+func (d *Driver) AddChunk(ctx context.Context, inode fuseops.InodeID, flags uint32, chunk database.Chunk) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return err
+	}
+
+	defer d.commit(ctx)
+
+	in := d.inodes[inode]
+	if in == nil {
+		return syscall.ENOENT
+	}
+
+	if in.immutable(time.Now()) {
+		return syscall.EPERM
+	}
+
+	if flags&syscall.O_APPEND != 0 {
+		chunk.InodeOffset = in.Size
+	}
+
+	if err := d.checkQuota(in.Uid, in.Gid, growth(in, chunk), 0); err != nil {
+		return err
+	}
+
+	if d.Dedup && chunk.Hash != "" {
+		d.dedup(&chunk)
+	}
+
+	d.writeChunk(in, chunk)
+
+	in.Atime = now()
+	in.Mtime = in.Atime
+	in.Ctime = in.Atime
+	d.audit(database.AuditAddChunk, in)
+	return nil
+}
+
+// CopyRange copies up to length bytes of srcInode starting at srcOffset to
+// dstInode at dstOffset without transferring any data, the new chunks
+// referencing the same storage objects as the source ones. The copy stops at
+// the end of the source, the amount of copied bytes being returned.
+func (d *Driver) CopyRange(ctx context.Context, srcInode fuseops.InodeID, srcOffset uint64, dstInode fuseops.InodeID, dstOffset uint64, length uint64) (uint64, error) {
+	if d.ReadOnly {
+		return 0, syscall.EROFS
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return 0, err
+	}
+
+	defer d.mutex.Unlock()
+
+	src, dst := d.inodes[srcInode], d.inodes[dstInode]
+	if src == nil || dst == nil {
+		return 0, syscall.ENOENT
+	}
+
+	if src.Mode.IsDir() || dst.Mode.IsDir() {
+		return 0, syscall.EISDIR
+	}
+
+	if dst.immutable(time.Now()) {
+		return 0, syscall.EPERM
+	}
+
+	if srcOffset >= src.Size || length == 0 {
+		return 0, nil
+	}
+
+	if length > src.Size-srcOffset {
+		length = src.Size - srcOffset
+	}
+
+	if err := d.checkQuota(dst.Uid, dst.Gid, growth(dst, zeroChunk(dstOffset, length)), 0); err != nil {
+		return 0, err
+	}
+
+	chunks := make([]database.Chunk, 0)
+	position := srcOffset
+
+	// Every overlapping chunk is trimmed to the copied range and moved to the
+	// destination, holes of the source being copied as zero chunks
+	for _, c := range src.chunksInRange(srcOffset, srcOffset+length) {
+		start := math.Max(c.InodeOffset, srcOffset)
+		end := math.Min(c.InodeOffset+c.Size, srcOffset+length)
+
+		if start > position {
+			chunks = append(chunks, zeroChunk(dstOffset+position-srcOffset, start-position))
+		}
+
+		piece := database.Chunk{
+			InodeOffset: dstOffset + start - srcOffset,
+			Chunk: storage.Chunk{
+				Storage:      c.Storage,
+				Key:          c.Key,
+				ObjectOffset: c.ObjectOffset + start - c.InodeOffset,
+				Size:         end - start,
+				ETag:         c.ETag,
+				Version:      c.Version,
+			},
+		}
+
+		// Chunks copied whole keep their checksum, covering the same data
+		if start == c.InodeOffset && end == c.InodeOffset+c.Size {
+			piece.Checksum = c.Checksum
+		}
+
+		chunks = append(chunks, piece)
+		position = end
+	}
+
+	if position < srcOffset+length {
+		chunks = append(chunks, zeroChunk(dstOffset+position-srcOffset, srcOffset+length-position))
+	}
+
+	for _, chunk := range chunks {
+		d.writeChunk(dst, chunk)
+	}
+
+	dst.Mtime = now()
+	dst.Ctime = dst.Mtime
+	return length, nil
+}
+
+// Fallocate reserves the given range of an inode. Space is never actually
+// allocated, so the file is just grown with zeros unless FallocKeepSize is
+// set, holes being already stored as zero chunks. With FallocZeroRange or
+// FallocPunchHole, the data within the range is replaced with zeros as well.
+func (d *Driver) Fallocate(ctx context.Context, inode fuseops.InodeID, offset uint64, length uint64, mode uint32) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if length == 0 {
+		return syscall.EINVAL
+	}
+
+	if mode&^(database.FallocKeepSize|database.FallocPunchHole|database.FallocZeroRange) != 0 {
+		return syscall.EOPNOTSUPP
+	}
+
+	if mode&database.FallocPunchHole != 0 && (mode&database.FallocKeepSize == 0 || mode&database.FallocZeroRange != 0) {
+		return syscall.EOPNOTSUPP
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return err
+	}
+
+	defer d.mutex.Unlock()
+
+	in := d.inodes[inode]
+	if in == nil {
+		return syscall.ENOENT
+	}
+
+	if in.Mode.IsDir() {
+		return syscall.EISDIR
+	}
+
+	if in.immutable(time.Now()) {
+		return syscall.EPERM
+	}
+
+	start, end := offset, offset+length
+	if mode&(database.FallocZeroRange|database.FallocPunchHole) == 0 {
+		start = in.Size
+	}
+
+	if mode&database.FallocKeepSize != 0 {
+		end = math.Min(end, in.Size)
+	}
+
+	if start >= end {
+		return nil
+	}
+
+	chunk := zeroChunk(start, end-start)
+	if err := d.checkQuota(in.Uid, in.Gid, growth(in, chunk), 0); err != nil {
+		return err
+	}
+
+	d.writeChunk(in, chunk)
+
+	in.Mtime = now()
+	in.Ctime = in.Mtime
+	return nil
+}
+
+// ChunksByStorage lists up to limit live chunks stored at the given storage,
+// sorted by id and starting after the chunk with the provided id, zero
+// meaning from the beginning
+func (d *Driver) ChunksByStorage(ctx context.Context, storageName string, afterID uint64, limit int) (*[]database.Chunk, error) {
+	if limit <= 0 {
+		return nil, syscall.EINVAL
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	chunks := make([]database.Chunk, 0, limit)
+	for id, c := range d.chunks {
+		if c.Storage == storageName && id > afterID && c.Inode != 0 {
+			chunks = append(chunks, c.Chunk)
+		}
+	}
+
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].ID < chunks[j].ID
+	})
+
+	if len(chunks) > limit {
+		chunks = chunks[:limit]
+	}
+
+	return &chunks, nil
+}
+
+// MigrateChunk points a live chunk to a copy of its object at another
+// storage, which must hold the same data at the same offsets. The previous
+// object is orphaned, so that it's removed once no chunk references it.
+func (d *Driver) MigrateChunk(ctx context.Context, id uint64, newStorage string, newKey string) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return err
+	}
+
+	defer d.mutex.Unlock()
+
+	c := d.chunks[id]
+	if c == nil || c.Inode == 0 {
+		return syscall.ENOENT
+	}
+
+	if c.Storage == newStorage && c.Key == newKey {
+		return nil
+	}
+
+	d.orphanObject(c.Storage, c.Key)
+	c.Storage = newStorage
+	c.Key = newKey
+	c.ETag = ""
+	c.Version = ""
+	return nil
+}
+
+// CompactChunks merges the chunks of an inode which are contiguous both
+// within the inode and within the same object, leaving the data it holds
+// and the stored objects untouched
+func (d *Driver) CompactChunks(ctx context.Context, inode fuseops.InodeID) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return err
+	}
+
+	defer d.mutex.Unlock()
+
+	in := d.inodes[inode]
+	if in == nil {
+		return syscall.ENOENT
+	}
+
+	chunks := make([]database.Chunk, 0, len(in.chunks))
+	for _, c := range in.chunksInRange(0, gomath.MaxInt64) {
+		chunks = append(chunks, c.Chunk)
+	}
+
+	grown, removed := database.MergeChunks(chunks)
+	for _, c := range grown {
+		d.chunks[c.ID].Chunk = c
+	}
+
+	for _, id := range removed {
+		delete(d.chunks, id)
+		delete(in.chunks, id)
+	}
+
+	return nil
+}
+
+// Defragment rewrites the runs of small chunks of an inode into new objects
+// of up to targetObjectSize bytes, orphaning the old ones
+func (d *Driver) Defragment(ctx context.Context, st storage.Storage, inode fuseops.InodeID, targetObjectSize uint64) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	d.mutex.Lock()
+	found := d.inodes[inode] != nil
+	d.mutex.Unlock()
+
+	if !found {
+		return syscall.ENOENT
+	}
+
+	return database.DefragmentList(ctx, d.liveChunks(inode), st, targetObjectSize, d.replaceChunks)
+}
+
+// RetierInode copies the chunks of an inode held by other storages into new
+// objects at the target one, orphaning the old ones
+func (d *Driver) RetierInode(ctx context.Context, st storage.Storage, inode fuseops.InodeID, target string) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	d.mutex.Lock()
+	found := d.inodes[inode] != nil
+	d.mutex.Unlock()
+
+	if !found {
+		return syscall.ENOENT
+	}
+
+	return database.RetierList(ctx, d.liveChunks(inode), st, target, d.replaceChunks)
+}
+
+// Chunks grabs the chunks for the given inode
+func (d *Driver) Chunks(ctx context.Context, inode fuseops.InodeID) (*[]database.Chunk, error) {
+	return d.ChunksInRange(ctx, inode, 0, gomath.MaxInt64)
+}
+
+// ChunksInRange grabs the chunks of the given inode which overlap the
+// provided byte range
+func (d *Driver) ChunksInRange(ctx context.Context, inode fuseops.InodeID, offset uint64, length uint64) (*[]database.Chunk, error) {
+	end := offset + length
+	if end < offset || end > gomath.MaxInt64 {
+		end = gomath.MaxInt64
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	chunks := make([]database.Chunk, 0)
+
+	in := d.inodes[inode]
+	if in == nil {
+		return &chunks, nil
+	}
+
+	d.touchAtime(in)
+
+	for _, c := range in.chunksInRange(offset, end) {
+		chunks = append(chunks, c.Chunk)
+	}
+
+	return &chunks, nil
+}
+
+// Children gets the list of children for the given inode
+func (d *Driver) Children(ctx context.Context, inode fuseops.InodeID) (*[]database.Child, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if in := d.inodes[inode]; in != nil {
+		d.touchAtime(in)
+	}
+
+	children := make([]database.Child, 0)
+	for _, name := range d.names(inode) {
+		id := d.entries[inode][name]
+		children = append(children, database.Child{Inode: id, Name: name, Mode: d.inodes[id].Mode})
+	}
+
+	return &children, nil
+}
+
+// ChildCount counts the children of the given inode without listing them,
+// leaving its access time untouched
+func (d *Driver) ChildCount(ctx context.Context, inode fuseops.InodeID) (uint64, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return uint64(len(d.entries[inode])), nil
+}
+
+// ChildrenPage gets up to limit children of the given inode whose name sorts
+// after afterName, in name order, so that big directories can be listed in
+// pages. The access time is only updated when fetching the first page.
+func (d *Driver) ChildrenPage(ctx context.Context, inode fuseops.InodeID, afterName string, limit int) (*[]database.Child, error) {
+	if limit <= 0 {
+		return nil, syscall.EINVAL
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if in := d.inodes[inode]; in != nil && afterName == "" {
+		d.touchAtime(in)
+	}
+
+	names := d.names(inode)
+	names = names[sort.SearchStrings(names, afterName):]
+	if len(names) > 0 && names[0] == afterName {
+		names = names[1:]
+	}
+
+	if len(names) > limit {
+		names = names[:limit]
+	}
+
+	children := make([]database.Child, 0, len(names))
+	for _, name := range names {
+		id := d.entries[inode][name]
+		children = append(children, database.Child{Inode: id, Name: name, Mode: d.inodes[id].Mode})
+	}
+
+	return &children, nil
+}
+
+// ChildrenPlus gets the children of the given inode along with their
+// attributes
+func (d *Driver) ChildrenPlus(ctx context.Context, inode fuseops.InodeID) (*[]database.Entry, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if in := d.inodes[inode]; in != nil {
+		d.touchAtime(in)
+	}
+
+	entries := make([]database.Entry, 0)
+	for _, name := range d.names(inode) {
+		in := d.inodes[d.entries[inode][name]]
+		entries = append(entries, database.Entry{Parent: inode, Name: name, Inode: d.stat(in)})
+	}
+
+	return &entries, nil
+}
+
+// ListXattr retrieves the list of extended attributes for the given inode
+func (d *Driver) ListXattr(ctx context.Context, inode fuseops.InodeID) (*[]string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	keys := make([]string, 0)
+	if in := d.inodes[inode]; in != nil {
+		for key := range in.xattrs {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	return &keys, nil
+}
+
+// RemoveXattr removes the given extended attribute from the given inode
+func (d *Driver) RemoveXattr(ctx context.Context, inode fuseops.InodeID, attr string) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return err
+	}
+
+	defer d.mutex.Unlock()
+
+	if in := d.inodes[inode]; in != nil {
+		delete(in.xattrs, attr)
+		in.Ctime = now()
+		in.Atime = in.Ctime
+	}
+
+	return nil
+}
+
+// GetXattr gets a certain external attribute from the given inode
+func (d *Driver) GetXattr(ctx context.Context, inode fuseops.InodeID, attr string) (*[]byte, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	in := d.inodes[inode]
+	if in == nil {
+		return nil, syscall.ENODATA
+	}
+
+	value, ok := in.xattrs[attr]
+	if !ok {
+		return nil, syscall.ENODATA
+	}
+
+	data := append([]byte{}, value...)
+	return &data, nil
+}
+
+// GetXattrSize retrieves the size of the value of an extended attribute
+func (d *Driver) GetXattrSize(ctx context.Context, inode fuseops.InodeID, attr string) (uint64, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	in := d.inodes[inode]
+	if in == nil {
+		return 0, syscall.ENODATA
+	}
+
+	value, ok := in.xattrs[attr]
+	if !ok {
+		return 0, syscall.ENODATA
+	}
+
+	return uint64(len(value)), nil
+}
+
+// SetXattr sets an extended attribute at the given node
+func (d *Driver) SetXattr(ctx context.Context, inode fuseops.InodeID, attr string, value []byte, flags uint32) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if flags&^(database.XattrCreate|database.XattrReplace) != 0 || flags == database.XattrCreate|database.XattrReplace {
+		return syscall.EINVAL
+	}
+
+	if len(attr) > database.MaxXattrNameSize {
+		return syscall.ERANGE
+	}
+
+	if len(value) > database.MaxXattrValueSize {
+		return syscall.E2BIG
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return err
+	}
+
+	defer d.commit(ctx)
+
+	in := d.inodes[inode]
+	if in == nil {
+		return syscall.ENOENT
+	}
+
+	_, exists := in.xattrs[attr]
+
+	switch {
+	case flags == database.XattrCreate && exists:
+		return syscall.EEXIST
+	case flags == database.XattrReplace && !exists:
+		return syscall.ENODATA
+	}
+
+	in.xattrs[attr] = append([]byte{}, value...)
+	in.Ctime = now()
+	in.Atime = in.Ctime
+	d.audit(database.AuditSetXattr, in)
+	return nil
+}
+
+// SwapXattr sets an extended attribute to the given value only if it holds
+// the expected one, or if it doesn't exist when expected is nil, telling
+// whether it was set
+func (d *Driver) SwapXattr(ctx context.Context, inode fuseops.InodeID, attr string, expected []byte, value []byte) (bool, error) {
+	if d.ReadOnly {
+		return false, syscall.EROFS
+	}
+
+	if len(attr) > database.MaxXattrNameSize {
+		return false, syscall.ERANGE
+	}
+
+	if len(value) > database.MaxXattrValueSize {
+		return false, syscall.E2BIG
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return false, err
+	}
+
+	defer d.mutex.Unlock()
+
+	in := d.inodes[inode]
+	if in == nil {
+		return false, syscall.ENOENT
+	}
+
+	current, exists := in.xattrs[attr]
+	if expected == nil && exists || expected != nil && (!exists || !bytes.Equal(current, expected)) {
+		return false, nil
+	}
+
+	in.xattrs[attr] = append([]byte{}, value...)
+	in.Ctime = now()
+	in.Atime = in.Ctime
+	return true, nil
+}
+
+// GetAllXattr retrieves all the extended attributes of the given inode along
+// with their values
+func (d *Driver) GetAllXattr(ctx context.Context, inode fuseops.InodeID) (map[string][]byte, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	attrs := make(map[string][]byte)
+	if in := d.inodes[inode]; in != nil {
+		for key, value := range in.xattrs {
+			attrs[key] = append([]byte{}, value...)
+		}
+	}
+
+	return attrs, nil
+}
+
+// SetAllXattr replaces the whole set of extended attributes of the given
+// inode, removing the ones not present in the given map
+func (d *Driver) SetAllXattr(ctx context.Context, inode fuseops.InodeID, attrs map[string][]byte) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	for attr, value := range attrs {
+		if len(attr) > database.MaxXattrNameSize {
+			return syscall.ERANGE
+		}
+
+		if len(value) > database.MaxXattrValueSize {
+			return syscall.E2BIG
+		}
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return err
+	}
+
+	defer d.mutex.Unlock()
+
+	in := d.inodes[inode]
+	if in == nil {
+		return syscall.ENOENT
+	}
+
+	in.xattrs = make(map[string][]byte, len(attrs))
+	for attr, value := range attrs {
+		in.xattrs[attr] = append([]byte{}, value...)
+	}
+
+	in.Ctime = now()
+	in.Atime = in.Ctime
+	return nil
+}
+
+// GetLock returns a lock held by another owner which would prevent the given
+// one from being taken, or nil if there's none
+func (d *Driver) GetLock(ctx context.Context, inode fuseops.InodeID, owner uint64, start uint64, length uint64, lockType database.LockType) (*database.Lock, error) {
+	lock := database.Lock{Inode: inode, Owner: owner, Start: start, Length: length, Type: lockType}
+	if !lock.Valid() {
+		return nil, syscall.EINVAL
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	in := d.inodes[inode]
+	if in == nil {
+		return nil, nil
+	}
+
+	return database.Conflicting(in.locks, lock), nil
+}
+
+// SetLock takes or releases an advisory lock over a byte range of an inode
+// on behalf of the given owner, replacing the ones it held over that range.
+// It fails with EAGAIN if a lock of another owner conflicts with it.
+func (d *Driver) SetLock(ctx context.Context, inode fuseops.InodeID, owner uint64, start uint64, length uint64, lockType database.LockType) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	lock := database.Lock{Inode: inode, Owner: owner, Start: start, Length: length, Type: lockType}
+	if !lock.Valid() {
+		return syscall.EINVAL
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return err
+	}
+
+	defer d.mutex.Unlock()
+
+	in := d.inodes[inode]
+	if in == nil {
+		return syscall.ENOENT
+	}
+
+	if database.Conflicting(in.locks, lock) != nil {
+		return syscall.EAGAIN
+	}
+
+	locks := make([]database.Lock, 0, len(in.locks)+2)
+	overlapping := make([]database.Lock, 0)
+
+	for _, l := range in.locks {
+		if l.Owner == owner && l.Start < lock.End() && lock.Start < l.End() {
+			overlapping = append(overlapping, l)
+		} else {
+			locks = append(locks, l)
+		}
+	}
+
+	locks = append(locks, database.Release(overlapping, lock)...)
+	if lockType != database.LockUnlock {
+		locks = append(locks, lock)
+	}
+
+	in.locks = locks
+	return nil
+}
+
+// ClearLocks releases every lock held by the given owner
+func (d *Driver) ClearLocks(ctx context.Context, owner uint64) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if err := d.begin(ctx); err != nil {
+		return err
+	}
+
+	defer d.mutex.Unlock()
+
+	for _, in := range d.inodes {
+		locks := make([]database.Lock, 0, len(in.locks))
+		for _, l := range in.locks {
+			if l.Owner != owner {
+				locks = append(locks, l)
+			}
+		}
+
+		in.locks = locks
+	}
+
+	return nil
+}
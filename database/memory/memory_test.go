@@ -0,0 +1,267 @@
+package memory
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database"
+	"github.com/manvalls/titan/database/dbtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestDriver(t testing.TB) *Driver {
+	d := &Driver{}
+	if err := d.Setup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return d
+}
+
+func TestDriver(t *testing.T) {
+	dbtest.Run(t, getTestDriver(t))
+}
+
+func TestFsStats(t *testing.T) {
+	d := getTestDriver(t)
+	d.Capacity = 1 << 30
+	dbtest.FsStats(t, d)
+}
+
+func TestBlockSize(t *testing.T) {
+	d := getTestDriver(t)
+	d.BlockSize = 1 << 16
+	dbtest.BlockSize(t, d, 1<<16)
+}
+
+func TestAtime(t *testing.T) {
+	ctx := context.Background()
+	d := getTestDriver(t)
+	file := dbtest.Mkfile(t, d, fuseops.RootInodeID)
+
+	old := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	recent := time.Now().UTC().Add(-time.Hour)
+	set := func(atime time.Time, mtime time.Time) {
+		in := d.inodes[file.ID]
+		in.Atime, in.Mtime, in.Ctime = atime, mtime, mtime
+	}
+
+	updated := func(read func() error) bool {
+		assert.Nil(t, read())
+		inode, err := d.Get(ctx, file.ID)
+		assert.Nil(t, err)
+		return time.Since(inode.Atime) < 30*time.Minute
+	}
+
+	chunks := func() error {
+		_, err := d.Chunks(ctx, file.ID)
+		return err
+	}
+
+	children := func() error {
+		_, err := d.Children(ctx, file.ID)
+		return err
+	}
+
+	d.Atime = database.NoAtime
+	set(old, old.Add(24*time.Hour))
+	assert.False(t, updated(chunks), "noatime should never update the access time")
+	assert.False(t, updated(children), "noatime should never update the access time")
+
+	d.Atime = database.RelAtime
+	set(recent, old)
+	assert.False(t, updated(chunks), "relatime should keep a recent access time newer than the modification time")
+
+	set(old, old.Add(24*time.Hour))
+	assert.True(t, updated(chunks), "relatime should update an access time older than the modification time")
+
+	set(old.Add(24*time.Hour), old)
+	assert.True(t, updated(children), "relatime should update an access time older than a day")
+
+	d.Atime = database.StrictAtime
+	set(recent, old)
+	assert.True(t, updated(chunks), "strictatime should always update the access time")
+}
+
+func TestStatsUnderflow(t *testing.T) {
+	ctx := context.Background()
+	d := getTestDriver(t)
+	dir := dbtest.Mkdir(t, d, fuseops.RootInodeID)
+
+	first := dbtest.Mkfile(t, d, dir)
+	second := dbtest.Mkfile(t, d, dir)
+	dbtest.AddChunk(t, d, first.ID, 0, "a", 0, 10)
+	dbtest.AddChunk(t, d, second.ID, 0, "b", 0, 10)
+	assert.Nil(t, d.Unlink(ctx, dir, first.Name))
+	assert.Nil(t, d.Unlink(ctx, dir, second.Name))
+
+	d.stats = database.Stats{Inodes: 2, Size: 5}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := d.Forget(ctx, first.ID); err != nil {
+				assert.Equal(t, syscall.ENOENT, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	stats, err := d.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, database.Stats{Inodes: 1, Size: 0}, *stats)
+
+	assert.Nil(t, d.ForgetBatch(ctx, []fuseops.InodeID{second.ID}))
+
+	stats, err = d.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, database.Stats{Inodes: 1, Size: 0}, *stats)
+
+	// Neither does shrinking files
+	third := dbtest.Mkfile(t, d, dir)
+	dbtest.AddChunk(t, d, third.ID, 0, "c", 0, 10)
+	d.stats.Size = 5
+
+	assert.Nil(t, d.Truncate(ctx, third.ID, 2))
+
+	stats, err = d.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), stats.Size)
+}
+
+func TestForgetRace(t *testing.T) {
+	ctx := context.Background()
+	d := getTestDriver(t)
+	dir := dbtest.Mkdir(t, d, fuseops.RootInodeID)
+
+	// Inodes are only removed once they have no links left
+	file := dbtest.Mkfile(t, d, dir)
+	unlinked := dbtest.Mkfile(t, d, dir)
+	assert.Nil(t, d.Unlink(ctx, dir, unlinked.Name))
+
+	assert.Nil(t, d.Forget(ctx, file.ID))
+	assert.Nil(t, d.ForgetBatch(ctx, []fuseops.InodeID{file.ID, unlinked.ID}))
+
+	found, err := d.LookUp(ctx, dir, file.Name)
+	if assert.Nil(t, err) {
+		assert.Equal(t, file.ID, found.ID)
+	}
+
+	_, err = d.Get(ctx, unlinked.ID)
+	assert.Equal(t, syscall.ENOENT, err)
+
+	racing := dbtest.Mkfile(t, d, dir)
+	assert.Nil(t, d.Unlink(ctx, dir, racing.Name))
+
+	wg := sync.WaitGroup{}
+	var forgetErr, linkErr error
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		forgetErr = d.Forget(ctx, racing.ID)
+	}()
+
+	go func() {
+		defer wg.Done()
+		_, linkErr = d.Link(ctx, racing.ID, dir, "racing")
+	}()
+
+	wg.Wait()
+	assert.Nil(t, forgetErr)
+
+	if linkErr != nil {
+		assert.Equal(t, syscall.ENOENT, linkErr)
+		return
+	}
+
+	found, err = d.LookUp(ctx, dir, "racing")
+	if assert.Nil(t, err) {
+		assert.Equal(t, racing.ID, found.ID)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	ctx := context.Background()
+	d := getTestDriver(t)
+
+	report, err := d.Fsck(ctx, false)
+	assert.Nil(t, err)
+	assert.True(t, report.Clean())
+
+	dir := dbtest.Mkdir(t, d, fuseops.RootInodeID)
+	file := dbtest.Mkfile(t, d, dir)
+	d.inodes[file.ID].Nlink = 3
+
+	expected := []database.RefcountMismatch{{Inode: file.ID, Refcount: 3, Links: 1}}
+
+	report, err = d.Fsck(ctx, false)
+	assert.Nil(t, err)
+	assert.False(t, report.Repaired)
+	assert.Equal(t, expected, report.Refcounts)
+
+	report, err = d.Fsck(ctx, true)
+	assert.Nil(t, err)
+	assert.True(t, report.Repaired)
+
+	inode, err := d.Get(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), inode.Nlink)
+
+	report, err = d.Fsck(ctx, false)
+	assert.Nil(t, err)
+	assert.True(t, report.Clean())
+}
+
+func TestLeakedAnonymous(t *testing.T) {
+	ctx := context.Background()
+	d := getTestDriver(t)
+
+	held, err := d.CreateAnonymous(ctx, 0644, 1000, 1000)
+	assert.Nil(t, err)
+
+	leaked, err := d.CreateAnonymous(ctx, 0644, 1000, 1000)
+	assert.Nil(t, err)
+	dbtest.AddChunk(t, d, leaked.ID, 0, "leaked", 0, 10)
+	d.inodes[leaked.ID].Ctime = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	report, err := d.CountOrphans(ctx, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), report.Inodes)
+	assert.Equal(t, uint64(1), report.OrphanedChunks)
+
+	assert.Nil(t, d.CleanOrphanInodes(ctx))
+
+	_, err = d.Get(ctx, leaked.ID)
+	assert.Equal(t, syscall.ENOENT, err, "leaked anonymous inodes should be collected")
+
+	_, err = d.Get(ctx, held.ID)
+	assert.Nil(t, err, "anonymous inodes still held should survive")
+}
+
+func TestDedup(t *testing.T) {
+	d := getTestDriver(t)
+	d.Dedup = true
+	dbtest.Dedup(t, d)
+}
+
+func TestAudit(t *testing.T) {
+	d := getTestDriver(t)
+	dbtest.Audit(t, d, &d.AuditHook)
+}
+
+func TestReadOnly(t *testing.T) {
+	d := getTestDriver(t)
+	dbtest.ReadOnly(t, d, &d.ReadOnly)
+}
+
+func TestDump(t *testing.T) {
+	dbtest.Dump(t, getTestDriver(t), getTestDriver(t))
+}
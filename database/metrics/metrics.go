@@ -0,0 +1,590 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"os"
+	"time"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database"
+	"github.com/manvalls/titan/storage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Pool is implemented by drivers backed by a database/sql connection pool
+type Pool interface {
+	PoolStats() sql.DBStats
+}
+
+// Db wraps a database.Db recording the amount of calls, errors and latency
+// of every method, labeled by method name
+type Db struct {
+	database.Db
+
+	operations *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+	latency    *prometheus.HistogramVec
+	rollbacks  prometheus.Counter
+}
+
+// WithMetrics wraps the given database registering its collectors in the
+// provided registerer. If the database implements Pool, the amount of open
+// connections is exposed too.
+func WithMetrics(db database.Db, reg prometheus.Registerer) (*Db, error) {
+	d := &Db{
+		Db: db,
+
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "titan_db_operations_total",
+			Help: "Amount of database operations",
+		}, []string{"method"}),
+
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "titan_db_errors_total",
+			Help: "Amount of database operations which failed",
+		}, []string{"method"}),
+
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "titan_db_operation_duration_seconds",
+			Help:    "Latency of database operations",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method"}),
+
+		rollbacks: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "titan_db_rollbacks_total",
+			Help: "Amount of database transactions rolled back",
+		}),
+	}
+
+	collectors := []prometheus.Collector{d.operations, d.errors, d.latency, d.rollbacks}
+
+	if pool, ok := db.(Pool); ok {
+		collectors = append(collectors, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "titan_db_open_connections",
+			Help: "Amount of open database connections",
+		}, func() float64 {
+			return float64(pool.PoolStats().OpenConnections)
+		}))
+	}
+
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
+
+// observe records a call to the given method which started at the provided time
+func (d *Db) observe(method string, start time.Time, err error) {
+	d.operations.WithLabelValues(method).Inc()
+	d.latency.WithLabelValues(method).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		d.errors.WithLabelValues(method).Inc()
+	}
+}
+
+// observeTx records a call to a method running within a transaction, which
+// is rolled back whenever the method fails
+func (d *Db) observeTx(method string, start time.Time, err error) {
+	d.observe(method, start, err)
+
+	if err != nil {
+		d.rollbacks.Inc()
+	}
+}
+
+// Ping checks that the database is reachable
+func (d *Db) Ping(ctx context.Context) error {
+	start := time.Now()
+	err := d.Db.Ping(ctx)
+	d.observe("Ping", start, err)
+	return err
+}
+
+// TryLock takes the named lock of the wrapped database, if it implements
+// database.Locker
+func (d *Db) TryLock(ctx context.Context, name string) (func(), error) {
+	start := time.Now()
+	release, err := database.TryLock(ctx, d.Db, name)
+	d.observe("TryLock", start, err)
+	return release, err
+}
+
+// Setup creates the tables and the initial data required by the file system
+func (d *Db) Setup(ctx context.Context) error {
+	start := time.Now()
+	err := d.Db.Setup(ctx)
+	d.observeTx("Setup", start, err)
+	return err
+}
+
+// Migrate upgrades the schema of an existing database to the current version
+func (d *Db) Migrate(ctx context.Context) error {
+	start := time.Now()
+	err := d.Db.Migrate(ctx)
+	d.observeTx("Migrate", start, err)
+	return err
+}
+
+// Stats retrieves the file system stats
+func (d *Db) Stats(ctx context.Context) (*database.Stats, error) {
+	start := time.Now()
+	stats, err := d.Db.Stats(ctx)
+	d.observe("Stats", start, err)
+	return stats, err
+}
+
+// FsStats retrieves the file system stats relative to its capacity
+func (d *Db) FsStats(ctx context.Context) (*database.FsStats, error) {
+	start := time.Now()
+	stats, err := d.Db.FsStats(ctx)
+	d.observe("FsStats", start, err)
+	return stats, err
+}
+
+// SubtreeStats retrieves the usage of an inode along with every inode below it
+func (d *Db) SubtreeStats(ctx context.Context, inode fuseops.InodeID) (*database.SubtreeStats, error) {
+	start := time.Now()
+	stats, err := d.Db.SubtreeStats(ctx, inode)
+	d.observe("SubtreeStats", start, err)
+	return stats, err
+}
+
+// SetQuota sets the limits of the given user and group
+func (d *Db) SetQuota(ctx context.Context, uid *uint32, gid *uint32, bytes uint64, inodes uint64) error {
+	start := time.Now()
+	err := d.Db.SetQuota(ctx, uid, gid, bytes, inodes)
+	d.observeTx("SetQuota", start, err)
+	return err
+}
+
+// GetQuota retrieves the limits and usage of either the given user or group
+func (d *Db) GetQuota(ctx context.Context, uid *uint32, gid *uint32) (*database.Quota, error) {
+	start := time.Now()
+	quota, err := d.Db.GetQuota(ctx, uid, gid)
+	d.observe("GetQuota", start, err)
+	return quota, err
+}
+
+// Create creates a new inode under the given parent
+func (d *Db) Create(ctx context.Context, entry database.Entry) (*database.Entry, error) {
+	start := time.Now()
+	result, err := d.Db.Create(ctx, entry)
+	d.observeTx("Create", start, err)
+	return result, err
+}
+
+// CreateAnonymous creates a new regular file without any links
+func (d *Db) CreateAnonymous(ctx context.Context, mode os.FileMode, uid uint32, gid uint32) (*database.Inode, error) {
+	start := time.Now()
+	result, err := d.Db.CreateAnonymous(ctx, mode, uid, gid)
+	d.observeTx("CreateAnonymous", start, err)
+	return result, err
+}
+
+// Link creates a new hard link to the given inode
+func (d *Db) Link(ctx context.Context, inode fuseops.InodeID, newParent fuseops.InodeID, newName string) (*database.Entry, error) {
+	start := time.Now()
+	result, err := d.Db.Link(ctx, inode, newParent, newName)
+	d.observeTx("Link", start, err)
+	return result, err
+}
+
+// Forget checks if an inode has any links and removes it if not
+func (d *Db) Forget(ctx context.Context, inode fuseops.InodeID) error {
+	start := time.Now()
+	err := d.Db.Forget(ctx, inode)
+	d.observeTx("Forget", start, err)
+	return err
+}
+
+// ForgetBatch removes those of the given inodes which have no links left
+func (d *Db) ForgetBatch(ctx context.Context, inodes []fuseops.InodeID) error {
+	start := time.Now()
+	err := d.Db.ForgetBatch(ctx, inodes)
+	d.observeTx("ForgetBatch", start, err)
+	return err
+}
+
+// CleanOrphanInodes removes all orphan inodes and chunks
+func (d *Db) CleanOrphanInodes(ctx context.Context) error {
+	start := time.Now()
+	err := d.Db.CleanOrphanInodes(ctx)
+	d.observeTx("CleanOrphanInodes", start, err)
+	return err
+}
+
+// CleanOrphanChunks removes orphaned chunks
+func (d *Db) CleanOrphanChunks(ctx context.Context, threshold time.Time, st storage.Storage, workers int) error {
+	start := time.Now()
+	err := d.Db.CleanOrphanChunks(ctx, threshold, st, workers)
+	d.observeTx("CleanOrphanChunks", start, err)
+	return err
+}
+
+// CountOrphans reports what the cleanup would remove
+func (d *Db) CountOrphans(ctx context.Context, threshold time.Time) (*database.OrphanReport, error) {
+	start := time.Now()
+	report, err := d.Db.CountOrphans(ctx, threshold)
+	d.observe("CountOrphans", start, err)
+	return report, err
+}
+
+// Fsck checks the consistency of the file system, optionally repairing it
+func (d *Db) Fsck(ctx context.Context, repair bool) (*database.FsckReport, error) {
+	start := time.Now()
+	report, err := d.Db.Fsck(ctx, repair)
+	d.observeTx("Fsck", start, err)
+	return report, err
+}
+
+// VerifyChunks lists the chunks of an inode whose object is missing
+func (d *Db) VerifyChunks(ctx context.Context, st storage.Storage, inode fuseops.InodeID) ([]uint64, error) {
+	start := time.Now()
+	missing, err := d.Db.VerifyChunks(ctx, st, inode)
+	d.observe("VerifyChunks", start, err)
+	return missing, err
+}
+
+// VerifyAllChunks lists the live chunks whose object is missing
+func (d *Db) VerifyAllChunks(ctx context.Context, st storage.Storage) ([]uint64, error) {
+	start := time.Now()
+	missing, err := d.Db.VerifyAllChunks(ctx, st)
+	d.observe("VerifyAllChunks", start, err)
+	return missing, err
+}
+
+// Export writes a portable dump of the file system
+func (d *Db) Export(ctx context.Context, w io.Writer) error {
+	start := time.Now()
+	err := d.Db.Export(ctx, w)
+	d.observe("Export", start, err)
+	return err
+}
+
+// Import recreates the contents of a dump
+func (d *Db) Import(ctx context.Context, r io.Reader) error {
+	start := time.Now()
+	err := d.Db.Import(ctx, r)
+	d.observe("Import", start, err)
+	return err
+}
+
+// Unlink removes an entry from the file system
+func (d *Db) Unlink(ctx context.Context, parent fuseops.InodeID, name string) error {
+	start := time.Now()
+	err := d.Db.Unlink(ctx, parent, name)
+	d.observeTx("Unlink", start, err)
+	return err
+}
+
+// RemoveTree removes an entry along with every entry below it
+func (d *Db) RemoveTree(ctx context.Context, parent fuseops.InodeID, name string, recursive bool) error {
+	start := time.Now()
+	err := d.Db.RemoveTree(ctx, parent, name, recursive)
+	d.observeTx("RemoveTree", start, err)
+	return err
+}
+
+// Snapshot copies a directory tree sharing the storage objects
+func (d *Db) Snapshot(ctx context.Context, srcInode fuseops.InodeID, dstParent fuseops.InodeID, dstName string) (*database.Entry, error) {
+	start := time.Now()
+	entry, err := d.Db.Snapshot(ctx, srcInode, dstParent, dstName)
+	d.observeTx("Snapshot", start, err)
+	return entry, err
+}
+
+// Rename renames an entry
+func (d *Db) Rename(ctx context.Context, oldParent fuseops.InodeID, oldName string, newParent fuseops.InodeID, newName string, flags uint32) error {
+	start := time.Now()
+	err := d.Db.Rename(ctx, oldParent, oldName, newParent, newName, flags)
+	d.observeTx("Rename", start, err)
+	return err
+}
+
+// LookUp finds the entry located under the specified parent with the specified name
+func (d *Db) LookUp(ctx context.Context, parent fuseops.InodeID, name string) (*database.Entry, error) {
+	start := time.Now()
+	entry, err := d.Db.LookUp(ctx, parent, name)
+	d.observe("LookUp", start, err)
+	return entry, err
+}
+
+// Get retrieves the stats of a particular inode
+func (d *Db) Get(ctx context.Context, inode fuseops.InodeID) (*database.Inode, error) {
+	start := time.Now()
+	result, err := d.Db.Get(ctx, inode)
+	d.observe("Get", start, err)
+	return result, err
+}
+
+// Statx retrieves the attributes of an inode along with its allocated blocks
+func (d *Db) Statx(ctx context.Context, inode fuseops.InodeID) (*database.Statx, error) {
+	start := time.Now()
+	statx, err := d.Db.Statx(ctx, inode)
+	d.observe("Statx", start, err)
+	return statx, err
+}
+
+// Paths retrieves the full paths reaching the given inode
+func (d *Db) Paths(ctx context.Context, inode fuseops.InodeID) (*[]string, error) {
+	start := time.Now()
+	paths, err := d.Db.Paths(ctx, inode)
+	d.observe("Paths", start, err)
+	return paths, err
+}
+
+// ReadLink retrieves the target of a symbolic link
+func (d *Db) ReadLink(ctx context.Context, inode fuseops.InodeID) (string, error) {
+	start := time.Now()
+	target, err := d.Db.ReadLink(ctx, inode)
+	d.observe("ReadLink", start, err)
+	return target, err
+}
+
+// Touch changes the stats of a file
+func (d *Db) Touch(ctx context.Context, inode fuseops.InodeID, size *uint64, mode *os.FileMode, atime *time.Time, mtime *time.Time, uid *uint32, gid *uint32) (*database.Inode, error) {
+	start := time.Now()
+	result, err := d.Db.Touch(ctx, inode, size, mode, atime, mtime, uid, gid)
+	d.observeTx("Touch", start, err)
+	return result, err
+}
+
+// Truncate changes the size of a file
+func (d *Db) Truncate(ctx context.Context, inode fuseops.InodeID, size uint64) error {
+	start := time.Now()
+	err := d.Db.Truncate(ctx, inode, size)
+	d.observeTx("Truncate", start, err)
+	return err
+}
+
+// SetImmutable sets or clears the immutable flag of an inode
+func (d *Db) SetImmutable(ctx context.Context, inode fuseops.InodeID, uid uint32, immutable bool, retainUntil *time.Time) error {
+	start := time.Now()
+	err := d.Db.SetImmutable(ctx, inode, uid, immutable, retainUntil)
+	d.observeTx("SetImmutable", start, err)
+	return err
+}
+
+// ChownTree changes the owner and group of a whole tree
+func (d *Db) ChownTree(ctx context.Context, inode fuseops.InodeID, uid *uint32, gid *uint32, fromUid *uint32) error {
+	start := time.Now()
+	err := d.Db.ChownTree(ctx, inode, uid, gid, fromUid)
+	d.observeTx("ChownTree", start, err)
+	return err
+}
+
+// ChmodTree changes the permissions of a whole tree
+func (d *Db) ChmodTree(ctx context.Context, inode fuseops.InodeID, dirMode os.FileMode, fileMode os.FileMode) error {
+	start := time.Now()
+	err := d.Db.ChmodTree(ctx, inode, dirMode, fileMode)
+	d.observeTx("ChmodTree", start, err)
+	return err
+}
+
+// AddChunk adds a chunk to the given inode
+func (d *Db) AddChunk(ctx context.Context, inode fuseops.InodeID, flags uint32, chunk database.Chunk) error {
+	start := time.Now()
+	err := d.Db.AddChunk(ctx, inode, flags, chunk)
+	d.observeTx("AddChunk", start, err)
+	return err
+}
+
+// CopyRange copies a range of an inode to another one sharing the storage objects
+func (d *Db) CopyRange(ctx context.Context, srcInode fuseops.InodeID, srcOffset uint64, dstInode fuseops.InodeID, dstOffset uint64, length uint64) (uint64, error) {
+	start := time.Now()
+	copied, err := d.Db.CopyRange(ctx, srcInode, srcOffset, dstInode, dstOffset, length)
+	d.observeTx("CopyRange", start, err)
+	return copied, err
+}
+
+// Fallocate reserves the given range of an inode
+func (d *Db) Fallocate(ctx context.Context, inode fuseops.InodeID, offset uint64, length uint64, mode uint32) error {
+	start := time.Now()
+	err := d.Db.Fallocate(ctx, inode, offset, length, mode)
+	d.observeTx("Fallocate", start, err)
+	return err
+}
+
+// ChunksByStorage lists the live chunks stored at the given storage
+func (d *Db) ChunksByStorage(ctx context.Context, storageName string, afterID uint64, limit int) (*[]database.Chunk, error) {
+	start := time.Now()
+	chunks, err := d.Db.ChunksByStorage(ctx, storageName, afterID, limit)
+	d.observe("ChunksByStorage", start, err)
+	return chunks, err
+}
+
+// MigrateChunk points a live chunk to a copy of its object at another storage
+func (d *Db) MigrateChunk(ctx context.Context, id uint64, newStorage string, newKey string) error {
+	start := time.Now()
+	err := d.Db.MigrateChunk(ctx, id, newStorage, newKey)
+	d.observeTx("MigrateChunk", start, err)
+	return err
+}
+
+// CompactChunks merges the contiguous chunks of an inode
+func (d *Db) CompactChunks(ctx context.Context, inode fuseops.InodeID) error {
+	start := time.Now()
+	err := d.Db.CompactChunks(ctx, inode)
+	d.observeTx("CompactChunks", start, err)
+	return err
+}
+
+// Defragment rewrites the small chunks of an inode into larger objects
+func (d *Db) Defragment(ctx context.Context, st storage.Storage, inode fuseops.InodeID, targetObjectSize uint64) error {
+	start := time.Now()
+	err := d.Db.Defragment(ctx, st, inode, targetObjectSize)
+	d.observeTx("Defragment", start, err)
+	return err
+}
+
+// RetierInode moves the chunks of an inode to another storage
+func (d *Db) RetierInode(ctx context.Context, st storage.Storage, inode fuseops.InodeID, target string) error {
+	start := time.Now()
+	err := d.Db.RetierInode(ctx, st, inode, target)
+	d.observeTx("RetierInode", start, err)
+	return err
+}
+
+// Chunks grabs the chunks for the given inode
+func (d *Db) Chunks(ctx context.Context, inode fuseops.InodeID) (*[]database.Chunk, error) {
+	start := time.Now()
+	chunks, err := d.Db.Chunks(ctx, inode)
+	d.observe("Chunks", start, err)
+	return chunks, err
+}
+
+// ChunksInRange grabs the chunks of the given inode which overlap the
+// provided byte range
+func (d *Db) ChunksInRange(ctx context.Context, inode fuseops.InodeID, offset uint64, length uint64) (*[]database.Chunk, error) {
+	start := time.Now()
+	chunks, err := d.Db.ChunksInRange(ctx, inode, offset, length)
+	d.observe("ChunksInRange", start, err)
+	return chunks, err
+}
+
+// Children gets the list of children for the given inode
+func (d *Db) Children(ctx context.Context, inode fuseops.InodeID) (*[]database.Child, error) {
+	start := time.Now()
+	children, err := d.Db.Children(ctx, inode)
+	d.observe("Children", start, err)
+	return children, err
+}
+
+// ChildCount counts the children of the given inode
+func (d *Db) ChildCount(ctx context.Context, inode fuseops.InodeID) (uint64, error) {
+	start := time.Now()
+	count, err := d.Db.ChildCount(ctx, inode)
+	d.observe("ChildCount", start, err)
+	return count, err
+}
+
+// ChildrenPage gets up to limit children of the given inode whose name sorts
+// after afterName
+func (d *Db) ChildrenPage(ctx context.Context, inode fuseops.InodeID, afterName string, limit int) (*[]database.Child, error) {
+	start := time.Now()
+	children, err := d.Db.ChildrenPage(ctx, inode, afterName, limit)
+	d.observe("ChildrenPage", start, err)
+	return children, err
+}
+
+// ChildrenPlus gets the children of the given inode along with their attributes
+func (d *Db) ChildrenPlus(ctx context.Context, inode fuseops.InodeID) (*[]database.Entry, error) {
+	start := time.Now()
+	entries, err := d.Db.ChildrenPlus(ctx, inode)
+	d.observe("ChildrenPlus", start, err)
+	return entries, err
+}
+
+// ListXattr retrieves the list of extended attributes for the given inode
+func (d *Db) ListXattr(ctx context.Context, inode fuseops.InodeID) (*[]string, error) {
+	start := time.Now()
+	keys, err := d.Db.ListXattr(ctx, inode)
+	d.observe("ListXattr", start, err)
+	return keys, err
+}
+
+// RemoveXattr removes an extended attribute
+func (d *Db) RemoveXattr(ctx context.Context, inode fuseops.InodeID, attr string) error {
+	start := time.Now()
+	err := d.Db.RemoveXattr(ctx, inode, attr)
+	d.observeTx("RemoveXattr", start, err)
+	return err
+}
+
+// GetXattr retrieves the value of an extended attribute
+func (d *Db) GetXattr(ctx context.Context, inode fuseops.InodeID, attr string) (*[]byte, error) {
+	start := time.Now()
+	value, err := d.Db.GetXattr(ctx, inode, attr)
+	d.observe("GetXattr", start, err)
+	return value, err
+}
+
+// GetXattrSize retrieves the size of the value of an extended attribute
+func (d *Db) GetXattrSize(ctx context.Context, inode fuseops.InodeID, attr string) (uint64, error) {
+	start := time.Now()
+	size, err := d.Db.GetXattrSize(ctx, inode, attr)
+	d.observe("GetXattrSize", start, err)
+	return size, err
+}
+
+// SetXattr sets the value of an extended attribute
+func (d *Db) SetXattr(ctx context.Context, inode fuseops.InodeID, attr string, value []byte, flags uint32) error {
+	start := time.Now()
+	err := d.Db.SetXattr(ctx, inode, attr, value, flags)
+	d.observeTx("SetXattr", start, err)
+	return err
+}
+
+// GetAllXattr retrieves all the extended attributes of an inode
+func (d *Db) GetAllXattr(ctx context.Context, inode fuseops.InodeID) (map[string][]byte, error) {
+	start := time.Now()
+	result, err := d.Db.GetAllXattr(ctx, inode)
+	d.observe("GetAllXattr", start, err)
+	return result, err
+}
+
+// SwapXattr sets the value of an extended attribute if it holds the expected one
+func (d *Db) SwapXattr(ctx context.Context, inode fuseops.InodeID, attr string, expected []byte, value []byte) (bool, error) {
+	start := time.Now()
+	swapped, err := d.Db.SwapXattr(ctx, inode, attr, expected, value)
+	d.observeTx("SwapXattr", start, err)
+	return swapped, err
+}
+
+// SetAllXattr replaces the whole set of extended attributes of an inode
+func (d *Db) SetAllXattr(ctx context.Context, inode fuseops.InodeID, attrs map[string][]byte) error {
+	start := time.Now()
+	err := d.Db.SetAllXattr(ctx, inode, attrs)
+	d.observeTx("SetAllXattr", start, err)
+	return err
+}
+
+// GetLock returns a lock conflicting with the given one, if any
+func (d *Db) GetLock(ctx context.Context, inode fuseops.InodeID, owner uint64, start uint64, length uint64, lockType database.LockType) (*database.Lock, error) {
+	begin := time.Now()
+	lock, err := d.Db.GetLock(ctx, inode, owner, start, length, lockType)
+	d.observe("GetLock", begin, err)
+	return lock, err
+}
+
+// SetLock takes or releases an advisory lock over a byte range of an inode
+func (d *Db) SetLock(ctx context.Context, inode fuseops.InodeID, owner uint64, start uint64, length uint64, lockType database.LockType) error {
+	begin := time.Now()
+	err := d.Db.SetLock(ctx, inode, owner, start, length, lockType)
+	d.observeTx("SetLock", begin, err)
+	return err
+}
+
+// ClearLocks releases every lock held by an owner
+func (d *Db) ClearLocks(ctx context.Context, owner uint64) error {
+	start := time.Now()
+	err := d.Db.ClearLocks(ctx, owner)
+	d.observeTx("ClearLocks", start, err)
+	return err
+}
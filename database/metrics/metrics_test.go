@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"syscall"
+	"testing"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockDb struct {
+	database.Db
+}
+
+func (m mockDb) LookUp(ctx context.Context, parent fuseops.InodeID, name string) (*database.Entry, error) {
+	if name == "missing" {
+		return nil, syscall.ENOENT
+	}
+
+	return &database.Entry{Parent: parent, Name: name}, nil
+}
+
+func (m mockDb) AddChunk(ctx context.Context, inode fuseops.InodeID, flags uint32, chunk database.Chunk) error {
+	return syscall.EDQUOT
+}
+
+func (m mockDb) PoolStats() sql.DBStats {
+	return sql.DBStats{OpenConnections: 3}
+}
+
+func TestWithMetrics(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewRegistry()
+
+	db, err := WithMetrics(mockDb{}, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.LookUp(ctx, fuseops.RootInodeID, "file")
+	assert.Nil(t, err)
+
+	_, err = db.LookUp(ctx, fuseops.RootInodeID, "missing")
+	assert.Equal(t, syscall.ENOENT, err)
+
+	assert.Equal(t, syscall.EDQUOT, db.AddChunk(ctx, fuseops.RootInodeID, 0, database.Chunk{}))
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(db.operations.WithLabelValues("LookUp")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(db.errors.WithLabelValues("LookUp")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(db.operations.WithLabelValues("AddChunk")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(db.errors.WithLabelValues("AddChunk")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(db.rollbacks))
+	assert.Equal(t, 2, testutil.CollectAndCount(db.latency))
+
+	families, err := reg.Gather()
+	assert.Nil(t, err)
+
+	for _, family := range families {
+		if family.GetName() == "titan_db_open_connections" {
+			assert.Equal(t, float64(3), family.GetMetric()[0].GetGauge().GetValue())
+			return
+		}
+	}
+
+	t.Error("titan_db_open_connections was not registered")
+}
+
+func TestWithMetricsTwice(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	_, err := WithMetrics(mockDb{}, reg)
+	assert.Nil(t, err)
+
+	_, err = WithMetrics(mockDb{}, reg)
+	assert.NotNil(t, err)
+}
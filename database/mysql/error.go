@@ -1,11 +1,44 @@
 package mysql
 
 import (
+	"context"
+	"database/sql/driver"
+	"errors"
 	"syscall"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
+	"github.com/manvalls/titan/database"
 )
 
+// errTablePrefix is returned by Open when the table prefix could be used to
+// inject SQL, or is too long
+var errTablePrefix = errors.New("Table prefix may only contain up to 50 letters, digits and underscores")
+
+// ErrLockTimeout is returned by WithLock when another client still holds the
+// lock once LockTimeout elapses
+var ErrLockTimeout = errors.New("Timed out waiting for a lock held by another client")
+
+// errDupEntry is returned by MySQL when a unique key is violated
+const errDupEntry = 1062
+
+// Errors returned by MySQL when deleting a row a foreign key references
+const (
+	errRowIsReferenced  = 1217
+	errRowIsReferenced2 = 1451
+)
+
+// Errors returned by InnoDB when a transaction is aborted because of the
+// locks held by another one, in which case it can be safely run again
+const (
+	errLockWaitTimeout = 1205
+	errDeadlock        = 1213
+)
+
+// deadlockDelay is the time waited before the first retry of a transaction
+// aborted by a deadlock, doubling after every attempt
+const deadlockDelay = 10 * time.Millisecond
+
 func treatError(err error) error {
 	me, ok := err.(*mysql.MySQLError)
 	if !ok {
@@ -13,9 +46,62 @@ func treatError(err error) error {
 	}
 
 	switch me.Number {
-	case 1062:
+	case errDupEntry:
 		return syscall.EEXIST
 	default:
 		return err
 	}
 }
+
+// treatForgetError reports the foreign key violations raised when deleting
+// an inode something still references as database.ErrReferenced
+func treatForgetError(err error) error {
+	me, ok := err.(*mysql.MySQLError)
+	if ok && (me.Number == errRowIsReferenced || me.Number == errRowIsReferenced2) {
+		return database.ErrReferenced
+	}
+
+	return treatError(err)
+}
+
+// isBadConn checks whether the given error was caused by a broken connection
+func isBadConn(err error) bool {
+	return err == driver.ErrBadConn || err == mysql.ErrInvalidConn
+}
+
+// retry runs the given read-only operation once more if it failed because of
+// a broken connection, which is discarded by then so that the second attempt
+// runs on a fresh one
+func retry(fn func() error) error {
+	err := fn()
+	if isBadConn(err) {
+		err = fn()
+	}
+
+	return err
+}
+
+// isDeadlock checks whether the given error aborted a transaction because of
+// a deadlock or a lock wait timeout
+func isDeadlock(err error) bool {
+	me, ok := err.(*mysql.MySQLError)
+	return ok && (me.Number == errDeadlock || me.Number == errLockWaitTimeout)
+}
+
+// retryDeadlocks runs the given transactional operation again while it's
+// aborted by a deadlock or a lock wait timeout, up to DeadlockRetries times
+// and waiting a growing delay between attempts
+func (d *Driver) retryDeadlocks(ctx context.Context, fn func() error) error {
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || !isDeadlock(err) || i >= d.DeadlockRetries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(deadlockDelay << uint(i)):
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package mysql
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/manvalls/fuse/fuseops"
+)
+
+// Logger receives the operations found slow by the driver, as done by
+// *slog.Logger
+type Logger interface {
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+}
+
+// untracked is returned by track when there's no Logger
+func untracked(*error) {}
+
+// track starts timing an operation, returning the function to defer with its
+// result so that it's logged if it took longer than SlowThreshold. Committed
+// operations are logged at info level, while the ones rolled back because of
+// an error are logged at warn level along with the errno they failed with.
+// Operations not bound to an inode are given a zero one.
+func (d *Driver) track(method string, inode fuseops.InodeID) func(*error) {
+	if d.Logger == nil {
+		return untracked
+	}
+
+	now := d.now
+	if now == nil {
+		now = time.Now
+	}
+
+	start := now()
+	return func(err *error) {
+		elapsed := now().Sub(start)
+		if elapsed < d.SlowThreshold {
+			return
+		}
+
+		args := []interface{}{"method", method, "elapsed", elapsed}
+		if inode != 0 {
+			args = append(args, "inode", uint64(inode))
+		}
+
+		if *err == nil {
+			d.Logger.Info("Slow operation", append(args, "result", "commit")...)
+			return
+		}
+
+		args = append(args, "result", "rollback", "error", (*err).Error())
+		if errno, ok := (*err).(syscall.Errno); ok {
+			args = append(args, "errno", int(errno))
+		}
+
+		d.Logger.Warn("Slow operation", args...)
+	}
+}
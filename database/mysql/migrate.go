@@ -0,0 +1,176 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"syscall"
+)
+
+// migrations upgrade the schema from one version to the next one, the first
+// of them upgrading version 1 to 2. They must be idempotent, as MySQL commits implicitly after
+// every DDL statement.
+var migrations = []func(d Driver, ctx context.Context, tx *sql.Tx) error{
+	Driver.createQuotas,
+	Driver.createChunksObjectIndex,
+	Driver.addChunksHash,
+	Driver.addInodesRdev,
+	Driver.addInodesFlags,
+	Driver.createLocks,
+	Driver.addChunksETag,
+	Driver.addChunksChecksum,
+}
+
+// schemaVersion is the version of the schema created by Setup
+var schemaVersion = len(migrations) + 1
+
+func (d Driver) createQuotas(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, d.tables("CREATE TABLE IF NOT EXISTS {quotas} (kind TINYINT UNSIGNED NOT NULL, id INT UNSIGNED NOT NULL, bytes BIGINT UNSIGNED NOT NULL, inodes BIGINT UNSIGNED NOT NULL, usedbytes BIGINT UNSIGNED NOT NULL, usedinodes BIGINT UNSIGNED NOT NULL, PRIMARY KEY (kind, id))"))
+	return err
+}
+
+// createChunksObjectIndex indexes chunks by the object they point to, so that
+// objects still referenced by live chunks can be found quickly
+func (d Driver) createChunksObjectIndex(ctx context.Context, tx *sql.Tx) error {
+	var count int
+
+	err := tx.QueryRowContext(ctx, d.tables("SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = '{chunks}' AND index_name = 'chunks_object'")).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, d.tables("CREATE INDEX chunks_object ON {chunks} (storage, `key`)"))
+	return err
+}
+
+// addChunksHash stores the hash of the data of chunks, indexed so that
+// chunks holding the same data can be deduplicated
+func (d Driver) addChunksHash(ctx context.Context, tx *sql.Tx) error {
+	var count int
+
+	err := tx.QueryRowContext(ctx, d.tables("SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = '{chunks}' AND column_name = 'hash'")).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, d.tables("ALTER TABLE {chunks} ADD COLUMN hash VARCHAR(64), ADD INDEX chunks_hash (hash)"))
+	return err
+}
+
+// addInodesRdev stores the device number of character and block devices
+func (d Driver) addInodesRdev(ctx context.Context, tx *sql.Tx) error {
+	var count int
+
+	err := tx.QueryRowContext(ctx, d.tables("SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = '{inodes}' AND column_name = 'rdev'")).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, d.tables("ALTER TABLE {inodes} ADD COLUMN rdev INT UNSIGNED NOT NULL DEFAULT 0"))
+	return err
+}
+
+// addInodesFlags stores the flags of inodes, along with the date until which
+// immutable inodes are retained
+func (d Driver) addInodesFlags(ctx context.Context, tx *sql.Tx) error {
+	var count int
+
+	err := tx.QueryRowContext(ctx, d.tables("SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = '{inodes}' AND column_name = 'flags'")).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, d.tables("ALTER TABLE {inodes} ADD COLUMN flags INT UNSIGNED NOT NULL DEFAULT 0, ADD COLUMN retainuntil DATETIME"))
+	return err
+}
+
+// createLocks stores the advisory locks held over byte ranges of inodes
+func (d Driver) createLocks(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, d.tables("CREATE TABLE IF NOT EXISTS {locks} (inode BIGINT UNSIGNED NOT NULL, owner BIGINT NOT NULL, startoffset BIGINT UNSIGNED NOT NULL, endoffset BIGINT UNSIGNED NOT NULL, kind TINYINT UNSIGNED NOT NULL, INDEX (inode), INDEX (owner), FOREIGN KEY (inode) REFERENCES {inodes}(id))"))
+	return err
+}
+
+// addChunksETag stores the ETag and version reported by the storage for the
+// objects of chunks, so that overwritten objects can be detected
+func (d Driver) addChunksETag(ctx context.Context, tx *sql.Tx) error {
+	var count int
+
+	err := tx.QueryRowContext(ctx, d.tables("SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = '{chunks}' AND column_name = 'etag'")).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, d.tables("ALTER TABLE {chunks} ADD COLUMN etag VARCHAR(255), ADD COLUMN version VARCHAR(255)"))
+	return err
+}
+
+// addChunksChecksum stores the checksum of the data of chunks, so that
+// corrupted objects can be detected when reading them
+func (d Driver) addChunksChecksum(ctx context.Context, tx *sql.Tx) error {
+	var count int
+
+	err := tx.QueryRowContext(ctx, d.tables("SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = '{chunks}' AND column_name = 'checksum'")).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, d.tables("ALTER TABLE {chunks} ADD COLUMN checksum VARCHAR(8)"))
+	return err
+}
+
+// Migrate upgrades the schema of an existing database to the current version,
+// applying every pending migration in its own transaction along with the
+// version it leads to. Databases created before schemas were versioned are
+// considered to be at version 1.
+func (d *Driver) Migrate(ctx context.Context) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if _, err := d.DB.ExecContext(ctx, d.tables("CREATE TABLE IF NOT EXISTS {schema_version} (version INT UNSIGNED NOT NULL)")); err != nil {
+		return treatError(err)
+	}
+
+	if _, err := d.DB.ExecContext(ctx, d.tables("INSERT INTO {schema_version}(version) SELECT 1 FROM DUAL WHERE NOT EXISTS (SELECT * FROM {schema_version})")); err != nil {
+		return treatError(err)
+	}
+
+	for {
+		done, err := d.migrate(ctx)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// migrate applies the next pending migration, reporting whether the schema
+// was already up to date
+func (d *Driver) migrate(ctx context.Context) (bool, error) {
+	var version int
+
+	tx, err := d.DB.BeginTx(ctx, d.txOptions())
+	if err != nil {
+		return false, treatError(err)
+	}
+
+	if err = tx.QueryRowContext(ctx, d.tables("SELECT version FROM {schema_version} FOR UPDATE")).Scan(&version); err != nil {
+		tx.Rollback()
+		return false, treatError(err)
+	}
+
+	if version >= schemaVersion {
+		tx.Rollback()
+		return true, nil
+	}
+
+	if err = migrations[version-1](*d, ctx, tx); err != nil {
+		tx.Rollback()
+		return false, treatError(err)
+	}
+
+	if _, err = tx.ExecContext(ctx, d.tables("UPDATE {schema_version} SET version = ?"), version+1); err != nil {
+		tx.Rollback()
+		return false, treatError(err)
+	}
+
+	return false, tx.Commit()
+}
@@ -0,0 +1,565 @@
+package mysql
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database/dbtest"
+	"github.com/manvalls/titan/database/stmt"
+	"github.com/stretchr/testify/assert"
+)
+
+// openTestDriver connects to an empty test database
+func openTestDriver(t testing.TB, opts ...Option) *Driver {
+	uri := os.Getenv("TITAN_TEST_MYSQL_URI")
+	if uri == "" {
+		t.Skip("TITAN_TEST_MYSQL_URI is not set")
+	}
+
+	d := New(uri, opts...)
+	if err := d.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range []string{"locks", "xattr", "chunks", "entries", "stats", "quotas", "schema_version", "inodes"} {
+		if _, err := d.DB.Exec("DROP TABLE IF EXISTS " + d.TablePrefix + table); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return d
+}
+
+func getTestDriver(t testing.TB, opts ...Option) *Driver {
+	d := openTestDriver(t, opts...)
+	if err := d.Setup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return d
+}
+
+func TestDriver(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	dbtest.Run(t, d)
+}
+
+func TestFsStats(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	d.Capacity = 1 << 30
+	dbtest.FsStats(t, d)
+}
+
+func TestBlockSize(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	d.BlockSize = 1 << 16
+	dbtest.BlockSize(t, d, 1<<16)
+}
+
+func TestStatsUnderflow(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	dbtest.StatsUnderflow(t, d, d.DB)
+}
+
+func TestFsck(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	dbtest.Fsck(t, d, d.DB)
+}
+
+func TestForgetRace(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	dbtest.ForgetRace(t, d, d.DB)
+}
+
+func TestLeakedAnonymous(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	dbtest.LeakedAnonymous(t, d, d.DB)
+}
+
+func TestAtime(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	dbtest.Atime(t, d, d.DB, &d.Atime)
+}
+
+func TestDedup(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	d.Dedup = true
+	dbtest.Dedup(t, d)
+}
+
+func TestAudit(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	dbtest.Audit(t, d, &d.AuditHook)
+}
+
+func TestRowsErrors(t *testing.T) {
+	db := dbtest.FailingDB()
+	defer db.Close()
+
+	d := &Driver{DB: db, stmts: stmt.NewCache(db)}
+	dbtest.RowsErrors(t, d)
+}
+
+func TestRetry(t *testing.T) {
+	calls := 0
+	err := retry(func() error {
+		calls++
+		if calls == 1 {
+			return driver.ErrBadConn
+		}
+
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, calls)
+
+	calls = 0
+	failure := errors.New("failure")
+	err = retry(func() error {
+		calls++
+		return failure
+	})
+
+	assert.Equal(t, failure, err)
+	assert.Equal(t, 1, calls)
+
+	calls = 0
+	err = retry(func() error {
+		calls++
+		return driver.ErrBadConn
+	})
+
+	assert.Equal(t, driver.ErrBadConn, err)
+	assert.Equal(t, 2, calls)
+}
+
+func TestRetryDeadlocks(t *testing.T) {
+	ctx := context.Background()
+	d := New("", WithDeadlockRetries(2))
+
+	calls := 0
+	err := d.retryDeadlocks(ctx, func() error {
+		calls++
+		if calls == 1 {
+			return &mysql.MySQLError{Number: errDeadlock}
+		}
+
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, calls)
+
+	calls = 0
+	timeout := &mysql.MySQLError{Number: errLockWaitTimeout}
+	err = d.retryDeadlocks(ctx, func() error {
+		calls++
+		return timeout
+	})
+
+	assert.Equal(t, timeout, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = d.retryDeadlocks(ctx, func() error {
+		calls++
+		return syscall.ENOENT
+	})
+
+	assert.Equal(t, syscall.ENOENT, err)
+	assert.Equal(t, 1, calls)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	calls = 0
+	err = d.retryDeadlocks(cancelled, func() error {
+		calls++
+		return timeout
+	})
+
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 1, calls)
+}
+
+func BenchmarkChildren(b *testing.B) {
+	d := getTestDriver(b)
+	defer d.Close()
+
+	benchmarkChildren(b, d)
+}
+
+func benchmarkChildren(b *testing.B, d *Driver) {
+	ctx := context.Background()
+	dir := dbtest.Mkdir(b, d, fuseops.RootInodeID)
+
+	for i := 0; i < 10000; i++ {
+		dbtest.Mkfile(b, d, dir)
+	}
+
+	list := func(b *testing.B, rows *sql.Rows, err error) {
+		var inode uint64
+		var mode uint32
+		var name string
+
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		defer rows.Close()
+
+		for rows.Next() {
+			if err = rows.Scan(&inode, &name, &mode); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("Prepared", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s, err := d.stmts.Get(ctx, d.tables(childrenQuery))
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			rows, err := s.QueryContext(ctx, uint64(dir))
+			list(b, rows, err)
+		}
+	})
+
+	b.Run("Unprepared", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			rows, err := d.DB.QueryContext(ctx, d.tables(childrenQuery), uint64(dir))
+			list(b, rows, err)
+		}
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	d := openTestDriver(t)
+	defer d.Close()
+
+	if err := d.setup(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	dbtest.Migrate(t, d, d.DB, schemaVersion)
+}
+
+func TestReadOnly(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	dbtest.ReadOnly(t, d, &d.ReadOnly)
+}
+
+func TestTablePrefix(t *testing.T) {
+	ctx := context.Background()
+
+	a := getTestDriver(t, WithTablePrefix("tenant1_"))
+	defer a.Close()
+
+	b := getTestDriver(t, WithTablePrefix("tenant2_"))
+	defer b.Close()
+
+	dbtest.Run(t, a)
+
+	children, err := b.Children(ctx, fuseops.RootInodeID)
+	assert.Nil(t, err)
+	assert.Empty(t, *children)
+
+	stats, err := b.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), stats.Inodes)
+	assert.Equal(t, uint64(0), stats.Size)
+
+	file := dbtest.Mkfile(t, b, fuseops.RootInodeID)
+
+	_, err = a.LookUp(ctx, fuseops.RootInodeID, file.Name)
+	assert.Equal(t, syscall.ENOENT, err)
+
+	entry, err := b.LookUp(ctx, fuseops.RootInodeID, file.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, file.ID, entry.ID)
+}
+
+func TestInvalidTablePrefix(t *testing.T) {
+	for _, prefix := range []string{"tenant-1", "t`; DROP TABLE inodes; --", "t.", strings.Repeat("t", 51)} {
+		assert.Equal(t, errTablePrefix, New("titan@tcp(127.0.0.1:3306)/titan", WithTablePrefix(prefix)).Open())
+	}
+
+	d := New("titan@tcp(127.0.0.1:3306)/titan", WithTablePrefix(strings.Repeat("t", 50)))
+	assert.Nil(t, d.Open())
+	d.Close()
+}
+
+func TestTryLock(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	other := New(d.DbURI)
+	if err := other.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer other.Close()
+
+	dbtest.TryLock(t, d, other)
+}
+
+func TestTryLockLongPrefix(t *testing.T) {
+	prefix := strings.Repeat("t", maxTablePrefix)
+	d := getTestDriver(t, WithTablePrefix(prefix))
+	defer d.Close()
+
+	other := New(d.DbURI, WithTablePrefix(prefix))
+	if err := other.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer other.Close()
+
+	dbtest.TryLock(t, d, other)
+
+	// Names longer than the limit of MySQL are taken as well
+	release, err := d.TryLock(context.Background(), strings.Repeat("l", 64))
+	assert.Nil(t, err)
+	if assert.NotNil(t, release) {
+		release()
+	}
+}
+
+func TestWithLock(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	other := New(d.DbURI, WithLockTimeout(time.Second))
+	if err := other.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer other.Close()
+
+	ran := false
+	err := d.WithLock(context.Background(), "test", func() error {
+		start := time.Now()
+		assert.Equal(t, ErrLockTimeout, other.WithLock(context.Background(), "test", func() error {
+			t.Error("fn shouldn't run while another client holds the lock")
+			return nil
+		}))
+
+		assert.True(t, time.Since(start) >= time.Second, "the lock should be waited for")
+		assert.Nil(t, other.WithLock(context.Background(), "other", func() error { return nil }))
+
+		ran = true
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.True(t, ran)
+
+	fnErr := errors.New("failed")
+	assert.Equal(t, fnErr, other.WithLock(context.Background(), "test", func() error { return fnErr }))
+	assert.Nil(t, d.WithLock(context.Background(), "test", func() error { return nil }), "the lock should be released even if fn fails")
+
+	held := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- d.WithLock(context.Background(), "test", func() error {
+			close(held)
+			time.Sleep(100 * time.Millisecond)
+			return nil
+		})
+	}()
+
+	<-held
+	assert.Nil(t, other.WithLock(context.Background(), "test", func() error { return nil }), "locks released within the timeout should be taken")
+	assert.Nil(t, <-done)
+}
+
+func TestDSN(t *testing.T) {
+	d := New("titan@tcp(127.0.0.1:3306)/titan", WithTLSConfig("titan-test", &tls.Config{}), WithCollation("utf8mb4_bin"), WithTimeout(5*time.Second))
+	assert.Nil(t, d.Open())
+	d.Close()
+
+	dsn, err := d.dsn()
+	assert.Nil(t, err)
+
+	cfg, err := mysql.ParseDSN(dsn)
+	assert.Nil(t, err)
+	assert.True(t, cfg.ParseTime)
+	assert.Equal(t, "titan-test", cfg.TLSConfig)
+	assert.Equal(t, "utf8mb4_bin", cfg.Collation)
+	assert.Equal(t, 5*time.Second, cfg.Timeout)
+
+	d.DbURI = "titan@tcp(127.0.0.1:3306)/titan?tls=skip-verify&collation=latin1_swedish_ci&timeout=1s&readTimeout=2s"
+	dsn, err = d.dsn()
+	assert.Nil(t, err)
+
+	cfg, err = mysql.ParseDSN(dsn)
+	assert.Nil(t, err)
+	assert.True(t, cfg.ParseTime)
+	assert.Equal(t, "skip-verify", cfg.TLSConfig)
+	assert.Equal(t, "latin1_swedish_ci", cfg.Collation)
+	assert.Equal(t, time.Second, cfg.Timeout)
+	assert.Equal(t, 2*time.Second, cfg.ReadTimeout)
+
+	d = New("titan@tcp(127.0.0.1:3306)/titan?parseTime=true")
+	dsn, err = d.dsn()
+	assert.Nil(t, err)
+	assert.Equal(t, "titan@tcp(127.0.0.1:3306)/titan?parseTime=true", dsn)
+
+	d.DbURI = "titan@tcp(127.0.0.1:3306)/titan?timeout=bogus"
+	_, err = d.dsn()
+	assert.NotNil(t, err)
+}
+
+func TestDSNParseTime(t *testing.T) {
+	for _, uri := range []string{
+		"titan@tcp(127.0.0.1:3306)/titan",
+		"titan@tcp(127.0.0.1:3306)/titan?parseTime=true",
+		"titan@tcp(127.0.0.1:3306)/titan?parseTime=false",
+		"titan@tcp(127.0.0.1:3306)/titan?charset=utf8mb4&loc=Local",
+	} {
+		dsn, err := New(uri).dsn()
+		assert.Nil(t, err)
+		assert.Equal(t, 1, strings.Count(dsn, "?"), dsn)
+
+		cfg, err := mysql.ParseDSN(dsn)
+		assert.Nil(t, err)
+		assert.True(t, cfg.ParseTime, dsn)
+	}
+
+	dsn, err := New("titan@tcp(127.0.0.1:3306)/titan?charset=utf8mb4&loc=Local").dsn()
+	assert.Nil(t, err)
+	assert.Contains(t, dsn, "charset=utf8mb4")
+	assert.Contains(t, dsn, "loc=Local")
+}
+
+func TestTables(t *testing.T) {
+	d := Driver{TablePrefix: "tenant1_"}
+	assert.Equal(t, "SELECT i.id FROM tenant1_inodes i, tenant1_entries e WHERE i.id = e.inode", d.tables("SELECT i.id FROM {inodes} i, {entries} e WHERE i.id = e.inode"))
+
+	d.TablePrefix = ""
+	assert.Equal(t, "UPDATE stats SET inodes = inodes + 1", d.tables("UPDATE {stats} SET inodes = inodes + 1"))
+}
+
+func TestDump(t *testing.T) {
+	src := getTestDriver(t)
+	defer src.Close()
+
+	dst := getTestDriver(t, WithTablePrefix("dump_"))
+	defer dst.Close()
+
+	dbtest.Dump(t, src, dst)
+}
+
+// testLogger records the messages it's told
+type testLogger struct {
+	infos [][]interface{}
+	warns [][]interface{}
+}
+
+func (l *testLogger) Info(msg string, args ...interface{}) {
+	l.infos = append(l.infos, append([]interface{}{msg}, args...))
+}
+
+func (l *testLogger) Warn(msg string, args ...interface{}) {
+	l.warns = append(l.warns, append([]interface{}{msg}, args...))
+}
+
+// ticking returns a fake clock moving forward the given step every time it's
+// read
+func ticking(step time.Duration) func() time.Time {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	return func() time.Time {
+		now = now.Add(step)
+		return now
+	}
+}
+
+func TestSlowLog(t *testing.T) {
+	l := &testLogger{}
+	d := New("", WithLogger(l, time.Second), WithReadOnly(true))
+
+	d.now = ticking(time.Millisecond)
+	assert.Equal(t, syscall.EROFS, d.Rename(context.Background(), 1, "a", 1, "b", 0))
+	assert.Empty(t, l.infos)
+	assert.Empty(t, l.warns)
+
+	d.now = ticking(2 * time.Second)
+	assert.Equal(t, syscall.EROFS, d.Rename(context.Background(), 1, "a", 1, "b", 0))
+	assert.Empty(t, l.infos)
+	assert.Equal(t, [][]interface{}{{
+		"Slow operation", "method", "Rename", "elapsed", 2 * time.Second, "inode", uint64(1),
+		"result", "rollback", "error", syscall.EROFS.Error(), "errno", int(syscall.EROFS),
+	}}, l.warns)
+
+	var err error
+	done := d.track("CleanOrphanInodes", 0)
+	done(&err)
+
+	assert.Equal(t, [][]interface{}{{
+		"Slow operation", "method", "CleanOrphanInodes", "elapsed", 2 * time.Second, "result", "commit",
+	}}, l.infos)
+}
+
+func TestSlowLogDisabled(t *testing.T) {
+	d := New("", WithReadOnly(true))
+	d.now = func() time.Time {
+		t.Fatal("operations shouldn't be timed without a logger")
+		return time.Time{}
+	}
+
+	assert.Equal(t, syscall.EROFS, d.Rename(context.Background(), 1, "a", 1, "b", 0))
+}
+
+func TestSlowLogCommit(t *testing.T) {
+	l := &testLogger{}
+	d := getTestDriver(t, WithLogger(l, 0))
+	defer d.Close()
+
+	file := dbtest.Mkfile(t, d, fuseops.RootInodeID)
+	assert.Nil(t, d.Unlink(context.Background(), fuseops.RootInodeID, file.Name))
+	assert.Equal(t, syscall.ENOENT, d.Unlink(context.Background(), fuseops.RootInodeID, file.Name))
+
+	if assert.Len(t, l.infos, 2) {
+		assert.Equal(t, []interface{}{"Slow operation", "method", "Create"}, l.infos[0][:3])
+		assert.Equal(t, []interface{}{"Slow operation", "method", "Unlink"}, l.infos[1][:3])
+	}
+
+	if assert.Len(t, l.warns, 1) {
+		assert.Equal(t, []interface{}{"errno", int(syscall.ENOENT)}, l.warns[0][len(l.warns[0])-2:])
+	}
+}
@@ -0,0 +1,191 @@
+package mysql
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"time"
+
+	"github.com/manvalls/titan/database"
+)
+
+// Default connection pool settings used by New
+const (
+	DefaultMaxOpenConns    = 64
+	DefaultMaxIdleConns    = 16
+	DefaultConnMaxLifetime = 5 * time.Minute
+	DefaultConnMaxIdleTime = 1 * time.Minute
+)
+
+// DefaultDeadlockRetries is the number of times writes aborted by a deadlock
+// are retried by default
+const DefaultDeadlockRetries = 3
+
+// DefaultLockTimeout is the time WithLock waits for a lock by default
+const DefaultLockTimeout = 10 * time.Second
+
+// DefaultTLSConfigName is the name TLS configurations are registered under
+// when none is given
+const DefaultTLSConfigName = "titan"
+
+// Option configures a Driver built by New
+type Option func(*Driver)
+
+// New builds a Driver for the given DSN. Unless overridden by the provided
+// options, the connection pool keeps at most DefaultMaxOpenConns open
+// connections, DefaultMaxIdleConns of them idle, and recycles connections
+// after DefaultConnMaxLifetime or DefaultConnMaxIdleTime of inactivity.
+// Writes aborted by deadlocks are retried DefaultDeadlockRetries times.
+func New(dsn string, opts ...Option) *Driver {
+	d := &Driver{
+		DbURI:           dsn,
+		MaxOpenConns:    DefaultMaxOpenConns,
+		MaxIdleConns:    DefaultMaxIdleConns,
+		ConnMaxLifetime: DefaultConnMaxLifetime,
+		ConnMaxIdleTime: DefaultConnMaxIdleTime,
+		DeadlockRetries: DefaultDeadlockRetries,
+	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	return d
+}
+
+// WithMaxOpenConns sets the maximum amount of open connections
+func WithMaxOpenConns(n int) Option {
+	return func(d *Driver) {
+		d.MaxOpenConns = n
+	}
+}
+
+// WithMaxIdleConns sets the maximum amount of idle connections
+func WithMaxIdleConns(n int) Option {
+	return func(d *Driver) {
+		d.MaxIdleConns = n
+	}
+}
+
+// WithConnMaxLifetime sets the maximum amount of time a connection may be reused
+func WithConnMaxLifetime(t time.Duration) Option {
+	return func(d *Driver) {
+		d.ConnMaxLifetime = t
+	}
+}
+
+// WithConnMaxIdleTime sets the maximum amount of time a connection may be idle
+func WithConnMaxIdleTime(t time.Duration) Option {
+	return func(d *Driver) {
+		d.ConnMaxIdleTime = t
+	}
+}
+
+// WithTLSConfig sets the TLS configuration of connections, registered under
+// the given name when opening the driver, unless the DSN sets its own
+func WithTLSConfig(name string, config *tls.Config) Option {
+	return func(d *Driver) {
+		d.TLSConfigName = name
+		d.TLSConfig = config
+	}
+}
+
+// WithCollation sets the collation of connections, unless the DSN sets its own
+func WithCollation(collation string) Option {
+	return func(d *Driver) {
+		d.Collation = collation
+	}
+}
+
+// WithTimeout sets the timeout of dialing connections, unless the DSN sets
+// its own
+func WithTimeout(t time.Duration) Option {
+	return func(d *Driver) {
+		d.Timeout = t
+	}
+}
+
+// WithCapacity sets the amount of bytes and inodes reported as the file
+// system capacity, zero meaning there's no quota
+func WithCapacity(size uint64, inodes uint64) Option {
+	return func(d *Driver) {
+		d.Capacity = size
+		d.InodeCapacity = inodes
+	}
+}
+
+// WithBlockSize sets the preferred size of IO operations, which holes of
+// grown files align to
+func WithBlockSize(size uint64) Option {
+	return func(d *Driver) {
+		d.BlockSize = size
+	}
+}
+
+// WithAtime sets when reads update the access time of inodes
+func WithAtime(policy database.AtimePolicy) Option {
+	return func(d *Driver) {
+		d.Atime = policy
+	}
+}
+
+// WithDedup sets whether chunks holding already stored data point to the
+// existing object
+func WithDedup(dedup bool) Option {
+	return func(d *Driver) {
+		d.Dedup = dedup
+	}
+}
+
+// WithIsolation sets the isolation level of transactions
+func WithIsolation(level sql.IsolationLevel) Option {
+	return func(d *Driver) {
+		d.Isolation = level
+	}
+}
+
+// WithDeadlockRetries sets the number of times writes aborted by a deadlock
+// or a lock wait timeout are run again
+func WithDeadlockRetries(n int) Option {
+	return func(d *Driver) {
+		d.DeadlockRetries = n
+	}
+}
+
+// WithAuditHook sets the hook notified of the committed mutating operations
+func WithAuditHook(hook database.AuditHook) Option {
+	return func(d *Driver) {
+		d.AuditHook = hook
+	}
+}
+
+// WithReadOnly sets whether every mutation fails with EROFS
+func WithReadOnly(readOnly bool) Option {
+	return func(d *Driver) {
+		d.ReadOnly = readOnly
+	}
+}
+
+// WithLockTimeout sets the time WithLock waits for other clients to release
+// a lock
+func WithLockTimeout(t time.Duration) Option {
+	return func(d *Driver) {
+		d.LockTimeout = t
+	}
+}
+
+// WithLogger sets the logger told about the operations taking longer than the
+// given threshold
+func WithLogger(logger Logger, threshold time.Duration) Option {
+	return func(d *Driver) {
+		d.Logger = logger
+		d.SlowThreshold = threshold
+	}
+}
+
+// WithTablePrefix sets the prefix of the name of every table, letting several
+// file systems share a database
+func WithTablePrefix(prefix string) Option {
+	return func(d *Driver) {
+		d.TablePrefix = prefix
+	}
+}
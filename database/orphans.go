@@ -0,0 +1,146 @@
+package database
+
+import (
+	"database/sql"
+	"sync"
+
+	"github.com/manvalls/titan/storage"
+)
+
+// OrphanReport tells what CleanOrphanInodes and CleanOrphanChunks would
+// remove. The size of the objects is unknown, as orphaned chunks don't keep
+// it, so the reclaimed bytes are those of the removed inodes.
+type OrphanReport struct {
+	// Inodes is the amount of inodes without links left, which hold Size
+	// bytes along with Xattrs extended attributes
+	Inodes uint64
+	Size   uint64
+	Xattrs uint64
+
+	// OrphanedChunks is the amount of chunks of those inodes, which are
+	// orphaned rather than removed
+	OrphanedChunks uint64
+
+	// Chunks is the amount of chunks orphaned before the threshold, whose
+	// Objects objects no live chunk references are removed from the storage
+	Chunks  uint64
+	Objects uint64
+}
+
+// RemoveObjects removes from the storage the objects read from the given
+// rows, made of a storage and a key, in batches of up to RemoveBatchSize
+// objects handled by the given amount of workers. Rows are always closed.
+// No more batches are sent to the workers once one of them fails, the first
+// error being returned so that the caller can keep the chunks of the
+// objects which may not have been removed.
+func RemoveObjects(rows *sql.Rows, st storage.Storage, workers int) error {
+	defer rows.Close()
+
+	return removeObjects(func() (*storage.Chunk, error) {
+		if !rows.Next() {
+			return nil, rows.Err()
+		}
+
+		chunk := storage.Chunk{}
+		if err := rows.Scan(&chunk.Storage, &chunk.Key); err != nil {
+			return nil, err
+		}
+
+		return &chunk, nil
+	}, st, workers)
+}
+
+// RemoveObjectList removes the given objects from the storage as
+// RemoveObjects does, for drivers which already hold them in memory
+func RemoveObjectList(objects []storage.Chunk, st storage.Storage, workers int) error {
+	i := 0
+
+	return removeObjects(func() (*storage.Chunk, error) {
+		if i == len(objects) {
+			return nil, nil
+		}
+
+		i++
+		return &objects[i-1], nil
+	}, st, workers)
+}
+
+// removeObjects removes the objects returned by next, which returns nil
+// once there are no more of them
+func removeObjects(next func() (*storage.Chunk, error), st storage.Storage, workers int) error {
+	var result error
+	mutex := sync.Mutex{}
+	failed := make(chan struct{})
+
+	fail := func(err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if result == nil {
+			result = err
+			close(failed)
+		}
+	}
+
+	ch := make(chan []storage.Chunk)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			for batch := range ch {
+				if err := storage.RemoveBatch(st, batch); err != nil {
+					fail(err)
+				}
+			}
+
+			wg.Done()
+		}()
+	}
+
+	send := func(batch []storage.Chunk) bool {
+		select {
+		case ch <- batch:
+			return true
+		case <-failed:
+			return false
+		}
+	}
+
+	batch := make([]storage.Chunk, 0, RemoveBatchSize)
+	for {
+		chunk, err := next()
+		if err != nil {
+			fail(err)
+			break
+		}
+
+		if chunk == nil {
+			break
+		}
+
+		batch = append(batch, *chunk)
+		if len(batch) == RemoveBatchSize {
+			if !send(batch) {
+				break
+			}
+
+			batch = make([]storage.Chunk, 0, RemoveBatchSize)
+		}
+	}
+
+	select {
+	case <-failed:
+	default:
+		if len(batch) > 0 {
+			send(batch)
+		}
+	}
+
+	close(ch)
+	wg.Wait()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	return result
+}
@@ -0,0 +1,43 @@
+package database
+
+import (
+	"path"
+	"sort"
+
+	"github.com/manvalls/fuse/fuseops"
+)
+
+// JoinPaths builds the sorted full paths reaching the given inode through
+// the given links, which must include those of all of its ancestors. Paths
+// not reaching the root are left out.
+func JoinPaths(inode fuseops.InodeID, links []Link) []string {
+	parents := make(map[fuseops.InodeID][]Link)
+	for _, link := range links {
+		parents[link.Inode] = append(parents[link.Inode], link)
+	}
+
+	var join func(inode fuseops.InodeID, depth int) []string
+	join = func(inode fuseops.InodeID, depth int) []string {
+		if inode == fuseops.RootInodeID {
+			return []string{"/"}
+		}
+
+		// Every step up uses a different link unless there's a loop
+		if depth > len(links) {
+			return nil
+		}
+
+		paths := make([]string, 0)
+		for _, link := range parents[inode] {
+			for _, parent := range join(link.Parent, depth+1) {
+				paths = append(paths, path.Join(parent, link.Name))
+			}
+		}
+
+		return paths
+	}
+
+	paths := join(inode, 0)
+	sort.Strings(paths)
+	return paths
+}
@@ -0,0 +1,23 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJoinPaths(t *testing.T) {
+	links := []Link{
+		{1, "dir", 2},
+		{2, "file", 3},
+		{1, "link", 3},
+		{4, "orphan", 3},
+		{5, "loop", 5},
+	}
+
+	assert.Equal(t, []string{"/dir/file", "/link"}, JoinPaths(3, links))
+	assert.Equal(t, []string{"/dir"}, JoinPaths(2, links))
+	assert.Equal(t, []string{"/"}, JoinPaths(fuseops.RootInodeID, nil))
+	assert.Empty(t, JoinPaths(5, links))
+}
@@ -0,0 +1,40 @@
+package postgres
+
+import (
+	"syscall"
+
+	"github.com/lib/pq"
+	"github.com/manvalls/titan/database"
+)
+
+// errUniqueViolation is returned by PostgreSQL when a unique key is violated
+const errUniqueViolation = "23505"
+
+// errForeignKeyViolation is returned by PostgreSQL when a foreign key is
+// violated
+const errForeignKeyViolation = "23503"
+
+func treatError(err error) error {
+	pe, ok := err.(*pq.Error)
+	if !ok {
+		return err
+	}
+
+	switch pe.Code {
+	case errUniqueViolation:
+		return syscall.EEXIST
+	default:
+		return err
+	}
+}
+
+// treatForgetError reports the foreign key violations raised when deleting
+// an inode something still references as database.ErrReferenced
+func treatForgetError(err error) error {
+	pe, ok := err.(*pq.Error)
+	if ok && pe.Code == errForeignKeyViolation {
+		return database.ErrReferenced
+	}
+
+	return treatError(err)
+}
@@ -0,0 +1,150 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"syscall"
+)
+
+// migrations upgrade the schema from one version to the next one, the first
+// of them upgrading version 1 to 2. They must be idempotent, so that partially applied upgrades
+// can be safely retried.
+var migrations = []func(ctx context.Context, tx *sql.Tx) error{
+	createQuotas,
+	createChunksObjectIndex,
+	addChunksHash,
+	addInodesRdev,
+	addInodesFlags,
+	createLocks,
+	addChunksETag,
+	addChunksChecksum,
+}
+
+// schemaVersion is the version of the schema created by Setup
+var schemaVersion = len(migrations) + 1
+
+func createQuotas(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS quotas (kind SMALLINT NOT NULL, id BIGINT NOT NULL, bytes BIGINT NOT NULL, inodes BIGINT NOT NULL, usedbytes BIGINT NOT NULL, usedinodes BIGINT NOT NULL, PRIMARY KEY (kind, id))")
+	return err
+}
+
+// createChunksObjectIndex indexes chunks by the object they point to, so that
+// objects still referenced by live chunks can be found quickly
+func createChunksObjectIndex(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS chunks_object ON chunks (storage, key)")
+	return err
+}
+
+// addChunksHash stores the hash of the data of chunks, indexed so that
+// chunks holding the same data can be deduplicated
+func addChunksHash(ctx context.Context, tx *sql.Tx) error {
+	if _, err := tx.ExecContext(ctx, "ALTER TABLE chunks ADD COLUMN IF NOT EXISTS hash VARCHAR(64)"); err != nil {
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS chunks_hash ON chunks (hash)")
+	return err
+}
+
+// addInodesRdev stores the device number of character and block devices
+func addInodesRdev(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, "ALTER TABLE inodes ADD COLUMN IF NOT EXISTS rdev BIGINT NOT NULL DEFAULT 0")
+	return err
+}
+
+// addInodesFlags stores the flags of inodes, along with the date until which
+// immutable inodes are retained
+func addInodesFlags(ctx context.Context, tx *sql.Tx) error {
+	if _, err := tx.ExecContext(ctx, "ALTER TABLE inodes ADD COLUMN IF NOT EXISTS flags BIGINT NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx, "ALTER TABLE inodes ADD COLUMN IF NOT EXISTS retainuntil TIMESTAMP")
+	return err
+}
+
+// createLocks stores the advisory locks held over byte ranges of inodes
+func createLocks(ctx context.Context, tx *sql.Tx) error {
+	if _, err := tx.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS locks (inode BIGINT NOT NULL, owner BIGINT NOT NULL, startoffset BIGINT NOT NULL, endoffset BIGINT NOT NULL, kind SMALLINT NOT NULL, FOREIGN KEY (inode) REFERENCES inodes(id))"); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS locks_inode ON locks (inode)"); err != nil {
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS locks_owner ON locks (owner)")
+	return err
+}
+
+// addChunksETag stores the ETag and version reported by the storage for the
+// objects of chunks, so that overwritten objects can be detected
+func addChunksETag(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, "ALTER TABLE chunks ADD COLUMN IF NOT EXISTS etag VARCHAR(255), ADD COLUMN IF NOT EXISTS version VARCHAR(255)")
+	return err
+}
+
+// addChunksChecksum stores the checksum of the data of chunks, so that
+// corrupted objects can be detected when reading them
+func addChunksChecksum(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, "ALTER TABLE chunks ADD COLUMN IF NOT EXISTS checksum VARCHAR(8)")
+	return err
+}
+
+// Migrate upgrades the schema of an existing database to the current version,
+// applying every pending migration in its own transaction along with the
+// version it leads to. Databases created before schemas were versioned are
+// considered to be at version 1.
+func (d *Driver) Migrate(ctx context.Context) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if _, err := d.DB.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)"); err != nil {
+		return treatError(err)
+	}
+
+	if _, err := d.DB.ExecContext(ctx, "INSERT INTO schema_version(version) SELECT 1 WHERE NOT EXISTS (SELECT * FROM schema_version)"); err != nil {
+		return treatError(err)
+	}
+
+	for {
+		done, err := d.migrate(ctx)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// migrate applies the next pending migration, reporting whether the schema
+// was already up to date
+func (d *Driver) migrate(ctx context.Context) (bool, error) {
+	var version int
+
+	tx, err := d.DB.BeginTx(ctx, d.txOptions())
+	if err != nil {
+		return false, treatError(err)
+	}
+
+	if err = tx.QueryRowContext(ctx, "SELECT version FROM schema_version FOR UPDATE").Scan(&version); err != nil {
+		tx.Rollback()
+		return false, treatError(err)
+	}
+
+	if version >= schemaVersion {
+		tx.Rollback()
+		return true, nil
+	}
+
+	if err = migrations[version-1](ctx, tx); err != nil {
+		tx.Rollback()
+		return false, treatError(err)
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE schema_version SET version = $1", version+1); err != nil {
+		tx.Rollback()
+		return false, treatError(err)
+	}
+
+	return false, tx.Commit()
+}
@@ -0,0 +1,221 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database/dbtest"
+	"github.com/manvalls/titan/database/memory"
+	"github.com/manvalls/titan/database/stmt"
+)
+
+// openTestDriver connects to an empty test database
+func openTestDriver(t testing.TB) *Driver {
+	uri := os.Getenv("TITAN_TEST_POSTGRES_URI")
+	if uri == "" {
+		t.Skip("TITAN_TEST_POSTGRES_URI is not set")
+	}
+
+	d := &Driver{DbURI: uri}
+	if err := d.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range []string{"locks", "xattr", "chunks", "entries", "stats", "quotas", "schema_version", "inodes"} {
+		if _, err := d.DB.Exec("DROP TABLE IF EXISTS " + table); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return d
+}
+
+func getTestDriver(t testing.TB) *Driver {
+	d := openTestDriver(t)
+	if err := d.Setup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return d
+}
+
+func TestDriver(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	dbtest.Run(t, d)
+}
+
+func TestFsStats(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	d.Capacity = 1 << 30
+	dbtest.FsStats(t, d)
+}
+
+func TestBlockSize(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	d.BlockSize = 1 << 16
+	dbtest.BlockSize(t, d, 1<<16)
+}
+
+func TestStatsUnderflow(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	dbtest.StatsUnderflow(t, d, d.DB)
+}
+
+func TestFsck(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	dbtest.Fsck(t, d, d.DB)
+}
+
+func TestForgetRace(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	dbtest.ForgetRace(t, d, d.DB)
+}
+
+func TestLeakedAnonymous(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	dbtest.LeakedAnonymous(t, d, d.DB)
+}
+
+func TestAtime(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	dbtest.Atime(t, d, d.DB, &d.Atime)
+}
+
+func TestDedup(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	d.Dedup = true
+	dbtest.Dedup(t, d)
+}
+
+func TestAudit(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	dbtest.Audit(t, d, &d.AuditHook)
+}
+
+func TestRowsErrors(t *testing.T) {
+	db := dbtest.FailingDB()
+	defer db.Close()
+
+	d := &Driver{DB: db, stmts: stmt.NewCache(db)}
+	dbtest.RowsErrors(t, d)
+}
+
+func BenchmarkChildren(b *testing.B) {
+	d := getTestDriver(b)
+	defer d.Close()
+
+	benchmarkChildren(b, d)
+}
+
+func benchmarkChildren(b *testing.B, d *Driver) {
+	ctx := context.Background()
+	dir := dbtest.Mkdir(b, d, fuseops.RootInodeID)
+
+	for i := 0; i < 10000; i++ {
+		dbtest.Mkfile(b, d, dir)
+	}
+
+	list := func(b *testing.B, rows *sql.Rows, err error) {
+		var inode uint64
+		var mode uint32
+		var name string
+
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		defer rows.Close()
+
+		for rows.Next() {
+			if err = rows.Scan(&inode, &name, &mode); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("Prepared", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s, err := d.stmts.Get(ctx, childrenQuery)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			rows, err := s.QueryContext(ctx, uint64(dir))
+			list(b, rows, err)
+		}
+	})
+
+	b.Run("Unprepared", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			rows, err := d.DB.QueryContext(ctx, childrenQuery, uint64(dir))
+			list(b, rows, err)
+		}
+	})
+}
+
+func TestTryLock(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	other := &Driver{DbURI: d.DbURI}
+	if err := other.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer other.Close()
+
+	dbtest.TryLock(t, d, other)
+}
+
+func TestMigrate(t *testing.T) {
+	d := openTestDriver(t)
+	defer d.Close()
+
+	if err := d.setup(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	dbtest.Migrate(t, d, d.DB, schemaVersion)
+}
+
+func TestReadOnly(t *testing.T) {
+	d := getTestDriver(t)
+	defer d.Close()
+
+	dbtest.ReadOnly(t, d, &d.ReadOnly)
+}
+
+func TestDump(t *testing.T) {
+	src := getTestDriver(t)
+	defer src.Close()
+
+	dst := &memory.Driver{}
+	if err := dst.Setup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	dbtest.Dump(t, src, dst)
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"io"
+
+	"github.com/manvalls/titan/storage"
+)
+
+// Retier moves the chunks read from the given rows, made of an id, an inode,
+// a storage, a key, an object offset, an inode offset, a size, a hash and a checksum, as
+// RetierList does. Rows are always closed.
+func Retier(ctx context.Context, rows *sql.Rows, st storage.Storage, target string, replace ChunkReplacer) error {
+	chunks := make([]Chunk, 0)
+
+	for rows.Next() {
+		chunk := Chunk{}
+		if err := rows.Scan(&chunk.ID, &chunk.Inode, &chunk.Storage, &chunk.Key, &chunk.ObjectOffset, &chunk.InodeOffset, &chunk.Size, &chunk.Hash, &chunk.Checksum); err != nil {
+			rows.Close()
+			return err
+		}
+
+		chunks = append(chunks, chunk)
+	}
+
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return RetierList(ctx, chunks, st, target, replace)
+}
+
+// RetierList copies the data of the given chunks of an inode into new
+// objects stored at the target storage, through storage.GetChunkAt, which
+// then replace them. Every chunk is replaced on its own once its object is
+// stored, the old one staying readable until then and being orphaned
+// afterwards, so that running it again after an interruption carries on
+// where it stopped. Chunks changed meanwhile are skipped, their new object
+// being removed. Holes and chunks already held by the target storage are
+// left as they are. Drivers can implement their RetierInode method with it.
+func RetierList(ctx context.Context, chunks []Chunk, st storage.Storage, target string, replace ChunkReplacer) error {
+	for _, c := range chunks {
+		if c.IsHole() || c.Storage == target {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rc, err := st.GetReadCloser(c.Chunk)
+		if err != nil {
+			return err
+		}
+
+		object, err := storage.GetChunkAt(st, target, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+
+		if object.Size != c.Size {
+			st.Remove(*object)
+			return io.ErrUnexpectedEOF
+		}
+
+		replaced, err := replace(ctx, []Chunk{c}, Chunk{
+			Inode:       c.Inode,
+			InodeOffset: c.InodeOffset,
+			Chunk:       *object,
+			Hash:        c.Hash,
+			Checksum:    c.Checksum,
+		})
+
+		if err != nil || !replaced {
+			st.Remove(*object)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
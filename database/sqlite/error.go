@@ -0,0 +1,43 @@
+package sqlite
+
+import (
+	"syscall"
+
+	"github.com/manvalls/titan/database"
+	"github.com/mattn/go-sqlite3"
+)
+
+func treatError(err error) error {
+	se, ok := err.(sqlite3.Error)
+	if !ok {
+		return err
+	}
+
+	switch se.Code {
+	case sqlite3.ErrConstraint:
+		switch se.ExtendedCode {
+		case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+			return syscall.EEXIST
+		default:
+			return err
+		}
+	default:
+		return err
+	}
+}
+
+// treatForgetError reports the foreign key violations raised when deleting
+// an inode something still references as database.ErrReferenced
+func treatForgetError(err error) error {
+	se, ok := err.(sqlite3.Error)
+	if ok && se.ExtendedCode == sqlite3.ErrConstraintForeignKey {
+		return database.ErrReferenced
+	}
+
+	return treatError(err)
+}
+
+func isBusy(err error) bool {
+	se, ok := err.(sqlite3.Error)
+	return ok && (se.Code == sqlite3.ErrBusy || se.Code == sqlite3.ErrLocked)
+}
@@ -0,0 +1,531 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database"
+	"github.com/manvalls/titan/storage"
+)
+
+// nlinkColumn computes the link count reported for the inode aliased as i.
+// Directories still linked count their entry, their own "." entry and the
+// ".." entries of their subdirectories, while refcount only tracks entries.
+const nlinkColumn = "CASE WHEN (i.mode & 2147483648) <> 0 AND i.refcount > 0 THEN 2 + (SELECT COUNT(*) FROM entries se, inodes si WHERE se.parent = i.id AND si.id = se.inode AND (si.mode & 2147483648) <> 0) ELSE i.refcount END"
+
+// Queries run on every file system operation, kept prepared by the driver
+const (
+	getInodeQuery     = "SELECT mode, uid, gid, size, refcount, atime, mtime, ctime, crtime, target, rdev FROM inodes WHERE id = ?"
+	getQuery          = "SELECT i.mode, i.uid, i.gid, i.size, " + nlinkColumn + ", i.atime, i.mtime, i.ctime, i.crtime, i.rdev FROM inodes i WHERE i.id = ?"
+	lookUpQuery       = "SELECT i.id, i.mode, i.uid, i.gid, i.size, " + nlinkColumn + ", i.atime, i.mtime, i.ctime, i.crtime, i.rdev FROM inodes i, entries e WHERE i.id = e.inode AND e.parent = ? AND e.name = ?"
+	chunksQuery       = "SELECT id, storage, `key`, objectoffset, inodeoffset, size, COALESCE(etag, ''), COALESCE(version, ''), COALESCE(checksum, '') FROM chunks WHERE inode = ? AND inodeoffset < ? AND inodeoffset + size > ? ORDER BY inodeoffset ASC"
+	childrenQuery     = "SELECT e.inode, e.name, i.mode FROM entries e, inodes i WHERE e.parent = ? AND i.id = e.inode"
+	childrenPageQuery = "SELECT e.inode, e.name, i.mode FROM entries e, inodes i WHERE e.parent = ? AND e.name > ? AND i.id = e.inode ORDER BY e.name LIMIT ?"
+	childrenPlusQuery = "SELECT e.name, i.id, i.mode, i.uid, i.gid, i.size, " + nlinkColumn + ", i.atime, i.mtime, i.ctime, i.crtime, i.rdev FROM entries e, inodes i WHERE e.parent = ? AND i.id = e.inode"
+)
+
+// subtreeQuery starts statements with a table listing an inode along with
+// every inode below it, each of them once
+const subtreeQuery = "WITH RECURSIVE tree(inode) AS (SELECT ? UNION SELECT e.inode FROM entries e, tree t WHERE e.parent = t.inode) "
+
+// anonymousFlag is the database.InodeAnonymous flag within queries
+var anonymousFlag = strconv.Itoa(database.InodeAnonymous)
+
+// anonymousTimeout is database.AnonymousTimeout in seconds within queries
+var anonymousTimeout = strconv.Itoa(int(database.AnonymousTimeout / time.Second))
+
+// orphanInodesCondition selects the inodes without links left, but those held
+// by the handle that created them with the database.InodeAnonymous flag unless
+// they're deemed leaked. It's shared by CleanOrphanInodes and CountOrphans so
+// that its counts match.
+var orphanInodesCondition = "refcount = 0 AND ((flags & " + anonymousFlag + ") = 0 OR datetime(ctime) < datetime('now', '-" + anonymousTimeout + " seconds'))"
+
+// Conditions selecting what CleanOrphanChunks removes, shared with
+// CountOrphans so that its counts match them
+const (
+	// orphanChunksCondition selects the chunks orphaned before a threshold
+	orphanChunksCondition = "inode IS NULL AND orphandate < ?"
+
+	// orphanObjectsQuery lists the objects of the chunks orphaned before a
+	// threshold which no live chunk references anymore
+	orphanObjectsQuery = "SELECT o.storage, o.`key` FROM chunks o WHERE o.inode IS NULL AND o.orphandate < ? AND NOT EXISTS (SELECT 1 FROM chunks l WHERE l.storage = o.storage AND l.`key` = o.`key` AND l.inode IS NOT NULL) GROUP BY o.storage, o.`key`"
+)
+
+const busyDelay = 10 * time.Millisecond
+
+// begin starts an immediate transaction, so that the write lock is taken
+// upfront, retrying while the database is busy
+func (d Driver) begin(ctx context.Context) (*sql.Tx, error) {
+	for i := 0; ; i++ {
+		tx, err := d.DB.BeginTx(ctx, nil)
+		if err == nil || !isBusy(err) || i >= d.BusyRetries {
+			return tx, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(busyDelay * time.Duration(i+1)):
+		}
+	}
+}
+
+func (d Driver) getInode(ctx context.Context, tx *sql.Tx, inode fuseops.InodeID) (*database.Inode, error) {
+	var mode uint32
+
+	s, err := d.stmts.Get(ctx, getInodeQuery)
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	row := tx.StmtContext(ctx, s).QueryRowContext(ctx, uint64(inode))
+
+	result := database.Inode{}
+	result.ID = inode
+
+	err = row.Scan(&mode, &result.Uid, &result.Gid, &result.Size, &result.Nlink, &result.Atime, &result.Mtime, &result.Ctime, &result.Crtime, &result.SymLink, &result.Rdev)
+	if err != nil {
+		return nil, syscall.ENOENT
+	}
+
+	result.Mode = os.FileMode(mode)
+	return &result, nil
+}
+
+// queryer runs queries either within a transaction or outside of any
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// countChildren counts the entries of a directory
+func (d Driver) countChildren(ctx context.Context, q queryer, inode fuseops.InodeID) (uint64, error) {
+	var count uint64
+	if err := q.QueryRowContext(ctx, "SELECT COUNT(*) FROM entries WHERE parent = ?", uint64(inode)).Scan(&count); err != nil {
+		return 0, treatError(err)
+	}
+
+	return count, nil
+}
+
+// countEntries counts the entries pointing to an inode, which its refcount
+// should match
+func (d Driver) countEntries(ctx context.Context, tx *sql.Tx, inode fuseops.InodeID) (uint32, error) {
+	var count uint32
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM entries WHERE inode = ?", uint64(inode)).Scan(&count); err != nil {
+		return 0, treatError(err)
+	}
+
+	return count, nil
+}
+
+// getFlags retrieves the owner, the flags and the retention date of an inode
+func (d Driver) getFlags(ctx context.Context, tx *sql.Tx, inode fuseops.InodeID) (uint32, uint32, *time.Time, error) {
+	var uid, flags uint32
+	var retainUntil *time.Time
+
+	row := tx.QueryRowContext(ctx, "SELECT uid, flags, retainuntil FROM inodes WHERE id = ?", uint64(inode))
+	if err := row.Scan(&uid, &flags, &retainUntil); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, 0, nil, syscall.ENOENT
+		}
+
+		return 0, 0, nil, treatError(err)
+	}
+
+	return uid, flags, retainUntil, nil
+}
+
+// getOwner retrieves the user and group owning an inode
+func (d Driver) getOwner(ctx context.Context, tx *sql.Tx, inode fuseops.InodeID) (uint32, uint32, error) {
+	var uid, gid uint32
+
+	row := tx.QueryRowContext(ctx, "SELECT uid, gid FROM inodes WHERE id = ?", uint64(inode))
+	if err := row.Scan(&uid, &gid); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, 0, syscall.ENOENT
+		}
+
+		return 0, 0, treatError(err)
+	}
+
+	return uid, gid, nil
+}
+
+// checkMutable fails with EPERM if the given inode is immutable
+func (d Driver) checkMutable(ctx context.Context, tx *sql.Tx, inode fuseops.InodeID) error {
+	_, flags, retainUntil, err := d.getFlags(ctx, tx, inode)
+	if err != nil {
+		return err
+	}
+
+	if database.IsImmutable(flags, retainUntil, time.Now()) {
+		return syscall.EPERM
+	}
+
+	return nil
+}
+
+func (d Driver) getEntry(ctx context.Context, tx *sql.Tx, parent fuseops.InodeID, name string) (fuseops.InodeID, error) {
+	var inode uint64
+
+	row := tx.QueryRowContext(ctx, "SELECT inode FROM entries WHERE parent = ? AND name = ?", uint64(parent), []byte(name))
+	if err := row.Scan(&inode); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, syscall.ENOENT
+		}
+
+		return 0, treatError(err)
+	}
+
+	return fuseops.InodeID(inode), nil
+}
+
+// isAncestor checks whether the given inode is the provided directory or
+// one of its ancestors
+func (d Driver) isAncestor(ctx context.Context, tx *sql.Tx, inode fuseops.InodeID, dir fuseops.InodeID) (bool, error) {
+	for dir != inode {
+		var parent uint64
+
+		if dir == fuseops.RootInodeID {
+			return false, nil
+		}
+
+		row := tx.QueryRowContext(ctx, "SELECT parent FROM entries WHERE inode = ? LIMIT 1", uint64(dir))
+		if err := row.Scan(&parent); err != nil {
+			if err == sql.ErrNoRows {
+				return false, nil
+			}
+
+			return false, treatError(err)
+		}
+
+		dir = fuseops.InodeID(parent)
+	}
+
+	return true, nil
+}
+
+// exchange swaps the inodes the given entries point to, the destination
+// must exist
+func (d Driver) exchange(ctx context.Context, tx *sql.Tx, oldParent fuseops.InodeID, oldName string, inode fuseops.InodeID, newParent fuseops.InodeID, newName string) error {
+	target, err := d.getEntry(ctx, tx, newParent, newName)
+	if err != nil {
+		return err
+	}
+
+	in, err := d.getInode(ctx, tx, target)
+	if err != nil {
+		return treatError(err)
+	}
+
+	if in.Mode.IsDir() {
+		var cycle bool
+
+		if cycle, err = d.isAncestor(ctx, tx, target, oldParent); err != nil {
+			return err
+		}
+
+		if cycle {
+			return syscall.EINVAL
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE entries SET inode = ? WHERE parent = ? AND name = ?", uint64(target), uint64(oldParent), []byte(oldName)); err != nil {
+		return treatError(err)
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE entries SET inode = ? WHERE parent = ? AND name = ?", uint64(inode), uint64(newParent), []byte(newName)); err != nil {
+		return treatError(err)
+	}
+
+	return nil
+}
+
+// checkForget fails with EROFS if forgetting any of the given inodes would
+// remove it, as read-only drivers can't
+func (d Driver) checkForget(ctx context.Context, inodes []fuseops.InodeID) error {
+	for _, inode := range inodes {
+		var refcount uint32
+
+		row := d.DB.QueryRowContext(ctx, "SELECT refcount FROM inodes WHERE id = ?", uint64(inode))
+		if err := row.Scan(&refcount); err != nil {
+			if err == sql.ErrNoRows {
+				continue
+			}
+
+			return treatError(err)
+		}
+
+		if refcount == 0 {
+			return syscall.EROFS
+		}
+	}
+
+	return nil
+}
+
+// touchAtime updates the access time of an inode being read according to
+// the atime policy of the driver
+func (d Driver) touchAtime(ctx context.Context, inode fuseops.InodeID) error {
+	var err error
+
+	if d.ReadOnly {
+		return nil
+	}
+
+	switch d.Atime {
+	case database.NoAtime:
+	case database.RelAtime:
+		_, err = d.DB.ExecContext(ctx, "UPDATE inodes SET atime = datetime('now') WHERE id = ? AND (datetime(atime) <= datetime(mtime) OR datetime(atime) <= datetime(ctime) OR datetime(atime) < datetime('now', '-1 day'))", uint64(inode))
+	default:
+		_, err = d.DB.ExecContext(ctx, "UPDATE inodes SET atime = datetime('now') WHERE id = ?", uint64(inode))
+	}
+
+	return treatError(err)
+}
+
+// zeroChunk returns a chunk filling the given range of an inode with zeros
+func zeroChunk(offset uint64, size uint64) database.Chunk {
+	return database.Chunk{
+		InodeOffset: offset,
+		Chunk:       storage.Chunk{Storage: database.ZeroStorage, Size: size},
+	}
+}
+
+// timeOrNull returns the given time in UTC, or NULL if it's the zero time
+// so that the database default can be used instead
+func timeOrNull(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+
+	return t.In(time.UTC)
+}
+
+// maxPlaceholders is the maximum amount of placeholders allowed in a single statement
+const maxPlaceholders = 999
+
+// inList returns a comma separated list of n placeholders
+func inList(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// nullString returns the given string, or NULL if it's empty
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// chunkColumns is the amount of columns set when inserting a chunk
+const chunkColumns = 10
+
+// insertChunks inserts the given chunks using as few statements as possible
+func (d Driver) insertChunks(ctx context.Context, tx *sql.Tx, inode fuseops.InodeID, chunks []database.Chunk) error {
+	for len(chunks) > 0 {
+		n := len(chunks)
+		if n > maxPlaceholders/chunkColumns {
+			n = maxPlaceholders / chunkColumns
+		}
+
+		values := make([]string, 0, n)
+		args := make([]interface{}, 0, n*chunkColumns)
+
+		for _, c := range chunks[:n] {
+			values = append(values, "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+			args = append(args, uint64(inode), c.Storage, c.Key, c.ObjectOffset, c.InodeOffset, c.Size, nullString(c.Hash), nullString(c.ETag), nullString(c.Version), nullString(c.Checksum))
+		}
+
+		if _, err := tx.ExecContext(ctx, "INSERT INTO chunks(inode, storage, `key`, objectoffset, inodeoffset, size, hash, etag, version, checksum) VALUES "+strings.Join(values, ", "), args...); err != nil {
+			return treatError(err)
+		}
+
+		chunks = chunks[n:]
+	}
+
+	return nil
+}
+
+// replaceChunks replaces the given chunks of an inode with a new one, as
+// long as none of them changed
+func (d Driver) replaceChunks(ctx context.Context, old []database.Chunk, chunk database.Chunk) (bool, error) {
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return false, treatError(err)
+	}
+
+	if _, err = d.getInode(ctx, tx, chunk.Inode); err != nil {
+		tx.Rollback()
+		return false, treatError(err)
+	}
+
+	ids := make([]interface{}, 0, len(old))
+	for _, c := range old {
+		var count int
+		if err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM chunks WHERE id = ? AND inode = ? AND storage = ? AND `key` = ? AND objectoffset = ? AND inodeoffset = ? AND size = ?", c.ID, uint64(chunk.Inode), c.Storage, c.Key, c.ObjectOffset, c.InodeOffset, c.Size).Scan(&count); err != nil {
+			tx.Rollback()
+			return false, treatError(err)
+		}
+
+		if count == 0 {
+			tx.Rollback()
+			return false, nil
+		}
+
+		ids = append(ids, c.ID)
+	}
+
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > maxPlaceholders {
+			n = maxPlaceholders
+		}
+
+		if _, err = tx.ExecContext(ctx, "UPDATE chunks SET inode = NULL, objectoffset = NULL, inodeoffset = NULL, size = NULL, orphandate = datetime('now') WHERE id IN ("+inList(n)+")", ids[:n]...); err != nil {
+			tx.Rollback()
+			return false, treatError(err)
+		}
+
+		ids = ids[n:]
+	}
+
+	if err = d.insertChunks(ctx, tx, chunk.Inode, []database.Chunk{chunk}); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, treatError(err)
+	}
+
+	return true, nil
+}
+
+// updateChunks updates the position of the given chunks reusing a single
+// prepared statement, forgetting their hashes and checksums as their data changed
+func (d Driver) updateChunks(ctx context.Context, tx *sql.Tx, chunks []database.Chunk) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	stmt, err := tx.PrepareContext(ctx, "UPDATE chunks SET size = ?, inodeoffset = ?, objectoffset = ?, hash = NULL, checksum = NULL WHERE id = ?")
+	if err != nil {
+		return treatError(err)
+	}
+
+	defer stmt.Close()
+
+	for _, c := range chunks {
+		if _, err = stmt.ExecContext(ctx, c.Size, c.InodeOffset, c.ObjectOffset, c.ID); err != nil {
+			return treatError(err)
+		}
+	}
+
+	return nil
+}
+
+// dedup points the given chunk to an object already holding the same data,
+// if any, orphaning the object it pointed to so that it's eventually removed
+func (d Driver) dedup(ctx context.Context, tx *sql.Tx, chunk *database.Chunk) error {
+	existing := storage.Chunk{Size: chunk.Size}
+
+	err := tx.QueryRowContext(ctx, "SELECT storage, `key`, objectoffset, COALESCE(etag, ''), COALESCE(version, '') FROM chunks WHERE hash = ? AND size = ? AND inode IS NOT NULL LIMIT 1", chunk.Hash, chunk.Size).Scan(
+		&existing.Storage,
+		&existing.Key,
+		&existing.ObjectOffset,
+		&existing.ETag,
+		&existing.Version,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil
+	}
+
+	if err != nil {
+		return treatError(err)
+	}
+
+	if existing.Storage == chunk.Storage && existing.Key == chunk.Key {
+		return nil
+	}
+
+	if _, err = tx.ExecContext(ctx, "INSERT INTO chunks(storage, `key`, orphandate) VALUES (?, ?, datetime('now'))", chunk.Storage, chunk.Key); err != nil {
+		return treatError(err)
+	}
+
+	chunk.Chunk = existing
+	return nil
+}
+
+// Kinds of owners a quota may apply to
+const (
+	userQuota  = 0
+	groupQuota = 1
+)
+
+// inodeOwner is the user and group owning an inode
+type inodeOwner struct {
+	uid uint32
+	gid uint32
+}
+
+// quotaOwner is a user or a group a quota applies to
+type quotaOwner struct {
+	kind   int
+	column string
+	id     uint32
+}
+
+// quotaOwners lists the owners among the provided user and group
+func quotaOwners(uid *uint32, gid *uint32) []quotaOwner {
+	owners := make([]quotaOwner, 0, 2)
+
+	if uid != nil {
+		owners = append(owners, quotaOwner{userQuota, "uid", *uid})
+	}
+
+	if gid != nil {
+		owners = append(owners, quotaOwner{groupQuota, "gid", *gid})
+	}
+
+	return owners
+}
+
+// updateQuota adds the given amount of bytes and inodes to the usage of the
+// provided user and group, failing with EDQUOT if check is set and any of
+// their limits would be exceeded
+func (d Driver) updateQuota(ctx context.Context, tx *sql.Tx, uid uint32, gid uint32, bytes int64, inodes int64, check bool) error {
+	if bytes == 0 && inodes == 0 {
+		return nil
+	}
+
+	for _, owner := range quotaOwners(&uid, &gid) {
+		if check {
+			quota := database.Quota{}
+
+			row := tx.QueryRowContext(ctx, "SELECT bytes, inodes, usedbytes, usedinodes FROM quotas WHERE kind = ? AND id = ?", owner.kind, owner.id)
+			err := row.Scan(&quota.Bytes, &quota.Inodes, &quota.UsedBytes, &quota.UsedInodes)
+			if err == sql.ErrNoRows {
+				continue
+			}
+
+			if err != nil {
+				return treatError(err)
+			}
+
+			if quota.Exceeds(bytes, inodes) {
+				return syscall.EDQUOT
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, "UPDATE quotas SET usedbytes = usedbytes + ?, usedinodes = usedinodes + ? WHERE kind = ? AND id = ?", bytes, inodes, owner.kind, owner.id); err != nil {
+			return treatError(err)
+		}
+	}
+
+	return nil
+}
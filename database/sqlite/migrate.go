@@ -0,0 +1,202 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"syscall"
+)
+
+// migrations upgrade the schema from one version to the next one, the first
+// of them upgrading version 1 to 2. They must be idempotent, so that partially applied upgrades
+// can be safely retried.
+var migrations = []func(ctx context.Context, tx *sql.Tx) error{
+	createQuotas,
+	createChunksObjectIndex,
+	addChunksHash,
+	addInodesRdev,
+	addInodesFlags,
+	createLocks,
+	addChunksETag,
+	addChunksChecksum,
+}
+
+// schemaVersion is the version of the schema created by Setup
+var schemaVersion = len(migrations) + 1
+
+func createQuotas(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS quotas (kind INTEGER NOT NULL, id INTEGER NOT NULL, bytes INTEGER NOT NULL, inodes INTEGER NOT NULL, usedbytes INTEGER NOT NULL, usedinodes INTEGER NOT NULL, PRIMARY KEY (kind, id))")
+	return err
+}
+
+// createChunksObjectIndex indexes chunks by the object they point to, so that
+// objects still referenced by live chunks can be found quickly
+func createChunksObjectIndex(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS chunks_object ON chunks (storage, `key`)")
+	return err
+}
+
+// addChunksHash stores the hash of the data of chunks, indexed so that
+// chunks holding the same data can be deduplicated
+func addChunksHash(ctx context.Context, tx *sql.Tx) error {
+	var count int
+
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info('chunks') WHERE name = 'hash'").Scan(&count); err != nil {
+		return err
+	}
+
+	if count == 0 {
+		if _, err := tx.ExecContext(ctx, "ALTER TABLE chunks ADD COLUMN hash VARCHAR(64)"); err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS chunks_hash ON chunks (hash)")
+	return err
+}
+
+// addInodesRdev stores the device number of character and block devices
+func addInodesRdev(ctx context.Context, tx *sql.Tx) error {
+	var count int
+
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info('inodes') WHERE name = 'rdev'").Scan(&count); err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return nil
+	}
+
+	_, err := tx.ExecContext(ctx, "ALTER TABLE inodes ADD COLUMN rdev INTEGER NOT NULL DEFAULT 0")
+	return err
+}
+
+// addInodesFlags stores the flags of inodes, along with the date until which
+// immutable inodes are retained
+func addInodesFlags(ctx context.Context, tx *sql.Tx) error {
+	var count int
+
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info('inodes') WHERE name = 'flags'").Scan(&count); err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, "ALTER TABLE inodes ADD COLUMN flags INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx, "ALTER TABLE inodes ADD COLUMN retainuntil DATETIME")
+	return err
+}
+
+// createLocks stores the advisory locks held over byte ranges of inodes
+func createLocks(ctx context.Context, tx *sql.Tx) error {
+	if _, err := tx.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS locks (inode INTEGER NOT NULL, owner INTEGER NOT NULL, startoffset INTEGER NOT NULL, endoffset INTEGER NOT NULL, kind INTEGER NOT NULL, FOREIGN KEY (inode) REFERENCES inodes(id))"); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS locks_inode ON locks (inode)"); err != nil {
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS locks_owner ON locks (owner)")
+	return err
+}
+
+// addChunksETag stores the ETag and version reported by the storage for the
+// objects of chunks, so that overwritten objects can be detected
+func addChunksETag(ctx context.Context, tx *sql.Tx) error {
+	var count int
+
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info('chunks') WHERE name = 'etag'").Scan(&count); err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, "ALTER TABLE chunks ADD COLUMN etag VARCHAR(255)"); err != nil {
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx, "ALTER TABLE chunks ADD COLUMN version VARCHAR(255)")
+	return err
+}
+
+// addChunksChecksum stores the checksum of the data of chunks, so that
+// corrupted objects can be detected when reading them
+func addChunksChecksum(ctx context.Context, tx *sql.Tx) error {
+	var count int
+
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info('chunks') WHERE name = 'checksum'").Scan(&count); err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return nil
+	}
+
+	_, err := tx.ExecContext(ctx, "ALTER TABLE chunks ADD COLUMN checksum VARCHAR(8)")
+	return err
+}
+
+// Migrate upgrades the schema of an existing database to the current version,
+// applying every pending migration in its own transaction along with the
+// version it leads to. Databases created before schemas were versioned are
+// considered to be at version 1.
+func (d *Driver) Migrate(ctx context.Context) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if _, err := d.DB.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)"); err != nil {
+		return treatError(err)
+	}
+
+	if _, err := d.DB.ExecContext(ctx, "INSERT INTO schema_version(version) SELECT 1 WHERE NOT EXISTS (SELECT * FROM schema_version)"); err != nil {
+		return treatError(err)
+	}
+
+	for {
+		done, err := d.migrate(ctx)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// migrate applies the next pending migration, reporting whether the schema
+// was already up to date
+func (d *Driver) migrate(ctx context.Context) (bool, error) {
+	var version int
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return false, treatError(err)
+	}
+
+	if err = tx.QueryRowContext(ctx, "SELECT version FROM schema_version").Scan(&version); err != nil {
+		tx.Rollback()
+		return false, treatError(err)
+	}
+
+	if version >= schemaVersion {
+		tx.Rollback()
+		return true, nil
+	}
+
+	if err = migrations[version-1](ctx, tx); err != nil {
+		tx.Rollback()
+		return false, treatError(err)
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE schema_version SET version = ?", version+1); err != nil {
+		tx.Rollback()
+		return false, treatError(err)
+	}
+
+	return false, tx.Commit()
+}
@@ -0,0 +1,3045 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	gomath "math"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database"
+	"github.com/manvalls/titan/database/stmt"
+	"github.com/manvalls/titan/math"
+	"github.com/manvalls/titan/storage"
+
+	// sqlite driver for the sql package
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Driver implements the Db interface for the titan file system
+type Driver struct {
+	// DbURI is the path to the database file, optionally followed by
+	// go-sqlite3 connection parameters
+	DbURI string
+
+	// BusyRetries is the number of times a write transaction is retried while
+	// the database is locked by another writer
+	BusyRetries int
+
+	// ForeignKeys enables the enforcement of foreign key constraints
+	ForeignKeys bool
+
+	// Capacity is the amount of bytes reported as the size of the file
+	// system, zero meaning there's no quota
+	Capacity uint64
+
+	// InodeCapacity is the amount of inodes reported as available to the file
+	// system, zero meaning there's no quota
+	InodeCapacity uint64
+
+	// BlockSize is the preferred size of IO operations reported by FsStats,
+	// the zeros filling grown files being split so that holes align to it
+	BlockSize uint64
+
+	// Atime controls when reads update the access time of inodes
+	Atime database.AtimePolicy
+
+	// Dedup makes chunks whose data is already stored point to the existing
+	// object, orphaning the new one
+	Dedup bool
+
+	// AuditHook is notified of the mutating operations once committed, none
+	// being reported if it's nil
+	AuditHook database.AuditHook
+
+	// ReadOnly makes every mutation fail with EROFS without touching the
+	// database, reads leaving access times untouched too
+	ReadOnly bool
+
+	*sql.DB
+
+	stmts *stmt.Cache
+}
+
+// Open opens the underlying connection
+func (d *Driver) Open() error {
+	separator := "?"
+	if strings.Contains(d.DbURI, "?") {
+		separator = "&"
+	}
+
+	uri := d.DbURI + separator + "_txlock=immediate&_journal_mode=WAL"
+	if d.ForeignKeys {
+		uri += "&_foreign_keys=1"
+	}
+
+	db, err := sql.Open("sqlite3", uri)
+	if err != nil {
+		return err
+	}
+
+	d.DB = db
+	d.stmts = stmt.NewCache(db)
+	return nil
+}
+
+// Ping checks that the database is reachable, opening a new connection if needed
+func (d *Driver) Ping(ctx context.Context) error {
+	return d.DB.PingContext(ctx)
+}
+
+// PoolStats returns the statistics of the underlying connection pool
+func (d *Driver) PoolStats() sql.DBStats {
+	if d.DB == nil {
+		return sql.DBStats{}
+	}
+
+	return d.DB.Stats()
+}
+
+// Close closes the underlying connection
+func (d *Driver) Close() error {
+	d.stmts.Close()
+	return d.DB.Close()
+}
+
+// Setup creates the tables and the initial data required by the file system
+func (d *Driver) Setup(ctx context.Context) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	return d.setup(ctx, schemaVersion)
+}
+
+// setup creates the tables at the given schema version
+func (d *Driver) setup(ctx context.Context, version int) error {
+	tx, err := d.begin(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	queries := []string{
+		"CREATE TABLE inodes ( id INTEGER PRIMARY KEY AUTOINCREMENT, mode INTEGER NOT NULL, gid INTEGER NOT NULL, uid INTEGER NOT NULL, target BLOB NOT NULL DEFAULT x'', size INTEGER NOT NULL, refcount INTEGER NOT NULL, atime DATETIME NOT NULL, mtime DATETIME NOT NULL, ctime DATETIME NOT NULL, crtime DATETIME NOT NULL )",
+
+		"CREATE TABLE entries (parent INTEGER NOT NULL, name BLOB NOT NULL, inode INTEGER NOT NULL, PRIMARY KEY (parent, name), FOREIGN KEY (parent) REFERENCES inodes(id), FOREIGN KEY (inode) REFERENCES inodes(id))",
+		"CREATE INDEX entries_inode ON entries (inode)",
+
+		"CREATE TABLE chunks (id INTEGER PRIMARY KEY AUTOINCREMENT, inode INTEGER, storage VARCHAR(255), `key` VARCHAR(255), objectoffset INTEGER, inodeoffset INTEGER, size INTEGER, orphandate DATETIME, FOREIGN KEY (inode) REFERENCES inodes(id))",
+		"CREATE INDEX chunks_inode ON chunks (inode)",
+
+		"CREATE TABLE xattr (inode INTEGER NOT NULL, `key` BLOB NOT NULL, value BLOB NOT NULL, PRIMARY KEY (inode, `key`), FOREIGN KEY (inode) REFERENCES inodes(id))",
+
+		"CREATE TABLE stats (inodes INTEGER NOT NULL, size INTEGER NOT NULL)",
+
+		"INSERT INTO inodes(id, mode, uid, gid, size, refcount, atime, mtime, ctime, crtime) VALUES(1, 2147484159, 0, 0, 0, 1, datetime('now'), datetime('now'), datetime('now'), datetime('now'))",
+		"INSERT INTO stats(inodes, size) VALUES(1, 0)",
+		"CREATE TABLE schema_version (version INTEGER NOT NULL)",
+		"INSERT INTO schema_version(version) VALUES(1)",
+	}
+
+	for _, query := range queries {
+		_, err = tx.ExecContext(ctx, query)
+
+		if err != nil {
+			tx.Rollback()
+			return treatError(err)
+		}
+	}
+
+	for _, migration := range migrations[:version-1] {
+		if err = migration(ctx, tx); err != nil {
+			tx.Rollback()
+			return treatError(err)
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE schema_version SET version = ?", version); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	return tx.Commit()
+}
+
+// Stats retrieves the file system stats
+func (d *Driver) Stats(ctx context.Context) (*database.Stats, error) {
+	stats := database.Stats{}
+	row := d.DB.QueryRowContext(ctx, "SELECT inodes, size FROM stats")
+	err := row.Scan(&stats.Inodes, &stats.Size)
+
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	return &stats, nil
+}
+
+// FsStats retrieves the file system stats relative to its capacity
+func (d *Driver) FsStats(ctx context.Context) (*database.FsStats, error) {
+	stats, err := d.Stats(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	fsStats := database.NewFsStats(*stats, d.Capacity, d.InodeCapacity)
+	fsStats.BlockSize = d.BlockSize
+	return fsStats, nil
+}
+
+// SubtreeStats retrieves the amount of inodes and bytes of an inode along
+// with every inode below it, each of them counted once
+func (d *Driver) SubtreeStats(ctx context.Context, inode fuseops.InodeID) (*database.SubtreeStats, error) {
+	stats := database.SubtreeStats{}
+	row := d.DB.QueryRowContext(ctx, subtreeQuery+"SELECT COUNT(*), COALESCE(SUM(size), 0), (SELECT COALESCE(SUM(c.size), 0) FROM chunks c WHERE c.inode IN (SELECT inode FROM tree) AND c.storage <> ? AND c.`key` <> '') FROM inodes WHERE id IN (SELECT inode FROM tree)", uint64(inode), database.ZeroStorage)
+
+	if err := row.Scan(&stats.Inodes, &stats.Size, &stats.Allocated); err != nil {
+		return nil, treatError(err)
+	}
+
+	if stats.Inodes == 0 {
+		return nil, syscall.ENOENT
+	}
+
+	return &stats, nil
+}
+
+// SetQuota sets the limits of the given user and group, computing their
+// current usage if they had no quota yet
+func (d *Driver) SetQuota(ctx context.Context, uid *uint32, gid *uint32, bytes uint64, inodes uint64) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return treatError(err)
+	}
+
+	for _, owner := range quotaOwners(uid, gid) {
+		query := "INSERT INTO quotas(kind, id, bytes, inodes, usedbytes, usedinodes) VALUES (?, ?, ?, ?, (SELECT COALESCE(SUM(size), 0) FROM inodes WHERE " + owner.column + " = ?), (SELECT COUNT(*) FROM inodes WHERE " + owner.column + " = ?)) ON CONFLICT (kind, id) DO UPDATE SET bytes = excluded.bytes, inodes = excluded.inodes"
+		if _, err = tx.ExecContext(ctx, query, owner.kind, owner.id, bytes, inodes, owner.id, owner.id); err != nil {
+			tx.Rollback()
+			return treatError(err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return treatError(err)
+	}
+
+	return nil
+}
+
+// GetQuota retrieves the limits and usage of either the given user or group
+func (d *Driver) GetQuota(ctx context.Context, uid *uint32, gid *uint32) (*database.Quota, error) {
+	owners := quotaOwners(uid, gid)
+	if len(owners) != 1 {
+		return nil, syscall.EINVAL
+	}
+
+	quota := database.Quota{}
+	row := d.DB.QueryRowContext(ctx, "SELECT bytes, inodes, usedbytes, usedinodes FROM quotas WHERE kind = ? AND id = ?", owners[0].kind, owners[0].id)
+
+	if err := row.Scan(&quota.Bytes, &quota.Inodes, &quota.UsedBytes, &quota.UsedInodes); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, syscall.ENOENT
+		}
+
+		return nil, treatError(err)
+	}
+
+	return &quota, nil
+}
+
+// Create creates a new inode under the given parent. Its times are set to
+// the current time unless given, e.g when restoring a backup.
+func (d *Driver) Create(ctx context.Context, entry database.Entry) (*database.Entry, error) {
+	if d.ReadOnly {
+		return nil, syscall.EROFS
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	parentInode, err := d.getInode(ctx, tx, entry.Parent)
+	if err != nil {
+		tx.Rollback()
+		return nil, treatError(err)
+	}
+
+	if !parentInode.Mode.IsDir() {
+		tx.Rollback()
+		return nil, syscall.ENOTDIR
+	}
+
+	inode, err := d.createInode(ctx, tx, entry.Inode, 1)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	entry.Inode = *inode
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO entries(parent, name, inode) VALUES(?, ?, ?)", uint64(entry.Parent), []byte(entry.Name), uint64(entry.ID))
+	if err != nil {
+		tx.Rollback()
+		return nil, treatError(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, treatError(err)
+	}
+
+	database.Audit(ctx, d.AuditHook, database.AuditCreate, entry.ID, entry.Uid, entry.Gid)
+	return &entry, nil
+}
+
+// CreateAnonymous creates a new regular file without any links, as an
+// O_TMPFILE open would. It's kept alive by the handle opening it and can be
+// given a name with Link, being removed by Forget otherwise.
+func (d *Driver) CreateAnonymous(ctx context.Context, mode os.FileMode, uid uint32, gid uint32) (*database.Inode, error) {
+	if d.ReadOnly {
+		return nil, syscall.EROFS
+	}
+
+	if !mode.IsRegular() {
+		return nil, syscall.EINVAL
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	inode, err := d.createInode(ctx, tx, database.Inode{InodeAttributes: fuseops.InodeAttributes{Mode: mode, Uid: uid, Gid: gid}}, 0)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	// Until linked, the inode is held by the handle creating it
+	if _, err = tx.ExecContext(ctx, "UPDATE inodes SET flags = ? WHERE id = ?", database.InodeAnonymous, uint64(inode.ID)); err != nil {
+		tx.Rollback()
+		return nil, treatError(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, treatError(err)
+	}
+
+	return inode, nil
+}
+
+// createInode inserts a new inode with the given attributes and reference
+// count within the given transaction, updating the stats and the quotas of
+// its owners
+func (d *Driver) createInode(ctx context.Context, tx *sql.Tx, inode database.Inode, refcount uint32) (*database.Inode, error) {
+	var result sql.Result
+	var id int64
+	var err error
+
+	if err = d.updateQuota(ctx, tx, inode.Uid, inode.Gid, 0, 1, true); err != nil {
+		return nil, err
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE stats SET inodes = inodes + 1"); err != nil {
+		return nil, treatError(err)
+	}
+
+	result, err = tx.ExecContext(ctx, "INSERT INTO inodes(mode, uid, gid, size, refcount, atime, mtime, ctime, crtime, target, rdev) VALUES(?, ?, ?, 0, ?, COALESCE(?, datetime('now')), COALESCE(?, datetime('now')), COALESCE(?, datetime('now')), COALESCE(?, datetime('now')), ?, ?)", uint32(inode.Mode), inode.Uid, inode.Gid, refcount, timeOrNull(inode.Atime), timeOrNull(inode.Mtime), timeOrNull(inode.Ctime), timeOrNull(inode.Crtime), []byte(inode.SymLink), inode.Rdev)
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	id, err = result.LastInsertId()
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	created, err := d.getInode(ctx, tx, fuseops.InodeID(id))
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	return created, nil
+}
+
+// Link creates a new hard link to the given inode
+func (d *Driver) Link(ctx context.Context, inode fuseops.InodeID, newParent fuseops.InodeID, newName string) (*database.Entry, error) {
+	if d.ReadOnly {
+		return nil, syscall.EROFS
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	parentInode, err := d.getInode(ctx, tx, newParent)
+	if err != nil {
+		tx.Rollback()
+		return nil, treatError(err)
+	}
+
+	if !parentInode.Mode.IsDir() {
+		tx.Rollback()
+		return nil, syscall.ENOTDIR
+	}
+
+	in, err := d.getInode(ctx, tx, inode)
+	if err != nil {
+		tx.Rollback()
+		return nil, treatError(err)
+	}
+
+	if in.Mode.IsDir() {
+		tx.Rollback()
+		return nil, syscall.EPERM
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO entries(parent, name, inode) VALUES(?, ?, ?)", uint64(newParent), []byte(newName), uint64(inode))
+	if err != nil {
+		tx.Rollback()
+		return nil, treatError(err)
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE inodes SET refcount = refcount + 1, flags = flags & ~"+anonymousFlag+" WHERE id = ?", uint64(inode))
+	if err != nil {
+		tx.Rollback()
+		return nil, treatError(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, treatError(err)
+	}
+
+	database.Audit(ctx, d.AuditHook, database.AuditLink, inode, in.Uid, in.Gid)
+
+	in.Nlink++
+	return &database.Entry{Parent: newParent, Name: newName, Inode: *in}, nil
+}
+
+// Forget checks if an inode has any links and removes it if not
+func (d *Driver) Forget(ctx context.Context, inode fuseops.InodeID) error {
+	if d.ReadOnly {
+		return d.checkForget(ctx, []fuseops.InodeID{inode})
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return treatError(err)
+	}
+
+	in, err := d.getInode(ctx, tx, inode)
+	if err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	// the refcount could have missed an entry still pointing to the inode,
+	// which is then kept rather than failing to be deleted
+	if in.Nlink == 0 {
+		if in.Nlink, err = d.countEntries(ctx, tx, in.ID); err != nil {
+			tx.Rollback()
+			return treatError(err)
+		}
+	}
+
+	if in.Nlink == 0 {
+
+		if _, err = tx.ExecContext(ctx, "UPDATE chunks SET inode = NULL, objectoffset = NULL, inodeoffset = NULL, size = NULL, orphandate = datetime('now') WHERE inode = ?", in.ID); err != nil {
+			tx.Rollback()
+			return treatError(err)
+		}
+
+		if _, err = tx.ExecContext(ctx, "DELETE FROM xattr WHERE inode = ?", uint64(in.ID)); err != nil {
+			tx.Rollback()
+			return treatError(err)
+		}
+
+		if _, err = tx.ExecContext(ctx, "DELETE FROM locks WHERE inode = ?", uint64(in.ID)); err != nil {
+			tx.Rollback()
+			return treatError(err)
+		}
+
+		if _, err = tx.ExecContext(ctx, "DELETE FROM inodes WHERE id = ?", uint64(in.ID)); err != nil {
+			tx.Rollback()
+			return treatForgetError(err)
+		}
+
+		// the stats are clamped so that a drifted counter never underflows,
+		// the root being always counted
+		if _, err = tx.ExecContext(ctx, "UPDATE stats SET size = size - MIN(size, ?), inodes = inodes - MIN(inodes - 1, 1)", in.Size); err != nil {
+			tx.Rollback()
+			return treatError(err)
+		}
+
+		if err = d.updateQuota(ctx, tx, in.Uid, in.Gid, -int64(in.Size), -1, false); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+	}
+
+	if err = tx.Commit(); err != nil {
+		return treatError(err)
+	}
+
+	return nil
+}
+
+// ForgetBatch removes, in a single transaction, those of the given inodes
+// which have no links left
+func (d *Driver) ForgetBatch(ctx context.Context, inodes []fuseops.InodeID) error {
+	if d.ReadOnly {
+		return d.checkForget(ctx, inodes)
+	}
+
+	if len(inodes) == 0 {
+		return nil
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return treatError(err)
+	}
+
+	if err = d.forget(ctx, tx, inodes); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return treatError(err)
+	}
+
+	return nil
+}
+
+// forget removes, within the given transaction, those of the given inodes
+// which have no links left, orphaning their chunks and updating the stats
+// and the quotas of their owners
+func (d *Driver) forget(ctx context.Context, tx *sql.Tx, inodes []fuseops.InodeID) error {
+	var err error
+
+	total := database.Stats{}
+	usage := make(map[inodeOwner]*database.Stats)
+
+	for len(inodes) > 0 {
+		n := len(inodes)
+		if n > maxPlaceholders {
+			n = maxPlaceholders
+		}
+
+		args := make([]interface{}, 0, n)
+		for _, inode := range inodes[:n] {
+			args = append(args, uint64(inode))
+		}
+
+		// inodes still referenced by an entry are kept, like in Forget
+		rows, err := tx.QueryContext(ctx, "SELECT id, uid, gid, size FROM inodes WHERE refcount = 0 AND NOT EXISTS (SELECT 1 FROM entries e WHERE e.inode = inodes.id) AND id IN ("+inList(n)+")", args...)
+		if err != nil {
+			return treatError(err)
+		}
+
+		forgotten := make([]interface{}, 0, n)
+		for rows.Next() {
+			var id uint64
+			var owner inodeOwner
+			var size uint64
+
+			if err = rows.Scan(&id, &owner.uid, &owner.gid, &size); err != nil {
+				rows.Close()
+				return treatError(err)
+			}
+
+			if usage[owner] == nil {
+				usage[owner] = &database.Stats{}
+			}
+
+			usage[owner].Inodes++
+			usage[owner].Size += size
+			total.Inodes++
+			total.Size += size
+			forgotten = append(forgotten, id)
+		}
+
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return treatError(err)
+		}
+
+		inodes = inodes[n:]
+		if len(forgotten) == 0 {
+			continue
+		}
+
+		in := inList(len(forgotten))
+
+		if _, err = tx.ExecContext(ctx, "UPDATE chunks SET inode = NULL, objectoffset = NULL, inodeoffset = NULL, size = NULL, orphandate = datetime('now') WHERE inode IN ("+in+")", forgotten...); err != nil {
+			return treatError(err)
+		}
+
+		if _, err = tx.ExecContext(ctx, "DELETE FROM xattr WHERE inode IN ("+in+")", forgotten...); err != nil {
+			return treatError(err)
+		}
+
+		if _, err = tx.ExecContext(ctx, "DELETE FROM locks WHERE inode IN ("+in+")", forgotten...); err != nil {
+			return treatError(err)
+		}
+
+		if _, err = tx.ExecContext(ctx, "DELETE FROM inodes WHERE id IN ("+in+")", forgotten...); err != nil {
+			return treatForgetError(err)
+		}
+	}
+
+	if total.Inodes > 0 {
+
+		// clamped like in Forget
+		if _, err = tx.ExecContext(ctx, "UPDATE stats SET size = size - MIN(size, ?), inodes = inodes - MIN(inodes - 1, ?)", total.Size, total.Inodes); err != nil {
+			return treatError(err)
+		}
+
+		for owner, used := range usage {
+			if err = d.updateQuota(ctx, tx, owner.uid, owner.gid, -int64(used.Size), -int64(used.Inodes), false); err != nil {
+				return err
+			}
+		}
+
+	}
+
+	return nil
+}
+
+// CountOrphans reports what CleanOrphanInodes and CleanOrphanChunks, given
+// the same threshold, would remove without removing anything
+func (d *Driver) CountOrphans(ctx context.Context, threshold time.Time) (*database.OrphanReport, error) {
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	report := &database.OrphanReport{}
+
+	counts := []struct {
+		query  string
+		args   []interface{}
+		fields []interface{}
+	}{
+		{"SELECT COUNT(*), COALESCE(SUM(size), 0) FROM inodes WHERE " + orphanInodesCondition, nil, []interface{}{&report.Inodes, &report.Size}},
+		{"SELECT COUNT(*) FROM xattr x, inodes i WHERE i.id = x.inode AND " + orphanInodesCondition, nil, []interface{}{&report.Xattrs}},
+		{"SELECT COUNT(*) FROM chunks c, inodes i WHERE c.inode = i.id AND " + orphanInodesCondition, nil, []interface{}{&report.OrphanedChunks}},
+		{"SELECT COUNT(*) FROM chunks WHERE " + orphanChunksCondition, []interface{}{threshold.In(time.UTC)}, []interface{}{&report.Chunks}},
+		{"SELECT COUNT(*) FROM (" + orphanObjectsQuery + ") objects", []interface{}{threshold.In(time.UTC)}, []interface{}{&report.Objects}},
+	}
+
+	for _, count := range counts {
+		if err = tx.QueryRowContext(ctx, count.query, count.args...).Scan(count.fields...); err != nil {
+			tx.Rollback()
+			return nil, treatError(err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, treatError(err)
+	}
+
+	return report, nil
+}
+
+// CleanOrphanInodes removes all orphan inodes and chunks
+func (d *Driver) CleanOrphanInodes(ctx context.Context) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return treatError(err)
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE chunks SET inode = NULL, objectoffset = NULL, inodeoffset = NULL, size = NULL, orphandate = datetime('now') WHERE inode IN (SELECT id FROM inodes WHERE "+orphanInodesCondition+")"); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM xattr WHERE inode IN (SELECT id FROM inodes WHERE "+orphanInodesCondition+")"); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM locks WHERE inode IN (SELECT id FROM inodes WHERE "+orphanInodesCondition+")"); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM inodes WHERE "+orphanInodesCondition); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE stats SET inodes = (SELECT COUNT(*) FROM inodes), size = (SELECT COALESCE(SUM(size), 0) FROM inodes)"); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE quotas SET usedbytes = (SELECT COALESCE(SUM(size), 0) FROM inodes WHERE CASE quotas.kind WHEN ? THEN uid ELSE gid END = quotas.id), usedinodes = (SELECT COUNT(*) FROM inodes WHERE CASE quotas.kind WHEN ? THEN uid ELSE gid END = quotas.id)", userQuota, userQuota); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return treatError(err)
+	}
+
+	return nil
+}
+
+// CleanOrphanChunks removes orphaned chunks. Concurrent cleanups run one
+// after the other, as transactions take the write lock upfront.
+func (d *Driver) CleanOrphanChunks(ctx context.Context, threshold time.Time, st storage.Storage, workers int) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Chunks may share objects, so every object is removed once and only if
+	// no live chunk references it anymore
+	rows, err := tx.QueryContext(ctx, orphanObjectsQuery, threshold.In(time.UTC))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// Chunks are only deleted if all of their objects could be removed
+	if err = database.RemoveObjects(rows, st, workers); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM chunks WHERE "+orphanChunksCondition, threshold.In(time.UTC))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Fsck checks the reference count of every inode against the entries
+// pointing to it, also looking for dangling entries and unreachable inodes.
+// If repair is set, reference counts are fixed in the same transaction.
+func (d *Driver) Fsck(ctx context.Context, repair bool) (*database.FsckReport, error) {
+	if repair && d.ReadOnly {
+		return nil, syscall.EROFS
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT id, refcount FROM inodes")
+	if err != nil {
+		tx.Rollback()
+		return nil, treatError(err)
+	}
+
+	refcounts := make(map[fuseops.InodeID]uint64)
+	for rows.Next() {
+		var id uint64
+		var refcount uint64
+
+		if err = rows.Scan(&id, &refcount); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return nil, treatError(err)
+		}
+
+		refcounts[fuseops.InodeID(id)] = refcount
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		tx.Rollback()
+		return nil, treatError(err)
+	}
+
+	rows, err = tx.QueryContext(ctx, "SELECT parent, name, inode FROM entries ORDER BY parent, name")
+	if err != nil {
+		tx.Rollback()
+		return nil, treatError(err)
+	}
+
+	links := make([]database.Link, 0)
+	for rows.Next() {
+		var parent uint64
+		var name string
+		var inode uint64
+
+		if err = rows.Scan(&parent, &name, &inode); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return nil, treatError(err)
+		}
+
+		links = append(links, database.Link{Parent: fuseops.InodeID(parent), Name: name, Inode: fuseops.InodeID(inode)})
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		tx.Rollback()
+		return nil, treatError(err)
+	}
+
+	report := database.NewFsckReport(refcounts, links)
+
+	if repair {
+		for _, mismatch := range report.Refcounts {
+			if _, err = tx.ExecContext(ctx, "UPDATE inodes SET refcount = ? WHERE id = ?", mismatch.Links, uint64(mismatch.Inode)); err != nil {
+				tx.Rollback()
+				return nil, treatError(err)
+			}
+		}
+
+		report.Repaired = true
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, treatError(err)
+	}
+
+	return report, nil
+}
+
+// VerifyChunks checks that the objects of the chunks of an inode are still
+// stored, returning the ids of the chunks whose object is missing or no
+// longer has the ETag it had when it was stored
+func (d *Driver) VerifyChunks(ctx context.Context, st storage.Storage, inode fuseops.InodeID) ([]uint64, error) {
+	rows, err := d.DB.QueryContext(ctx, "SELECT id, storage, `key`, objectoffset, size, COALESCE(etag, '') FROM chunks WHERE inode = ? ORDER BY id", uint64(inode))
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	return database.MissingObjects(ctx, rows, st)
+}
+
+// VerifyAllChunks checks the objects of every live chunk as VerifyChunks
+// does, which may take long on big file systems
+func (d *Driver) VerifyAllChunks(ctx context.Context, st storage.Storage) ([]uint64, error) {
+	rows, err := d.DB.QueryContext(ctx, "SELECT id, storage, `key`, objectoffset, size, COALESCE(etag, '') FROM chunks WHERE inode IS NOT NULL ORDER BY id")
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	return database.MissingObjects(ctx, rows, st)
+}
+
+// Export writes a portable dump of the file system to w
+func (d *Driver) Export(ctx context.Context, w io.Writer) error {
+	return database.Export(ctx, d, w)
+}
+
+// Import recreates the contents of a dump below the root, giving new ids to
+// the imported inodes
+func (d *Driver) Import(ctx context.Context, r io.Reader) error {
+	return database.Import(ctx, d, r)
+}
+
+// Unlink removes an entry from the file system
+func (d *Driver) Unlink(ctx context.Context, parent fuseops.InodeID, name string) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return treatError(err)
+	}
+
+	inode, err := d.unlink(ctx, tx, parent, name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	var uid, gid uint32
+	if d.AuditHook != nil {
+		if uid, gid, err = d.getOwner(ctx, tx, inode); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return treatError(err)
+	}
+
+	database.Audit(ctx, d.AuditHook, database.AuditUnlink, inode, uid, gid)
+	return nil
+}
+
+func (d *Driver) unlink(ctx context.Context, tx *sql.Tx, parent fuseops.InodeID, name string) (fuseops.InodeID, error) {
+	var inode uint64
+
+	row := tx.QueryRowContext(ctx, "SELECT inode FROM entries WHERE parent = ? AND name = ?", uint64(parent), []byte(name))
+
+	if err := row.Scan(&inode); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, syscall.ENOENT
+		}
+
+		return 0, treatError(err)
+	}
+
+	children, err := d.countChildren(ctx, tx, fuseops.InodeID(inode))
+	if err != nil {
+		return 0, err
+	}
+
+	if children > 0 {
+		return 0, syscall.ENOTEMPTY
+	}
+
+	if err = d.checkMutable(ctx, tx, fuseops.InodeID(inode)); err != nil {
+		return 0, err
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM entries WHERE parent = ? AND name = ?", uint64(parent), []byte(name)); err != nil {
+		return 0, treatError(err)
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE inodes SET refcount = refcount - 1 WHERE id = ?", uint64(inode)); err != nil {
+		return 0, treatError(err)
+	}
+
+	return fuseops.InodeID(inode), nil
+}
+
+// RemoveTree removes an entry in a single transaction along with, if it's a
+// directory, every entry below it. Non-empty directories are only removed if
+// recursive is set, failing with ENOTEMPTY otherwise. Unlike Unlink, inodes
+// left without links are removed right away, orphaning their chunks.
+func (d *Driver) RemoveTree(ctx context.Context, parent fuseops.InodeID, name string, recursive bool) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return treatError(err)
+	}
+
+	if err = d.removeTree(ctx, tx, parent, name, recursive); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return treatError(err)
+	}
+
+	return nil
+}
+
+func (d *Driver) removeTree(ctx context.Context, tx *sql.Tx, parent fuseops.InodeID, name string, recursive bool) error {
+	var entries uint64
+	immutable := false
+	now := time.Now()
+
+	inodes := make([]fuseops.InodeID, 0)
+	dirs := make([]interface{}, 0)
+
+	// Inodes are grouped by the amount of links removed from them, which
+	// is only greater than one for files hard linked within the tree
+	links := make(map[uint64][]interface{})
+
+	rows, err := tx.QueryContext(ctx, "WITH RECURSIVE tree(inode) AS (SELECT inode FROM entries WHERE parent = ? AND name = ? UNION ALL SELECT e.inode FROM entries e, tree t WHERE e.parent = t.inode) SELECT t.inode, COUNT(*), i.mode, i.flags, i.retainuntil FROM tree t, inodes i WHERE i.id = t.inode GROUP BY t.inode, i.mode, i.flags, i.retainuntil", uint64(parent), []byte(name))
+	if err != nil {
+		return treatError(err)
+	}
+
+	for rows.Next() {
+		var id, count uint64
+		var mode, flags uint32
+		var retainUntil *time.Time
+
+		if err = rows.Scan(&id, &count, &mode, &flags, &retainUntil); err != nil {
+			rows.Close()
+			return treatError(err)
+		}
+
+		if os.FileMode(mode).IsDir() {
+			dirs = append(dirs, id)
+		}
+
+		immutable = immutable || database.IsImmutable(flags, retainUntil, now)
+		links[count] = append(links[count], id)
+		inodes = append(inodes, fuseops.InodeID(id))
+		entries += count
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return treatError(err)
+	}
+
+	if entries == 0 {
+		return syscall.ENOENT
+	}
+
+	if entries > 1 && !recursive {
+		return syscall.ENOTEMPTY
+	}
+
+	if immutable {
+		return syscall.EPERM
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM entries WHERE parent = ? AND name = ?", uint64(parent), []byte(name)); err != nil {
+		return treatError(err)
+	}
+
+	for len(dirs) > 0 {
+		n := len(dirs)
+		if n > maxPlaceholders {
+			n = maxPlaceholders
+		}
+
+		if _, err = tx.ExecContext(ctx, "DELETE FROM entries WHERE parent IN ("+inList(n)+")", dirs[:n]...); err != nil {
+			return treatError(err)
+		}
+
+		dirs = dirs[n:]
+	}
+
+	for count, ids := range links {
+		for len(ids) > 0 {
+			n := len(ids)
+			if n > maxPlaceholders-1 {
+				n = maxPlaceholders - 1
+			}
+
+			batch := ids[:n]
+			if _, err = tx.ExecContext(ctx, "UPDATE inodes SET refcount = refcount - ? WHERE id IN ("+inList(n)+")", append([]interface{}{count}, batch...)...); err != nil {
+				return treatError(err)
+			}
+
+			ids = ids[n:]
+		}
+	}
+
+	return d.forget(ctx, tx, inodes)
+}
+
+// Snapshot copies the directory tree rooted at srcInode to a new entry of
+// dstParent without duplicating any data, the copied chunks referencing the
+// same storage objects as the original ones. Files hard linked within the
+// tree are still linked together in the copy.
+func (d *Driver) Snapshot(ctx context.Context, srcInode fuseops.InodeID, dstParent fuseops.InodeID, dstName string) (*database.Entry, error) {
+	if d.ReadOnly {
+		return nil, syscall.EROFS
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	entry, err := d.snapshot(ctx, tx, srcInode, dstParent, dstName)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, treatError(err)
+	}
+
+	return entry, nil
+}
+
+type snapshotEntry struct {
+	parent fuseops.InodeID
+	name   []byte
+	inode  fuseops.InodeID
+}
+
+func (d *Driver) snapshot(ctx context.Context, tx *sql.Tx, srcInode fuseops.InodeID, dstParent fuseops.InodeID, dstName string) (*database.Entry, error) {
+	src, err := d.getInode(ctx, tx, srcInode)
+	if err != nil {
+		return nil, err
+	}
+
+	parentInode, err := d.getInode(ctx, tx, dstParent)
+	if err != nil {
+		return nil, err
+	}
+
+	if !src.Mode.IsDir() || !parentInode.Mode.IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+
+	entries := make([]snapshotEntry, 0)
+	inodes := make([]fuseops.InodeID, 0)
+	links := make(map[fuseops.InodeID]uint32)
+
+	rows, err := tx.QueryContext(ctx, "WITH RECURSIVE tree(parent, name, inode) AS (SELECT parent, name, inode FROM entries WHERE parent = ? UNION ALL SELECT e.parent, e.name, e.inode FROM entries e, tree t WHERE e.parent = t.inode) SELECT parent, name, inode FROM tree", uint64(srcInode))
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	for rows.Next() {
+		var e snapshotEntry
+
+		if err = rows.Scan(&e.parent, &e.name, &e.inode); err != nil {
+			rows.Close()
+			return nil, treatError(err)
+		}
+
+		if links[e.inode] == 0 {
+			inodes = append(inodes, e.inode)
+		}
+
+		links[e.inode]++
+		entries = append(entries, e)
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, treatError(err)
+	}
+
+	// The destination can't be within the copied tree
+	if _, ok := links[dstParent]; ok || dstParent == srcInode {
+		return nil, syscall.EINVAL
+	}
+
+	root, err := d.copyInode(ctx, tx, src, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = tx.ExecContext(ctx, "INSERT INTO entries(parent, name, inode) VALUES(?, ?, ?)", uint64(dstParent), []byte(dstName), uint64(root.ID)); err != nil {
+		return nil, treatError(err)
+	}
+
+	copies := map[fuseops.InodeID]fuseops.InodeID{srcInode: root.ID}
+	for _, id := range inodes {
+		i, err := d.getInode(ctx, tx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		copied, err := d.copyInode(ctx, tx, i, links[id])
+		if err != nil {
+			return nil, err
+		}
+
+		copies[id] = copied.ID
+	}
+
+	for _, e := range entries {
+		if _, err = tx.ExecContext(ctx, "INSERT INTO entries(parent, name, inode) VALUES(?, ?, ?)", uint64(copies[e.parent]), e.name, uint64(copies[e.inode])); err != nil {
+			return nil, treatError(err)
+		}
+	}
+
+	return &database.Entry{Parent: dstParent, Name: dstName, Inode: *root}, nil
+}
+
+// copyInode creates a new inode with the attributes, chunks and extended
+// attributes of the given one, sharing its storage objects
+func (d *Driver) copyInode(ctx context.Context, tx *sql.Tx, i *database.Inode, refcount uint32) (*database.Inode, error) {
+	copied, err := d.createInode(ctx, tx, *i, refcount)
+	if err != nil {
+		return nil, err
+	}
+
+	if i.Size > 0 {
+		if err = d.updateQuota(ctx, tx, i.Uid, i.Gid, int64(i.Size), 0, true); err != nil {
+			return nil, err
+		}
+
+		if _, err = tx.ExecContext(ctx, "UPDATE stats SET size = size + ?", i.Size); err != nil {
+			return nil, treatError(err)
+		}
+
+		if _, err = tx.ExecContext(ctx, "UPDATE inodes SET size = ? WHERE id = ?", i.Size, uint64(copied.ID)); err != nil {
+			return nil, treatError(err)
+		}
+
+		copied.Size = i.Size
+	}
+
+	if _, err = tx.ExecContext(ctx, "INSERT INTO chunks(inode, storage, `key`, objectoffset, inodeoffset, size, hash, etag, version, checksum) SELECT ?, storage, `key`, objectoffset, inodeoffset, size, hash, etag, version, checksum FROM chunks WHERE inode = ?", uint64(copied.ID), uint64(i.ID)); err != nil {
+		return nil, treatError(err)
+	}
+
+	if _, err = tx.ExecContext(ctx, "INSERT INTO xattr(inode, `key`, value) SELECT ?, `key`, value FROM xattr WHERE inode = ?", uint64(copied.ID), uint64(i.ID)); err != nil {
+		return nil, treatError(err)
+	}
+
+	return copied, nil
+}
+
+// Rename renames an entry, replacing the destination unless told otherwise
+// by the provided flags. A replaced inode left without links is removed
+// right away, orphaning its chunks.
+func (d *Driver) Rename(ctx context.Context, oldParent fuseops.InodeID, oldName string, newParent fuseops.InodeID, newName string, flags uint32) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if flags&^(database.RenameNoReplace|database.RenameExchange|database.RenameEmpty|database.RenameMutable) != 0 || flags&database.RenameExchange != 0 && flags != database.RenameExchange {
+		return syscall.EINVAL
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	inode, err := d.getEntry(ctx, tx, oldParent, oldName)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	in, err := d.getInode(ctx, tx, inode)
+	if err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	if flags&database.RenameMutable != 0 {
+		if err = d.checkMutable(ctx, tx, inode); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if in.Mode.IsDir() {
+		var cycle bool
+
+		if cycle, err = d.isAncestor(ctx, tx, inode, newParent); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if cycle {
+			tx.Rollback()
+			return syscall.EINVAL
+		}
+
+		if flags&database.RenameEmpty != 0 {
+			var children uint64
+
+			if children, err = d.countChildren(ctx, tx, inode); err != nil {
+				tx.Rollback()
+				return err
+			}
+
+			if children > 0 {
+				tx.Rollback()
+				return syscall.ENOTEMPTY
+			}
+		}
+	}
+
+	if flags&database.RenameExchange != 0 {
+		if err = d.exchange(ctx, tx, oldParent, oldName, inode, newParent, newName); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err = tx.Commit(); err != nil {
+			return treatError(err)
+		}
+
+		database.Audit(ctx, d.AuditHook, database.AuditRename, inode, in.Uid, in.Gid)
+		return nil
+	}
+
+	if flags&database.RenameNoReplace != 0 {
+		if _, err = d.getEntry(ctx, tx, newParent, newName); err != syscall.ENOENT {
+			tx.Rollback()
+			if err == nil {
+				return syscall.EEXIST
+			}
+
+			return err
+		}
+	}
+
+	replaced, err := d.unlink(ctx, tx, newParent, newName)
+	if err != nil && err != syscall.ENOENT {
+		tx.Rollback()
+		return err
+	}
+
+	// The replaced inode is removed right away if it has no links left
+	if err == nil {
+		if err = d.forget(ctx, tx, []fuseops.InodeID{replaced}); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	result, err := tx.ExecContext(ctx, "UPDATE entries SET parent = ?, name = ? WHERE parent = ? AND name = ?", uint64(newParent), []byte(newName), uint64(oldParent), []byte(oldName))
+
+	if err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		tx.Rollback()
+		return syscall.ENOENT
+	}
+
+	if err = tx.Commit(); err != nil {
+		return treatError(err)
+	}
+
+	database.Audit(ctx, d.AuditHook, database.AuditRename, inode, in.Uid, in.Gid)
+	return nil
+}
+
+// LookUp finds the entry located under the specified parent with the specified name
+func (d *Driver) LookUp(ctx context.Context, parent fuseops.InodeID, name string) (*database.Entry, error) {
+	s, err := d.stmts.Get(ctx, lookUpQuery)
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	row := s.QueryRowContext(ctx, uint64(parent), []byte(name))
+
+	var mode uint32
+	var id uint64
+	inode := database.Inode{}
+
+	err = row.Scan(&id, &mode, &inode.Uid, &inode.Gid, &inode.Size, &inode.Nlink, &inode.Atime, &inode.Mtime, &inode.Ctime, &inode.Crtime, &inode.Rdev)
+	if err != nil {
+		return nil, syscall.ENOENT
+	}
+
+	inode.Mode = os.FileMode(mode)
+	inode.ID = fuseops.InodeID(id)
+
+	return &database.Entry{Inode: inode, Name: name, Parent: parent}, nil
+}
+
+// Get retrieves the stats of a particular inode
+func (d *Driver) Get(ctx context.Context, inode fuseops.InodeID) (*database.Inode, error) {
+	var mode uint32
+
+	s, err := d.stmts.Get(ctx, getQuery)
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	row := s.QueryRowContext(ctx, uint64(inode))
+
+	result := database.Inode{}
+	result.ID = inode
+
+	err = row.Scan(&mode, &result.Uid, &result.Gid, &result.Size, &result.Nlink, &result.Atime, &result.Mtime, &result.Ctime, &result.Crtime, &result.Rdev)
+	if err != nil {
+		return nil, syscall.ENOENT
+	}
+
+	result.Mode = os.FileMode(mode)
+	return &result, nil
+}
+
+// Statx retrieves the attributes of an inode along with its birth time and
+// the amount of blocks actually holding its data
+func (d *Driver) Statx(ctx context.Context, inode fuseops.InodeID) (*database.Statx, error) {
+	in, err := d.Get(ctx, inode)
+	if err != nil {
+		return nil, err
+	}
+
+	var chunks, size uint64
+	if err = d.DB.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(SUM(size), 0) FROM chunks WHERE inode = ? AND `key` <> ''", uint64(inode)).Scan(&chunks, &size); err != nil {
+		return nil, treatError(err)
+	}
+
+	return database.NewStatx(*in, chunks, size), nil
+}
+
+// Paths retrieves the full paths reaching the given inode, several of them
+// if it's hard linked, failing with ENOENT if there's none
+func (d *Driver) Paths(ctx context.Context, inode fuseops.InodeID) (*[]string, error) {
+	rows, err := d.DB.QueryContext(ctx, "WITH RECURSIVE up(parent, name, inode) AS (SELECT parent, name, inode FROM entries WHERE inode = ? UNION SELECT e.parent, e.name, e.inode FROM entries e, up u WHERE e.inode = u.parent) SELECT parent, name, inode FROM up", uint64(inode))
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	links := make([]database.Link, 0)
+	for rows.Next() {
+		var parent, id uint64
+		var name string
+
+		if err = rows.Scan(&parent, &name, &id); err != nil {
+			rows.Close()
+			return nil, treatError(err)
+		}
+
+		links = append(links, database.Link{Parent: fuseops.InodeID(parent), Name: name, Inode: fuseops.InodeID(id)})
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, treatError(err)
+	}
+
+	paths := database.JoinPaths(inode, links)
+	if len(paths) == 0 {
+		return nil, syscall.ENOENT
+	}
+
+	return &paths, nil
+}
+
+// ReadLink retrieves the target of a symbolic link
+func (d *Driver) ReadLink(ctx context.Context, inode fuseops.InodeID) (string, error) {
+	var mode uint32
+	var target string
+
+	row := d.DB.QueryRowContext(ctx, "SELECT mode, target FROM inodes WHERE id = ?", uint64(inode))
+	if err := row.Scan(&mode, &target); err != nil {
+		return "", syscall.ENOENT
+	}
+
+	if os.FileMode(mode)&os.ModeSymlink == 0 {
+		return "", syscall.EINVAL
+	}
+
+	return target, nil
+}
+
+// Touch changes the stats of a file
+func (d *Driver) Touch(ctx context.Context, inode fuseops.InodeID, size *uint64, mode *os.FileMode, atime *time.Time, mtime *time.Time, uid *uint32, gid *uint32) (*database.Inode, error) {
+	if d.ReadOnly {
+		return nil, syscall.EROFS
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	i, err := d.getInode(ctx, tx, inode)
+	if err != nil {
+		tx.Rollback()
+		return nil, treatError(err)
+	}
+
+	original := *i
+
+	if size != nil && *size != i.Size {
+		if err = d.checkMutable(ctx, tx, inode); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		if err = d.truncate(ctx, tx, i, *size); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if mode != nil {
+		i.Mode = *mode
+	}
+
+	if atime != nil {
+		i.Atime = *atime
+	}
+
+	if mtime != nil {
+		i.Mtime = *mtime
+	}
+
+	if uid != nil {
+		i.Uid = *uid
+	}
+
+	if gid != nil {
+		i.Gid = *gid
+	}
+
+	if original.Uid != i.Uid || original.Gid != i.Gid {
+		if err = d.updateQuota(ctx, tx, original.Uid, original.Gid, -int64(original.Size), -1, false); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		if err = d.updateQuota(ctx, tx, i.Uid, i.Gid, int64(i.Size), 1, false); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	} else if err = d.updateQuota(ctx, tx, i.Uid, i.Gid, int64(i.Size)-int64(original.Size), 0, false); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE inodes SET mode = ?, uid = ?, gid = ?, size = ?, atime = ?, mtime = ?, ctime = datetime('now') WHERE id = ?", uint32(i.Mode), i.Uid, i.Gid, i.Size, i.Atime.In(time.UTC), i.Mtime.In(time.UTC), uint64(i.ID)); err != nil {
+		tx.Rollback()
+		return nil, treatError(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, treatError(err)
+	}
+
+	database.Audit(ctx, d.AuditHook, database.AuditTouch, i.ID, i.Uid, i.Gid)
+	return i, nil
+}
+
+// Truncate changes the size of a file, filling it with zeros when growing it
+func (d *Driver) Truncate(ctx context.Context, inode fuseops.InodeID, size uint64) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return treatError(err)
+	}
+
+	i, err := d.getInode(ctx, tx, inode)
+	if err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	if i.Mode.IsDir() {
+		tx.Rollback()
+		return syscall.EISDIR
+	}
+
+	if size == i.Size {
+		tx.Rollback()
+		return nil
+	}
+
+	if err = d.checkMutable(ctx, tx, inode); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	original := i.Size
+	if err = d.truncate(ctx, tx, i, size); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = d.updateQuota(ctx, tx, i.Uid, i.Gid, int64(i.Size)-int64(original), 0, false); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE inodes SET size = ?, mtime = datetime('now'), ctime = datetime('now') WHERE id = ?", i.Size, uint64(i.ID)); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return treatError(err)
+	}
+
+	return nil
+}
+
+// truncate resizes a locked inode within the given transaction, filling
+// the new space with zeros when growing it, and trimming or orphaning the
+// chunks past the new size when shrinking it, every chunk being orphaned at
+// once when emptying it. The size of the inode is updated in memory, along
+// with the stats, but neither in the inodes table nor in the quotas of its
+// owners.
+func (d *Driver) truncate(ctx context.Context, tx *sql.Tx, i *database.Inode, size uint64) error {
+	if size > i.Size {
+		if err := d.insertChunks(ctx, tx, i.ID, database.ZeroFill(i.Size, size, d.BlockSize)); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, "UPDATE stats SET size = size + ?", size-i.Size); err != nil {
+			return treatError(err)
+		}
+
+		i.Size = size
+		return nil
+	}
+
+	if size == 0 {
+		if _, err := tx.ExecContext(ctx, "UPDATE chunks SET inode = NULL, objectoffset = NULL, inodeoffset = NULL, size = NULL, orphandate = datetime('now') WHERE inode = ?", uint64(i.ID)); err != nil {
+			return treatError(err)
+		}
+
+		if _, err := tx.ExecContext(ctx, "UPDATE stats SET size = size - MIN(size, ?)", i.Size); err != nil {
+			return treatError(err)
+		}
+
+		i.Size = 0
+		return nil
+	}
+
+	chunksToBeDeleted := make([]string, 0)
+	chunksToBeUpdated := make([]database.Chunk, 0)
+	var freed uint64
+
+	rows, err := tx.QueryContext(ctx, "SELECT id, storage, `key`, objectoffset, inodeoffset, size FROM chunks WHERE inode = ? AND inodeoffset + size > ?", uint64(i.ID), size)
+	if err != nil {
+		return treatError(err)
+	}
+
+	for rows.Next() {
+
+		chunk := database.Chunk{Inode: i.ID}
+
+		err = rows.Scan(
+			&chunk.ID,
+			&chunk.Storage,
+			&chunk.Key,
+			&chunk.ObjectOffset,
+			&chunk.InodeOffset,
+			&chunk.Size,
+		)
+
+		if err != nil {
+			rows.Close()
+			return treatError(err)
+		}
+
+		if chunk.InodeOffset < size {
+			freed += chunk.Size - (size - chunk.InodeOffset)
+			chunk.Size = size - chunk.InodeOffset
+			chunksToBeUpdated = append(chunksToBeUpdated, chunk)
+		} else {
+			freed += chunk.Size
+			chunksToBeDeleted = append(chunksToBeDeleted, strconv.FormatUint(chunk.ID, 10))
+		}
+
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return treatError(err)
+	}
+
+	if err = d.updateChunks(ctx, tx, chunksToBeUpdated); err != nil {
+		return err
+	}
+
+	if len(chunksToBeDeleted) > 0 {
+		if _, err = tx.ExecContext(ctx, "UPDATE chunks SET inode = NULL, objectoffset = NULL, inodeoffset = NULL, size = NULL, orphandate = datetime('now') WHERE id IN ("+strings.Join(chunksToBeDeleted, ", ")+")"); err != nil {
+			return treatError(err)
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE stats SET size = size - MIN(size, ?)", freed); err != nil {
+		return treatError(err)
+	}
+
+	i.Size = size
+	return nil
+}
+
+// SetImmutable sets or clears the immutable flag of an inode on behalf of
+// the given user, who must be either its owner or root. If a retention date
+// is given the flag clears by itself once it passes, and until then it can
+// neither be cleared nor have its retention shortened.
+func (d *Driver) SetImmutable(ctx context.Context, inode fuseops.InodeID, uid uint32, immutable bool, retainUntil *time.Time) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return treatError(err)
+	}
+
+	owner, flags, until, err := d.getFlags(ctx, tx, inode)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if uid != 0 && uid != owner {
+		tx.Rollback()
+		return syscall.EPERM
+	}
+
+	if until != nil && database.IsImmutable(flags, until, time.Now()) && (!immutable || retainUntil != nil && retainUntil.Before(*until)) {
+		tx.Rollback()
+		return syscall.EPERM
+	}
+
+	var retention interface{}
+	if immutable {
+		flags |= database.InodeImmutable
+		if retainUntil != nil {
+			retention = retainUntil.In(time.UTC)
+		}
+	} else {
+		flags &^= database.InodeImmutable
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE inodes SET flags = ?, retainuntil = ?, ctime = datetime('now') WHERE id = ?", flags, retention, uint64(inode)); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return treatError(err)
+	}
+
+	return nil
+}
+
+// ChownTree changes the owner and group of an inode and of every inode below
+// it in a single transaction, leaving them unchanged where nil. If fromUid is
+// given, only the inodes owned by that user are changed.
+func (d *Driver) ChownTree(ctx context.Context, inode fuseops.InodeID, uid *uint32, gid *uint32, fromUid *uint32) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return treatError(err)
+	}
+
+	if _, err = d.getInode(ctx, tx, inode); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	condition := "id IN (SELECT inode FROM tree)"
+	args := []interface{}{uint64(inode)}
+
+	if fromUid != nil {
+		condition += " AND uid = ?"
+		args = append(args, *fromUid)
+	}
+
+	rows, err := tx.QueryContext(ctx, subtreeQuery+"SELECT uid, gid, COUNT(*), COALESCE(SUM(size), 0) FROM inodes WHERE "+condition+" GROUP BY uid, gid", args...)
+	if err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	usage := make(map[inodeOwner]*database.Stats)
+	for rows.Next() {
+		var owner inodeOwner
+		stats := &database.Stats{}
+
+		if err = rows.Scan(&owner.uid, &owner.gid, &stats.Inodes, &stats.Size); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return treatError(err)
+		}
+
+		usage[owner] = stats
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	// The usage of the changed inodes moves from their previous owners to
+	// the new ones
+	for owner, stats := range usage {
+		if err = d.updateQuota(ctx, tx, owner.uid, owner.gid, -int64(stats.Size), -int64(stats.Inodes), false); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if uid != nil {
+			owner.uid = *uid
+		}
+
+		if gid != nil {
+			owner.gid = *gid
+		}
+
+		if err = d.updateQuota(ctx, tx, owner.uid, owner.gid, int64(stats.Size), int64(stats.Inodes), false); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	set := make([]string, 0, 3)
+	setArgs := []interface{}{uint64(inode)}
+
+	if uid != nil {
+		set = append(set, "uid = ?")
+		setArgs = append(setArgs, *uid)
+	}
+
+	if gid != nil {
+		set = append(set, "gid = ?")
+		setArgs = append(setArgs, *gid)
+	}
+
+	set = append(set, "ctime = datetime('now')")
+
+	if _, err = tx.ExecContext(ctx, subtreeQuery+"UPDATE inodes SET "+strings.Join(set, ", ")+" WHERE "+condition, append(setArgs, args[1:]...)...); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return treatError(err)
+	}
+
+	return nil
+}
+
+// ChmodTree changes the permissions of an inode and of every inode below it
+// in a single transaction, directories taking the ones of dirMode and regular
+// files the ones of fileMode. Only the bits within database.ModePermissions
+// change, the type of inodes and any other kind of inode being left alone.
+func (d *Driver) ChmodTree(ctx context.Context, inode fuseops.InodeID, dirMode os.FileMode, fileMode os.FileMode) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return treatError(err)
+	}
+
+	if _, err = d.getInode(ctx, tx, inode); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	kept := uint32(^database.ModePermissions)
+	for _, change := range []struct{ kind, mode os.FileMode }{{os.ModeDir, dirMode}, {0, fileMode}} {
+		if _, err = tx.ExecContext(ctx, subtreeQuery+"UPDATE inodes SET mode = (mode & ?) | ?, ctime = datetime('now') WHERE id IN (SELECT inode FROM tree) AND (mode & ?) = ?", uint64(inode), kept, uint32(change.mode&database.ModePermissions), uint32(os.ModeType), uint32(change.kind)); err != nil {
+			tx.Rollback()
+			return treatError(err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return treatError(err)
+	}
+
+	return nil
+}
+
+// AddChunk adds a chunk to the given inode
+func (d *Driver) AddChunk(ctx context.Context, inode fuseops.InodeID, flags uint32, chunk database.Chunk) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return treatError(err)
+	}
+
+	i, err := d.getInode(ctx, tx, inode)
+	if err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	if err = d.checkMutable(ctx, tx, inode); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if flags&syscall.O_APPEND != 0 {
+		chunk.InodeOffset = i.Size
+	}
+
+	if d.Dedup && chunk.Hash != "" {
+		if err = d.dedup(ctx, tx, &chunk); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err = d.writeChunk(ctx, tx, i, chunk); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE inodes SET size = ?, atime = datetime('now'), mtime = datetime('now'), ctime = datetime('now') WHERE id = ?", i.Size, uint64(i.ID)); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return treatError(err)
+	}
+
+	database.Audit(ctx, d.AuditHook, database.AuditAddChunk, inode, i.Uid, i.Gid)
+	return nil
+}
+
+// writeChunk adds a chunk to a locked inode within the given transaction,
+// trimming or orphaning the chunks it overlaps and filling any hole before
+// it with zeros. The size of the inode is updated in memory, along with the
+// stats and the quotas of its owners, but not in the inodes table.
+func (d *Driver) writeChunk(ctx context.Context, tx *sql.Tx, i *database.Inode, chunk database.Chunk) error {
+	chunksToBeDeleted := make([]string, 0)
+	chunksToBeUpdated := make([]database.Chunk, 0)
+	chunksToBeInserted := make([]database.Chunk, 1)
+
+	chunksToBeInserted[0] = chunk
+
+	if i.Size < chunk.InodeOffset {
+		if err := d.insertChunks(ctx, tx, i.ID, database.ZeroFill(i.Size, chunk.InodeOffset, d.BlockSize)); err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT id, storage, `key`, objectoffset, inodeoffset, size, COALESCE(etag, ''), COALESCE(version, '') FROM chunks WHERE inode = ? AND inodeoffset < ? AND inodeoffset + size > ?", uint64(i.ID), chunk.InodeOffset+chunk.Size, chunk.InodeOffset)
+	if err != nil {
+		return treatError(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		c := database.Chunk{Inode: i.ID}
+
+		err = rows.Scan(
+			&c.ID,
+			&c.Storage,
+			&c.Key,
+			&c.ObjectOffset,
+			&c.InodeOffset,
+			&c.Size,
+			&c.ETag,
+			&c.Version,
+		)
+
+		if err != nil {
+			return treatError(err)
+		}
+
+		if c.InodeOffset >= chunk.InodeOffset && c.InodeOffset+c.Size <= chunk.InodeOffset+chunk.Size {
+			chunksToBeDeleted = append(chunksToBeDeleted, strconv.FormatUint(c.ID, 10))
+		} else {
+			var newInodeOffset, newInodeEnd uint64
+
+			// The chunk lies within c, whose tail is kept as a new chunk pointing
+			// further into the same object, while c itself is trimmed down to
+			// its head below
+			if c.InodeOffset < chunk.InodeOffset && c.InodeOffset+c.Size > chunk.InodeOffset+chunk.Size {
+				chunkEnd := chunk.InodeOffset + chunk.Size
+
+				chunksToBeInserted = append(chunksToBeInserted, database.Chunk{
+					Inode:       c.Inode,
+					InodeOffset: chunkEnd,
+					Chunk: storage.Chunk{
+						Storage:      c.Storage,
+						Key:          c.Key,
+						ObjectOffset: c.ObjectOffset + chunkEnd - c.InodeOffset,
+						Size:         c.InodeOffset + c.Size - chunkEnd,
+						ETag:         c.ETag,
+						Version:      c.Version,
+					},
+				})
+			}
+
+			if c.InodeOffset < chunk.InodeOffset {
+				newInodeOffset = c.InodeOffset
+				newInodeEnd = chunk.InodeOffset
+			} else {
+				newInodeOffset = chunk.InodeOffset + chunk.Size
+				newInodeEnd = c.InodeOffset + c.Size
+			}
+
+			c.ObjectOffset += newInodeOffset - c.InodeOffset
+			c.InodeOffset = newInodeOffset
+			c.Size = newInodeEnd - c.InodeOffset
+
+			chunksToBeUpdated = append(chunksToBeUpdated, c)
+		}
+
+	}
+
+	if err = d.updateChunks(ctx, tx, chunksToBeUpdated); err != nil {
+		return err
+	}
+
+	if err = d.insertChunks(ctx, tx, i.ID, chunksToBeInserted); err != nil {
+		return err
+	}
+
+	newInodeSize := math.Max(i.Size, chunk.InodeOffset+chunk.Size)
+
+	if newInodeSize != i.Size {
+		if err = d.updateQuota(ctx, tx, i.Uid, i.Gid, int64(newInodeSize-i.Size), 0, true); err != nil {
+			return err
+		}
+
+		if _, err = tx.ExecContext(ctx, "UPDATE stats SET size = size + ?", newInodeSize-i.Size); err != nil {
+			return treatError(err)
+		}
+
+		i.Size = newInodeSize
+	}
+
+	if len(chunksToBeDeleted) > 0 {
+		if _, err = tx.ExecContext(ctx, "UPDATE chunks SET inode = NULL, objectoffset = NULL, inodeoffset = NULL, size = NULL, orphandate = datetime('now') WHERE id IN ("+strings.Join(chunksToBeDeleted, ", ")+")"); err != nil {
+			return treatError(err)
+		}
+	}
+
+	return nil
+}
+
+// CopyRange copies up to length bytes of srcInode starting at srcOffset to
+// dstInode at dstOffset without transferring any data, the new chunks
+// referencing the same storage objects as the source ones. The copy stops at
+// the end of the source, the amount of copied bytes being returned.
+func (d *Driver) CopyRange(ctx context.Context, srcInode fuseops.InodeID, srcOffset uint64, dstInode fuseops.InodeID, dstOffset uint64, length uint64) (uint64, error) {
+	if d.ReadOnly {
+		return 0, syscall.EROFS
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return 0, treatError(err)
+	}
+
+	// Inodes are always locked in the same order to avoid deadlocks
+	first, second := srcInode, dstInode
+	if first > second {
+		first, second = second, first
+	}
+
+	locked := make(map[fuseops.InodeID]*database.Inode)
+	for _, id := range []fuseops.InodeID{first, second} {
+		if _, ok := locked[id]; ok {
+			continue
+		}
+
+		if locked[id], err = d.getInode(ctx, tx, id); err != nil {
+			tx.Rollback()
+			return 0, treatError(err)
+		}
+	}
+
+	src, dst := locked[srcInode], locked[dstInode]
+	if src.Mode.IsDir() || dst.Mode.IsDir() {
+		tx.Rollback()
+		return 0, syscall.EISDIR
+	}
+
+	if err = d.checkMutable(ctx, tx, dstInode); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if srcOffset >= src.Size || length == 0 {
+		tx.Rollback()
+		return 0, nil
+	}
+
+	if length > src.Size-srcOffset {
+		length = src.Size - srcOffset
+	}
+
+	rows, err := tx.QueryContext(ctx, chunksQuery, uint64(srcInode), srcOffset+length, srcOffset)
+	if err != nil {
+		tx.Rollback()
+		return 0, treatError(err)
+	}
+
+	chunks := make([]database.Chunk, 0)
+	position := srcOffset
+
+	// Every overlapping chunk is trimmed to the copied range and moved to the
+	// destination, holes of the source being copied as zero chunks
+	for rows.Next() {
+		c := database.Chunk{}
+
+		if err = rows.Scan(&c.ID, &c.Storage, &c.Key, &c.ObjectOffset, &c.InodeOffset, &c.Size, &c.ETag, &c.Version, &c.Checksum); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return 0, treatError(err)
+		}
+
+		start := math.Max(c.InodeOffset, srcOffset)
+		end := math.Min(c.InodeOffset+c.Size, srcOffset+length)
+
+		if start > position {
+			chunks = append(chunks, zeroChunk(dstOffset+position-srcOffset, start-position))
+		}
+
+		piece := database.Chunk{
+			InodeOffset: dstOffset + start - srcOffset,
+			Chunk: storage.Chunk{
+				Storage:      c.Storage,
+				Key:          c.Key,
+				ObjectOffset: c.ObjectOffset + start - c.InodeOffset,
+				Size:         end - start,
+				ETag:         c.ETag,
+				Version:      c.Version,
+			},
+		}
+
+		// Chunks copied whole keep their checksum, covering the same data
+		if start == c.InodeOffset && end == c.InodeOffset+c.Size {
+			piece.Checksum = c.Checksum
+		}
+
+		chunks = append(chunks, piece)
+		position = end
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		tx.Rollback()
+		return 0, treatError(err)
+	}
+
+	if position < srcOffset+length {
+		chunks = append(chunks, zeroChunk(dstOffset+position-srcOffset, srcOffset+length-position))
+	}
+
+	for _, chunk := range chunks {
+		chunk.Inode = dstInode
+		if err = d.writeChunk(ctx, tx, dst, chunk); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE inodes SET size = ?, mtime = datetime('now'), ctime = datetime('now') WHERE id = ?", dst.Size, uint64(dst.ID)); err != nil {
+		tx.Rollback()
+		return 0, treatError(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, treatError(err)
+	}
+
+	return length, nil
+}
+
+// Fallocate reserves the given range of an inode. Space is never actually
+// allocated, so the file is just grown with zeros unless FallocKeepSize is
+// set, holes being already stored as zero chunks. With FallocZeroRange or
+// FallocPunchHole, the data within the range is replaced with zeros as well.
+func (d *Driver) Fallocate(ctx context.Context, inode fuseops.InodeID, offset uint64, length uint64, mode uint32) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if length == 0 {
+		return syscall.EINVAL
+	}
+
+	if mode&^(database.FallocKeepSize|database.FallocPunchHole|database.FallocZeroRange) != 0 {
+		return syscall.EOPNOTSUPP
+	}
+
+	if mode&database.FallocPunchHole != 0 && (mode&database.FallocKeepSize == 0 || mode&database.FallocZeroRange != 0) {
+		return syscall.EOPNOTSUPP
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return treatError(err)
+	}
+
+	i, err := d.getInode(ctx, tx, inode)
+	if err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	if i.Mode.IsDir() {
+		tx.Rollback()
+		return syscall.EISDIR
+	}
+
+	if err = d.checkMutable(ctx, tx, inode); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	start, end := offset, offset+length
+	if mode&(database.FallocZeroRange|database.FallocPunchHole) == 0 {
+		start = i.Size
+	}
+
+	if mode&database.FallocKeepSize != 0 {
+		end = math.Min(end, i.Size)
+	}
+
+	if start >= end {
+		tx.Rollback()
+		return nil
+	}
+
+	if err = d.writeChunk(ctx, tx, i, zeroChunk(start, end-start)); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE inodes SET size = ?, mtime = datetime('now'), ctime = datetime('now') WHERE id = ?", i.Size, uint64(i.ID)); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return treatError(err)
+	}
+
+	return nil
+}
+
+// ChunksByStorage lists up to limit live chunks stored at the given storage,
+// sorted by id and starting after the chunk with the provided id, zero
+// meaning from the beginning
+func (d *Driver) ChunksByStorage(ctx context.Context, storageName string, afterID uint64, limit int) (*[]database.Chunk, error) {
+	if limit <= 0 {
+		return nil, syscall.EINVAL
+	}
+
+	rows, err := d.DB.QueryContext(ctx, "SELECT id, inode, `key`, objectoffset, inodeoffset, size FROM chunks WHERE storage = ? AND id > ? AND inode IS NOT NULL ORDER BY id LIMIT ?", storageName, afterID, limit)
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	defer rows.Close()
+	chunks := make([]database.Chunk, 0, limit)
+
+	for rows.Next() {
+		var inode uint64
+		chunk := database.Chunk{}
+		chunk.Storage = storageName
+
+		err = rows.Scan(
+			&chunk.ID,
+			&inode,
+			&chunk.Key,
+			&chunk.ObjectOffset,
+			&chunk.InodeOffset,
+			&chunk.Size,
+		)
+
+		if err != nil {
+			return nil, treatError(err)
+		}
+
+		chunk.Inode = fuseops.InodeID(inode)
+		chunks = append(chunks, chunk)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, treatError(err)
+	}
+
+	return &chunks, nil
+}
+
+// MigrateChunk points a live chunk to a copy of its object at another
+// storage, which must hold the same data at the same offsets. The previous
+// object is orphaned, so that it's removed once no chunk references it.
+func (d *Driver) MigrateChunk(ctx context.Context, id uint64, newStorage string, newKey string) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return treatError(err)
+	}
+
+	var oldStorage, oldKey string
+
+	err = tx.QueryRowContext(ctx, "SELECT storage, `key` FROM chunks WHERE id = ? AND inode IS NOT NULL", id).Scan(&oldStorage, &oldKey)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return syscall.ENOENT
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	if oldStorage == newStorage && oldKey == newKey {
+		tx.Rollback()
+		return nil
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE chunks SET storage = ?, `key` = ?, etag = NULL, version = NULL WHERE id = ?", newStorage, newKey, id); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	if _, err = tx.ExecContext(ctx, "INSERT INTO chunks(storage, `key`, orphandate) VALUES (?, ?, datetime('now'))", oldStorage, oldKey); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return treatError(err)
+	}
+
+	return nil
+}
+
+// CompactChunks merges the chunks of an inode which are contiguous both
+// within the inode and within the same object, leaving the data it holds
+// and the stored objects untouched
+func (d *Driver) CompactChunks(ctx context.Context, inode fuseops.InodeID) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return treatError(err)
+	}
+
+	if _, err = d.getInode(ctx, tx, inode); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT id, storage, `key`, objectoffset, inodeoffset, size FROM chunks WHERE inode = ? ORDER BY inodeoffset", uint64(inode))
+	if err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	chunks := make([]database.Chunk, 0)
+	for rows.Next() {
+		chunk := database.Chunk{Inode: inode}
+		if err = rows.Scan(&chunk.ID, &chunk.Storage, &chunk.Key, &chunk.ObjectOffset, &chunk.InodeOffset, &chunk.Size); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return treatError(err)
+		}
+
+		chunks = append(chunks, chunk)
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	grown, removed := database.MergeChunks(chunks)
+	for _, chunk := range grown {
+		if _, err = tx.ExecContext(ctx, "UPDATE chunks SET size = ?, hash = NULL, checksum = NULL WHERE id = ?", chunk.Size, chunk.ID); err != nil {
+			tx.Rollback()
+			return treatError(err)
+		}
+	}
+
+	for len(removed) > 0 {
+		n := len(removed)
+		if n > maxPlaceholders {
+			n = maxPlaceholders
+		}
+
+		args := make([]interface{}, 0, n)
+		for _, id := range removed[:n] {
+			args = append(args, id)
+		}
+
+		if _, err = tx.ExecContext(ctx, "DELETE FROM chunks WHERE id IN ("+inList(n)+")", args...); err != nil {
+			tx.Rollback()
+			return treatError(err)
+		}
+
+		removed = removed[n:]
+	}
+
+	if err = tx.Commit(); err != nil {
+		return treatError(err)
+	}
+
+	return nil
+}
+
+// Defragment rewrites the runs of small chunks of an inode into new objects
+// of up to targetObjectSize bytes, orphaning the old ones
+func (d *Driver) Defragment(ctx context.Context, st storage.Storage, inode fuseops.InodeID, targetObjectSize uint64) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return treatError(err)
+	}
+
+	if _, err = d.getInode(ctx, tx, inode); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return treatError(err)
+	}
+
+	rows, err := d.DB.QueryContext(ctx, "SELECT id, inode, storage, `key`, objectoffset, inodeoffset, size FROM chunks WHERE inode = ?", uint64(inode))
+	if err != nil {
+		return treatError(err)
+	}
+
+	return database.Defragment(ctx, rows, st, targetObjectSize, d.replaceChunks)
+}
+
+// RetierInode copies the chunks of an inode held by other storages into new
+// objects at the target one, orphaning the old ones
+func (d *Driver) RetierInode(ctx context.Context, st storage.Storage, inode fuseops.InodeID, target string) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return treatError(err)
+	}
+
+	if _, err = d.getInode(ctx, tx, inode); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return treatError(err)
+	}
+
+	rows, err := d.DB.QueryContext(ctx, "SELECT id, inode, storage, `key`, objectoffset, inodeoffset, size, COALESCE(hash, ''), COALESCE(checksum, '') FROM chunks WHERE inode = ?", uint64(inode))
+	if err != nil {
+		return treatError(err)
+	}
+
+	return database.Retier(ctx, rows, st, target, d.replaceChunks)
+}
+
+// Chunks grabs the chunks for the given inode
+func (d *Driver) Chunks(ctx context.Context, inode fuseops.InodeID) (*[]database.Chunk, error) {
+	return d.ChunksInRange(ctx, inode, 0, gomath.MaxInt64)
+}
+
+// ChunksInRange grabs the chunks of the given inode which overlap the
+// provided byte range
+func (d *Driver) ChunksInRange(ctx context.Context, inode fuseops.InodeID, offset uint64, length uint64) (*[]database.Chunk, error) {
+	end := offset + length
+	if end < offset || end > gomath.MaxInt64 {
+		end = gomath.MaxInt64
+	}
+
+	if err := d.touchAtime(ctx, inode); err != nil {
+		return nil, err
+	}
+
+	s, err := d.stmts.Get(ctx, chunksQuery)
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	rows, err := s.QueryContext(ctx, uint64(inode), end, offset)
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	defer rows.Close()
+
+	chunks := make([]database.Chunk, 0)
+
+	for rows.Next() {
+		chunk := database.Chunk{Inode: inode}
+
+		err := rows.Scan(
+			&chunk.ID,
+			&chunk.Storage,
+			&chunk.Key,
+			&chunk.ObjectOffset,
+			&chunk.InodeOffset,
+			&chunk.Size,
+			&chunk.ETag,
+			&chunk.Version,
+			&chunk.Checksum,
+		)
+
+		if err != nil {
+			return nil, treatError(err)
+		}
+
+		chunks = append(chunks, chunk)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, treatError(err)
+	}
+
+	return &chunks, nil
+}
+
+// Children gets the list of children for the given inode
+func (d *Driver) Children(ctx context.Context, inode fuseops.InodeID) (*[]database.Child, error) {
+	if err := d.touchAtime(ctx, inode); err != nil {
+		return nil, err
+	}
+
+	s, err := d.stmts.Get(ctx, childrenQuery)
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	rows, err := s.QueryContext(ctx, uint64(inode))
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	defer rows.Close()
+
+	children := make([]database.Child, 0)
+
+	for rows.Next() {
+		var inode uint64
+		var mode uint32
+		var name string
+
+		err := rows.Scan(
+			&inode,
+			&name,
+			&mode,
+		)
+
+		if err != nil {
+			return nil, treatError(err)
+		}
+
+		child := database.Child{
+			Inode: fuseops.InodeID(inode),
+			Name:  name,
+			Mode:  os.FileMode(mode),
+		}
+
+		children = append(children, child)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, treatError(err)
+	}
+
+	return &children, nil
+}
+
+// ChildCount counts the children of the given inode without listing them,
+// leaving its access time untouched
+func (d *Driver) ChildCount(ctx context.Context, inode fuseops.InodeID) (uint64, error) {
+	return d.countChildren(ctx, d.DB, inode)
+}
+
+// ChildrenPage gets up to limit children of the given inode whose name sorts
+// after afterName, in name order, so that big directories can be listed in
+// pages. The access time is only updated when fetching the first page.
+func (d *Driver) ChildrenPage(ctx context.Context, inode fuseops.InodeID, afterName string, limit int) (*[]database.Child, error) {
+	if limit <= 0 {
+		return nil, syscall.EINVAL
+	}
+
+	if afterName == "" {
+		if err := d.touchAtime(ctx, inode); err != nil {
+			return nil, err
+		}
+	}
+
+	s, err := d.stmts.Get(ctx, childrenPageQuery)
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	rows, err := s.QueryContext(ctx, uint64(inode), []byte(afterName), limit)
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	defer rows.Close()
+	children := make([]database.Child, 0, limit)
+
+	for rows.Next() {
+		var inode uint64
+		var mode uint32
+		var name string
+
+		if err = rows.Scan(&inode, &name, &mode); err != nil {
+			return nil, treatError(err)
+		}
+
+		children = append(children, database.Child{
+			Inode: fuseops.InodeID(inode),
+			Name:  name,
+			Mode:  os.FileMode(mode),
+		})
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, treatError(err)
+	}
+
+	return &children, nil
+}
+
+// ChildrenPlus gets the children of the given inode along with their
+// attributes, using a single query
+func (d *Driver) ChildrenPlus(ctx context.Context, inode fuseops.InodeID) (*[]database.Entry, error) {
+	if err := d.touchAtime(ctx, inode); err != nil {
+		return nil, err
+	}
+
+	s, err := d.stmts.Get(ctx, childrenPlusQuery)
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	rows, err := s.QueryContext(ctx, uint64(inode))
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	defer rows.Close()
+	entries := make([]database.Entry, 0)
+
+	for rows.Next() {
+		var id uint64
+		var mode uint32
+		entry := database.Entry{Parent: inode}
+
+		err = rows.Scan(&entry.Name, &id, &mode, &entry.Uid, &entry.Gid, &entry.Size, &entry.Nlink, &entry.Atime, &entry.Mtime, &entry.Ctime, &entry.Crtime, &entry.Rdev)
+		if err != nil {
+			return nil, treatError(err)
+		}
+
+		entry.ID = fuseops.InodeID(id)
+		entry.Mode = os.FileMode(mode)
+		entries = append(entries, entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, treatError(err)
+	}
+
+	return &entries, nil
+}
+
+// ListXattr retrieves the list of extended attributes for the given inode
+func (d *Driver) ListXattr(ctx context.Context, inode fuseops.InodeID) (*[]string, error) {
+	keys := make([]string, 0)
+
+	rows, err := d.DB.QueryContext(ctx, "SELECT `key` FROM xattr WHERE inode = ?", uint64(inode))
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+
+		if err = rows.Scan(&key); err != nil {
+			return nil, treatError(err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, treatError(err)
+	}
+
+	return &keys, nil
+}
+
+// RemoveXattr removes the given extended attribute from the given inode
+func (d *Driver) RemoveXattr(ctx context.Context, inode fuseops.InodeID, attr string) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return treatError(err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM xattr WHERE inode = ? AND `key` = ?", uint64(inode), []byte(attr)); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE inodes SET ctime = datetime('now'), atime = datetime('now') WHERE id = ?", uint64(inode)); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	return tx.Commit()
+}
+
+// GetXattr gets a certain external attribute from the given inode
+func (d *Driver) GetXattr(ctx context.Context, inode fuseops.InodeID, attr string) (*[]byte, error) {
+	row := d.DB.QueryRowContext(ctx, "SELECT value FROM xattr WHERE inode = ? AND `key` = ?", uint64(inode), []byte(attr))
+
+	var data []byte
+	if err := row.Scan(&data); err != nil {
+		return nil, syscall.ENODATA
+	}
+
+	return &data, nil
+}
+
+// GetXattrSize retrieves the size of the value of an extended attribute
+func (d *Driver) GetXattrSize(ctx context.Context, inode fuseops.InodeID, attr string) (uint64, error) {
+	row := d.DB.QueryRowContext(ctx, "SELECT length(value) FROM xattr WHERE inode = ? AND `key` = ?", uint64(inode), []byte(attr))
+
+	var size uint64
+	if err := row.Scan(&size); err != nil {
+		return 0, syscall.ENODATA
+	}
+
+	return size, nil
+}
+
+// SetXattr sets an extended attribute at the given node
+func (d *Driver) SetXattr(ctx context.Context, inode fuseops.InodeID, attr string, value []byte, flags uint32) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if flags&^(database.XattrCreate|database.XattrReplace) != 0 || flags == database.XattrCreate|database.XattrReplace {
+		return syscall.EINVAL
+	}
+
+	if len(attr) > database.MaxXattrNameSize {
+		return syscall.ERANGE
+	}
+
+	if len(value) > database.MaxXattrValueSize {
+		return syscall.E2BIG
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return treatError(err)
+	}
+
+	switch flags {
+	case database.XattrCreate:
+
+		if _, err = tx.ExecContext(ctx, "INSERT INTO xattr(inode, `key`, value) VALUES (?, ?, ?)", uint64(inode), []byte(attr), value); err != nil {
+			tx.Rollback()
+			return treatError(err)
+		}
+
+	case database.XattrReplace:
+
+		var result sql.Result
+		var rowsAffected int64
+
+		if result, err = tx.ExecContext(ctx, "UPDATE xattr SET value = ? WHERE inode = ? AND `key` = ?", value, uint64(inode), []byte(attr)); err != nil {
+			tx.Rollback()
+			return treatError(err)
+		}
+
+		if rowsAffected, err = result.RowsAffected(); err != nil {
+			tx.Rollback()
+			return treatError(err)
+		}
+
+		if rowsAffected == 0 {
+			tx.Rollback()
+			return syscall.ENODATA
+		}
+
+	default:
+
+		if _, err = tx.ExecContext(ctx, "INSERT INTO xattr(inode, `key`, value) VALUES (?, ?, ?) ON CONFLICT (inode, `key`) DO UPDATE SET value = excluded.value", uint64(inode), []byte(attr), value); err != nil {
+			tx.Rollback()
+			return treatError(err)
+		}
+
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE inodes SET ctime = datetime('now'), atime = datetime('now') WHERE id = ?", uint64(inode)); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	var uid, gid uint32
+	if d.AuditHook != nil {
+		if uid, gid, err = d.getOwner(ctx, tx, inode); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return treatError(err)
+	}
+
+	database.Audit(ctx, d.AuditHook, database.AuditSetXattr, inode, uid, gid)
+	return nil
+}
+
+// SwapXattr sets an extended attribute to the given value only if it holds
+// the expected one, or if it doesn't exist when expected is nil, telling
+// whether it was set
+func (d *Driver) SwapXattr(ctx context.Context, inode fuseops.InodeID, attr string, expected []byte, value []byte) (bool, error) {
+	if d.ReadOnly {
+		return false, syscall.EROFS
+	}
+
+	if len(attr) > database.MaxXattrNameSize {
+		return false, syscall.ERANGE
+	}
+
+	if len(value) > database.MaxXattrValueSize {
+		return false, syscall.E2BIG
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return false, treatError(err)
+	}
+
+	var result sql.Result
+	var rowsAffected int64
+
+	if expected == nil {
+		result, err = tx.ExecContext(ctx, "INSERT INTO xattr(inode, `key`, value) VALUES (?, ?, ?) ON CONFLICT (inode, `key`) DO NOTHING", uint64(inode), []byte(attr), value)
+	} else {
+		result, err = tx.ExecContext(ctx, "UPDATE xattr SET value = ? WHERE inode = ? AND `key` = ? AND value = ?", value, uint64(inode), []byte(attr), expected)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return false, treatError(err)
+	}
+
+	if rowsAffected, err = result.RowsAffected(); err != nil {
+		tx.Rollback()
+		return false, treatError(err)
+	}
+
+	if rowsAffected == 0 {
+		tx.Rollback()
+		return false, nil
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE inodes SET ctime = datetime('now'), atime = datetime('now') WHERE id = ?", uint64(inode)); err != nil {
+		tx.Rollback()
+		return false, treatError(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, treatError(err)
+	}
+
+	return true, nil
+}
+
+// GetAllXattr retrieves all the extended attributes of the given inode along
+// with their values
+func (d *Driver) GetAllXattr(ctx context.Context, inode fuseops.InodeID) (map[string][]byte, error) {
+	rows, err := d.DB.QueryContext(ctx, "SELECT `key`, value FROM xattr WHERE inode = ?", uint64(inode))
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	defer rows.Close()
+
+	attrs := make(map[string][]byte)
+	for rows.Next() {
+		var key string
+		var value []byte
+
+		if err = rows.Scan(&key, &value); err != nil {
+			return nil, treatError(err)
+		}
+
+		attrs[key] = value
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, treatError(err)
+	}
+
+	return attrs, nil
+}
+
+// SetAllXattr replaces the whole set of extended attributes of the given
+// inode, removing the ones not present in the given map
+func (d *Driver) SetAllXattr(ctx context.Context, inode fuseops.InodeID, attrs map[string][]byte) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	for attr, value := range attrs {
+		if len(attr) > database.MaxXattrNameSize {
+			return syscall.ERANGE
+		}
+
+		if len(value) > database.MaxXattrValueSize {
+			return syscall.E2BIG
+		}
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return treatError(err)
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM xattr WHERE inode = ?", uint64(inode)); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	for attr, value := range attrs {
+		if _, err = tx.ExecContext(ctx, "INSERT INTO xattr(inode, `key`, value) VALUES (?, ?, ?)", uint64(inode), []byte(attr), value); err != nil {
+			tx.Rollback()
+			return treatError(err)
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE inodes SET ctime = datetime('now'), atime = datetime('now') WHERE id = ?", uint64(inode)); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	return tx.Commit()
+}
+
+// GetLock returns a lock held by another owner which would prevent the given
+// one from being taken, or nil if there's none
+func (d *Driver) GetLock(ctx context.Context, inode fuseops.InodeID, owner uint64, start uint64, length uint64, lockType database.LockType) (*database.Lock, error) {
+	lock := database.Lock{Inode: inode, Owner: owner, Start: start, Length: length, Type: lockType}
+	if !lock.Valid() {
+		return nil, syscall.EINVAL
+	}
+
+	rows, err := d.DB.QueryContext(ctx, "SELECT owner, startoffset, endoffset, kind FROM locks WHERE inode = ? AND owner <> ? AND startoffset < ? AND endoffset > ?", uint64(inode), int64(owner), lock.End(), lock.Start)
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	held, err := database.ScanLocks(rows, inode)
+	if err != nil {
+		return nil, treatError(err)
+	}
+
+	return database.Conflicting(held, lock), nil
+}
+
+// SetLock takes or releases an advisory lock over a byte range of an inode
+// on behalf of the given owner, replacing the ones it held over that range.
+// It fails with EAGAIN if a lock of another owner conflicts with it.
+func (d *Driver) SetLock(ctx context.Context, inode fuseops.InodeID, owner uint64, start uint64, length uint64, lockType database.LockType) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	lock := database.Lock{Inode: inode, Owner: owner, Start: start, Length: length, Type: lockType}
+	if !lock.Valid() {
+		return syscall.EINVAL
+	}
+
+	tx, err := d.begin(ctx)
+	if err != nil {
+		return treatError(err)
+	}
+
+	if _, err = d.getInode(ctx, tx, inode); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT owner, startoffset, endoffset, kind FROM locks WHERE inode = ? AND startoffset < ? AND endoffset > ?", uint64(inode), lock.End(), lock.Start)
+	if err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	held, err := database.ScanLocks(rows, inode)
+	if err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	if database.Conflicting(held, lock) != nil {
+		tx.Rollback()
+		return syscall.EAGAIN
+	}
+
+	owned := make([]database.Lock, 0)
+	for _, l := range held {
+		if l.Owner == owner {
+			owned = append(owned, l)
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM locks WHERE inode = ? AND owner = ? AND startoffset < ? AND endoffset > ?", uint64(inode), int64(owner), lock.End(), lock.Start); err != nil {
+		tx.Rollback()
+		return treatError(err)
+	}
+
+	locks := database.Release(owned, lock)
+	if lockType != database.LockUnlock {
+		locks = append(locks, lock)
+	}
+
+	for _, l := range locks {
+		if _, err = tx.ExecContext(ctx, "INSERT INTO locks(inode, owner, startoffset, endoffset, kind) VALUES (?, ?, ?, ?, ?)", uint64(inode), int64(owner), l.Start, l.End(), l.Type); err != nil {
+			tx.Rollback()
+			return treatError(err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return treatError(err)
+	}
+
+	return nil
+}
+
+// ClearLocks releases every lock held by the given owner
+func (d *Driver) ClearLocks(ctx context.Context, owner uint64) error {
+	if d.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if _, err := d.DB.ExecContext(ctx, "DELETE FROM locks WHERE owner = ?", int64(owner)); err != nil {
+		return treatError(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,225 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database/dbtest"
+	"github.com/manvalls/titan/database/stmt"
+	"github.com/stretchr/testify/assert"
+)
+
+// openTestDriver opens an empty database in a temporary folder
+func openTestDriver(t testing.TB) (*Driver, func()) {
+	dir, err := ioutil.TempDir("", "titan")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Driver{DbURI: filepath.Join(dir, "titan.db"), BusyRetries: 10, ForeignKeys: true}
+	if err := d.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	return d, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func getTestDriver(t testing.TB) (*Driver, func()) {
+	d, cleanup := openTestDriver(t)
+	if err := d.Setup(context.Background()); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	return d, cleanup
+}
+
+func TestDriver(t *testing.T) {
+	d, cleanup := getTestDriver(t)
+	defer cleanup()
+
+	dbtest.Run(t, d)
+}
+
+func TestFsStats(t *testing.T) {
+	d, cleanup := getTestDriver(t)
+	defer cleanup()
+
+	d.Capacity = 1 << 30
+	dbtest.FsStats(t, d)
+}
+
+func TestBlockSize(t *testing.T) {
+	d, cleanup := getTestDriver(t)
+	defer cleanup()
+
+	d.BlockSize = 1 << 16
+	dbtest.BlockSize(t, d, 1<<16)
+}
+
+func TestStatsUnderflow(t *testing.T) {
+	d, cleanup := getTestDriver(t)
+	defer cleanup()
+
+	dbtest.StatsUnderflow(t, d, d.DB)
+}
+
+func TestFsck(t *testing.T) {
+	d, cleanup := getTestDriver(t)
+	defer cleanup()
+
+	dbtest.Fsck(t, d, d.DB)
+}
+
+func TestForgetRace(t *testing.T) {
+	d, cleanup := getTestDriver(t)
+	defer cleanup()
+
+	dbtest.ForgetRace(t, d, d.DB)
+}
+
+func TestLeakedAnonymous(t *testing.T) {
+	d, cleanup := getTestDriver(t)
+	defer cleanup()
+
+	dbtest.LeakedAnonymous(t, d, d.DB)
+}
+
+func TestAtime(t *testing.T) {
+	d, cleanup := getTestDriver(t)
+	defer cleanup()
+
+	dbtest.Atime(t, d, d.DB, &d.Atime)
+}
+
+func TestDedup(t *testing.T) {
+	d, cleanup := getTestDriver(t)
+	defer cleanup()
+
+	d.Dedup = true
+	dbtest.Dedup(t, d)
+}
+
+func TestAudit(t *testing.T) {
+	d, cleanup := getTestDriver(t)
+	defer cleanup()
+
+	dbtest.Audit(t, d, &d.AuditHook)
+}
+
+func TestRowsErrors(t *testing.T) {
+	db := dbtest.FailingDB()
+	defer db.Close()
+
+	d := &Driver{DB: db, stmts: stmt.NewCache(db)}
+	dbtest.RowsErrors(t, d)
+}
+
+func BenchmarkChildren(b *testing.B) {
+	d, cleanup := getTestDriver(b)
+	defer cleanup()
+
+	benchmarkChildren(b, d)
+}
+
+func benchmarkChildren(b *testing.B, d *Driver) {
+	ctx := context.Background()
+	dir := dbtest.Mkdir(b, d, fuseops.RootInodeID)
+
+	for i := 0; i < 10000; i++ {
+		dbtest.Mkfile(b, d, dir)
+	}
+
+	list := func(b *testing.B, rows *sql.Rows, err error) {
+		var inode uint64
+		var mode uint32
+		var name string
+
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		defer rows.Close()
+
+		for rows.Next() {
+			if err = rows.Scan(&inode, &name, &mode); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("Prepared", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s, err := d.stmts.Get(ctx, childrenQuery)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			rows, err := s.QueryContext(ctx, uint64(dir))
+			list(b, rows, err)
+		}
+	})
+
+	b.Run("Unprepared", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			rows, err := d.DB.QueryContext(ctx, childrenQuery, uint64(dir))
+			list(b, rows, err)
+		}
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	d, cleanup := openTestDriver(t)
+	defer cleanup()
+
+	if err := d.setup(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	dbtest.Migrate(t, d, d.DB, schemaVersion)
+}
+
+func TestMigrateUnversioned(t *testing.T) {
+	ctx := context.Background()
+	d, cleanup := openTestDriver(t)
+	defer cleanup()
+
+	if err := d.setup(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.DB.Exec("DROP TABLE schema_version"); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, d.Migrate(ctx))
+
+	var version int
+	assert.Nil(t, d.DB.QueryRow("SELECT version FROM schema_version").Scan(&version))
+	assert.Equal(t, schemaVersion, version)
+}
+
+func TestReadOnly(t *testing.T) {
+	d, cleanup := getTestDriver(t)
+	defer cleanup()
+
+	dbtest.ReadOnly(t, d, &d.ReadOnly)
+}
+
+func TestDump(t *testing.T) {
+	src, cleanupSrc := getTestDriver(t)
+	defer cleanupSrc()
+
+	dst, cleanupDst := getTestDriver(t)
+	defer cleanupDst()
+
+	dbtest.Dump(t, src, dst)
+}
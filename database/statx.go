@@ -0,0 +1,52 @@
+package database
+
+// Masks of the fields filled by Statx, matching the ones of statx
+const (
+	// StatxBasicStats covers the fields stat reports
+	StatxBasicStats = 0x7ff
+
+	// StatxBtime covers the birth time, held as the Crtime of inodes
+	StatxBtime = 0x800
+)
+
+// Bounds of the preferred size of IO operations reported by Statx
+const (
+	MinBlockSize = 4096
+	MaxBlockSize = 1 << 20
+)
+
+// Statx holds the attributes of an inode as reported by statx
+type Statx struct {
+	Inode
+
+	// Mask tells which of the fields are filled
+	Mask uint32
+
+	// Blocks is the amount of 512 bytes blocks holding data, so that holes
+	// and zeroed ranges of sparse files don't count
+	Blocks uint64
+
+	// BlockSize is the preferred size of IO operations, based on the size of
+	// the chunks of the inode
+	BlockSize uint32
+}
+
+// NewStatx computes the statx attributes of an inode holding the given
+// amount of chunks with data, which add up to the given size. The block size
+// is the mean size of those chunks rounded up to a power of two, within
+// MinBlockSize and MaxBlockSize.
+func NewStatx(inode Inode, chunks uint64, size uint64) *Statx {
+	blockSize := uint64(MinBlockSize)
+	if chunks > 0 {
+		for blockSize < MaxBlockSize && blockSize < size/chunks {
+			blockSize <<= 1
+		}
+	}
+
+	return &Statx{
+		Inode:     inode,
+		Mask:      StatxBasicStats | StatxBtime,
+		Blocks:    (size + 511) / 512,
+		BlockSize: uint32(blockSize),
+	}
+}
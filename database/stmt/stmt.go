@@ -0,0 +1,59 @@
+package stmt
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// Cache lazily prepares statements and keeps them around for reuse
+type Cache struct {
+	db    *sql.DB
+	mutex sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+// NewCache builds a statement cache for the given database
+func NewCache(db *sql.DB) *Cache {
+	return &Cache{
+		db:    db,
+		stmts: make(map[string]*sql.Stmt),
+	}
+}
+
+// Get retrieves the prepared statement for the given query, preparing it
+// the first time it's requested
+func (c *Cache) Get(ctx context.Context, query string) (*sql.Stmt, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if s, ok := c.stmts[query]; ok {
+		return s, nil
+	}
+
+	s, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	c.stmts[query] = s
+	return s, nil
+}
+
+// Close closes all cached statements
+func (c *Cache) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var err error
+
+	for query, s := range c.stmts {
+		if cerr := s.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+
+		delete(c.stmts, query)
+	}
+
+	return err
+}
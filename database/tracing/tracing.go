@@ -0,0 +1,677 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database"
+	"github.com/manvalls/titan/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const tracerName = "github.com/manvalls/titan/database"
+
+// Db wraps a database.Db opening a span named after the method for every call
+type Db struct {
+	database.Db
+	tracer trace.Tracer
+}
+
+// WithTracerProvider wraps the given database so that its methods are traced
+// using the provided provider, a no-op one is used if nil
+func WithTracerProvider(db database.Db, tp trace.TracerProvider) *Db {
+	if tp == nil {
+		tp = noop.NewTracerProvider()
+	}
+
+	return &Db{Db: db, tracer: tp.Tracer(tracerName)}
+}
+
+func (d *Db) start(ctx context.Context, method string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return d.tracer.Start(ctx, method, trace.WithAttributes(attrs...))
+}
+
+// end marks the span as failed if an error was returned and closes it
+func end(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+func inodeAttr(key string, inode fuseops.InodeID) attribute.KeyValue {
+	return attribute.Int64(key, int64(inode))
+}
+
+// tracedStorage opens a child span of the given context for every removal
+// or batch of removals
+type tracedStorage struct {
+	storage.Storage
+	ctx    context.Context
+	tracer trace.Tracer
+}
+
+func (s tracedStorage) Remove(chunk storage.Chunk) error {
+	_, span := s.tracer.Start(s.ctx, "Storage.Remove", trace.WithAttributes(
+		attribute.String("titan.storage", chunk.Storage),
+		attribute.String("titan.key", chunk.Key),
+	))
+
+	err := s.Storage.Remove(chunk)
+	end(span, err)
+	return err
+}
+
+func (s tracedStorage) RemoveBatch(chunks []storage.Chunk) error {
+	_, span := s.tracer.Start(s.ctx, "Storage.RemoveBatch", trace.WithAttributes(
+		attribute.Int("titan.chunks", len(chunks)),
+	))
+
+	err := storage.RemoveBatch(s.Storage, chunks)
+	end(span, err)
+	return err
+}
+
+// Ping checks that the database is reachable
+func (d *Db) Ping(ctx context.Context) (err error) {
+	ctx, span := d.start(ctx, "Ping")
+	defer func() { end(span, err) }()
+
+	return d.Db.Ping(ctx)
+}
+
+// TryLock takes the named lock of the wrapped database, if it implements
+// database.Locker
+func (d *Db) TryLock(ctx context.Context, name string) (release func(), err error) {
+	ctx, span := d.start(ctx, "TryLock", attribute.String("titan.lock", name))
+	defer func() { end(span, err) }()
+
+	return database.TryLock(ctx, d.Db, name)
+}
+
+// Setup creates the tables and the initial data required by the file system
+func (d *Db) Setup(ctx context.Context) (err error) {
+	ctx, span := d.start(ctx, "Setup")
+	defer func() { end(span, err) }()
+
+	return d.Db.Setup(ctx)
+}
+
+// Migrate upgrades the schema of an existing database to the current version
+func (d *Db) Migrate(ctx context.Context) (err error) {
+	ctx, span := d.start(ctx, "Migrate")
+	defer func() { end(span, err) }()
+
+	return d.Db.Migrate(ctx)
+}
+
+// Stats retrieves the file system stats
+func (d *Db) Stats(ctx context.Context) (stats *database.Stats, err error) {
+	ctx, span := d.start(ctx, "Stats")
+	defer func() { end(span, err) }()
+
+	return d.Db.Stats(ctx)
+}
+
+// FsStats retrieves the file system stats relative to its capacity
+func (d *Db) FsStats(ctx context.Context) (stats *database.FsStats, err error) {
+	ctx, span := d.start(ctx, "FsStats")
+	defer func() { end(span, err) }()
+
+	return d.Db.FsStats(ctx)
+}
+
+// SubtreeStats retrieves the usage of an inode along with every inode below it
+func (d *Db) SubtreeStats(ctx context.Context, inode fuseops.InodeID) (stats *database.SubtreeStats, err error) {
+	ctx, span := d.start(ctx, "SubtreeStats", inodeAttr("titan.inode", inode))
+	defer func() { end(span, err) }()
+
+	return d.Db.SubtreeStats(ctx, inode)
+}
+
+// SetQuota sets the limits of the given user and group
+func (d *Db) SetQuota(ctx context.Context, uid *uint32, gid *uint32, bytes uint64, inodes uint64) (err error) {
+	ctx, span := d.start(ctx, "SetQuota", attribute.Int64("titan.bytes", int64(bytes)), attribute.Int64("titan.inodes", int64(inodes)))
+	defer func() { end(span, err) }()
+
+	return d.Db.SetQuota(ctx, uid, gid, bytes, inodes)
+}
+
+// GetQuota retrieves the limits and usage of either the given user or group
+func (d *Db) GetQuota(ctx context.Context, uid *uint32, gid *uint32) (quota *database.Quota, err error) {
+	ctx, span := d.start(ctx, "GetQuota")
+	defer func() { end(span, err) }()
+
+	return d.Db.GetQuota(ctx, uid, gid)
+}
+
+// Create creates a new inode under the given parent
+func (d *Db) Create(ctx context.Context, entry database.Entry) (result *database.Entry, err error) {
+	ctx, span := d.start(ctx, "Create", inodeAttr("titan.parent", entry.Parent), attribute.String("titan.name", entry.Name))
+	defer func() { end(span, err) }()
+
+	result, err = d.Db.Create(ctx, entry)
+	if err == nil {
+		span.SetAttributes(inodeAttr("titan.inode", result.ID))
+	}
+
+	return
+}
+
+// CreateAnonymous creates a new regular file without any links
+func (d *Db) CreateAnonymous(ctx context.Context, mode os.FileMode, uid uint32, gid uint32) (result *database.Inode, err error) {
+	ctx, span := d.start(ctx, "CreateAnonymous")
+	defer func() { end(span, err) }()
+
+	result, err = d.Db.CreateAnonymous(ctx, mode, uid, gid)
+	if err == nil {
+		span.SetAttributes(inodeAttr("titan.inode", result.ID))
+	}
+
+	return
+}
+
+// Link creates a new hard link to the given inode
+func (d *Db) Link(ctx context.Context, inode fuseops.InodeID, newParent fuseops.InodeID, newName string) (result *database.Entry, err error) {
+	ctx, span := d.start(ctx, "Link", inodeAttr("titan.inode", inode), inodeAttr("titan.parent", newParent), attribute.String("titan.name", newName))
+	defer func() { end(span, err) }()
+
+	return d.Db.Link(ctx, inode, newParent, newName)
+}
+
+// Forget checks if an inode has any links and removes it if not
+func (d *Db) Forget(ctx context.Context, inode fuseops.InodeID) (err error) {
+	ctx, span := d.start(ctx, "Forget", inodeAttr("titan.inode", inode))
+	defer func() { end(span, err) }()
+
+	return d.Db.Forget(ctx, inode)
+}
+
+// ForgetBatch removes those of the given inodes which have no links left
+func (d *Db) ForgetBatch(ctx context.Context, inodes []fuseops.InodeID) (err error) {
+	ctx, span := d.start(ctx, "ForgetBatch", attribute.Int("titan.inodes", len(inodes)))
+	defer func() { end(span, err) }()
+
+	return d.Db.ForgetBatch(ctx, inodes)
+}
+
+// CleanOrphanInodes removes all orphan inodes and chunks
+func (d *Db) CleanOrphanInodes(ctx context.Context) (err error) {
+	ctx, span := d.start(ctx, "CleanOrphanInodes")
+	defer func() { end(span, err) }()
+
+	return d.Db.CleanOrphanInodes(ctx)
+}
+
+// CleanOrphanChunks removes orphaned chunks, tracing every removal from the
+// storage as a child span
+func (d *Db) CleanOrphanChunks(ctx context.Context, threshold time.Time, st storage.Storage, workers int) (err error) {
+	ctx, span := d.start(ctx, "CleanOrphanChunks", attribute.Int("titan.workers", workers))
+	defer func() { end(span, err) }()
+
+	return d.Db.CleanOrphanChunks(ctx, threshold, tracedStorage{st, ctx, d.tracer}, workers)
+}
+
+// CountOrphans reports what the cleanup would remove
+func (d *Db) CountOrphans(ctx context.Context, threshold time.Time) (report *database.OrphanReport, err error) {
+	ctx, span := d.start(ctx, "CountOrphans")
+	defer func() { end(span, err) }()
+
+	return d.Db.CountOrphans(ctx, threshold)
+}
+
+// Fsck checks the consistency of the file system, optionally repairing it
+func (d *Db) Fsck(ctx context.Context, repair bool) (report *database.FsckReport, err error) {
+	ctx, span := d.start(ctx, "Fsck", attribute.Bool("titan.repair", repair))
+	defer func() { end(span, err) }()
+
+	return d.Db.Fsck(ctx, repair)
+}
+
+// VerifyChunks lists the chunks of an inode whose object is missing
+func (d *Db) VerifyChunks(ctx context.Context, st storage.Storage, inode fuseops.InodeID) (missing []uint64, err error) {
+	ctx, span := d.start(ctx, "VerifyChunks", inodeAttr("titan.inode", inode))
+	defer func() { end(span, err) }()
+
+	missing, err = d.Db.VerifyChunks(ctx, st, inode)
+	if err == nil {
+		span.SetAttributes(attribute.Int("titan.missing", len(missing)))
+	}
+
+	return
+}
+
+// Export writes a portable dump of the file system
+func (d *Db) Export(ctx context.Context, w io.Writer) (err error) {
+	ctx, span := d.start(ctx, "Export")
+	defer func() { end(span, err) }()
+
+	return d.Db.Export(ctx, w)
+}
+
+// Import recreates the contents of a dump
+func (d *Db) Import(ctx context.Context, r io.Reader) (err error) {
+	ctx, span := d.start(ctx, "Import")
+	defer func() { end(span, err) }()
+
+	return d.Db.Import(ctx, r)
+}
+
+// VerifyAllChunks lists the live chunks whose object is missing
+func (d *Db) VerifyAllChunks(ctx context.Context, st storage.Storage) (missing []uint64, err error) {
+	ctx, span := d.start(ctx, "VerifyAllChunks")
+	defer func() { end(span, err) }()
+
+	missing, err = d.Db.VerifyAllChunks(ctx, st)
+	if err == nil {
+		span.SetAttributes(attribute.Int("titan.missing", len(missing)))
+	}
+
+	return
+}
+
+// Unlink removes an entry from the file system
+func (d *Db) Unlink(ctx context.Context, parent fuseops.InodeID, name string) (err error) {
+	ctx, span := d.start(ctx, "Unlink", inodeAttr("titan.parent", parent), attribute.String("titan.name", name))
+	defer func() { end(span, err) }()
+
+	return d.Db.Unlink(ctx, parent, name)
+}
+
+// RemoveTree removes an entry along with every entry below it
+func (d *Db) RemoveTree(ctx context.Context, parent fuseops.InodeID, name string, recursive bool) (err error) {
+	ctx, span := d.start(ctx, "RemoveTree",
+		inodeAttr("titan.parent", parent),
+		attribute.String("titan.name", name),
+		attribute.Bool("titan.recursive", recursive),
+	)
+
+	defer func() { end(span, err) }()
+
+	return d.Db.RemoveTree(ctx, parent, name, recursive)
+}
+
+// Snapshot copies a directory tree sharing the storage objects
+func (d *Db) Snapshot(ctx context.Context, srcInode fuseops.InodeID, dstParent fuseops.InodeID, dstName string) (entry *database.Entry, err error) {
+	ctx, span := d.start(ctx, "Snapshot",
+		inodeAttr("titan.inode", srcInode),
+		inodeAttr("titan.new_parent", dstParent),
+		attribute.String("titan.new_name", dstName),
+	)
+
+	defer func() { end(span, err) }()
+
+	return d.Db.Snapshot(ctx, srcInode, dstParent, dstName)
+}
+
+// Rename renames an entry
+func (d *Db) Rename(ctx context.Context, oldParent fuseops.InodeID, oldName string, newParent fuseops.InodeID, newName string, flags uint32) (err error) {
+	ctx, span := d.start(ctx, "Rename",
+		inodeAttr("titan.parent", oldParent),
+		attribute.String("titan.name", oldName),
+		inodeAttr("titan.new_parent", newParent),
+		attribute.String("titan.new_name", newName),
+		attribute.Int64("titan.flags", int64(flags)),
+	)
+
+	defer func() { end(span, err) }()
+
+	return d.Db.Rename(ctx, oldParent, oldName, newParent, newName, flags)
+}
+
+// LookUp finds the entry located under the specified parent with the specified name
+func (d *Db) LookUp(ctx context.Context, parent fuseops.InodeID, name string) (entry *database.Entry, err error) {
+	ctx, span := d.start(ctx, "LookUp", inodeAttr("titan.parent", parent), attribute.String("titan.name", name))
+	defer func() { end(span, err) }()
+
+	return d.Db.LookUp(ctx, parent, name)
+}
+
+// Get retrieves the stats of a particular inode
+func (d *Db) Get(ctx context.Context, inode fuseops.InodeID) (result *database.Inode, err error) {
+	ctx, span := d.start(ctx, "Get", inodeAttr("titan.inode", inode))
+	defer func() { end(span, err) }()
+
+	return d.Db.Get(ctx, inode)
+}
+
+// Statx retrieves the attributes of an inode along with its allocated blocks
+func (d *Db) Statx(ctx context.Context, inode fuseops.InodeID) (statx *database.Statx, err error) {
+	ctx, span := d.start(ctx, "Statx", inodeAttr("titan.inode", inode))
+	defer func() { end(span, err) }()
+
+	return d.Db.Statx(ctx, inode)
+}
+
+// Paths retrieves the full paths reaching the given inode
+func (d *Db) Paths(ctx context.Context, inode fuseops.InodeID) (paths *[]string, err error) {
+	ctx, span := d.start(ctx, "Paths", inodeAttr("titan.inode", inode))
+	defer func() { end(span, err) }()
+
+	return d.Db.Paths(ctx, inode)
+}
+
+// ReadLink retrieves the target of a symbolic link
+func (d *Db) ReadLink(ctx context.Context, inode fuseops.InodeID) (target string, err error) {
+	ctx, span := d.start(ctx, "ReadLink", inodeAttr("titan.inode", inode))
+	defer func() { end(span, err) }()
+
+	return d.Db.ReadLink(ctx, inode)
+}
+
+// Touch changes the stats of a file
+func (d *Db) Touch(ctx context.Context, inode fuseops.InodeID, size *uint64, mode *os.FileMode, atime *time.Time, mtime *time.Time, uid *uint32, gid *uint32) (result *database.Inode, err error) {
+	ctx, span := d.start(ctx, "Touch", inodeAttr("titan.inode", inode))
+	defer func() { end(span, err) }()
+
+	if size != nil {
+		span.SetAttributes(attribute.Int64("titan.size", int64(*size)))
+	}
+
+	return d.Db.Touch(ctx, inode, size, mode, atime, mtime, uid, gid)
+}
+
+// Truncate changes the size of a file
+func (d *Db) Truncate(ctx context.Context, inode fuseops.InodeID, size uint64) (err error) {
+	ctx, span := d.start(ctx, "Truncate",
+		inodeAttr("titan.inode", inode),
+		attribute.Int64("titan.size", int64(size)),
+	)
+
+	defer func() { end(span, err) }()
+
+	return d.Db.Truncate(ctx, inode, size)
+}
+
+// SetImmutable sets or clears the immutable flag of an inode
+func (d *Db) SetImmutable(ctx context.Context, inode fuseops.InodeID, uid uint32, immutable bool, retainUntil *time.Time) (err error) {
+	ctx, span := d.start(ctx, "SetImmutable",
+		inodeAttr("titan.inode", inode),
+		attribute.Bool("titan.immutable", immutable),
+	)
+
+	defer func() { end(span, err) }()
+
+	return d.Db.SetImmutable(ctx, inode, uid, immutable, retainUntil)
+}
+
+// ChownTree changes the owner and group of a whole tree
+func (d *Db) ChownTree(ctx context.Context, inode fuseops.InodeID, uid *uint32, gid *uint32, fromUid *uint32) (err error) {
+	ctx, span := d.start(ctx, "ChownTree", inodeAttr("titan.inode", inode))
+	defer func() { end(span, err) }()
+
+	return d.Db.ChownTree(ctx, inode, uid, gid, fromUid)
+}
+
+// ChmodTree changes the permissions of a whole tree
+func (d *Db) ChmodTree(ctx context.Context, inode fuseops.InodeID, dirMode os.FileMode, fileMode os.FileMode) (err error) {
+	ctx, span := d.start(ctx, "ChmodTree", inodeAttr("titan.inode", inode))
+	defer func() { end(span, err) }()
+
+	return d.Db.ChmodTree(ctx, inode, dirMode, fileMode)
+}
+
+// AddChunk adds a chunk to the given inode
+func (d *Db) AddChunk(ctx context.Context, inode fuseops.InodeID, flags uint32, chunk database.Chunk) (err error) {
+	ctx, span := d.start(ctx, "AddChunk",
+		inodeAttr("titan.inode", inode),
+		attribute.String("titan.storage", chunk.Storage),
+		attribute.String("titan.key", chunk.Key),
+		attribute.Int64("titan.offset", int64(chunk.InodeOffset)),
+		attribute.Int64("titan.size", int64(chunk.Size)),
+	)
+
+	defer func() { end(span, err) }()
+
+	return d.Db.AddChunk(ctx, inode, flags, chunk)
+}
+
+// CopyRange copies a range of an inode to another one sharing the storage objects
+func (d *Db) CopyRange(ctx context.Context, srcInode fuseops.InodeID, srcOffset uint64, dstInode fuseops.InodeID, dstOffset uint64, length uint64) (copied uint64, err error) {
+	ctx, span := d.start(ctx, "CopyRange",
+		inodeAttr("titan.inode", srcInode),
+		attribute.Int64("titan.offset", int64(srcOffset)),
+		inodeAttr("titan.dst_inode", dstInode),
+		attribute.Int64("titan.dst_offset", int64(dstOffset)),
+		attribute.Int64("titan.length", int64(length)),
+	)
+
+	defer func() { end(span, err) }()
+
+	return d.Db.CopyRange(ctx, srcInode, srcOffset, dstInode, dstOffset, length)
+}
+
+// Fallocate reserves the given range of an inode
+func (d *Db) Fallocate(ctx context.Context, inode fuseops.InodeID, offset uint64, length uint64, mode uint32) (err error) {
+	ctx, span := d.start(ctx, "Fallocate",
+		inodeAttr("titan.inode", inode),
+		attribute.Int64("titan.offset", int64(offset)),
+		attribute.Int64("titan.length", int64(length)),
+		attribute.Int64("titan.mode", int64(mode)),
+	)
+
+	defer func() { end(span, err) }()
+
+	return d.Db.Fallocate(ctx, inode, offset, length, mode)
+}
+
+// ChunksByStorage lists the live chunks stored at the given storage
+func (d *Db) ChunksByStorage(ctx context.Context, storageName string, afterID uint64, limit int) (chunks *[]database.Chunk, err error) {
+	ctx, span := d.start(ctx, "ChunksByStorage",
+		attribute.String("titan.storage", storageName),
+		attribute.Int64("titan.after_id", int64(afterID)),
+		attribute.Int("titan.limit", limit),
+	)
+
+	defer func() { end(span, err) }()
+
+	return d.Db.ChunksByStorage(ctx, storageName, afterID, limit)
+}
+
+// MigrateChunk points a live chunk to a copy of its object at another storage
+func (d *Db) MigrateChunk(ctx context.Context, id uint64, newStorage string, newKey string) (err error) {
+	ctx, span := d.start(ctx, "MigrateChunk",
+		attribute.Int64("titan.chunk", int64(id)),
+		attribute.String("titan.storage", newStorage),
+		attribute.String("titan.key", newKey),
+	)
+
+	defer func() { end(span, err) }()
+
+	return d.Db.MigrateChunk(ctx, id, newStorage, newKey)
+}
+
+// CompactChunks merges the contiguous chunks of an inode
+func (d *Db) CompactChunks(ctx context.Context, inode fuseops.InodeID) (err error) {
+	ctx, span := d.start(ctx, "CompactChunks", inodeAttr("titan.inode", inode))
+	defer func() { end(span, err) }()
+
+	return d.Db.CompactChunks(ctx, inode)
+}
+
+// Defragment rewrites the small chunks of an inode into larger objects
+func (d *Db) Defragment(ctx context.Context, st storage.Storage, inode fuseops.InodeID, targetObjectSize uint64) (err error) {
+	ctx, span := d.start(ctx, "Defragment",
+		inodeAttr("titan.inode", inode),
+		attribute.Int64("titan.size", int64(targetObjectSize)),
+	)
+	defer func() { end(span, err) }()
+
+	return d.Db.Defragment(ctx, st, inode, targetObjectSize)
+}
+
+// RetierInode moves the chunks of an inode to another storage
+func (d *Db) RetierInode(ctx context.Context, st storage.Storage, inode fuseops.InodeID, target string) (err error) {
+	ctx, span := d.start(ctx, "RetierInode",
+		inodeAttr("titan.inode", inode),
+		attribute.String("titan.storage", target),
+	)
+	defer func() { end(span, err) }()
+
+	return d.Db.RetierInode(ctx, st, inode, target)
+}
+
+// Chunks grabs the chunks for the given inode
+func (d *Db) Chunks(ctx context.Context, inode fuseops.InodeID) (chunks *[]database.Chunk, err error) {
+	ctx, span := d.start(ctx, "Chunks", inodeAttr("titan.inode", inode))
+	defer func() { end(span, err) }()
+
+	return d.Db.Chunks(ctx, inode)
+}
+
+// ChunksInRange grabs the chunks of the given inode which overlap the
+// provided byte range
+func (d *Db) ChunksInRange(ctx context.Context, inode fuseops.InodeID, offset uint64, length uint64) (chunks *[]database.Chunk, err error) {
+	ctx, span := d.start(ctx, "ChunksInRange",
+		inodeAttr("titan.inode", inode),
+		attribute.Int64("titan.offset", int64(offset)),
+		attribute.Int64("titan.length", int64(length)),
+	)
+
+	defer func() { end(span, err) }()
+
+	return d.Db.ChunksInRange(ctx, inode, offset, length)
+}
+
+// Children gets the list of children for the given inode
+func (d *Db) Children(ctx context.Context, inode fuseops.InodeID) (children *[]database.Child, err error) {
+	ctx, span := d.start(ctx, "Children", inodeAttr("titan.inode", inode))
+	defer func() { end(span, err) }()
+
+	return d.Db.Children(ctx, inode)
+}
+
+// ChildCount counts the children of the given inode
+func (d *Db) ChildCount(ctx context.Context, inode fuseops.InodeID) (count uint64, err error) {
+	ctx, span := d.start(ctx, "ChildCount", inodeAttr("titan.inode", inode))
+	defer func() { end(span, err) }()
+
+	return d.Db.ChildCount(ctx, inode)
+}
+
+// ChildrenPage gets up to limit children of the given inode whose name sorts
+// after afterName
+func (d *Db) ChildrenPage(ctx context.Context, inode fuseops.InodeID, afterName string, limit int) (children *[]database.Child, err error) {
+	ctx, span := d.start(ctx, "ChildrenPage", inodeAttr("titan.inode", inode), attribute.Int("titan.limit", limit))
+	defer func() { end(span, err) }()
+
+	return d.Db.ChildrenPage(ctx, inode, afterName, limit)
+}
+
+// ChildrenPlus gets the children of the given inode along with their attributes
+func (d *Db) ChildrenPlus(ctx context.Context, inode fuseops.InodeID) (entries *[]database.Entry, err error) {
+	ctx, span := d.start(ctx, "ChildrenPlus", inodeAttr("titan.inode", inode))
+	defer func() { end(span, err) }()
+
+	return d.Db.ChildrenPlus(ctx, inode)
+}
+
+// ListXattr retrieves the list of extended attributes for the given inode
+func (d *Db) ListXattr(ctx context.Context, inode fuseops.InodeID) (keys *[]string, err error) {
+	ctx, span := d.start(ctx, "ListXattr", inodeAttr("titan.inode", inode))
+	defer func() { end(span, err) }()
+
+	return d.Db.ListXattr(ctx, inode)
+}
+
+// RemoveXattr removes an extended attribute
+func (d *Db) RemoveXattr(ctx context.Context, inode fuseops.InodeID, attr string) (err error) {
+	ctx, span := d.start(ctx, "RemoveXattr", inodeAttr("titan.inode", inode), attribute.String("titan.xattr", attr))
+	defer func() { end(span, err) }()
+
+	return d.Db.RemoveXattr(ctx, inode, attr)
+}
+
+// GetXattr retrieves the value of an extended attribute
+func (d *Db) GetXattr(ctx context.Context, inode fuseops.InodeID, attr string) (value *[]byte, err error) {
+	ctx, span := d.start(ctx, "GetXattr", inodeAttr("titan.inode", inode), attribute.String("titan.xattr", attr))
+	defer func() { end(span, err) }()
+
+	return d.Db.GetXattr(ctx, inode, attr)
+}
+
+// GetXattrSize retrieves the size of the value of an extended attribute
+func (d *Db) GetXattrSize(ctx context.Context, inode fuseops.InodeID, attr string) (size uint64, err error) {
+	ctx, span := d.start(ctx, "GetXattrSize", inodeAttr("titan.inode", inode), attribute.String("titan.xattr", attr))
+	defer func() { end(span, err) }()
+
+	return d.Db.GetXattrSize(ctx, inode, attr)
+}
+
+// SetXattr sets the value of an extended attribute
+func (d *Db) SetXattr(ctx context.Context, inode fuseops.InodeID, attr string, value []byte, flags uint32) (err error) {
+	ctx, span := d.start(ctx, "SetXattr", inodeAttr("titan.inode", inode), attribute.String("titan.xattr", attr))
+	defer func() { end(span, err) }()
+
+	return d.Db.SetXattr(ctx, inode, attr, value, flags)
+}
+
+// GetAllXattr retrieves all the extended attributes of an inode
+func (d *Db) GetAllXattr(ctx context.Context, inode fuseops.InodeID) (result map[string][]byte, err error) {
+	ctx, span := d.start(ctx, "GetAllXattr", inodeAttr("titan.inode", inode))
+	defer func() { end(span, err) }()
+
+	return d.Db.GetAllXattr(ctx, inode)
+}
+
+// SwapXattr sets the value of an extended attribute if it holds the expected one
+func (d *Db) SwapXattr(ctx context.Context, inode fuseops.InodeID, attr string, expected []byte, value []byte) (swapped bool, err error) {
+	ctx, span := d.start(ctx, "SwapXattr", inodeAttr("titan.inode", inode), attribute.String("titan.xattr", attr))
+	defer func() {
+		span.SetAttributes(attribute.Bool("titan.swapped", swapped))
+		end(span, err)
+	}()
+
+	return d.Db.SwapXattr(ctx, inode, attr, expected, value)
+}
+
+// SetAllXattr replaces the whole set of extended attributes of an inode
+func (d *Db) SetAllXattr(ctx context.Context, inode fuseops.InodeID, attrs map[string][]byte) (err error) {
+	ctx, span := d.start(ctx, "SetAllXattr", inodeAttr("titan.inode", inode), attribute.Int("titan.xattrs", len(attrs)))
+	defer func() { end(span, err) }()
+
+	return d.Db.SetAllXattr(ctx, inode, attrs)
+}
+
+// lockAttrs returns the attributes describing an advisory lock
+func lockAttrs(inode fuseops.InodeID, owner uint64, start uint64, length uint64, lockType database.LockType) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		inodeAttr("titan.inode", inode),
+		attribute.Int64("titan.owner", int64(owner)),
+		attribute.Int64("titan.offset", int64(start)),
+		attribute.Int64("titan.size", int64(length)),
+		attribute.Int64("titan.lock_type", int64(lockType)),
+	}
+}
+
+// GetLock returns a lock conflicting with the given one, if any
+func (d *Db) GetLock(ctx context.Context, inode fuseops.InodeID, owner uint64, start uint64, length uint64, lockType database.LockType) (lock *database.Lock, err error) {
+	ctx, span := d.start(ctx, "GetLock", lockAttrs(inode, owner, start, length, lockType)...)
+	defer func() { end(span, err) }()
+
+	return d.Db.GetLock(ctx, inode, owner, start, length, lockType)
+}
+
+// SetLock takes or releases an advisory lock over a byte range of an inode
+func (d *Db) SetLock(ctx context.Context, inode fuseops.InodeID, owner uint64, start uint64, length uint64, lockType database.LockType) (err error) {
+	ctx, span := d.start(ctx, "SetLock", lockAttrs(inode, owner, start, length, lockType)...)
+	defer func() { end(span, err) }()
+
+	return d.Db.SetLock(ctx, inode, owner, start, length, lockType)
+}
+
+// ClearLocks releases every lock held by an owner
+func (d *Db) ClearLocks(ctx context.Context, owner uint64) (err error) {
+	ctx, span := d.start(ctx, "ClearLocks", attribute.Int64("titan.owner", int64(owner)))
+	defer func() { end(span, err) }()
+
+	return d.Db.ClearLocks(ctx, owner)
+}
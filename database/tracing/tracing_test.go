@@ -0,0 +1,104 @@
+package tracing
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database"
+	"github.com/manvalls/titan/storage"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type mockDb struct {
+	database.Db
+}
+
+func (m mockDb) LookUp(ctx context.Context, parent fuseops.InodeID, name string) (*database.Entry, error) {
+	if name == "missing" {
+		return nil, syscall.ENOENT
+	}
+
+	return &database.Entry{Parent: parent, Name: name}, nil
+}
+
+func (m mockDb) CleanOrphanChunks(ctx context.Context, threshold time.Time, st storage.Storage, workers int) error {
+	st.Remove(storage.Chunk{Storage: "s3", Key: "a"})
+	return st.Remove(storage.Chunk{Storage: "s3", Key: "b"})
+}
+
+type mockStorage struct {
+	storage.Storage
+}
+
+func (m mockStorage) Remove(chunk storage.Chunk) error {
+	if chunk.Key == "b" {
+		return syscall.EIO
+	}
+
+	return nil
+}
+
+func TestWithTracerProvider(t *testing.T) {
+	ctx := context.Background()
+	recorder := tracetest.NewSpanRecorder()
+	db := WithTracerProvider(mockDb{}, sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	_, err := db.LookUp(ctx, fuseops.RootInodeID, "file")
+	assert.Nil(t, err)
+
+	_, err = db.LookUp(ctx, fuseops.RootInodeID, "missing")
+	assert.Equal(t, syscall.ENOENT, err)
+
+	spans := recorder.Ended()
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+
+	assert.Equal(t, "LookUp", spans[0].Name())
+	assert.Equal(t, codes.Unset, spans[0].Status().Code)
+	assert.Contains(t, spans[0].Attributes(), attribute.String("titan.name", "file"))
+	assert.Contains(t, spans[0].Attributes(), attribute.Int64("titan.parent", int64(fuseops.RootInodeID)))
+
+	assert.Equal(t, "LookUp", spans[1].Name())
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+}
+
+func TestCleanOrphanChunksSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	db := WithTracerProvider(mockDb{}, sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	assert.Equal(t, syscall.EIO, db.CleanOrphanChunks(context.Background(), time.Now(), mockStorage{}, 1))
+
+	spans := recorder.Ended()
+	if !assert.Len(t, spans, 3) {
+		return
+	}
+
+	parent := spans[2]
+	assert.Equal(t, "CleanOrphanChunks", parent.Name())
+	assert.Equal(t, codes.Error, parent.Status().Code)
+
+	for i, key := range []string{"a", "b"} {
+		assert.Equal(t, "Storage.Remove", spans[i].Name())
+		assert.Equal(t, parent.SpanContext().SpanID(), spans[i].Parent().SpanID())
+		assert.Contains(t, spans[i].Attributes(), attribute.String("titan.key", key))
+	}
+
+	assert.Equal(t, codes.Unset, spans[0].Status().Code)
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+}
+
+func TestNoopProvider(t *testing.T) {
+	db := WithTracerProvider(mockDb{}, nil)
+
+	entry, err := db.LookUp(context.Background(), fuseops.RootInodeID, "file")
+	assert.Nil(t, err)
+	assert.Equal(t, "file", entry.Name)
+}
@@ -0,0 +1,352 @@
+package trash
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database"
+)
+
+// Dir is the name of the hidden directory below the root holding the
+// unlinked entries
+const Dir = ".trash"
+
+// xattrPrefix prefixes the name of the extended attribute of trashed inodes
+// telling where each of their entries in the trash was unlinked from, as the
+// entries are given names of a fixed length instead of their original ones
+const xattrPrefix = "trusted.titan.trash."
+
+// Item is an entry held in the trash
+type Item struct {
+	// Name is the name of the entry within the trash directory
+	Name  string
+	Inode fuseops.InodeID
+
+	// Parent and OriginalName tell where the entry was unlinked from
+	Parent       fuseops.InodeID
+	OriginalName string
+
+	DeletedAt time.Time
+}
+
+// Db wraps a database.Db so that unlinked entries are moved to the trash
+// directory instead of being removed, giving an undo window until they're
+// removed by PurgeExpired once the retention passes. Where they were
+// unlinked from is kept in an extended attribute of their inode. Entries
+// unlinked within the trash, replaced by Rename or removed with RemoveTree are
+// removed right away. Immutable inodes can't be moved to the trash, Unlink
+// fails with EPERM for them as the wrapped database does.
+type Db struct {
+	database.Db
+	Retention time.Duration
+}
+
+// WithTrash wraps the given database so that unlinked entries are kept in the
+// trash for the given time
+func WithTrash(db database.Db, retention time.Duration) *Db {
+	return &Db{Db: db, Retention: retention}
+}
+
+// TryLock takes the named lock of the wrapped database, if it implements
+// database.Locker
+func (d *Db) TryLock(ctx context.Context, name string) (func(), error) {
+	return database.TryLock(ctx, d.Db, name)
+}
+
+// Unlink moves an entry to the trash, failing with EPERM for immutable inodes
+// and with ENOTEMPTY for directories with children, both checked within the
+// same transaction as the move. Entries within the trash are removed instead.
+func (d *Db) Unlink(ctx context.Context, parent fuseops.InodeID, name string) error {
+	if parent == fuseops.RootInodeID && name == Dir {
+		return d.Db.Unlink(ctx, parent, name)
+	}
+
+	trashed, err := d.inTrash(ctx, parent)
+	if err != nil {
+		return err
+	}
+
+	entry, err := d.Db.LookUp(ctx, parent, name)
+	if err != nil {
+		return err
+	}
+
+	if trashed {
+		if err = d.Db.Unlink(ctx, parent, name); err != nil {
+			return err
+		}
+
+		return d.clear(ctx, entry.ID, name)
+	}
+
+	dir, err := d.dir(ctx)
+	if err != nil {
+		return err
+	}
+
+	item, err := itemName(time.Now())
+	if err != nil {
+		return err
+	}
+
+	err = d.Db.SetXattr(ctx, entry.ID, xattrPrefix+item, origin(parent, name), database.XattrCreate)
+	if err != nil {
+		return err
+	}
+
+	if err = d.Db.Rename(ctx, parent, name, dir, item, database.RenameNoReplace|database.RenameEmpty|database.RenameMutable); err != nil {
+		d.clear(ctx, entry.ID, item)
+		return err
+	}
+
+	return nil
+}
+
+// Trash lists the entries held in the trash, the oldest first
+func (d *Db) Trash(ctx context.Context) ([]Item, error) {
+	entry, err := d.Db.LookUp(ctx, fuseops.RootInodeID, Dir)
+	if err == syscall.ENOENT {
+		return []Item{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	children, err := d.Db.Children(ctx, entry.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]Item, 0, len(*children))
+	for _, child := range *children {
+		item, ok := parseItem(child.Name)
+		if !ok {
+			continue
+		}
+
+		item.Inode = child.Inode
+
+		value, err := d.Db.GetXattr(ctx, child.Inode, xattrPrefix+child.Name)
+		if err != nil && err != syscall.ENODATA {
+			return nil, err
+		}
+
+		if err == nil {
+			item.Parent, item.OriginalName, _ = parseOrigin(*value)
+		}
+
+		items = append(items, item)
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].DeletedAt.Before(items[j].DeletedAt)
+	})
+
+	return items, nil
+}
+
+// RestoreFromTrash moves the given entry of the trash back to where it was
+// unlinked from, failing with EEXIST if another entry took its name and with
+// ENOENT if its parent is gone
+func (d *Db) RestoreFromTrash(ctx context.Context, name string) error {
+	if _, ok := parseItem(name); !ok {
+		return syscall.ENOENT
+	}
+
+	dir, err := d.Db.LookUp(ctx, fuseops.RootInodeID, Dir)
+	if err != nil {
+		return err
+	}
+
+	entry, err := d.Db.LookUp(ctx, dir.ID, name)
+	if err != nil {
+		return err
+	}
+
+	value, err := d.Db.GetXattr(ctx, entry.ID, xattrPrefix+name)
+	if err == syscall.ENODATA {
+		return syscall.ENOENT
+	}
+
+	if err != nil {
+		return err
+	}
+
+	parent, original, ok := parseOrigin(*value)
+	if !ok {
+		return syscall.ENOENT
+	}
+
+	if err = d.Db.Rename(ctx, dir.ID, name, parent, original, database.RenameNoReplace); err != nil {
+		return err
+	}
+
+	return d.clear(ctx, entry.ID, name)
+}
+
+// EmptyTrash removes every entry held in the trash
+func (d *Db) EmptyTrash(ctx context.Context) error {
+	return d.purge(ctx, time.Now())
+}
+
+// PurgeExpired removes the entries of the trash older than the retention,
+// leaving their inodes to CleanOrphanInodes if they have no links left
+func (d *Db) PurgeExpired(ctx context.Context) error {
+	return d.purge(ctx, time.Now().Add(-d.Retention))
+}
+
+// purge removes the entries of the trash unlinked before the given time,
+// skipping the immutable ones
+func (d *Db) purge(ctx context.Context, before time.Time) error {
+	items, err := d.Trash(ctx)
+	if err != nil || len(items) == 0 {
+		return err
+	}
+
+	entry, err := d.Db.LookUp(ctx, fuseops.RootInodeID, Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if !item.DeletedAt.Before(before) {
+			break
+		}
+
+		err = d.Db.RemoveTree(ctx, entry.ID, item.Name, true)
+		if err == syscall.EPERM || err == syscall.ENOENT {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// Inodes with links left elsewhere keep living
+		if err = d.clear(ctx, item.Inode, item.Name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dir returns the trash directory, creating it if missing
+func (d *Db) dir(ctx context.Context) (fuseops.InodeID, error) {
+	entry, err := d.Db.LookUp(ctx, fuseops.RootInodeID, Dir)
+	if err == syscall.ENOENT {
+		entry, err = d.Db.Create(ctx, database.Entry{
+			Parent: fuseops.RootInodeID,
+			Name:   Dir,
+			Inode: database.Inode{
+				InodeAttributes: fuseops.InodeAttributes{
+					Mode: os.ModeDir | 0700,
+				},
+			},
+		})
+
+		// Another client may have just created it
+		if err == syscall.EEXIST {
+			entry, err = d.Db.LookUp(ctx, fuseops.RootInodeID, Dir)
+		}
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return entry.ID, nil
+}
+
+// inTrash tells whether the given directory is the trash or lies within it
+func (d *Db) inTrash(ctx context.Context, dir fuseops.InodeID) (bool, error) {
+	if dir == fuseops.RootInodeID {
+		return false, nil
+	}
+
+	paths, err := d.Db.Paths(ctx, dir)
+	if err != nil {
+		return false, err
+	}
+
+	for _, path := range *paths {
+		if path == "/"+Dir || strings.HasPrefix(path, "/"+Dir+"/") {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// clear removes the extended attribute telling where the given entry of the
+// trash was unlinked from, which may be gone along with its inode
+func (d *Db) clear(ctx context.Context, inode fuseops.InodeID, name string) error {
+	err := d.Db.RemoveXattr(ctx, inode, xattrPrefix+name)
+	if err == syscall.ENODATA || err == syscall.ENOENT {
+		return nil
+	}
+
+	return err
+}
+
+// itemName returns a new name for an entry of the trash, made of the time it
+// was unlinked at and a random id so that it's unique and of a fixed length
+func itemName(deletedAt time.Time) (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return strconv.FormatInt(deletedAt.UnixNano(), 10) + "-" + hex.EncodeToString(id), nil
+}
+
+// parseItem parses the name of an entry of the trash, reporting whether it
+// was valid
+func parseItem(name string) (Item, bool) {
+	parts := strings.SplitN(name, "-", 2)
+	if len(parts) != 2 || len(parts[1]) != 16 {
+		return Item{}, false
+	}
+
+	deletedAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return Item{}, false
+	}
+
+	if _, err = hex.DecodeString(parts[1]); err != nil {
+		return Item{}, false
+	}
+
+	return Item{Name: name, DeletedAt: time.Unix(0, deletedAt)}, true
+}
+
+// origin returns the value of the extended attribute telling where an entry
+// of the trash was unlinked from, made of its parent and its name
+func origin(parent fuseops.InodeID, name string) []byte {
+	return []byte(strconv.FormatUint(uint64(parent), 10) + "/" + name)
+}
+
+// parseOrigin parses the value returned by origin, reporting whether it was
+// valid
+func parseOrigin(value []byte) (fuseops.InodeID, string, bool) {
+	parts := strings.SplitN(string(value), "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return 0, "", false
+	}
+
+	parent, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+
+	return fuseops.InodeID(parent), parts[1], true
+}
@@ -0,0 +1,262 @@
+package trash
+
+import (
+	"context"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database"
+	"github.com/manvalls/titan/database/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestDb(t *testing.T, retention time.Duration) *Db {
+	m := &memory.Driver{}
+	if err := m.Setup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return WithTrash(m, retention)
+}
+
+func create(t *testing.T, db database.Db, parent fuseops.InodeID, name string, mode os.FileMode) *database.Entry {
+	entry, err := db.Create(context.Background(), database.Entry{
+		Parent: parent,
+		Name:   name,
+		Inode:  database.Inode{InodeAttributes: fuseops.InodeAttributes{Mode: mode}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return entry
+}
+
+func TestRestore(t *testing.T) {
+	ctx := context.Background()
+	d := getTestDb(t, time.Hour)
+	dir := create(t, d, fuseops.RootInodeID, "dir", os.ModeDir|0755)
+	file := create(t, d, dir.ID, "file", 0644)
+
+	assert.Nil(t, d.Unlink(ctx, dir.ID, "file"))
+
+	_, err := d.LookUp(ctx, dir.ID, "file")
+	assert.Equal(t, syscall.ENOENT, err)
+
+	items, err := d.Trash(ctx)
+	assert.Nil(t, err)
+	if !assert.Len(t, items, 1) {
+		return
+	}
+
+	assert.Equal(t, file.ID, items[0].Inode)
+	assert.Equal(t, dir.ID, items[0].Parent)
+	assert.Equal(t, "file", items[0].OriginalName)
+	assert.WithinDuration(t, time.Now(), items[0].DeletedAt, time.Minute)
+
+	assert.Nil(t, d.PurgeExpired(ctx))
+	assert.Nil(t, d.CleanOrphanInodes(ctx))
+
+	inode, err := d.Get(ctx, file.ID)
+	assert.Nil(t, err, "trashed inodes should be kept until the retention passes")
+	assert.Equal(t, uint32(1), inode.Nlink)
+
+	assert.Nil(t, d.RestoreFromTrash(ctx, items[0].Name))
+
+	entry, err := d.LookUp(ctx, dir.ID, "file")
+	assert.Nil(t, err)
+	assert.Equal(t, file.ID, entry.ID)
+
+	items, err = d.Trash(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, items)
+
+	assert.Equal(t, syscall.ENOENT, d.RestoreFromTrash(ctx, "missing"))
+}
+
+func TestRestoreTaken(t *testing.T) {
+	ctx := context.Background()
+	d := getTestDb(t, time.Hour)
+	create(t, d, fuseops.RootInodeID, "file", 0644)
+
+	assert.Nil(t, d.Unlink(ctx, fuseops.RootInodeID, "file"))
+	create(t, d, fuseops.RootInodeID, "file", 0644)
+
+	items, err := d.Trash(ctx)
+	assert.Nil(t, err)
+	if assert.Len(t, items, 1) {
+		assert.Equal(t, syscall.EEXIST, d.RestoreFromTrash(ctx, items[0].Name))
+	}
+}
+
+func TestRetention(t *testing.T) {
+	ctx := context.Background()
+	d := getTestDb(t, time.Hour)
+	file := create(t, d, fuseops.RootInodeID, "file", 0644)
+	dir := create(t, d, fuseops.RootInodeID, "dir", os.ModeDir|0755)
+
+	assert.Nil(t, d.Unlink(ctx, fuseops.RootInodeID, "file"))
+	assert.Nil(t, d.Unlink(ctx, fuseops.RootInodeID, "dir"))
+	assert.Nil(t, d.PurgeExpired(ctx))
+
+	items, err := d.Trash(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, items, 2)
+
+	d.Retention = 0
+	assert.Nil(t, d.PurgeExpired(ctx))
+
+	items, err = d.Trash(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, items)
+
+	assert.Nil(t, d.CleanOrphanInodes(ctx))
+	for _, id := range []fuseops.InodeID{file.ID, dir.ID} {
+		_, err = d.Get(ctx, id)
+		assert.Equal(t, syscall.ENOENT, err, "trashed inodes should be reaped once the retention passes")
+	}
+}
+
+func TestEmptyTrash(t *testing.T) {
+	ctx := context.Background()
+	d := getTestDb(t, time.Hour)
+	file := create(t, d, fuseops.RootInodeID, "file", 0644)
+
+	assert.Nil(t, d.EmptyTrash(ctx))
+	assert.Nil(t, d.Unlink(ctx, fuseops.RootInodeID, "file"))
+	assert.Nil(t, d.EmptyTrash(ctx))
+
+	items, err := d.Trash(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, items)
+
+	assert.Nil(t, d.CleanOrphanInodes(ctx))
+	_, err = d.Get(ctx, file.ID)
+	assert.Equal(t, syscall.ENOENT, err)
+
+	// Inodes linked elsewhere survive, forgetting where they were unlinked from
+	linked := create(t, d, fuseops.RootInodeID, "linked", 0644)
+	_, err = d.Link(ctx, linked.ID, fuseops.RootInodeID, "other")
+	assert.Nil(t, err)
+
+	assert.Nil(t, d.Unlink(ctx, fuseops.RootInodeID, "linked"))
+	assert.Nil(t, d.EmptyTrash(ctx))
+
+	attrs, err := d.ListXattr(ctx, linked.ID)
+	assert.Nil(t, err)
+	assert.Empty(t, *attrs)
+}
+
+func TestUnlinkWithinTrash(t *testing.T) {
+	ctx := context.Background()
+	d := getTestDb(t, time.Hour)
+	dir := create(t, d, fuseops.RootInodeID, "dir", os.ModeDir|0755)
+	create(t, d, dir.ID, "file", 0644)
+
+	assert.Equal(t, syscall.ENOTEMPTY, d.Unlink(ctx, fuseops.RootInodeID, "dir"))
+	assert.Nil(t, d.Rename(ctx, fuseops.RootInodeID, "dir", trashDir(t, d), "dir", 0))
+
+	assert.Nil(t, d.Unlink(ctx, dir.ID, "file"))
+	_, err := d.LookUp(ctx, dir.ID, "file")
+	assert.Equal(t, syscall.ENOENT, err)
+
+	items, err := d.Trash(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, items, "entries unlinked within the trash should be removed")
+
+	assert.Nil(t, d.Unlink(ctx, trashDir(t, d), "dir"))
+	assert.Nil(t, d.Unlink(ctx, fuseops.RootInodeID, Dir))
+
+	_, err = d.LookUp(ctx, fuseops.RootInodeID, Dir)
+	assert.Equal(t, syscall.ENOENT, err)
+}
+
+func TestUnlinkImmutable(t *testing.T) {
+	ctx := context.Background()
+	d := getTestDb(t, time.Hour)
+	file := create(t, d, fuseops.RootInodeID, "file", 0644)
+
+	assert.Nil(t, d.SetImmutable(ctx, file.ID, 0, true, nil))
+	assert.Equal(t, syscall.EPERM, d.Unlink(ctx, fuseops.RootInodeID, "file"))
+
+	entry, err := d.LookUp(ctx, fuseops.RootInodeID, "file")
+	assert.Nil(t, err)
+	assert.Equal(t, file.ID, entry.ID)
+
+	items, err := d.Trash(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, items)
+
+	names, err := d.ListXattr(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Empty(t, *names, "the origin of the entry shouldn't be left behind")
+}
+
+func TestLongName(t *testing.T) {
+	ctx := context.Background()
+	d := getTestDb(t, time.Hour)
+	name := strings.Repeat("n", 255)
+	file := create(t, d, fuseops.RootInodeID, name, 0644)
+
+	assert.Nil(t, d.Unlink(ctx, fuseops.RootInodeID, name))
+
+	items, err := d.Trash(ctx)
+	assert.Nil(t, err)
+	if !assert.Len(t, items, 1) {
+		return
+	}
+
+	assert.Equal(t, name, items[0].OriginalName)
+	assert.Equal(t, fuseops.RootInodeID, items[0].Parent)
+	assert.Nil(t, d.RestoreFromTrash(ctx, items[0].Name))
+
+	entry, err := d.LookUp(ctx, fuseops.RootInodeID, name)
+	assert.Nil(t, err)
+	assert.Equal(t, file.ID, entry.ID)
+
+	attrs, err := d.ListXattr(ctx, file.ID)
+	assert.Nil(t, err)
+	assert.Empty(t, *attrs, "restored inodes shouldn't keep where they were unlinked from")
+}
+
+func TestParseItem(t *testing.T) {
+	deletedAt := time.Unix(0, 1234567890)
+
+	name, err := itemName(deletedAt)
+	assert.Nil(t, err)
+
+	item, ok := parseItem(name)
+	assert.True(t, ok)
+	assert.Equal(t, name, item.Name)
+	assert.True(t, deletedAt.Equal(item.DeletedAt))
+
+	for _, name := range []string{"file", "1-2", "1-0123456789abcdef0", "a-0123456789abcdef", "1-0123456789abcdeg"} {
+		_, ok = parseItem(name)
+		assert.False(t, ok, name)
+	}
+
+	parent, original, ok := parseOrigin(origin(42, "a/file-name"))
+	assert.True(t, ok)
+	assert.Equal(t, fuseops.InodeID(42), parent)
+	assert.Equal(t, "a/file-name", original)
+
+	for _, value := range []string{"", "42", "42/", "a/file"} {
+		_, _, ok = parseOrigin([]byte(value))
+		assert.False(t, ok, value)
+	}
+}
+
+// trashDir returns the trash directory, creating it if needed
+func trashDir(t *testing.T, d *Db) fuseops.InodeID {
+	id, err := d.dir(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
@@ -0,0 +1,95 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/manvalls/titan/storage"
+)
+
+// MissingObjects checks that the objects of the chunks read from the given
+// rows, made of an id, a storage, a key, an object offset, a size and an
+// ETag, are still stored, returning the ids of the chunks whose object is
+// missing or was overwritten. Objects shared by several chunks are checked
+// once. Rows are always closed.
+func MissingObjects(ctx context.Context, rows *sql.Rows, st storage.Storage) ([]uint64, error) {
+	defer rows.Close()
+
+	return missingObjects(ctx, func() (*Chunk, error) {
+		if !rows.Next() {
+			return nil, rows.Err()
+		}
+
+		chunk := Chunk{}
+		if err := rows.Scan(&chunk.ID, &chunk.Storage, &chunk.Key, &chunk.ObjectOffset, &chunk.Size, &chunk.ETag); err != nil {
+			return nil, err
+		}
+
+		return &chunk, nil
+	}, st)
+}
+
+// MissingObjectList checks the objects of the given chunks as MissingObjects
+// does, for drivers which already hold them in memory
+func MissingObjectList(ctx context.Context, chunks []Chunk, st storage.Storage) ([]uint64, error) {
+	i := 0
+
+	return missingObjects(ctx, func() (*Chunk, error) {
+		if i == len(chunks) {
+			return nil, nil
+		}
+
+		i++
+		return &chunks[i-1], nil
+	}, st)
+}
+
+// missingObjects checks the objects of the chunks returned by next, which
+// returns nil once there are no more of them. Chunks without a key are
+// holes, which have no object. Objects are considered overwritten when both
+// the chunk and the storage know their ETag and it differs.
+func missingObjects(ctx context.Context, next func() (*Chunk, error), st storage.Storage) ([]uint64, error) {
+	missing := make([]uint64, 0)
+	checked := make(map[storage.Chunk]*object)
+
+	for {
+		chunk, err := next()
+		if err != nil {
+			return nil, err
+		}
+
+		if chunk == nil {
+			return missing, nil
+		}
+
+		if chunk.IsHole() {
+			continue
+		}
+
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		key := storage.Chunk{Storage: chunk.Storage, Key: chunk.Key}
+		o, ok := checked[key]
+
+		if !ok {
+			o = &object{}
+			if o.etag, o.exists, err = storage.ETag(st, chunk.Chunk); err != nil {
+				return nil, err
+			}
+
+			checked[key] = o
+		}
+
+		if !o.exists || (chunk.ETag != "" && o.etag != "" && chunk.ETag != o.etag) {
+			missing = append(missing, chunk.ID)
+		}
+	}
+}
+
+// object is the state of a stored object as seen by missingObjects
+type object struct {
+	etag   string
+	exists bool
+}
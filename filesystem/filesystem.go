@@ -18,10 +18,8 @@ import (
 )
 
 const (
-	totalBlocks = 281474976710656
-	totalInodes = 281474976710656
-	blockSize   = 4096
-	ioSize      = 65536
+	blockSize = 4096
+	ioSize    = 65536
 )
 
 // FileSystem implements the fuse filesystem interface
@@ -128,18 +126,23 @@ func (fs *FileSystem) createWriter(handle fuseops.HandleID, inode fuseops.InodeI
 
 // StatFS provides some information about the FS usage
 func (fs *FileSystem) StatFS(ctx context.Context, op *fuseops.StatFSOp) error {
-	stats, err := fs.Stats(ctx)
+	stats, err := fs.FsStats(ctx)
 	if err != nil {
 		return err
 	}
 
 	op.BlockSize = blockSize
 	op.IoSize = ioSize
-	op.Blocks = totalBlocks
-	op.Inodes = totalInodes
+	if stats.BlockSize > 0 {
+		op.BlockSize = uint32(stats.BlockSize)
+		op.IoSize = uint32(stats.BlockSize)
+	}
+
+	op.Blocks = stats.TotalSize / uint64(op.BlockSize)
+	op.Inodes = stats.TotalInodes
 
-	op.InodesFree = totalInodes - stats.Inodes
-	op.BlocksFree = totalBlocks - (stats.Size / blockSize)
+	op.InodesFree = stats.FreeInodes
+	op.BlocksFree = stats.FreeSize / uint64(op.BlockSize)
 	op.BlocksAvailable = op.BlocksFree
 	return nil
 }
@@ -270,14 +273,7 @@ func (fs *FileSystem) CreateFile(ctx context.Context, op *fuseops.CreateFileOp)
 
 // CreateLink creates a new hard link
 func (fs *FileSystem) CreateLink(ctx context.Context, op *fuseops.CreateLinkOp) error {
-	entry, err := fs.Create(ctx, database.Entry{
-		Parent: op.Parent,
-		Name:   op.Name,
-		Inode: database.Inode{
-			ID: op.Target,
-		},
-	})
-
+	entry, err := fs.Link(ctx, op.Target, op.Parent, op.Name)
 	if err != nil {
 		return err
 	}
@@ -311,9 +307,10 @@ func (fs *FileSystem) CreateSymlink(ctx context.Context, op *fuseops.CreateSymli
 	return nil
 }
 
-// Rename renames an entry
+// Rename renames an entry, RenameOp carries no renameat2 flags so the
+// destination is always replaced
 func (fs *FileSystem) Rename(ctx context.Context, op *fuseops.RenameOp) error {
-	return fs.Db.Rename(ctx, op.OldParent, op.OldName, op.NewParent, op.NewName)
+	return fs.Db.Rename(ctx, op.OldParent, op.OldName, op.NewParent, op.NewName, 0)
 }
 
 // RmDir removes a directory from the filesystem
@@ -441,14 +438,36 @@ func (fs *FileSystem) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) er
 	return err
 }
 
-// SyncFile flushes a writer
+// SyncFile makes sure that everything written to the inode is stored
 func (fs *FileSystem) SyncFile(ctx context.Context, op *fuseops.SyncFileOp) error {
-	w := fs.writer(op.Handle)
-	err := w.Flush()
+	err := fs.Sync(ctx, op.Inode)
 	fs.Validate(op.Inode)
 	return err
 }
 
+// Sync waits until every write to the given inode, through any of its open
+// handles, has been stored and its chunks committed
+func (fs *FileSystem) Sync(ctx context.Context, inode fuseops.InodeID) error {
+	fs.writerMutex.Lock()
+	writers := make([]*writer.Writer, 0)
+	for _, w := range fs.writers {
+		if w.InodeID == inode {
+			writers = append(writers, w)
+		}
+	}
+
+	fs.writerMutex.Unlock()
+
+	var result error
+	for _, w := range writers {
+		if err := w.Sync(); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	return result
+}
+
 // FlushFile flushes a writer
 func (fs *FileSystem) FlushFile(ctx context.Context, op *fuseops.FlushFileOp) error {
 	w := fs.writer(op.Handle)
@@ -473,12 +492,12 @@ func (fs *FileSystem) ReleaseFileHandle(ctx context.Context, op *fuseops.Release
 
 // ReadSymlink reads a symbolic link
 func (fs *FileSystem) ReadSymlink(ctx context.Context, op *fuseops.ReadSymlinkOp) error {
-	inode, err := fs.Get(ctx, op.Inode)
+	target, err := fs.ReadLink(ctx, op.Inode)
 	if err != nil {
 		return err
 	}
 
-	op.Target = inode.SymLink
+	op.Target = target
 	return nil
 }
 
@@ -493,6 +512,16 @@ func (fs *FileSystem) GetXattr(ctx context.Context, op *fuseops.GetXattrOp) erro
 		return syscall.ENODATA
 	}
 
+	if len(op.Dst) == 0 {
+		size, err := fs.Db.GetXattrSize(ctx, op.Inode, op.Name)
+		if err != nil {
+			return err
+		}
+
+		op.BytesRead = int(size)
+		return nil
+	}
+
 	value, err := fs.Db.GetXattr(ctx, op.Inode, op.Name)
 	if err != nil {
 		return err
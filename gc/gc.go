@@ -0,0 +1,157 @@
+// Package gc removes the data no longer referenced by the file system.
+//
+// The objects of the chunks orphaned before the grace period are removed from
+// the storage. The grace period protects the objects of chunks orphaned by
+// operations still in flight, e.g a chunk being deduplicated against an
+// object whose last chunk was just orphaned.
+//
+// Inodes left without links can be removed first as well, orphaning their
+// chunks, but only while the file system isn't mounted anywhere: unlinked
+// files still open have no links either until the kernel forgets them. Hence
+// background collections never remove inodes.
+//
+// The entries expiring on their own, e.g the ones of the trash, are removed
+// by every collection when the database implements database.Expirer.
+package gc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/manvalls/titan/database"
+	"github.com/manvalls/titan/storage"
+)
+
+var errNotInited = errors.New("This garbage collector has not been initialized")
+var errAlreadyInited = errors.New("This garbage collector has already been initialized")
+
+// Config controls what a garbage collection removes and how
+type Config struct {
+	// GracePeriod is the time orphaned chunks are kept for
+	GracePeriod time.Duration
+
+	// Workers is the amount of parallel workers removing objects
+	Workers int
+
+	// Inodes tells whether the inodes without links are removed first, which
+	// is only safe while the file system isn't mounted anywhere
+	Inodes bool
+}
+
+// Collector collects garbage, optionally on a regular basis
+type Collector struct {
+	database.Db
+	storage.Storage
+	Config
+
+	// Interval is the time between background collections
+	Interval time.Duration
+
+	// OnError, if set, is called with the errors of background collections
+	OnError func(error)
+
+	stopChannel chan bool
+	inited      bool
+	mutex       sync.Mutex
+}
+
+// NewCollector returns a new garbage collector
+func NewCollector() *Collector {
+	return &Collector{
+		Config: Config{
+			GracePeriod: 1 * time.Hour,
+			Workers:     10,
+		},
+		Interval:    1 * time.Hour,
+		stopChannel: make(chan bool),
+		inited:      false,
+		mutex:       sync.Mutex{},
+	}
+}
+
+// GarbageCollect removes the expired entries of the database, then the
+// objects of the chunks orphaned before the grace period of the given
+// configuration, after removing the inodes without links if it says so
+func (c *Collector) GarbageCollect(ctx context.Context, cfg Config) error {
+	threshold := time.Now().Add(-cfg.GracePeriod)
+
+	if err := database.PurgeExpired(ctx, c.Db); err != nil {
+		return err
+	}
+
+	if cfg.Inodes {
+		if err := c.CleanOrphanInodes(ctx); err != nil {
+			return err
+		}
+	}
+
+	return c.CleanOrphanChunks(ctx, threshold, c.Storage, cfg.Workers)
+}
+
+// CountGarbage reports what GarbageCollect would remove given the same
+// configuration, without removing anything. The chunks orphaned by removing
+// inodes are counted apart from the ones whose objects would be removed.
+func (c *Collector) CountGarbage(ctx context.Context, cfg Config) (*database.OrphanReport, error) {
+	report, err := c.CountOrphans(ctx, time.Now().Add(-cfg.GracePeriod))
+	if err != nil || cfg.Inodes {
+		return report, err
+	}
+
+	return &database.OrphanReport{Chunks: report.Chunks, Objects: report.Objects}, nil
+}
+
+// background returns the configuration of background collections, which
+// never remove inodes as the file system is mounted meanwhile
+func (c *Collector) background() Config {
+	cfg := c.Config
+	cfg.Inodes = false
+	return cfg
+}
+
+// Init starts collecting garbage every Interval in the background, leaving
+// the inodes without links alone
+func (c *Collector) Init() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.inited {
+		return errAlreadyInited
+	}
+
+	go func() {
+
+		for {
+			select {
+			case <-c.stopChannel:
+				return
+			case <-time.After(c.Interval):
+				if err := c.GarbageCollect(context.Background(), c.background()); err != nil && c.OnError != nil {
+					c.OnError(err)
+				}
+			}
+		}
+
+	}()
+
+	c.inited = true
+	return nil
+}
+
+// Destroy stops collecting garbage in the background, waiting for the
+// collection in progress, if any
+func (c *Collector) Destroy() error {
+	c.mutex.Lock()
+
+	if !c.inited {
+		c.mutex.Unlock()
+		return errNotInited
+	}
+
+	c.inited = false
+	c.mutex.Unlock()
+
+	c.stopChannel <- true
+	return nil
+}
@@ -0,0 +1,224 @@
+package gc
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database"
+	"github.com/manvalls/titan/database/dbtest"
+	"github.com/manvalls/titan/database/sqlite"
+	"github.com/manvalls/titan/database/trash"
+	"github.com/manvalls/titan/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+type testStorage struct {
+	mutex   sync.Mutex
+	removed map[string]bool
+}
+
+func (t *testStorage) Setup() error {
+	return nil
+}
+
+func (t *testStorage) GetChunk(reader io.Reader) (*storage.Chunk, error) {
+	return nil, syscall.ENOSYS
+}
+
+func (t *testStorage) GetReadCloser(chunk storage.Chunk) (io.ReadCloser, error) {
+	return nil, syscall.ENOSYS
+}
+
+func (t *testStorage) Remove(chunk storage.Chunk) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.removed[chunk.Key] = true
+	return nil
+}
+
+func (t *testStorage) isRemoved(key string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.removed[key]
+}
+
+func getTestCollector(t testing.TB) (*Collector, *sqlite.Driver, *testStorage, func()) {
+	dir, err := ioutil.TempDir("", "titan")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &sqlite.Driver{DbURI: filepath.Join(dir, "titan.db"), BusyRetries: 10, ForeignKeys: true}
+	if err := d.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Setup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	st := &testStorage{removed: make(map[string]bool)}
+
+	c := NewCollector()
+	c.Db = d
+	c.Storage = st
+
+	return c, d, st, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// orphan creates a file made of a single chunk, and removes it
+func orphan(t *testing.T, db database.Db, key string) {
+	ctx := context.Background()
+	file := dbtest.Mkfile(t, db, fuseops.RootInodeID)
+	dbtest.AddChunk(t, db, file.ID, 0, key, 0, 10)
+
+	if err := db.Unlink(ctx, fuseops.RootInodeID, file.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Forget(ctx, file.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGracePeriod(t *testing.T) {
+	c, d, st, cleanup := getTestCollector(t)
+	defer cleanup()
+
+	orphan(t, d, "old")
+	orphan(t, d, "recent")
+
+	if _, err := d.DB.Exec("UPDATE chunks SET orphandate = datetime('now', '-2 hours') WHERE `key` = 'old'"); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, c.GarbageCollect(context.Background(), Config{GracePeriod: time.Hour, Workers: 2}))
+	assert.True(t, st.isRemoved("old"), "chunks orphaned before the grace period should be collected")
+	assert.False(t, st.isRemoved("recent"), "chunks orphaned within the grace period should be kept")
+
+	assert.Nil(t, c.GarbageCollect(context.Background(), Config{GracePeriod: -time.Hour, Workers: 2}))
+	assert.True(t, st.isRemoved("recent"))
+}
+
+func TestCountGarbage(t *testing.T) {
+	c, d, st, cleanup := getTestCollector(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	cfg := Config{GracePeriod: time.Hour, Workers: 2}
+
+	orphan(t, d, "old")
+	orphan(t, d, "recent")
+
+	if _, err := d.DB.Exec("UPDATE chunks SET orphandate = datetime('now', '-2 hours') WHERE `key` = 'old'"); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := c.CountGarbage(ctx, cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), report.Chunks)
+	assert.Equal(t, uint64(1), report.Objects)
+	assert.False(t, st.isRemoved("old"), "nothing should be removed")
+
+	assert.Nil(t, c.GarbageCollect(ctx, cfg))
+	assert.True(t, st.isRemoved("old"))
+
+	report, err = c.CountGarbage(ctx, cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), report.Chunks)
+}
+
+func TestOpenInodes(t *testing.T) {
+	c, d, st, cleanup := getTestCollector(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	cfg := Config{GracePeriod: -time.Hour, Workers: 2}
+
+	// Unlinked files still open are only removed by Forget
+	file := dbtest.Mkfile(t, d, fuseops.RootInodeID)
+	dbtest.AddChunk(t, d, file.ID, 0, "open", 0, 10)
+	assert.Nil(t, d.Unlink(ctx, fuseops.RootInodeID, file.Name))
+
+	assert.Nil(t, c.GarbageCollect(ctx, cfg))
+	_, err := d.Get(ctx, file.ID)
+	assert.Nil(t, err, "inodes without links should be kept unless told otherwise")
+	assert.False(t, st.isRemoved("open"))
+
+	report, err := c.CountGarbage(ctx, cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), report.Inodes)
+
+	cfg.Inodes = true
+	report, err = c.CountGarbage(ctx, cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), report.Inodes)
+
+	assert.Nil(t, c.GarbageCollect(ctx, cfg))
+	_, err = d.Get(ctx, file.ID)
+	assert.Equal(t, syscall.ENOENT, err)
+	assert.True(t, st.isRemoved("open"))
+}
+
+func TestTrash(t *testing.T) {
+	c, d, _, cleanup := getTestCollector(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	db := trash.WithTrash(d, time.Hour)
+	c.Db = db
+
+	file := dbtest.Mkfile(t, db, fuseops.RootInodeID)
+	assert.Nil(t, db.Unlink(ctx, fuseops.RootInodeID, file.Name))
+
+	assert.Nil(t, c.GarbageCollect(ctx, c.background()))
+	items, err := db.Trash(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1, "entries should be kept in the trash until the retention passes")
+
+	db.Retention = 0
+	assert.Nil(t, c.GarbageCollect(ctx, c.background()))
+	items, err = db.Trash(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, items, "background collections should remove the expired entries of the trash")
+}
+
+func TestBackground(t *testing.T) {
+	c, d, st, cleanup := getTestCollector(t)
+	defer cleanup()
+
+	errs := make(chan error, 10)
+	c.Interval = 10 * time.Millisecond
+	c.GracePeriod = -time.Hour
+	c.OnError = func(err error) { errs <- err }
+
+	c.Inodes = true
+	assert.Nil(t, c.Init())
+	assert.Equal(t, errAlreadyInited, c.Init())
+
+	open := dbtest.Mkfile(t, d, fuseops.RootInodeID)
+	assert.Nil(t, d.Unlink(context.Background(), fuseops.RootInodeID, open.Name))
+
+	orphan(t, d, "chunk")
+	time.Sleep(200 * time.Millisecond)
+
+	_, err := d.Get(context.Background(), open.ID)
+	assert.Nil(t, err, "background collections should never remove inodes")
+
+	assert.Nil(t, c.Destroy())
+	assert.Equal(t, errNotInited, c.Destroy())
+
+	assert.True(t, st.isRemoved("chunk"))
+	assert.Len(t, errs, 0)
+}
@@ -0,0 +1,143 @@
+package gc
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/manvalls/titan/database"
+)
+
+var errAlreadyStarted = errors.New("This reaper has already been started")
+
+// ReaperLock is the name of the lock held by reapers while collecting
+// garbage, so that a single client of a shared database does it at once
+const ReaperLock = "titan-reaper"
+
+// Status is the outcome of a collection run by a reaper
+type Status struct {
+	Start    time.Time
+	Duration time.Duration
+
+	// Skipped tells whether another client held ReaperLock, so that nothing
+	// was collected
+	Skipped bool
+
+	Err error
+}
+
+// Reaper collects garbage in the background every Interval of its collector,
+// plus a random delay of up to Jitter so that the clients of a shared
+// database don't all try at once. Collections are skipped while another
+// client holds ReaperLock, if the database implements database.Locker. Like
+// any background collection, they never remove inodes, which may still be
+// open on any client sharing the database.
+type Reaper struct {
+	*Collector
+	Jitter time.Duration
+
+	mutex  sync.Mutex
+	status *Status
+	done   chan struct{}
+}
+
+// NewReaper returns a reaper running the given collector, its jitter being a
+// tenth of the collector interval
+func NewReaper(c *Collector) *Reaper {
+	return &Reaper{
+		Collector: c,
+		Jitter:    c.Interval / 10,
+	}
+}
+
+// Start collects garbage in the background until the given context is done
+func (r *Reaper) Start(ctx context.Context) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.done != nil {
+		return errAlreadyStarted
+	}
+
+	done := make(chan struct{})
+	r.done = done
+
+	go func() {
+		defer close(done)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(r.delay()):
+				r.Reap(ctx)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Wait blocks until the reaper stops once the context it was started with is
+// done, waiting for the collection in progress, if any
+func (r *Reaper) Wait() {
+	r.mutex.Lock()
+	done := r.done
+	r.mutex.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+// Reap collects garbage unless another client holds ReaperLock, recording
+// the outcome as the last status
+func (r *Reaper) Reap(ctx context.Context) Status {
+	status := Status{Start: time.Now()}
+
+	release, err := database.TryLock(ctx, r.Db, ReaperLock)
+	if err == nil && release == nil {
+		status.Skipped = true
+	} else if err == nil {
+		err = r.GarbageCollect(ctx, r.background())
+		release()
+	}
+
+	status.Duration = time.Since(status.Start)
+	status.Err = err
+
+	r.mutex.Lock()
+	r.status = &status
+	r.mutex.Unlock()
+
+	if err != nil && r.OnError != nil {
+		r.OnError(err)
+	}
+
+	return status
+}
+
+// LastStatus returns the outcome of the last collection, or nil if none ran
+// yet
+func (r *Reaper) LastStatus() *Status {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.status == nil {
+		return nil
+	}
+
+	status := *r.status
+	return &status
+}
+
+// delay returns the time to wait before the next collection
+func (r *Reaper) delay() time.Duration {
+	if r.Jitter <= 0 {
+		return r.Interval
+	}
+
+	return r.Interval + time.Duration(rand.Int63n(int64(r.Jitter)))
+}
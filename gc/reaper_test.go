@@ -0,0 +1,148 @@
+package gc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database"
+	"github.com/manvalls/titan/database/dbtest"
+	"github.com/stretchr/testify/assert"
+)
+
+// sharedLocks holds the named locks of several clients of a database
+type sharedLocks struct {
+	mutex sync.Mutex
+	held  map[string]bool
+}
+
+func (s *sharedLocks) TryLock(ctx context.Context, name string) (func(), error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.held[name] {
+		return nil, nil
+	}
+
+	s.held[name] = true
+	return func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		delete(s.held, name)
+	}, nil
+}
+
+type lockingDb struct {
+	database.Db
+	*sharedLocks
+}
+
+func TestReaperLock(t *testing.T) {
+	c, d, st, cleanup := getTestCollector(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	locks := &sharedLocks{held: make(map[string]bool)}
+	c.Db = lockingDb{Db: d, sharedLocks: locks}
+	c.GracePeriod = -time.Hour
+
+	r := NewReaper(c)
+	assert.Nil(t, r.LastStatus())
+
+	orphan(t, d, "chunk")
+
+	release, err := locks.TryLock(ctx, ReaperLock)
+	assert.Nil(t, err)
+
+	status := r.Reap(ctx)
+	assert.True(t, status.Skipped)
+	assert.Nil(t, status.Err)
+	assert.False(t, st.isRemoved("chunk"), "nothing should be collected while another client holds the lock")
+	assert.Equal(t, status, *r.LastStatus())
+
+	release()
+
+	status = r.Reap(ctx)
+	assert.False(t, status.Skipped)
+	assert.Nil(t, status.Err)
+	assert.True(t, st.isRemoved("chunk"))
+	assert.False(t, locks.held[ReaperLock], "the lock should be released")
+
+	status = r.Reap(ctx)
+	assert.False(t, status.Skipped)
+}
+
+func TestReaperOpenInodes(t *testing.T) {
+	c, d, _, cleanup := getTestCollector(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	c.GracePeriod = -time.Hour
+	c.Inodes = true
+
+	open := dbtest.Mkfile(t, d, fuseops.RootInodeID)
+	assert.Nil(t, d.Unlink(ctx, fuseops.RootInodeID, open.Name))
+
+	status := NewReaper(c).Reap(ctx)
+	assert.Nil(t, status.Err)
+
+	_, err := d.Get(ctx, open.ID)
+	assert.Nil(t, err, "reapers should never remove inodes, which may be open elsewhere")
+}
+
+func TestReaperError(t *testing.T) {
+	c, _, _, cleanup := getTestCollector(t)
+	defer cleanup()
+
+	errs := make(chan error, 1)
+	c.OnError = func(err error) { errs <- err }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r := NewReaper(c)
+	status := r.Reap(ctx)
+	assert.True(t, errors.Is(status.Err, context.Canceled))
+	assert.Equal(t, status.Err, <-errs)
+	assert.Equal(t, status.Err, r.LastStatus().Err)
+}
+
+func TestReaperStop(t *testing.T) {
+	c, d, st, cleanup := getTestCollector(t)
+	defer cleanup()
+
+	c.Interval = 10 * time.Millisecond
+	c.GracePeriod = -time.Hour
+
+	r := NewReaper(c)
+	assert.Equal(t, time.Millisecond, r.Jitter)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.Nil(t, r.Start(ctx))
+	assert.Equal(t, errAlreadyStarted, r.Start(ctx))
+
+	orphan(t, d, "chunk")
+	time.Sleep(200 * time.Millisecond)
+
+	cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		r.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the reaper should stop once its context is done")
+	}
+
+	assert.True(t, st.isRemoved("chunk"))
+	if assert.NotNil(t, r.LastStatus()) {
+		assert.False(t, r.LastStatus().Skipped)
+	}
+}
@@ -0,0 +1,167 @@
+package reader
+
+import (
+	"context"
+	"io"
+	"sync"
+	"syscall"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database"
+	"github.com/manvalls/titan/math"
+	"github.com/manvalls/titan/storage"
+)
+
+// Zero is the name of the storage producing the zeros of holes
+const Zero = database.ZeroStorage
+
+// Reader reads the contents of inodes straight from the storage, assembling
+// them from their chunks
+type Reader struct {
+	database.Db
+	storage.Storage
+
+	mutex sync.Mutex
+	last  *verified
+}
+
+// verified is a chunk whose data was checked against its checksum
+type verified struct {
+	chunk    storage.Chunk
+	checksum string
+	data     []byte
+}
+
+// ReadAt reads into p the contents of the inode starting at the given
+// offset, returning io.EOF along with the read bytes when reaching the end
+// of the inode before filling p. Ranges not covered by any chunk are read
+// as zeros from the zero storage. Chunks having a checksum are read whole
+// and checked against it, failing with EIO if their object was corrupted.
+// The last chunk checked is kept in memory, so that reading it piecemeal
+// downloads it once, at the cost of holding up to a whole chunk.
+func (r *Reader) ReadAt(ctx context.Context, inode fuseops.InodeID, p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+
+	i, err := r.Get(ctx, inode)
+	if err != nil {
+		return 0, err
+	}
+
+	if i.Mode.IsDir() {
+		return 0, syscall.EISDIR
+	}
+
+	offset := uint64(off)
+	if offset >= i.Size {
+		return 0, io.EOF
+	}
+
+	end := math.Min(i.Size, offset+uint64(len(p)))
+
+	chunks, err := r.ChunksInRange(ctx, inode, offset, end-offset)
+	if err != nil {
+		return 0, err
+	}
+
+	position := offset
+	for _, c := range *chunks {
+		if c.InodeOffset > position {
+			if err = r.read(p[position-offset:], storage.Chunk{Storage: Zero, Size: math.Min(c.InodeOffset, end) - position}); err != nil {
+				return int(position - offset), err
+			}
+
+			position = math.Min(c.InodeOffset, end)
+		}
+
+		chunkEnd := math.Min(c.InodeOffset+c.Size, end)
+		if chunkEnd <= position {
+			continue
+		}
+
+		if c.Checksum != "" {
+			err = r.readVerified(p[position-offset:], c, position-c.InodeOffset, chunkEnd-position)
+		} else {
+			err = r.read(p[position-offset:], storage.Chunk{
+				Storage:      c.Storage,
+				Key:          c.Key,
+				ObjectOffset: c.ObjectOffset + position - c.InodeOffset,
+				Size:         chunkEnd - position,
+			})
+		}
+
+		if err != nil {
+			return int(position - offset), err
+		}
+
+		position = chunkEnd
+	}
+
+	if position < end {
+		if err = r.read(p[position-offset:], storage.Chunk{Storage: Zero, Size: end - position}); err != nil {
+			return int(position - offset), err
+		}
+	}
+
+	if end-offset < uint64(len(p)) {
+		return int(end - offset), io.EOF
+	}
+
+	return len(p), nil
+}
+
+// read fills the beginning of p with the contents of the given chunk
+func (r *Reader) read(p []byte, chunk storage.Chunk) error {
+	rc, err := r.GetReadCloser(chunk)
+	if err != nil {
+		return err
+	}
+
+	defer rc.Close()
+
+	if _, err = io.ReadFull(rc, p[:chunk.Size]); err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// readVerified fills the beginning of p with size bytes of the given chunk
+// starting at from, reading the whole chunk to check it against its checksum
+func (r *Reader) readVerified(p []byte, c database.Chunk, from uint64, size uint64) error {
+	data, err := r.verify(c)
+	if err != nil {
+		return err
+	}
+
+	copy(p[:size], data[from:from+size])
+	return nil
+}
+
+// verify returns the data of the given chunk checked against its checksum,
+// reusing the last one checked if it's the same
+func (r *Reader) verify(c database.Chunk) ([]byte, error) {
+	r.mutex.Lock()
+	last := r.last
+	r.mutex.Unlock()
+
+	if last != nil && last.chunk == c.Chunk && last.checksum == c.Checksum {
+		return last.data, nil
+	}
+
+	data := make([]byte, c.Size)
+	if err := r.read(data, c.Chunk); err != nil {
+		return nil, err
+	}
+
+	if database.Checksum(data) != c.Checksum {
+		return nil, syscall.EIO
+	}
+
+	r.mutex.Lock()
+	r.last = &verified{chunk: c.Chunk, checksum: c.Checksum, data: data}
+	r.mutex.Unlock()
+
+	return data, nil
+}
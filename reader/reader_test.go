@@ -0,0 +1,262 @@
+package reader
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database"
+	"github.com/manvalls/titan/database/dbtest"
+	"github.com/manvalls/titan/database/sqlite"
+	"github.com/manvalls/titan/storage"
+	"github.com/manvalls/titan/storage/file"
+	"github.com/manvalls/titan/storage/multi"
+	"github.com/manvalls/titan/storage/zero"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestReader(t *testing.T) (*Reader, func()) {
+	dir, err := ioutil.TempDir("", "titan")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &sqlite.Driver{DbURI: filepath.Join(dir, "titan.db"), BusyRetries: 10, ForeignKeys: true}
+	if err := d.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Setup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	st := &multi.Multi{
+		Storages: map[string]storage.Storage{
+			"file": &file.File{Storage: "file", Root: filepath.Join(dir, "chunks")},
+			Zero:   &zero.Zero{Storage: Zero},
+		},
+		Default: "file",
+	}
+
+	return &Reader{Db: d, Storage: st}, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// write stores the given data and adds it to the inode at the given offset
+func write(t *testing.T, r *Reader, inode fuseops.InodeID, offset uint64, data string) {
+	chunk, err := r.GetChunk(bytes.NewBufferString(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.AddChunk(context.Background(), inode, 0, database.Chunk{
+		Inode:       inode,
+		InodeOffset: offset,
+		Chunk:       *chunk,
+		Checksum:    database.Checksum([]byte(data)),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func read(r *Reader, inode fuseops.InodeID, offset int64, size int) (string, error) {
+	p := make([]byte, size)
+	n, err := r.ReadAt(context.Background(), inode, p, offset)
+	return string(p[:n]), err
+}
+
+func TestSeveralChunks(t *testing.T) {
+	r, cleanup := getTestReader(t)
+	defer cleanup()
+
+	inode := dbtest.Mkfile(t, r.Db, fuseops.RootInodeID).ID
+	write(t, r, inode, 0, "0123456789")
+	write(t, r, inode, 10, "abcdefghij")
+	write(t, r, inode, 4, "ABCD")
+
+	data, err := read(r, inode, 0, 20)
+	assert.Nil(t, err)
+	assert.Equal(t, "0123ABCD89abcdefghij", data)
+
+	data, err = read(r, inode, 6, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, "CD89abcd", data)
+}
+
+func TestHole(t *testing.T) {
+	r, cleanup := getTestReader(t)
+	defer cleanup()
+
+	inode := dbtest.Mkfile(t, r.Db, fuseops.RootInodeID).ID
+	write(t, r, inode, 0, "01234")
+	write(t, r, inode, 10, "56789")
+
+	data, err := read(r, inode, 3, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, "34\x00\x00\x00\x00\x00567", data)
+
+	// Ranges without chunks are filled with zeros as well
+	r.Db = withoutZeroChunks{r.Db}
+
+	data, err = read(r, inode, 3, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, "34\x00\x00\x00\x00\x00567", data)
+
+	data, err = read(r, inode, 6, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "\x00\x00", data)
+}
+
+func TestEOF(t *testing.T) {
+	r, cleanup := getTestReader(t)
+	defer cleanup()
+
+	inode := dbtest.Mkfile(t, r.Db, fuseops.RootInodeID).ID
+	write(t, r, inode, 0, "0123456789")
+
+	data, err := read(r, inode, 7, 10)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "789", data)
+
+	data, err = read(r, inode, 10, 10)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "", data)
+
+	data, err = read(r, inode, 0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, "0123456789", data)
+
+	_, err = read(r, inode, -1, 10)
+	assert.Equal(t, syscall.EINVAL, err)
+
+	_, err = read(r, fuseops.RootInodeID, 0, 10)
+	assert.Equal(t, syscall.EISDIR, err)
+}
+
+func TestChecksum(t *testing.T) {
+	r, cleanup := getTestReader(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	inode := dbtest.Mkfile(t, r.Db, fuseops.RootInodeID).ID
+	write(t, r, inode, 0, "0123456789")
+	write(t, r, inode, 10, "abcdefghij")
+
+	chunks, err := r.Chunks(ctx, inode)
+	assert.Nil(t, err)
+	if !assert.Len(t, *chunks, 2) {
+		return
+	}
+
+	assert.Equal(t, database.Checksum([]byte("0123456789")), (*chunks)[0].Checksum)
+	r.Storage = corrupting{Storage: r.Storage, key: (*chunks)[1].Key}
+
+	data, err := read(r, inode, 2, 6)
+	assert.Nil(t, err)
+	assert.Equal(t, "234567", data)
+
+	data, err = read(r, inode, 8, 4)
+	assert.Equal(t, syscall.EIO, err, "corrupted objects should fail their checksum")
+	assert.Equal(t, "89", data)
+
+	_, err = read(r, inode, 15, 2)
+	assert.Equal(t, syscall.EIO, err)
+
+	// Chunks without a checksum are read as they are
+	c := (*chunks)[1]
+	c.Checksum = ""
+	assert.Nil(t, r.AddChunk(ctx, inode, 0, c))
+
+	data, err = read(r, inode, 10, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, "\x9ebc", data)
+}
+
+func TestChecksumOnce(t *testing.T) {
+	r, cleanup := getTestReader(t)
+	defer cleanup()
+
+	inode := dbtest.Mkfile(t, r.Db, fuseops.RootInodeID).ID
+	write(t, r, inode, 0, "0123456789")
+	write(t, r, inode, 10, "abcdefghij")
+
+	st := &counting{Storage: r.Storage}
+	r.Storage = st
+
+	for i := int64(0); i < 20; i += 2 {
+		data, err := read(r, inode, i, 2)
+		assert.Nil(t, err)
+		assert.Len(t, data, 2)
+	}
+
+	assert.Equal(t, 2, st.reads, "chunks read piecemeal should be downloaded once")
+}
+
+// counting counts the objects read
+type counting struct {
+	storage.Storage
+	reads int
+}
+
+func (c *counting) GetReadCloser(chunk storage.Chunk) (io.ReadCloser, error) {
+	c.reads++
+	return c.Storage.GetReadCloser(chunk)
+}
+
+// corrupting flips the first byte of the given object when reading it
+type corrupting struct {
+	storage.Storage
+	key string
+}
+
+func (c corrupting) GetReadCloser(chunk storage.Chunk) (io.ReadCloser, error) {
+	rc, err := c.Storage.GetReadCloser(chunk)
+	if err != nil || chunk.Key != c.key {
+		return rc, err
+	}
+
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	if chunk.ObjectOffset == 0 && len(data) > 0 {
+		data[0] ^= 0xff
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// withoutZeroChunks hides the zero chunks of inodes, leaving gaps between
+// their remaining chunks
+type withoutZeroChunks struct {
+	database.Db
+}
+
+func (w withoutZeroChunks) ChunksInRange(ctx context.Context, inode fuseops.InodeID, offset uint64, length uint64) (*[]database.Chunk, error) {
+	chunks, err := w.Db.ChunksInRange(ctx, inode, offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]database.Chunk, 0, len(*chunks))
+	for _, c := range *chunks {
+		if c.Storage != Zero {
+			result = append(result, c)
+		}
+	}
+
+	return &result, nil
+}
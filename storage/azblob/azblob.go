@@ -0,0 +1,184 @@
+package azblob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/manvalls/titan/storage"
+	"github.com/manvalls/titan/storage/retry"
+)
+
+// AzBlob is an Azure Blob Storage implementation of the storage interface
+type AzBlob struct {
+	Storage   string
+	Client    *azblob.Client
+	Container string
+
+	// Prefix is prepended to every blob name, so that several file systems
+	// can share the same container
+	Prefix string
+
+	// Context is used for every blob operation, cancelling it aborts
+	// in-flight requests
+	Context context.Context
+}
+
+// ServiceURL returns the blob service URL of the given account
+func ServiceURL(account string) string {
+	return "https://" + account + ".blob.core.windows.net/"
+}
+
+// NewSharedKeyClient returns a client authenticated with an account name and key
+func NewSharedKeyClient(serviceURL, account, key string) (*azblob.Client, error) {
+	credential, err := azblob.NewSharedKeyCredential(account, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return azblob.NewClientWithSharedKeyCredential(serviceURL, credential, nil)
+}
+
+// NewDefaultCredentialClient returns a client authenticated through Azure AD,
+// using the credentials found in the environment, managed identities or the
+// Azure CLI
+func NewDefaultCredentialClient(serviceURL string) (*azblob.Client, error) {
+	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return azblob.NewClient(serviceURL, credential, nil)
+}
+
+// Retryable tells whether an Azure error is transient
+func Retryable(err error) bool {
+	var rerr *azcore.ResponseError
+	if errors.As(err, &rerr) {
+		return retry.RetryableStatus(rerr.StatusCode)
+	}
+
+	return retry.Retryable(err)
+}
+
+func (a *AzBlob) ctx() context.Context {
+	if a.Context == nil {
+		return context.Background()
+	}
+
+	return a.Context
+}
+
+func (a *AzBlob) blob(key string) string {
+	return a.Prefix + key
+}
+
+// Setup sets up the storage
+func (a *AzBlob) Setup() error {
+	_, err := a.Client.CreateContainer(a.ctx(), a.Container, nil)
+	if bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+		return nil
+	}
+
+	return err
+}
+
+// GetChunk stores the contents of a reader and returns the built chunk
+func (a *AzBlob) GetChunk(reader io.Reader) (*storage.Chunk, error) {
+	r := &storage.ReaderWithSize{Reader: reader}
+
+	filename, err := storage.Key()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := a.Client.UploadStream(a.ctx(), a.Container, a.blob(filename), r, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	chunk := &storage.Chunk{
+		Storage:      a.Storage,
+		Key:          filename,
+		ObjectOffset: 0,
+		Size:         r.Size,
+		ETag:         etag(result.ETag),
+	}
+
+	if result.VersionID != nil {
+		chunk.Version = *result.VersionID
+	}
+
+	return chunk, nil
+}
+
+// GetReadCloser retrieves the contents of a chunk
+func (a *AzBlob) GetReadCloser(chunk storage.Chunk) (io.ReadCloser, error) {
+	// A zero count means the whole blob to the service
+	if chunk.Size == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	result, err := a.Client.DownloadStream(a.ctx(), a.Container, a.blob(chunk.Key), &azblob.DownloadStreamOptions{
+		Range: blob.HTTPRange{
+			Offset: int64(chunk.ObjectOffset),
+			Count:  int64(chunk.Size),
+		},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Body, nil
+}
+
+// Exists tells whether the object of a chunk is stored
+func (a *AzBlob) Exists(chunk storage.Chunk) (bool, error) {
+	_, err := a.Client.ServiceClient().NewContainerClient(a.Container).NewBlobClient(a.blob(chunk.Key)).GetProperties(a.ctx(), nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// ETag returns the current ETag of the object of a chunk
+func (a *AzBlob) ETag(chunk storage.Chunk) (string, bool, error) {
+	props, err := a.Client.ServiceClient().NewContainerClient(a.Container).NewBlobClient(a.blob(chunk.Key)).GetProperties(a.ctx(), nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return "", false, nil
+	}
+
+	if err != nil {
+		return "", false, err
+	}
+
+	return etag(props.ETag), true, nil
+}
+
+// etag returns the given ETag as a string, empty if unknown
+func etag(tag *azcore.ETag) string {
+	if tag == nil {
+		return ""
+	}
+
+	return string(*tag)
+}
+
+// Remove removes a chunk from the storage
+func (a *AzBlob) Remove(chunk storage.Chunk) error {
+	_, err := a.Client.DeleteBlob(a.ctx(), a.Container, a.blob(chunk.Key), nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,77 @@
+package azblob
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/manvalls/titan/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// getTestStorage connects to the emulator, e.g Azurite, whose connection
+// string is found at TITAN_AZBLOB_TEST_CONNECTION_STRING
+func getTestStorage(t *testing.T) *AzBlob {
+	connectionString := os.Getenv("TITAN_AZBLOB_TEST_CONNECTION_STRING")
+	if connectionString == "" {
+		t.Skip("TITAN_AZBLOB_TEST_CONNECTION_STRING not set")
+	}
+
+	client, err := azblob.NewClientFromConnectionString(connectionString, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &AzBlob{
+		Storage:   "azblob",
+		Client:    client,
+		Container: "titan",
+		Prefix:    "test/",
+	}
+
+	if err := a.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	return a
+}
+
+func TestAzBlob(t *testing.T) {
+	a := getTestStorage(t)
+	assert.Nil(t, a.Setup(), "setting up an existing container should succeed")
+
+	data := []byte("0123456789")
+	chunk, err := a.GetChunk(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "azblob", chunk.Storage)
+	assert.Equal(t, uint64(len(data)), chunk.Size)
+
+	for _, c := range []storage.Chunk{
+		*chunk,
+		{Storage: "azblob", Key: chunk.Key, ObjectOffset: 2, Size: 5},
+		{Storage: "azblob", Key: chunk.Key, ObjectOffset: 9, Size: 1},
+		{Storage: "azblob", Key: chunk.Key, ObjectOffset: 4, Size: 0},
+	} {
+		rc, err := a.GetReadCloser(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := ioutil.ReadAll(rc)
+		rc.Close()
+
+		assert.Nil(t, err)
+		assert.Equal(t, data[c.ObjectOffset:c.ObjectOffset+c.Size], result)
+	}
+
+	assert.Nil(t, a.Remove(*chunk))
+	assert.Nil(t, a.Remove(*chunk), "removing a missing blob should succeed")
+
+	_, err = a.GetReadCloser(*chunk)
+	assert.NotNil(t, err)
+}
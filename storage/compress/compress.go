@@ -0,0 +1,208 @@
+package compress
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/manvalls/titan/storage"
+)
+
+// Gzip compresses chunks using gzip
+const Gzip = "gzip"
+
+// Zstd compresses chunks using Zstandard
+const Zstd = "zstd"
+
+var errCodecNotSup = errors.New("Compression codec not supported")
+
+type codec struct {
+	writer func(io.Writer) (io.WriteCloser, error)
+	reader func(io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = map[string]codec{
+	Gzip: {
+		writer: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	Zstd: {
+		writer: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+
+			return d.IOReadCloser(), nil
+		},
+	},
+}
+
+// Compress wraps a storage compressing the contents of new chunks with the
+// given codec. The codec and the size of the stored object are appended to
+// the chunk key, so objects stored before compression was enabled, or with
+// a different codec, can still be read.
+type Compress struct {
+	storage.Storage
+	Codec string
+}
+
+// WithCompression wraps the given storage so that chunks are compressed
+// using the provided codec
+func WithCompression(st storage.Storage, codec string) (*Compress, error) {
+	if _, ok := codecs[codec]; !ok {
+		return nil, errCodecNotSup
+	}
+
+	return &Compress{Storage: st, Codec: codec}, nil
+}
+
+// object maps a chunk to the object actually stored in the underlying storage,
+// along with the codec used to compress it, if any
+func object(chunk storage.Chunk) (storage.Chunk, string) {
+	parts := strings.Split(chunk.Key, ".")
+	if len(parts) < 3 {
+		return chunk, ""
+	}
+
+	name := parts[len(parts)-2]
+	if _, ok := codecs[name]; !ok {
+		return chunk, ""
+	}
+
+	size, err := strconv.ParseUint(parts[len(parts)-1], 10, 64)
+	if err != nil {
+		return chunk, ""
+	}
+
+	return storage.Chunk{
+		Storage:      chunk.Storage,
+		Key:          strings.Join(parts[:len(parts)-2], "."),
+		ObjectOffset: 0,
+		Size:         size,
+	}, name
+}
+
+// GetChunk compresses and stores the contents of a reader, the size of the
+// returned chunk is the uncompressed one
+func (c *Compress) GetChunk(reader io.Reader) (*storage.Chunk, error) {
+	cd, ok := codecs[c.Codec]
+	if !ok {
+		return nil, errCodecNotSup
+	}
+
+	r := &storage.ReaderWithSize{Reader: reader}
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		w, err := cd.writer(pw)
+		if err == nil {
+			_, err = io.Copy(w, r)
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+		}
+
+		pw.CloseWithError(err)
+	}()
+
+	chunk, err := c.Storage.GetChunk(pr)
+	pr.CloseWithError(err)
+	<-done
+
+	if err != nil {
+		return nil, err
+	}
+
+	chunk.Key += "." + c.Codec + "." + strconv.FormatUint(chunk.Size, 10)
+	chunk.Size = r.Size
+	return chunk, nil
+}
+
+type compressedReadCloser struct {
+	io.Reader
+	decoder io.ReadCloser
+	object  io.ReadCloser
+}
+
+func (crc *compressedReadCloser) Close() error {
+	err := crc.decoder.Close()
+	if oerr := crc.object.Close(); err == nil {
+		err = oerr
+	}
+
+	return err
+}
+
+// GetReadCloser retrieves the uncompressed contents of a chunk
+func (c *Compress) GetReadCloser(chunk storage.Chunk) (io.ReadCloser, error) {
+	obj, name := object(chunk)
+	if name == "" {
+		return c.Storage.GetReadCloser(chunk)
+	}
+
+	rc, err := c.Storage.GetReadCloser(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder, err := codecs[name].reader(rc)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+
+	if _, err = io.CopyN(ioutil.Discard, decoder, int64(chunk.ObjectOffset)); err != nil {
+		decoder.Close()
+		rc.Close()
+		return nil, err
+	}
+
+	return &compressedReadCloser{
+		Reader:  io.LimitReader(decoder, int64(chunk.Size)),
+		decoder: decoder,
+		object:  rc,
+	}, nil
+}
+
+// Exists tells whether the object of a chunk is stored
+func (c *Compress) Exists(chunk storage.Chunk) (bool, error) {
+	obj, _ := object(chunk)
+	return storage.Exists(c.Storage, obj)
+}
+
+// ETag returns the current ETag of the object of a chunk
+func (c *Compress) ETag(chunk storage.Chunk) (string, bool, error) {
+	obj, _ := object(chunk)
+	return storage.ETag(c.Storage, obj)
+}
+
+// Remove removes a chunk from the storage
+func (c *Compress) Remove(chunk storage.Chunk) error {
+	obj, _ := object(chunk)
+	return c.Storage.Remove(obj)
+}
+
+// RemoveBatch removes several chunks from the storage
+func (c *Compress) RemoveBatch(chunks []storage.Chunk) error {
+	objects := make([]storage.Chunk, len(chunks))
+	for i, chunk := range chunks {
+		objects[i], _ = object(chunk)
+	}
+
+	return storage.RemoveBatch(c.Storage, objects)
+}
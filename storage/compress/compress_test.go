@@ -0,0 +1,147 @@
+package compress
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/manvalls/titan/cache/cinode"
+	"github.com/manvalls/titan/database"
+	"github.com/manvalls/titan/storage"
+	"github.com/manvalls/titan/storage/file"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestStorage(t testing.TB) (*file.File, func()) {
+	dir, err := ioutil.TempDir("", "titan")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &file.File{Storage: "file", Root: dir}
+	return f, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func read(t testing.TB, st storage.Storage, chunk storage.Chunk) []byte {
+	rc, err := st.GetReadCloser(chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func readInode(t testing.TB, st storage.Storage, chunks []database.Chunk, size uint64) []byte {
+	key, _ := storage.Key()
+	inode := cinode.NewInode()
+	inode.Storage = st
+	inode.Chunks = chunks
+	inode.Size = size
+	inode.Path = filepath.Join(os.TempDir(), key)
+
+	defer os.Remove(inode.Path)
+	defer inode.Close()
+
+	result := make([]byte, size)
+	n, err := inode.ReadAt(result, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return result[:n]
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, codec := range []string{Gzip, Zstd} {
+		t.Run(codec, func(t *testing.T) {
+			f, cleanup := getTestStorage(t)
+			defer cleanup()
+
+			st, err := WithCompression(f, codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data := []byte(strings.Repeat("all work and no play makes jack a dull boy\n", 1000))
+			chunk, err := st.GetChunk(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, uint64(len(data)), chunk.Size)
+			assert.True(t, strings.HasPrefix(chunk.Key[strings.Index(chunk.Key, "."):], "."+codec+"."))
+
+			obj, name := object(*chunk)
+			assert.Equal(t, codec, name)
+			assert.True(t, obj.Size < chunk.Size)
+
+			assert.Equal(t, data, read(t, st, *chunk))
+
+			partial := *chunk
+			partial.ObjectOffset = 4
+			partial.Size = 8
+			assert.Equal(t, data[4:12], read(t, st, partial))
+
+			chunks := []database.Chunk{
+				{Chunk: storage.Chunk{Storage: chunk.Storage, Key: chunk.Key, ObjectOffset: 100, Size: 1000}},
+				{Chunk: storage.Chunk{Storage: chunk.Storage, Key: chunk.Key, ObjectOffset: 0, Size: 100}, InodeOffset: 1000},
+			}
+
+			expected := append(append([]byte{}, data[100:1100]...), data[:100]...)
+			assert.Equal(t, expected, readInode(t, st, chunks, 1100))
+			assert.Equal(t, expected, readInode(t, st, chunks, 1100), "reading after evicting the cache should yield the same contents")
+
+			assert.Nil(t, st.Remove(*chunk))
+			_, err = st.GetReadCloser(*chunk)
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestMixedObjects(t *testing.T) {
+	f, cleanup := getTestStorage(t)
+	defer cleanup()
+
+	raw, err := f.GetChunk(bytes.NewReader([]byte("raw data")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gz, err := WithCompression(f, Gzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gzChunk, err := gz.GetChunk(bytes.NewReader([]byte("gzip data")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zst, err := WithCompression(f, Zstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []byte("raw data"), read(t, zst, *raw))
+	assert.Equal(t, []byte("gzip data"), read(t, zst, *gzChunk))
+}
+
+func TestUnknownCodec(t *testing.T) {
+	f, cleanup := getTestStorage(t)
+	defer cleanup()
+
+	_, err := WithCompression(f, "lzma")
+	assert.Equal(t, errCodecNotSup, err)
+}
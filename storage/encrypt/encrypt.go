@@ -0,0 +1,284 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"syscall"
+
+	"github.com/manvalls/titan/storage"
+)
+
+// suffix is appended to the key of encrypted chunks, so that objects stored
+// before encryption was enabled can still be read
+const suffix = ".aes256gcm"
+
+// segmentSize is the amount of plaintext sealed at once, objects are split
+// in segments so that ranges can be read without fetching the whole object
+const segmentSize = 65536
+
+const nonceSize = 12
+const tagSize = 16
+
+var errKeySize = errors.New("Encryption key must be 32 bytes long")
+
+// Encrypt wraps a storage encrypting chunks with AES-256-GCM. Every object
+// starts with a random nonce, followed by the sealed segments of the chunk,
+// each of them using the nonce combined with its index.
+type Encrypt struct {
+	storage.Storage
+	aead cipher.AEAD
+}
+
+// WithEncryption wraps the given storage so that chunks are encrypted using
+// the provided key, which may be a master key or a data key derived from a KMS
+func WithEncryption(st storage.Storage, key []byte) (*Encrypt, error) {
+	if len(key) != 32 {
+		return nil, errKeySize
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Encrypt{Storage: st, aead: aead}, nil
+}
+
+// segmentNonce computes the nonce used to seal the given segment
+func segmentNonce(nonce []byte, index uint64) []byte {
+	result := make([]byte, nonceSize)
+	copy(result, nonce)
+
+	counter := binary.BigEndian.Uint64(result[nonceSize-8:])
+	binary.BigEndian.PutUint64(result[nonceSize-8:], counter^index)
+	return result
+}
+
+// segmentOffset computes the position of the given segment within the object
+func segmentOffset(index uint64) uint64 {
+	return nonceSize + index*(segmentSize+tagSize)
+}
+
+// GetChunk encrypts and stores the contents of a reader, the size of the
+// returned chunk is the plaintext one
+func (e *Encrypt) GetChunk(reader io.Reader) (*storage.Chunk, error) {
+	r := &storage.ReaderWithSize{Reader: reader}
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		pw.CloseWithError(e.seal(pw, r))
+	}()
+
+	chunk, err := e.Storage.GetChunk(pr)
+	pr.CloseWithError(err)
+	<-done
+
+	if err != nil {
+		return nil, err
+	}
+
+	chunk.Key += suffix
+	chunk.Size = r.Size
+	return chunk, nil
+}
+
+// seal writes the encrypted contents of the reader to the writer
+func (e *Encrypt) seal(w io.Writer, r io.Reader) error {
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(nonce); err != nil {
+		return err
+	}
+
+	plaintext := make([]byte, segmentSize)
+	ciphertext := make([]byte, 0, segmentSize+tagSize)
+
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(r, plaintext)
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		ciphertext = e.aead.Seal(ciphertext[:0], segmentNonce(nonce, index), plaintext[:n], nil)
+		if _, werr := w.Write(ciphertext); werr != nil {
+			return werr
+		}
+
+		if err == io.ErrUnexpectedEOF {
+			return nil
+		}
+	}
+}
+
+type decrypter struct {
+	aead      cipher.AEAD
+	nonce     []byte
+	object    io.ReadCloser
+	index     uint64
+	skip      uint64
+	remaining uint64
+	buffer    []byte
+	plaintext []byte
+}
+
+// Read decrypts the next segment when the previous one has been consumed,
+// any authentication failure or truncated object is reported as EIO
+func (d *decrypter) Read(p []byte) (n int, err error) {
+	if d.remaining == 0 {
+		return 0, io.EOF
+	}
+
+	if len(d.plaintext) == 0 {
+		m, rerr := io.ReadFull(d.object, d.buffer)
+		if rerr != nil && rerr != io.ErrUnexpectedEOF {
+			if rerr == io.EOF {
+				return 0, syscall.EIO
+			}
+
+			return 0, rerr
+		}
+
+		d.plaintext, err = d.aead.Open(d.buffer[:0], segmentNonce(d.nonce, d.index), d.buffer[:m], nil)
+		if err != nil {
+			return 0, syscall.EIO
+		}
+
+		d.index++
+
+		if d.skip > uint64(len(d.plaintext)) {
+			return 0, syscall.EIO
+		}
+
+		d.plaintext = d.plaintext[d.skip:]
+		d.skip = 0
+
+		if uint64(len(d.plaintext)) > d.remaining {
+			d.plaintext = d.plaintext[:d.remaining]
+		}
+	}
+
+	n = copy(p, d.plaintext)
+	d.plaintext = d.plaintext[n:]
+	d.remaining -= uint64(n)
+	return n, nil
+}
+
+func (d *decrypter) Close() error {
+	return d.object.Close()
+}
+
+// GetReadCloser retrieves and authenticates the decrypted contents of a chunk
+func (e *Encrypt) GetReadCloser(chunk storage.Chunk) (io.ReadCloser, error) {
+	if !strings.HasSuffix(chunk.Key, suffix) {
+		return e.Storage.GetReadCloser(chunk)
+	}
+
+	if chunk.Size == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	first := chunk.ObjectOffset / segmentSize
+	last := (chunk.ObjectOffset + chunk.Size - 1) / segmentSize
+
+	obj := storage.Chunk{
+		Storage:      chunk.Storage,
+		Key:          strings.TrimSuffix(chunk.Key, suffix),
+		ObjectOffset: segmentOffset(first),
+		Size:         segmentOffset(last+1) - segmentOffset(first),
+	}
+
+	nonce := make([]byte, nonceSize)
+
+	if first == 0 {
+		obj.ObjectOffset = 0
+		obj.Size += nonceSize
+	} else {
+		header := obj
+		header.ObjectOffset = 0
+		header.Size = nonceSize
+
+		rc, err := e.Storage.GetReadCloser(header)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = io.ReadFull(rc, nonce)
+		rc.Close()
+
+		if err != nil {
+			return nil, syscall.EIO
+		}
+	}
+
+	rc, err := e.Storage.GetReadCloser(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	if first == 0 {
+		if _, err = io.ReadFull(rc, nonce); err != nil {
+			rc.Close()
+			return nil, syscall.EIO
+		}
+	}
+
+	return &decrypter{
+		aead:      e.aead,
+		nonce:     nonce,
+		object:    rc,
+		index:     first,
+		skip:      chunk.ObjectOffset - first*segmentSize,
+		remaining: chunk.Size,
+		buffer:    make([]byte, segmentSize+tagSize),
+	}, nil
+}
+
+// Exists tells whether the object of a chunk is stored
+func (e *Encrypt) Exists(chunk storage.Chunk) (bool, error) {
+	chunk.Key = strings.TrimSuffix(chunk.Key, suffix)
+	return storage.Exists(e.Storage, chunk)
+}
+
+// ETag returns the current ETag of the object of a chunk
+func (e *Encrypt) ETag(chunk storage.Chunk) (string, bool, error) {
+	chunk.Key = strings.TrimSuffix(chunk.Key, suffix)
+	return storage.ETag(e.Storage, chunk)
+}
+
+// Remove removes a chunk from the storage
+func (e *Encrypt) Remove(chunk storage.Chunk) error {
+	chunk.Key = strings.TrimSuffix(chunk.Key, suffix)
+	return e.Storage.Remove(chunk)
+}
+
+// RemoveBatch removes several chunks from the storage
+func (e *Encrypt) RemoveBatch(chunks []storage.Chunk) error {
+	objects := make([]storage.Chunk, len(chunks))
+	for i, chunk := range chunks {
+		objects[i] = chunk
+		objects[i].Key = strings.TrimSuffix(chunk.Key, suffix)
+	}
+
+	return storage.RemoveBatch(e.Storage, objects)
+}
@@ -0,0 +1,243 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/manvalls/titan/storage"
+	"github.com/manvalls/titan/storage/compress"
+	"github.com/manvalls/titan/storage/file"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestStorage(t testing.TB) (*file.File, func()) {
+	dir, err := ioutil.TempDir("", "titan")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &file.File{Storage: "file", Root: dir}
+	return f, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func getKey(t testing.TB) []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func getData(t testing.TB, size int) []byte {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func read(st storage.Storage, chunk storage.Chunk) ([]byte, error) {
+	rc, err := st.GetReadCloser(chunk)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// objectPath finds the file backing the only object of the given storage
+func objectPath(t testing.TB, f *file.File) string {
+	var result string
+
+	filepath.Walk(f.Root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			result = path
+		}
+
+		return nil
+	})
+
+	if result == "" {
+		t.Fatal("object not found")
+	}
+
+	return result
+}
+
+func TestRoundTrip(t *testing.T) {
+	f, cleanup := getTestStorage(t)
+	defer cleanup()
+
+	st, err := WithEncryption(f, getKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 1, segmentSize - 1, segmentSize, 3*segmentSize + 100} {
+		data := getData(t, size)
+
+		chunk, err := st.GetChunk(bytes.NewReader(data))
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		assert.Equal(t, uint64(size), chunk.Size)
+
+		result, err := read(st, *chunk)
+		assert.Nil(t, err)
+		assert.Equal(t, data, result)
+
+		raw, err := read(f, storage.Chunk{Key: chunk.Key[:len(chunk.Key)-len(suffix)], Size: 1 << 30})
+		assert.Nil(t, err)
+		assert.False(t, size > 16 && bytes.Contains(raw, data[:16]), "objects should not contain the plaintext")
+
+		assert.Nil(t, st.Remove(*chunk))
+	}
+}
+
+func TestRanges(t *testing.T) {
+	f, cleanup := getTestStorage(t)
+	defer cleanup()
+
+	st, err := WithEncryption(f, getKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := getData(t, 3*segmentSize+100)
+	chunk, err := st.GetChunk(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ranges := [][2]uint64{
+		{0, 10},
+		{segmentSize - 5, 10},
+		{segmentSize, segmentSize},
+		{2*segmentSize + 7, segmentSize + 93},
+		{uint64(len(data)) - 1, 1},
+	}
+
+	for _, r := range ranges {
+		partial := *chunk
+		partial.ObjectOffset = r[0]
+		partial.Size = r[1]
+
+		result, err := read(st, partial)
+		assert.Nil(t, err)
+		assert.Equal(t, data[r[0]:r[0]+r[1]], result)
+	}
+}
+
+func TestTamper(t *testing.T) {
+	f, cleanup := getTestStorage(t)
+	defer cleanup()
+
+	st, err := WithEncryption(f, getKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := getData(t, 2*segmentSize)
+	chunk, err := st.GetChunk(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := objectPath(t, f)
+	original, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte{}, original...)
+	tampered[segmentOffset(1)+3] ^= 1
+	assert.Nil(t, ioutil.WriteFile(path, tampered, 0644))
+
+	_, err = read(st, *chunk)
+	assert.Equal(t, syscall.EIO, err)
+
+	first := *chunk
+	first.Size = segmentSize
+	result, err := read(st, first)
+	assert.Nil(t, err, "untouched segments should still be readable")
+	assert.Equal(t, data[:segmentSize], result)
+
+	swapped := append([]byte{}, original[:nonceSize]...)
+	swapped = append(swapped, original[segmentOffset(1):]...)
+	swapped = append(swapped, original[segmentOffset(0):segmentOffset(1)]...)
+	assert.Nil(t, ioutil.WriteFile(path, swapped, 0644))
+
+	_, err = read(st, *chunk)
+	assert.Equal(t, syscall.EIO, err)
+
+	assert.Nil(t, ioutil.WriteFile(path, original[:segmentOffset(1)], 0644))
+
+	_, err = read(st, *chunk)
+	assert.Equal(t, syscall.EIO, err)
+
+	assert.Nil(t, ioutil.WriteFile(path, original, 0644))
+
+	other, err := WithEncryption(f, getKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = read(other, *chunk)
+	assert.Equal(t, syscall.EIO, err)
+
+	result, err = read(st, *chunk)
+	assert.Nil(t, err)
+	assert.Equal(t, data, result)
+}
+
+func TestMixedObjects(t *testing.T) {
+	f, cleanup := getTestStorage(t)
+	defer cleanup()
+
+	raw, err := f.GetChunk(bytes.NewReader([]byte("raw data")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := compress.WithCompression(f, compress.Zstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := WithEncryption(c, getKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("compressed and encrypted "), 10000)
+	chunk, err := st.GetChunk(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, uint64(len(data)), chunk.Size)
+
+	result, err := read(st, *chunk)
+	assert.Nil(t, err)
+	assert.Equal(t, data, result)
+
+	result, err = read(st, *raw)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("raw data"), result)
+}
+
+func TestKeySize(t *testing.T) {
+	_, err := WithEncryption(nil, make([]byte, 16))
+	assert.Equal(t, errKeySize, err)
+}
@@ -0,0 +1,146 @@
+package file
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/manvalls/titan/storage"
+)
+
+// shardWidth is the amount of key characters used to name each level of
+// subdirectories
+const shardWidth = 2
+
+// shardLevels is the amount of nested subdirectories a chunk is stored under
+const shardLevels = 2
+
+// File is a local file system implementation of the storage interface, suited
+// for single node deployments on top of a local or NFS mounted folder
+type File struct {
+	Storage string
+
+	// Root is the folder under which chunks are stored
+	Root string
+}
+
+// path computes the location of the given key, sharded into subdirectories
+// named after its prefix to avoid huge folders
+func (f *File) path(key string) string {
+	parts := []string{f.Root}
+
+	for i := 0; i < shardLevels && (i+1)*shardWidth < len(key); i++ {
+		parts = append(parts, key[i*shardWidth:(i+1)*shardWidth])
+	}
+
+	return filepath.Join(append(parts, key)...)
+}
+
+// Setup sets up the storage
+func (f *File) Setup() error {
+	return os.MkdirAll(f.Root, 0755)
+}
+
+// GetChunk stores the contents of a reader and returns the built chunk
+func (f *File) GetChunk(reader io.Reader) (*storage.Chunk, error) {
+	r := &storage.ReaderWithSize{Reader: reader}
+
+	filename, err := storage.Key()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = f.write(filename, r); err != nil {
+		return nil, err
+	}
+
+	return &storage.Chunk{
+		Storage:      f.Storage,
+		Key:          filename,
+		ObjectOffset: 0,
+		Size:         r.Size,
+	}, nil
+}
+
+// write stores the contents of the reader in a temporary file which is then
+// renamed to its final location, so that a crash never leaves a partial chunk
+func (f *File) write(key string, reader io.Reader) error {
+	p := f.path(key)
+	dir := filepath.Dir(p)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+key+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(tmp, reader); err == nil {
+		err = tmp.Sync()
+	}
+
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
+
+type fileReadCloser struct {
+	io.Reader
+	file *os.File
+}
+
+func (frc *fileReadCloser) Close() error {
+	return frc.file.Close()
+}
+
+// GetReadCloser retrieves the contents of a chunk
+func (f *File) GetReadCloser(chunk storage.Chunk) (io.ReadCloser, error) {
+	file, err := os.Open(f.path(chunk.Key))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = file.Seek(int64(chunk.ObjectOffset), io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &fileReadCloser{
+		Reader: io.LimitReader(file, int64(chunk.Size)),
+		file:   file,
+	}, nil
+}
+
+// Exists tells whether the object of a chunk is stored
+func (f *File) Exists(chunk storage.Chunk) (bool, error) {
+	_, err := os.Stat(f.path(chunk.Key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Remove removes a chunk from the storage
+func (f *File) Remove(chunk storage.Chunk) error {
+	err := os.Remove(f.path(chunk.Key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
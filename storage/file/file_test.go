@@ -0,0 +1,138 @@
+package file
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/manvalls/titan/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestStorage(t testing.TB) (*File, func()) {
+	dir, err := ioutil.TempDir("", "titan")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &File{Storage: "file", Root: filepath.Join(dir, "chunks")}
+	if err := f.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	return f, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func read(t testing.TB, f *File, chunk storage.Chunk) []byte {
+	rc, err := f.GetReadCloser(chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestSharding(t *testing.T) {
+	f, cleanup := getTestStorage(t)
+	defer cleanup()
+
+	assert.Equal(t, filepath.Join(f.Root, "01", "AB", "01ABCDEF"), f.path("01ABCDEF"))
+	assert.Equal(t, filepath.Join(f.Root, "01", "01A"), f.path("01A"))
+	assert.Equal(t, filepath.Join(f.Root, "01"), f.path("01"))
+
+	chunk, err := f.GetChunk(bytes.NewReader([]byte("hello world")))
+	assert.Nil(t, err)
+	assert.Equal(t, "file", chunk.Storage)
+	assert.Equal(t, uint64(11), chunk.Size)
+
+	_, err = os.Stat(filepath.Join(f.Root, chunk.Key[0:2], chunk.Key[2:4], chunk.Key))
+	assert.Nil(t, err)
+
+	entries, err := ioutil.ReadDir(filepath.Join(f.Root, chunk.Key[0:2], chunk.Key[2:4]))
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1, "no temporary files should be left behind")
+
+	assert.Equal(t, []byte("hello world"), read(t, f, *chunk))
+
+	chunk.ObjectOffset = 6
+	chunk.Size = 3
+	assert.Equal(t, []byte("wor"), read(t, f, *chunk))
+}
+
+func TestRemove(t *testing.T) {
+	f, cleanup := getTestStorage(t)
+	defer cleanup()
+
+	chunk, err := f.GetChunk(bytes.NewReader([]byte("data")))
+	assert.Nil(t, err)
+
+	assert.Nil(t, f.Remove(*chunk))
+	assert.Nil(t, f.Remove(*chunk))
+	assert.Nil(t, f.Remove(storage.Chunk{Key: "missing"}))
+
+	_, err = f.GetReadCloser(*chunk)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestExists(t *testing.T) {
+	f, cleanup := getTestStorage(t)
+	defer cleanup()
+
+	chunk, err := f.GetChunk(bytes.NewReader([]byte("data")))
+	assert.Nil(t, err)
+
+	exists, err := storage.Exists(f, *chunk)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	assert.Nil(t, f.Remove(*chunk))
+
+	exists, err = storage.Exists(f, *chunk)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	f, cleanup := getTestStorage(t)
+	defer cleanup()
+
+	const n = 50
+	chunks := make([]*storage.Chunk, n)
+	errs := make([]error, n)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			chunks[i], errs[i] = f.GetChunk(bytes.NewReader([]byte(strconv.Itoa(i))))
+		}(i)
+	}
+
+	wg.Wait()
+
+	keys := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		if !assert.Nil(t, errs[i]) {
+			continue
+		}
+
+		keys[chunks[i].Key] = true
+		assert.Equal(t, []byte(strconv.Itoa(i)), read(t, f, *chunks[i]))
+	}
+
+	assert.Len(t, keys, n)
+}
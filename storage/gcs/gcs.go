@@ -0,0 +1,138 @@
+package gcs
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+
+	gstorage "cloud.google.com/go/storage"
+	"github.com/manvalls/titan/storage"
+	"github.com/manvalls/titan/storage/retry"
+	"google.golang.org/api/googleapi"
+)
+
+// GCS is a Google Cloud Storage implementation of the storage interface
+type GCS struct {
+	Storage string
+	Client  *gstorage.Client
+	Bucket  string
+
+	// Project is the project the bucket will be created in by Setup
+	Project string
+
+	// Prefix is prepended to every object name, so that several file systems
+	// can share the same bucket
+	Prefix string
+
+	// Context is used for every object operation, cancelling it aborts
+	// in-flight requests
+	Context context.Context
+}
+
+// Retryable tells whether a GCS error is transient
+func Retryable(err error) bool {
+	if gerr, ok := err.(*googleapi.Error); ok {
+		return retry.RetryableStatus(gerr.Code)
+	}
+
+	return retry.Retryable(err)
+}
+
+func (g *GCS) ctx() context.Context {
+	if g.Context == nil {
+		return context.Background()
+	}
+
+	return g.Context
+}
+
+func (g *GCS) object(key string) *gstorage.ObjectHandle {
+	return g.Client.Bucket(g.Bucket).Object(g.Prefix + key)
+}
+
+// Setup sets up the storage
+func (g *GCS) Setup() error {
+	err := g.Client.Bucket(g.Bucket).Create(g.ctx(), g.Project, nil)
+
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusConflict {
+		return nil
+	}
+
+	return err
+}
+
+// GetChunk stores the contents of a reader and returns the built chunk
+func (g *GCS) GetChunk(reader io.Reader) (*storage.Chunk, error) {
+	r := &storage.ReaderWithSize{Reader: reader}
+
+	filename, err := storage.Key()
+	if err != nil {
+		return nil, err
+	}
+
+	w := g.object(filename).NewWriter(g.ctx())
+	if _, err = io.Copy(w, r); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+
+	attrs := w.Attrs()
+
+	return &storage.Chunk{
+		Storage:      g.Storage,
+		Key:          filename,
+		ObjectOffset: 0,
+		Size:         r.Size,
+		ETag:         attrs.Etag,
+		Version:      strconv.FormatInt(attrs.Generation, 10),
+	}, nil
+}
+
+// GetReadCloser retrieves the contents of a chunk
+func (g *GCS) GetReadCloser(chunk storage.Chunk) (io.ReadCloser, error) {
+	reader, err := g.object(chunk.Key).NewRangeReader(g.ctx(), int64(chunk.ObjectOffset), int64(chunk.Size))
+	if err != nil {
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+// Exists tells whether the object of a chunk is stored
+func (g *GCS) Exists(chunk storage.Chunk) (bool, error) {
+	_, err := g.object(chunk.Key).Attrs(g.ctx())
+	if err == gstorage.ErrObjectNotExist {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// ETag returns the current ETag of the object of a chunk
+func (g *GCS) ETag(chunk storage.Chunk) (string, bool, error) {
+	attrs, err := g.object(chunk.Key).Attrs(g.ctx())
+	if err == gstorage.ErrObjectNotExist {
+		return "", false, nil
+	}
+
+	if err != nil {
+		return "", false, err
+	}
+
+	return attrs.Etag, true, nil
+}
+
+// Remove removes a chunk from the storage
+func (g *GCS) Remove(chunk storage.Chunk) error {
+	err := g.object(chunk.Key).Delete(g.ctx())
+	if err == gstorage.ErrObjectNotExist {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,218 @@
+package lru
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/manvalls/titan/storage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// object identifies a stored object, regardless of the range being read
+type object struct {
+	storage string
+	key     string
+}
+
+type entry struct {
+	chunk   storage.Chunk
+	data    []byte
+	expires time.Time
+}
+
+// LRU wraps a storage keeping the contents of recently read chunks in memory,
+// evicting the least recently used ones once MaxMemory is exceeded
+type LRU struct {
+	storage.Storage
+	MaxMemory uint64
+	TTL       time.Duration
+
+	mutex   sync.Mutex
+	size    uint64
+	epoch   uint64
+	order   *list.List
+	entries map[storage.Chunk]*list.Element
+	objects map[object]map[*list.Element]bool
+
+	requests *prometheus.CounterVec
+}
+
+// WithLRU wraps the given storage so that up to maxMemory bytes of chunk
+// contents are kept in memory for the provided TTL, zero meaning forever.
+// If a registerer is provided, cache hits and misses are exposed.
+func WithLRU(st storage.Storage, maxMemory uint64, ttl time.Duration, reg prometheus.Registerer) (*LRU, error) {
+	l := &LRU{
+		Storage:   st,
+		MaxMemory: maxMemory,
+		TTL:       ttl,
+
+		order:   list.New(),
+		entries: make(map[storage.Chunk]*list.Element),
+		objects: make(map[object]map[*list.Element]bool),
+
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "titan_storage_cache_requests_total",
+			Help: "Amount of chunk reads served by the in-memory cache, labeled by result",
+		}, []string{"result"}),
+	}
+
+	if reg != nil {
+		if err := reg.Register(l.requests); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// get retrieves the cached contents of a chunk, if present and not expired
+func (l *LRU) get(chunk storage.Chunk) ([]byte, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	el, ok := l.entries[chunk]
+	if !ok {
+		return nil, false
+	}
+
+	e := el.Value.(*entry)
+	if l.TTL > 0 && time.Now().After(e.expires) {
+		l.remove(el)
+		return nil, false
+	}
+
+	l.order.MoveToFront(el)
+	return e.data, true
+}
+
+// add caches the contents of a chunk unless the object it belongs to was
+// removed since the given epoch
+func (l *LRU) add(chunk storage.Chunk, data []byte, epoch uint64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if epoch != l.epoch {
+		return
+	}
+
+	if el, ok := l.entries[chunk]; ok {
+		l.remove(el)
+	}
+
+	el := l.order.PushFront(&entry{
+		chunk:   chunk,
+		data:    data,
+		expires: time.Now().Add(l.TTL),
+	})
+
+	o := object{chunk.Storage, chunk.Key}
+	if l.objects[o] == nil {
+		l.objects[o] = make(map[*list.Element]bool)
+	}
+
+	l.entries[chunk] = el
+	l.objects[o][el] = true
+	l.size += uint64(len(data))
+
+	for l.size > l.MaxMemory {
+		l.remove(l.order.Back())
+	}
+}
+
+// remove evicts an entry, the mutex must be held
+func (l *LRU) remove(el *list.Element) {
+	e := el.Value.(*entry)
+	o := object{e.chunk.Storage, e.chunk.Key}
+
+	l.order.Remove(el)
+	delete(l.entries, e.chunk)
+	delete(l.objects[o], el)
+	if len(l.objects[o]) == 0 {
+		delete(l.objects, o)
+	}
+
+	l.size -= uint64(len(e.data))
+}
+
+// GetReadCloser retrieves the contents of a chunk, from memory if possible
+func (l *LRU) GetReadCloser(chunk storage.Chunk) (io.ReadCloser, error) {
+	if data, ok := l.get(chunk); ok {
+		l.requests.WithLabelValues("hit").Inc()
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	l.requests.WithLabelValues("miss").Inc()
+
+	if chunk.Size > l.MaxMemory {
+		return l.Storage.GetReadCloser(chunk)
+	}
+
+	l.mutex.Lock()
+	epoch := l.epoch
+	l.mutex.Unlock()
+
+	rc, err := l.Storage.GetReadCloser(chunk)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	l.add(chunk, data, epoch)
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Exists tells whether the object of a chunk is stored, always asking the
+// underlying storage as cached contents may outlive the object
+func (l *LRU) Exists(chunk storage.Chunk) (bool, error) {
+	return storage.Exists(l.Storage, chunk)
+}
+
+// ETag returns the current ETag of the object of a chunk, always asking the
+// underlying storage
+func (l *LRU) ETag(chunk storage.Chunk) (string, bool, error) {
+	return storage.ETag(l.Storage, chunk)
+}
+
+// GetChunkAt stores the contents of a reader at the named storage of the
+// underlying one
+func (l *LRU) GetChunkAt(name string, reader io.Reader) (*storage.Chunk, error) {
+	return storage.GetChunkAt(l.Storage, name, reader)
+}
+
+// Remove removes a chunk from the storage, evicting every cached range of it
+func (l *LRU) Remove(chunk storage.Chunk) error {
+	err := l.Storage.Remove(chunk)
+	l.evict([]storage.Chunk{chunk})
+	return err
+}
+
+// RemoveBatch removes several chunks from the storage, evicting every cached
+// range of them
+func (l *LRU) RemoveBatch(chunks []storage.Chunk) error {
+	err := storage.RemoveBatch(l.Storage, chunks)
+	l.evict(chunks)
+	return err
+}
+
+// evict drops every cached range of the objects of the given chunks
+func (l *LRU) evict(chunks []storage.Chunk) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.epoch++
+	for _, chunk := range chunks {
+		for el := range l.objects[object{chunk.Storage, chunk.Key}] {
+			l.remove(el)
+		}
+	}
+}
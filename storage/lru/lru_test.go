@@ -0,0 +1,214 @@
+package lru
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/manvalls/titan/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type testStorage struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+	reads   int
+}
+
+func newTestStorage() *testStorage {
+	return &testStorage{objects: make(map[string][]byte)}
+}
+
+func (t *testStorage) Setup() error {
+	return nil
+}
+
+func (t *testStorage) GetChunk(reader io.Reader) (*storage.Chunk, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := storage.Key()
+	if err != nil {
+		return nil, err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.objects[key] = data
+
+	return &storage.Chunk{Storage: "test", Key: key, Size: uint64(len(data))}, nil
+}
+
+func (t *testStorage) GetReadCloser(chunk storage.Chunk) (io.ReadCloser, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.reads++
+	data, ok := t.objects[chunk.Key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data[chunk.ObjectOffset : chunk.ObjectOffset+chunk.Size])), nil
+}
+
+func (t *testStorage) Remove(chunk storage.Chunk) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.objects, chunk.Key)
+	return nil
+}
+
+func (t *testStorage) getReads() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.reads
+}
+
+func read(t testing.TB, st storage.Storage, chunk storage.Chunk) []byte {
+	rc, err := st.GetReadCloser(chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestHits(t *testing.T) {
+	ts := newTestStorage()
+	l, err := WithLRU(ts, 1000, 0, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunk, _ := l.GetChunk(bytes.NewReader([]byte("hello world")))
+
+	assert.Equal(t, []byte("hello world"), read(t, l, *chunk))
+	assert.Equal(t, []byte("hello world"), read(t, l, *chunk))
+
+	partial := *chunk
+	partial.ObjectOffset = 6
+	partial.Size = 5
+	assert.Equal(t, []byte("world"), read(t, l, partial))
+	assert.Equal(t, []byte("world"), read(t, l, partial))
+
+	assert.Equal(t, 2, ts.getReads())
+	assert.Equal(t, float64(2), testutil.ToFloat64(l.requests.WithLabelValues("hit")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(l.requests.WithLabelValues("miss")))
+}
+
+func TestEviction(t *testing.T) {
+	ts := newTestStorage()
+	l, err := WithLRU(ts, 25, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, _ := l.GetChunk(bytes.NewReader(bytes.Repeat([]byte("a"), 10)))
+	b, _ := l.GetChunk(bytes.NewReader(bytes.Repeat([]byte("b"), 10)))
+	c, _ := l.GetChunk(bytes.NewReader(bytes.Repeat([]byte("c"), 10)))
+	big, _ := l.GetChunk(bytes.NewReader(bytes.Repeat([]byte("d"), 30)))
+
+	read(t, l, *a)
+	read(t, l, *b)
+	read(t, l, *a)
+	read(t, l, *c)
+	assert.Equal(t, 3, ts.getReads())
+	assert.Equal(t, uint64(20), l.size)
+
+	read(t, l, *a)
+	assert.Equal(t, 3, ts.getReads(), "a was recently used so it should have been kept")
+
+	read(t, l, *b)
+	assert.Equal(t, 4, ts.getReads(), "b was the least recently used so it should have been evicted")
+
+	read(t, l, *big)
+	read(t, l, *big)
+	assert.Equal(t, 6, ts.getReads(), "chunks bigger than the cache should not be cached")
+	assert.Equal(t, uint64(20), l.size)
+}
+
+func TestTTL(t *testing.T) {
+	ts := newTestStorage()
+	l, err := WithLRU(ts, 1000, 50*time.Millisecond, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunk, _ := l.GetChunk(bytes.NewReader([]byte("data")))
+
+	read(t, l, *chunk)
+	read(t, l, *chunk)
+	assert.Equal(t, 1, ts.getReads())
+
+	time.Sleep(100 * time.Millisecond)
+
+	read(t, l, *chunk)
+	assert.Equal(t, 2, ts.getReads())
+}
+
+func TestRemove(t *testing.T) {
+	ts := newTestStorage()
+	l, err := WithLRU(ts, 1000, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunk, _ := l.GetChunk(bytes.NewReader([]byte("hello world")))
+	partial := *chunk
+	partial.Size = 5
+
+	read(t, l, *chunk)
+	read(t, l, partial)
+	assert.Equal(t, uint64(16), l.size)
+
+	assert.Nil(t, l.Remove(*chunk))
+	assert.Equal(t, uint64(0), l.size)
+	assert.Len(t, l.objects, 0)
+
+	_, err = l.GetReadCloser(partial)
+	assert.Equal(t, os.ErrNotExist, err)
+}
+
+func TestConcurrentReads(t *testing.T) {
+	ts := newTestStorage()
+	l, err := WithLRU(ts, 100, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := make([]*storage.Chunk, 20)
+	for i := range chunks {
+		chunks[i], _ = l.GetChunk(bytes.NewReader(bytes.Repeat([]byte{byte(i)}, 10)))
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j, chunk := range chunks {
+				assert.Equal(t, bytes.Repeat([]byte{byte(j)}, 10), read(t, l, *chunk))
+			}
+		}()
+	}
+
+	wg.Wait()
+	assert.True(t, l.size <= 100)
+}
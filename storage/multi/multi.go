@@ -16,7 +16,13 @@ type Multi struct {
 
 var errNotSup = errors.New("Storage not supported")
 
+// getStorage returns the storage of the given name, the default one being
+// used for chunks which don't name any
 func (m *Multi) getStorage(storage string) (storage.Storage, error) {
+	if storage == "" {
+		storage = m.Default
+	}
+
 	st, ok := m.Storages[storage]
 	if !ok {
 		return nil, errNotSup
@@ -40,6 +46,16 @@ func (m *Multi) GetChunk(reader io.Reader) (*storage.Chunk, error) {
 	return st.GetChunk(reader)
 }
 
+// GetChunkAt stores the contents of a reader at the named storage
+func (m *Multi) GetChunkAt(name string, reader io.Reader) (*storage.Chunk, error) {
+	st, err := m.getStorage(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.GetChunkAt(st, name, reader)
+}
+
 // GetReadCloser retrieves the contents of a chunk
 func (m *Multi) GetReadCloser(chunk storage.Chunk) (io.ReadCloser, error) {
 	st, err := m.getStorage(chunk.Storage)
@@ -50,6 +66,26 @@ func (m *Multi) GetReadCloser(chunk storage.Chunk) (io.ReadCloser, error) {
 	return st.GetReadCloser(chunk)
 }
 
+// Exists tells whether the object of a chunk is stored at its storage
+func (m *Multi) Exists(chunk storage.Chunk) (bool, error) {
+	st, err := m.getStorage(chunk.Storage)
+	if err != nil {
+		return false, err
+	}
+
+	return storage.Exists(st, chunk)
+}
+
+// ETag returns the current ETag of the object of a chunk at its storage
+func (m *Multi) ETag(chunk storage.Chunk) (string, bool, error) {
+	st, err := m.getStorage(chunk.Storage)
+	if err != nil {
+		return "", false, err
+	}
+
+	return storage.ETag(st, chunk)
+}
+
 // Remove removes a chunk from the storage
 func (m *Multi) Remove(chunk storage.Chunk) error {
 	st, err := m.getStorage(chunk.Storage)
@@ -59,3 +95,31 @@ func (m *Multi) Remove(chunk storage.Chunk) error {
 
 	return st.Remove(chunk)
 }
+
+// RemoveBatch removes several chunks, grouping them by storage
+func (m *Multi) RemoveBatch(chunks []storage.Chunk) error {
+	names := make([]string, 0)
+	groups := make(map[string][]storage.Chunk)
+
+	for _, chunk := range chunks {
+		if _, ok := groups[chunk.Storage]; !ok {
+			names = append(names, chunk.Storage)
+		}
+
+		groups[chunk.Storage] = append(groups[chunk.Storage], chunk)
+	}
+
+	var result error
+	for _, name := range names {
+		st, err := m.getStorage(name)
+		if err == nil {
+			err = storage.RemoveBatch(st, groups[name])
+		}
+
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,339 @@
+package replicate
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/manvalls/titan/storage"
+)
+
+// separator joins the keys a chunk has at every replica, in the order of
+// the storages, into the key of the chunk
+const separator = ","
+
+var errQuorum = errors.New("Chunk couldn't be stored at enough replicas")
+var errKey = errors.New("Key doesn't match the amount of replicas")
+var errNoReplica = errors.New("Chunk isn't stored at any replica")
+
+// Replicate wraps several storages writing every chunk to all of them, and
+// reading it from the fastest one still working
+type Replicate struct {
+	Storage  string
+	Storages []storage.Storage
+
+	// Quorum is the amount of storages a chunk needs to be written to for
+	// GetChunk to succeed, a majority of them if zero
+	Quorum int
+
+	// Cooldown is the time a storage failing a read is tried last for
+	Cooldown time.Duration
+
+	mutex    sync.Mutex
+	replicas []replica
+}
+
+// replica holds the read statistics of a storage
+type replica struct {
+	latency  time.Duration
+	failedAt time.Time
+}
+
+// WithReplication wraps the given storages so that chunks are replicated
+// across all of them, naming the resulting chunks after the given storage
+func WithReplication(name string, storages ...storage.Storage) *Replicate {
+	return &Replicate{
+		Storage:  name,
+		Storages: storages,
+		Cooldown: 30 * time.Second,
+	}
+}
+
+func (r *Replicate) quorum() int {
+	if r.Quorum > 0 {
+		return r.Quorum
+	}
+
+	return len(r.Storages)/2 + 1
+}
+
+// keys splits the key of a chunk into the ones it has at every replica,
+// empty for replicas which failed to store it
+func (r *Replicate) keys(chunk storage.Chunk) ([]string, error) {
+	keys := strings.Split(chunk.Key, separator)
+	if len(keys) != len(r.Storages) {
+		return nil, errKey
+	}
+
+	return keys, nil
+}
+
+// Setup sets up every storage
+func (r *Replicate) Setup() error {
+	for _, st := range r.Storages {
+		if err := st.Setup(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fanOut copies the written data to several pipes, dropping the ones whose
+// reader fails so that the rest can go on
+type fanOut struct {
+	writers []*io.PipeWriter
+	failed  []bool
+}
+
+func (f *fanOut) Write(p []byte) (int, error) {
+	written := false
+
+	for i, w := range f.writers {
+		if f.failed[i] {
+			continue
+		}
+
+		if _, err := w.Write(p); err != nil {
+			f.failed[i] = true
+			continue
+		}
+
+		written = true
+	}
+
+	if !written {
+		return 0, errQuorum
+	}
+
+	return len(p), nil
+}
+
+// GetChunk stores the contents of a reader at every storage at once,
+// failing if fewer than the quorum succeed
+func (r *Replicate) GetChunk(reader io.Reader) (*storage.Chunk, error) {
+	n := len(r.Storages)
+	chunks := make([]*storage.Chunk, n)
+	errs := make([]error, n)
+	out := &fanOut{writers: make([]*io.PipeWriter, n), failed: make([]bool, n)}
+	wg := sync.WaitGroup{}
+
+	for i, st := range r.Storages {
+		pr, pw := io.Pipe()
+		out.writers[i] = pw
+
+		wg.Add(1)
+		go func(i int, st storage.Storage) {
+			defer wg.Done()
+			chunks[i], errs[i] = st.GetChunk(pr)
+			pr.CloseWithError(errs[i])
+		}(i, st)
+	}
+
+	size, err := io.Copy(out, reader)
+	for _, pw := range out.writers {
+		pw.CloseWithError(err)
+	}
+
+	wg.Wait()
+
+	keys := make([]string, n)
+	stored := 0
+	var firstErr error
+
+	for i := range r.Storages {
+		if errs[i] == nil && (out.failed[i] || chunks[i].Size != uint64(size)) {
+			// The storage stopped reading before the end of the contents
+			errs[i] = io.ErrShortWrite
+			r.Storages[i].Remove(*chunks[i])
+		}
+
+		if errs[i] != nil {
+			if firstErr == nil {
+				firstErr = errs[i]
+			}
+
+			continue
+		}
+
+		keys[i] = chunks[i].Key
+		stored++
+	}
+
+	if (err == nil || err == errQuorum) && stored < r.quorum() {
+		err = firstErr
+		if err == nil {
+			err = errQuorum
+		}
+	}
+
+	if err != nil {
+		for i, key := range keys {
+			if key != "" {
+				r.Storages[i].Remove(*chunks[i])
+			}
+		}
+
+		return nil, err
+	}
+
+	return &storage.Chunk{
+		Storage:      r.Storage,
+		Key:          strings.Join(keys, separator),
+		ObjectOffset: 0,
+		Size:         uint64(size),
+	}, nil
+}
+
+// order sorts the replicas storing a chunk by their read latency, leaving
+// the ones which recently failed for the end
+func (r *Replicate) order(keys []string) []int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.replicas == nil {
+		r.replicas = make([]replica, len(r.Storages))
+	}
+
+	now := time.Now()
+	healthy := func(i int) bool {
+		return now.Sub(r.replicas[i].failedAt) >= r.Cooldown
+	}
+
+	indexes := make([]int, 0, len(keys))
+	for i, key := range keys {
+		if key != "" {
+			indexes = append(indexes, i)
+		}
+	}
+
+	sort.SliceStable(indexes, func(a, b int) bool {
+		i, j := indexes[a], indexes[b]
+		if healthy(i) != healthy(j) {
+			return healthy(i)
+		}
+
+		return r.replicas[i].latency < r.replicas[j].latency
+	})
+
+	return indexes
+}
+
+// observe records the outcome of a read from the given replica
+func (r *Replicate) observe(i int, d time.Duration, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err != nil {
+		r.replicas[i].failedAt = time.Now()
+		return
+	}
+
+	r.replicas[i].failedAt = time.Time{}
+	if r.replicas[i].latency == 0 {
+		r.replicas[i].latency = d
+	} else {
+		r.replicas[i].latency = (4*r.replicas[i].latency + d) / 5
+	}
+}
+
+// GetReadCloser retrieves the contents of a chunk from the fastest replica,
+// falling back to the other ones if it fails
+func (r *Replicate) GetReadCloser(chunk storage.Chunk) (io.ReadCloser, error) {
+	keys, err := r.keys(chunk)
+	if err != nil {
+		return nil, err
+	}
+
+	err = errNoReplica
+	for _, i := range r.order(keys) {
+		replicaChunk := chunk
+		replicaChunk.Key = keys[i]
+
+		start := time.Now()
+		rc, rerr := r.Storages[i].GetReadCloser(replicaChunk)
+		r.observe(i, time.Since(start), rerr)
+
+		if rerr == nil {
+			return rc, nil
+		}
+
+		if err == errNoReplica {
+			err = rerr
+		}
+	}
+
+	return nil, err
+}
+
+// Exists tells whether the object of a chunk is stored at any replica, as
+// reads fall back to the other ones
+func (r *Replicate) Exists(chunk storage.Chunk) (bool, error) {
+	keys, err := r.keys(chunk)
+	if err != nil {
+		return false, err
+	}
+
+	err = nil
+	for i, key := range keys {
+		if key == "" {
+			continue
+		}
+
+		replicaChunk := chunk
+		replicaChunk.Key = key
+
+		exists, rerr := storage.Exists(r.Storages[i], replicaChunk)
+		if exists {
+			return true, nil
+		}
+
+		if rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+
+	return false, err
+}
+
+// Remove removes a chunk from every replica
+func (r *Replicate) Remove(chunk storage.Chunk) error {
+	return r.RemoveBatch([]storage.Chunk{chunk})
+}
+
+// RemoveBatch removes several chunks from every replica, grouping them by
+// storage
+func (r *Replicate) RemoveBatch(chunks []storage.Chunk) error {
+	groups := make([][]storage.Chunk, len(r.Storages))
+
+	for _, chunk := range chunks {
+		keys, err := r.keys(chunk)
+		if err != nil {
+			return err
+		}
+
+		for i, key := range keys {
+			if key != "" {
+				replicaChunk := chunk
+				replicaChunk.Key = key
+				groups[i] = append(groups[i], replicaChunk)
+			}
+		}
+	}
+
+	var result error
+	for i, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+
+		if err := storage.RemoveBatch(r.Storages[i], group); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	return result
+}
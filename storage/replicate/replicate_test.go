@@ -0,0 +1,187 @@
+package replicate
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/manvalls/titan/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+var errDown = errors.New("down")
+
+// memory keeps chunks in memory, failing every operation while down
+type memory struct {
+	mutex   sync.Mutex
+	down    bool
+	objects map[string][]byte
+	reads   int
+}
+
+func newMemory() *memory {
+	return &memory{objects: make(map[string][]byte)}
+}
+
+func (m *memory) isDown() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.down
+}
+
+func (m *memory) Setup() error {
+	return nil
+}
+
+func (m *memory) GetChunk(reader io.Reader) (*storage.Chunk, error) {
+	if m.isDown() {
+		return nil, errDown
+	}
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := storage.Key()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.objects[key] = data
+	return &storage.Chunk{Key: key, Size: uint64(len(data))}, nil
+}
+
+func (m *memory) GetReadCloser(chunk storage.Chunk) (io.ReadCloser, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.reads++
+	if m.down {
+		return nil, errDown
+	}
+
+	data, ok := m.objects[chunk.Key]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data[chunk.ObjectOffset : chunk.ObjectOffset+chunk.Size])), nil
+}
+
+func (m *memory) Remove(chunk storage.Chunk) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.down {
+		return errDown
+	}
+
+	delete(m.objects, chunk.Key)
+	return nil
+}
+
+func read(t *testing.T, st storage.Storage, chunk storage.Chunk) []byte {
+	rc, err := st.GetReadCloser(chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestReplicate(t *testing.T) {
+	a, b := newMemory(), newMemory()
+	r := WithReplication("replicated", a, b)
+
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+	chunk, err := r.GetChunk(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "replicated", chunk.Storage)
+	assert.Equal(t, uint64(len(data)), chunk.Size)
+	assert.Len(t, a.objects, 1)
+	assert.Len(t, b.objects, 1)
+
+	assert.Equal(t, data[5:15], read(t, r, storage.Chunk{Storage: "replicated", Key: chunk.Key, ObjectOffset: 5, Size: 10}))
+
+	assert.Nil(t, r.Remove(*chunk))
+	assert.Empty(t, a.objects)
+	assert.Empty(t, b.objects)
+}
+
+func TestQuorum(t *testing.T) {
+	a, b, c := newMemory(), newMemory(), newMemory()
+	r := WithReplication("replicated", a, b, c)
+	b.down = true
+
+	chunk, err := r.GetChunk(bytes.NewBufferString("hello world"))
+	assert.Nil(t, err, "a majority of the replicas should be enough")
+	assert.Len(t, a.objects, 1)
+	assert.Len(t, c.objects, 1)
+
+	assert.Equal(t, []byte("hello world"), read(t, r, *chunk))
+
+	b.down = false
+	assert.Nil(t, r.Remove(*chunk))
+	assert.Empty(t, a.objects)
+	assert.Empty(t, c.objects)
+
+	r.Quorum = 3
+	b.down = true
+
+	_, err = r.GetChunk(bytes.NewBufferString("hello world"))
+	assert.Equal(t, errDown, err)
+	assert.Empty(t, a.objects, "chunks should be removed when the quorum isn't met")
+	assert.Empty(t, c.objects, "chunks should be removed when the quorum isn't met")
+
+	a.down = true
+	c.down = true
+	r.Quorum = 1
+
+	_, err = r.GetChunk(bytes.NewBufferString("hello world"))
+	assert.Equal(t, errDown, err)
+}
+
+func TestFailover(t *testing.T) {
+	primary, replica := newMemory(), newMemory()
+	r := WithReplication("replicated", primary, replica)
+
+	chunk, err := r.GetChunk(bytes.NewBufferString("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	primary.down = true
+	assert.Equal(t, []byte("hello world"), read(t, r, *chunk))
+	assert.Equal(t, 1, primary.reads)
+	assert.Equal(t, 1, replica.reads)
+
+	// Failed replicas aren't tried first until the cooldown is over
+	assert.Equal(t, []byte("hello world"), read(t, r, *chunk))
+	assert.Equal(t, 1, primary.reads)
+	assert.Equal(t, 2, replica.reads)
+
+	replica.down = true
+	_, err = r.GetReadCloser(*chunk)
+	assert.Equal(t, errDown, err)
+
+	primary.down = false
+	r.Cooldown = 0
+	assert.Equal(t, []byte("hello world"), read(t, r, *chunk))
+}
@@ -0,0 +1,294 @@
+package retry
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/manvalls/titan/storage"
+)
+
+// Classifier tells whether an error is transient, and thus whether the
+// operation which failed with it should be retried
+type Classifier func(error) bool
+
+// Retry wraps a storage retrying the operations failing with retryable
+// errors, waiting an exponentially growing and randomized interval between
+// attempts
+type Retry struct {
+	storage.Storage
+
+	// MaxAttempts is the maximum amount of times an operation is attempted
+	MaxAttempts int
+
+	// InitialInterval is the time waited before the second attempt
+	InitialInterval time.Duration
+
+	// MaxInterval caps the time waited between attempts
+	MaxInterval time.Duration
+
+	// MaxElapsedTime is the time after which no more attempts are made,
+	// unlimited if zero
+	MaxElapsedTime time.Duration
+
+	// Multiplier is the factor the interval grows by after every attempt
+	Multiplier float64
+
+	// Jitter randomizes intervals, e.g 0.5 makes them vary between 50%
+	// and 150% of their value
+	Jitter float64
+
+	// Classifier tells which errors are retryable
+	Classifier Classifier
+
+	// MaxBuffer is the amount of bytes of non-seekable readers kept in memory
+	// as they're uploaded so that they can be read again. Uploads failing
+	// after reading more aren't retried.
+	MaxBuffer int
+
+	// Context is used while waiting between attempts, cancelling it stops
+	// retrying
+	Context context.Context
+
+	sleep func(context.Context, time.Duration) error
+}
+
+// WithRetry wraps the given storage so that transient errors are retried
+// using the default settings
+func WithRetry(st storage.Storage) *Retry {
+	return &Retry{
+		Storage:         st,
+		MaxAttempts:     5,
+		InitialInterval: 100 * time.Millisecond,
+		MaxInterval:     10 * time.Second,
+		MaxElapsedTime:  1 * time.Minute,
+		Multiplier:      2,
+		Jitter:          0.5,
+		Classifier:      Retryable,
+		MaxBuffer:       8 << 20,
+	}
+}
+
+// RetryableStatus tells whether the given HTTP status code denotes a
+// transient error, i.e throttling or an unavailable service
+func RetryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// Retryable is the default classifier, which retries network timeouts and
+// errors carrying a retryable HTTP status code, e.g those of AWS
+func Retryable(err error) bool {
+	if serr, ok := err.(interface{ StatusCode() int }); ok {
+		return RetryableStatus(serr.StatusCode())
+	}
+
+	if nerr, ok := err.(net.Error); ok {
+		return nerr.Timeout()
+	}
+
+	return false
+}
+
+// permanentError stops do from retrying an operation, which fails with the
+// wrapped error
+type permanentError struct {
+	err error
+}
+
+func (p permanentError) Error() string {
+	return p.err.Error()
+}
+
+// buffer keeps the bytes written to it until they exceed its limit, after
+// which it drops them
+type buffer struct {
+	bytes.Buffer
+	max      int
+	overflow bool
+}
+
+func (b *buffer) Write(p []byte) (int, error) {
+	if b.overflow || b.Len()+len(p) > b.max {
+		b.overflow = true
+		b.Reset()
+		return len(p), nil
+	}
+
+	return b.Buffer.Write(p)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (r *Retry) ctx() context.Context {
+	if r.Context == nil {
+		return context.Background()
+	}
+
+	return r.Context
+}
+
+// interval computes the time to wait after the given failed attempt
+func (r *Retry) interval(attempt int) time.Duration {
+	d := float64(r.InitialInterval) * math.Pow(r.Multiplier, float64(attempt-1))
+	if r.MaxInterval > 0 && d > float64(r.MaxInterval) {
+		d = float64(r.MaxInterval)
+	}
+
+	if r.Jitter > 0 {
+		d *= 1 - r.Jitter + 2*r.Jitter*rand.Float64()
+	}
+
+	return time.Duration(d)
+}
+
+func (r *Retry) retryable(err error) bool {
+	if r.Classifier == nil {
+		return Retryable(err)
+	}
+
+	return r.Classifier(err)
+}
+
+// do runs the given operation until it succeeds, fails with a permanent
+// error or runs out of attempts, returning its last error
+func (r *Retry) do(op func() error) error {
+	ctx := r.ctx()
+	start := time.Now()
+
+	wait := r.sleep
+	if wait == nil {
+		wait = sleep
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := op()
+		if perr, ok := err.(permanentError); ok {
+			return perr.err
+		}
+
+		if err == nil || attempt >= r.MaxAttempts || !r.retryable(err) {
+			return err
+		}
+
+		d := r.interval(attempt)
+		if r.MaxElapsedTime > 0 && time.Since(start)+d > r.MaxElapsedTime {
+			return err
+		}
+
+		if serr := wait(ctx, d); serr != nil {
+			return serr
+		}
+	}
+}
+
+// GetChunk stores the contents of a reader and returns the built chunk.
+// Seekable readers are rewound before retrying, while up to MaxBuffer bytes of
+// any other reader are kept in memory as they're uploaded, so that they can be
+// read again. Uploads of the latter failing after reading more aren't retried.
+func (r *Retry) GetChunk(reader io.Reader) (chunk *storage.Chunk, err error) {
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		start, serr := seeker.Seek(0, io.SeekCurrent)
+		if serr != nil {
+			return nil, serr
+		}
+
+		first := true
+		err = r.do(func() (err error) {
+			if !first {
+				if _, err = seeker.Seek(start, io.SeekStart); err != nil {
+					return err
+				}
+			}
+
+			first = false
+			chunk, err = r.Storage.GetChunk(seeker)
+			return err
+		})
+
+		return chunk, err
+	}
+
+	read := &buffer{max: r.MaxBuffer}
+	err = r.do(func() (err error) {
+		// Replay what was read by previous attempts before reading on
+		body := io.MultiReader(bytes.NewReader(read.Bytes()), io.TeeReader(reader, read))
+
+		chunk, err = r.Storage.GetChunk(body)
+		if err != nil && read.overflow {
+			return permanentError{err}
+		}
+
+		return err
+	})
+
+	return chunk, err
+}
+
+// GetReadCloser retrieves the contents of a chunk
+func (r *Retry) GetReadCloser(chunk storage.Chunk) (rc io.ReadCloser, err error) {
+	err = r.do(func() (err error) {
+		rc, err = r.Storage.GetReadCloser(chunk)
+		return err
+	})
+
+	return rc, err
+}
+
+// Exists tells whether the object of a chunk is stored
+func (r *Retry) Exists(chunk storage.Chunk) (exists bool, err error) {
+	err = r.do(func() (err error) {
+		exists, err = storage.Exists(r.Storage, chunk)
+		return err
+	})
+
+	return exists, err
+}
+
+// ETag returns the current ETag of the object of a chunk
+func (r *Retry) ETag(chunk storage.Chunk) (etag string, exists bool, err error) {
+	err = r.do(func() (err error) {
+		etag, exists, err = storage.ETag(r.Storage, chunk)
+		return err
+	})
+
+	return etag, exists, err
+}
+
+// Remove removes a chunk from the storage
+func (r *Retry) Remove(chunk storage.Chunk) error {
+	return r.do(func() error {
+		return r.Storage.Remove(chunk)
+	})
+}
+
+// RemoveBatch removes several chunks from the storage
+func (r *Retry) RemoveBatch(chunks []storage.Chunk) error {
+	return r.do(func() error {
+		return storage.RemoveBatch(r.Storage, chunks)
+	})
+}
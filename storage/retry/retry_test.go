@@ -0,0 +1,211 @@
+package retry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/manvalls/titan/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+type statusError int
+
+func (s statusError) Error() string {
+	return "status " + strconv.Itoa(int(s))
+}
+
+func (s statusError) StatusCode() int {
+	return int(s)
+}
+
+// flakyStorage fails the first operations with the given error, keeping
+// the contents of the chunks it stores
+type flakyStorage struct {
+	failures int
+	err      error
+	attempts int
+	contents []string
+}
+
+func (f *flakyStorage) fail() error {
+	f.attempts++
+	if f.attempts <= f.failures {
+		return f.err
+	}
+
+	return nil
+}
+
+func (f *flakyStorage) Setup() error {
+	return nil
+}
+
+func (f *flakyStorage) GetChunk(reader io.Reader) (*storage.Chunk, error) {
+	// Read part of the contents before failing, as an interrupted upload would
+	buf := make([]byte, 3)
+	n, _ := io.ReadFull(reader, buf)
+
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+
+	rest, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	f.contents = append(f.contents, string(buf[:n])+string(rest))
+	return &storage.Chunk{Key: "key", Size: uint64(n + len(rest))}, nil
+}
+
+func (f *flakyStorage) GetReadCloser(chunk storage.Chunk) (io.ReadCloser, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(strings.NewReader("data")), nil
+}
+
+func (f *flakyStorage) Remove(chunk storage.Chunk) error {
+	return f.fail()
+}
+
+func getTestRetry(st storage.Storage) (*Retry, *[]time.Duration) {
+	waits := []time.Duration{}
+
+	r := WithRetry(st)
+	r.InitialInterval = 10 * time.Millisecond
+	r.Jitter = 0
+	r.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+
+	return r, &waits
+}
+
+func TestBackoff(t *testing.T) {
+	f := &flakyStorage{failures: 2, err: statusError(503)}
+	r, waits := getTestRetry(f)
+
+	assert.Nil(t, r.Remove(storage.Chunk{}))
+	assert.Equal(t, 3, f.attempts)
+	assert.Equal(t, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}, *waits)
+
+	f = &flakyStorage{failures: 2, err: statusError(429)}
+	r = WithRetry(f)
+	r.InitialInterval = 20 * time.Millisecond
+
+	start := time.Now()
+	rc, err := r.GetReadCloser(storage.Chunk{})
+	assert.Nil(t, err)
+	rc.Close()
+
+	assert.Equal(t, 3, f.attempts)
+	assert.True(t, time.Since(start) >= 30*time.Millisecond, "attempts should be spaced by the jittered intervals")
+}
+
+func TestJitter(t *testing.T) {
+	r := WithRetry(nil)
+	r.InitialInterval = 100 * time.Millisecond
+	r.MaxInterval = 300 * time.Millisecond
+
+	for i := 0; i < 100; i++ {
+		d := r.interval(1)
+		assert.True(t, d >= 50*time.Millisecond && d <= 150*time.Millisecond)
+
+		d = r.interval(4)
+		assert.True(t, d >= 150*time.Millisecond && d <= 450*time.Millisecond, "intervals should be capped before being randomized")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	f := &flakyStorage{failures: 10, err: statusError(503)}
+	r, waits := getTestRetry(f)
+	r.MaxAttempts = 4
+
+	assert.Equal(t, statusError(503), r.Remove(storage.Chunk{}))
+	assert.Equal(t, 4, f.attempts)
+	assert.Len(t, *waits, 3)
+
+	f = &flakyStorage{failures: 10, err: statusError(503)}
+	r, waits = getTestRetry(f)
+	r.MaxElapsedTime = 15 * time.Millisecond
+
+	assert.Equal(t, statusError(503), r.Remove(storage.Chunk{}))
+	assert.Equal(t, 2, f.attempts, "no attempt should be made past the maximum elapsed time")
+
+	f = &flakyStorage{failures: 10, err: statusError(404)}
+	r, _ = getTestRetry(f)
+
+	assert.Equal(t, statusError(404), r.Remove(storage.Chunk{}))
+	assert.Equal(t, 1, f.attempts, "permanent errors should not be retried")
+
+	f = &flakyStorage{failures: 10, err: errors.New("custom")}
+	r, _ = getTestRetry(f)
+	r.Classifier = func(err error) bool { return err.Error() == "custom" }
+
+	assert.NotNil(t, r.Remove(storage.Chunk{}))
+	assert.Equal(t, r.MaxAttempts, f.attempts)
+}
+
+func TestCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	f := &flakyStorage{failures: 10, err: statusError(503)}
+	r := WithRetry(f)
+	r.InitialInterval = time.Hour
+	r.Context = ctx
+
+	time.AfterFunc(10*time.Millisecond, cancel)
+	assert.Equal(t, context.Canceled, r.Remove(storage.Chunk{}))
+	assert.Equal(t, 1, f.attempts)
+
+	assert.Equal(t, context.Canceled, r.Remove(storage.Chunk{}))
+	assert.Equal(t, 1, f.attempts, "no attempt should be made once cancelled")
+}
+
+func TestGetChunk(t *testing.T) {
+	data := "0123456789"
+
+	f := &flakyStorage{failures: 2, err: statusError(503)}
+	r, _ := getTestRetry(f)
+
+	chunk, err := r.GetChunk(strings.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(len(data)), chunk.Size)
+	assert.Equal(t, []string{data}, f.contents)
+
+	f = &flakyStorage{failures: 2, err: statusError(503)}
+	r, _ = getTestRetry(f)
+
+	// Buffers can't seek, so their contents need to be kept aside
+	chunk, err = r.GetChunk(bytes.NewBufferString(data))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(len(data)), chunk.Size)
+	assert.Equal(t, []string{data}, f.contents)
+
+	f = &flakyStorage{failures: 2, err: statusError(503)}
+	r, _ = getTestRetry(f)
+	r.MaxBuffer = 2
+
+	// Uploads having read more than what's kept aside can't be retried
+	_, err = r.GetChunk(bytes.NewBufferString(data))
+	assert.Equal(t, statusError(503), err)
+	assert.Equal(t, 1, f.attempts)
+
+	f = &flakyStorage{}
+	r, _ = getTestRetry(f)
+	r.MaxBuffer = 2
+
+	chunk, err = r.GetChunk(bytes.NewBufferString(data))
+	assert.Nil(t, err, "uploads not failing shouldn't be limited")
+	assert.Equal(t, []string{data}, f.contents)
+}
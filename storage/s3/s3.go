@@ -2,14 +2,19 @@ package s3
 
 import (
 	"io"
+	"net/http"
 	"strconv"
 
 	"github.com/manvalls/titan/storage"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
+// maxBatchSize is the maximum amount of objects which can be deleted at once
+const maxBatchSize = 1000
+
 // S3 is an AWS S3 implementation of the storage interface
 type S3 struct {
 	Storage string
@@ -23,6 +28,10 @@ func (s *S3) Setup() error {
 		Bucket: aws.String(s.Bucket),
 	})
 
+	if isAwsError(err, s3.ErrCodeBucketAlreadyOwnedByYou) {
+		return nil
+	}
+
 	return err
 }
 
@@ -36,7 +45,7 @@ func (s *S3) GetChunk(reader io.Reader) (*storage.Chunk, error) {
 		return nil, err
 	}
 
-	_, err = uploader.Upload(&s3manager.UploadInput{
+	output, err := uploader.Upload(&s3manager.UploadInput{
 		Body:   r,
 		Bucket: aws.String(s.Bucket),
 		Key:    aws.String(filename),
@@ -51,6 +60,8 @@ func (s *S3) GetChunk(reader io.Reader) (*storage.Chunk, error) {
 		Key:          filename,
 		ObjectOffset: 0,
 		Size:         r.Size,
+		ETag:         aws.StringValue(output.ETag),
+		Version:      aws.StringValue(output.VersionID),
 	}, err
 }
 
@@ -69,6 +80,39 @@ func (s *S3) GetReadCloser(chunk storage.Chunk) (io.ReadCloser, error) {
 	return result.Body, nil
 }
 
+// Exists tells whether the object of a chunk is stored
+func (s *S3) Exists(chunk storage.Chunk) (bool, error) {
+	_, err := s.Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(chunk.Key),
+	})
+
+	// HEAD responses have no body, so missing objects only have a status
+	if rerr, ok := err.(awserr.RequestFailure); ok && rerr.StatusCode() == http.StatusNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// ETag returns the current ETag of the object of a chunk
+func (s *S3) ETag(chunk storage.Chunk) (string, bool, error) {
+	output, err := s.Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(chunk.Key),
+	})
+
+	if rerr, ok := err.(awserr.RequestFailure); ok && rerr.StatusCode() == http.StatusNotFound {
+		return "", false, nil
+	}
+
+	if err != nil {
+		return "", false, err
+	}
+
+	return aws.StringValue(output.ETag), true, nil
+}
+
 // Remove removes a chunk from the storage
 func (s *S3) Remove(chunk storage.Chunk) error {
 	_, err := s.Client.DeleteObject(&s3.DeleteObjectInput{
@@ -76,5 +120,62 @@ func (s *S3) Remove(chunk storage.Chunk) error {
 		Key:    aws.String(chunk.Key),
 	})
 
+	if isAwsError(err, s3.ErrCodeNoSuchKey) {
+		return nil
+	}
+
 	return err
 }
+
+// RemoveBatch removes several chunks from the storage, using as few requests
+// as possible
+func (s *S3) RemoveBatch(chunks []storage.Chunk) error {
+	keys := make([]string, 0, len(chunks))
+	seen := make(map[string]bool)
+
+	for _, chunk := range chunks {
+		if !seen[chunk.Key] {
+			seen[chunk.Key] = true
+			keys = append(keys, chunk.Key)
+		}
+	}
+
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxBatchSize {
+			n = maxBatchSize
+		}
+
+		objects := make([]*s3.ObjectIdentifier, 0, n)
+		for _, key := range keys[:n] {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+
+		result, err := s.Client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(s.Bucket),
+			Delete: &s3.Delete{
+				Objects: objects,
+				Quiet:   aws.Bool(true),
+			},
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, e := range result.Errors {
+			if aws.StringValue(e.Code) != s3.ErrCodeNoSuchKey {
+				return awserr.New(aws.StringValue(e.Code), aws.StringValue(e.Message), nil)
+			}
+		}
+
+		keys = keys[n:]
+	}
+
+	return nil
+}
+
+func isAwsError(err error, code string) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == code
+}
@@ -0,0 +1,350 @@
+package sftp
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/manvalls/titan/storage"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// shardWidth is the amount of key characters used to name each level of
+// subdirectories
+const shardWidth = 2
+
+// shardLevels is the amount of nested subdirectories a chunk is stored under
+const shardLevels = 2
+
+// SFTP is an implementation of the storage interface for hosts only
+// reachable through SSH, storing chunks as files under a remote folder
+type SFTP struct {
+	Storage string
+
+	// Addr is the host:port of the SSH server
+	Addr string
+
+	// Config holds the credentials and host key checks used to connect
+	Config *ssh.ClientConfig
+
+	// Root is the remote folder under which chunks are stored
+	Root string
+
+	// Connections is the amount of SSH connections kept open and shared by
+	// every operation, one if not set
+	Connections int
+
+	mutex sync.Mutex
+	pool  []*conn
+	next  int
+}
+
+type conn struct {
+	ssh  *ssh.Client
+	sftp *sftp.Client
+}
+
+func (c *conn) close() {
+	c.sftp.Close()
+	c.ssh.Close()
+}
+
+// NewClientConfig builds the configuration used to connect as the given user,
+// authenticating with a password, a private key file or both, and checking
+// the host key of the server against a known_hosts file
+func NewClientConfig(user, password, keyFile, knownHostsFile string) (*ssh.ClientConfig, error) {
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := []ssh.AuthMethod{}
+
+	if keyFile != "" {
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+
+	if password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}, nil
+}
+
+// path computes the location of the given key, sharded into subdirectories
+// named after its prefix to avoid huge folders
+func (s *SFTP) path(key string) string {
+	parts := []string{s.Root}
+
+	for i := 0; i < shardLevels && (i+1)*shardWidth < len(key); i++ {
+		parts = append(parts, key[i*shardWidth:(i+1)*shardWidth])
+	}
+
+	return path.Join(append(parts, key)...)
+}
+
+// client returns the next pooled connection, dialing it if it isn't open
+func (s *SFTP) client() (*conn, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.pool == nil {
+		size := s.Connections
+		if size < 1 {
+			size = 1
+		}
+
+		s.pool = make([]*conn, size)
+	}
+
+	i := s.next % len(s.pool)
+	s.next = i + 1
+
+	if s.pool[i] != nil {
+		return s.pool[i], nil
+	}
+
+	sshClient, err := ssh.Dial("tcp", s.Addr, s.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+
+	c := &conn{ssh: sshClient, sftp: sftpClient}
+	s.pool[i] = c
+
+	// Dropped connections are taken out of the pool right away, so that the
+	// next operations dial a new one
+	go func() {
+		sshClient.Wait()
+		s.discard(c)
+	}()
+
+	return c, nil
+}
+
+// discard closes the given connection and removes it from the pool
+func (s *SFTP) discard(c *conn) {
+	s.mutex.Lock()
+	for i, pooled := range s.pool {
+		if pooled == c {
+			s.pool[i] = nil
+		}
+	}
+
+	s.mutex.Unlock()
+	c.close()
+}
+
+// broken tells whether an error was caused by the connection rather than
+// by the server refusing the operation
+func broken(err error) bool {
+	var status *sftp.StatusError
+	if errors.As(err, &status) {
+		return false
+	}
+
+	return !errors.Is(err, os.ErrNotExist) && !errors.Is(err, os.ErrPermission) && !errors.Is(err, os.ErrExist)
+}
+
+// do runs the operation using a pooled connection. Connections found broken
+// are discarded and, unless canRetry tells otherwise, the operation is
+// attempted once more using a new one.
+func (s *SFTP) do(op func(*sftp.Client) error, canRetry func() bool) error {
+	for attempt := 0; ; attempt++ {
+		c, err := s.client()
+		if err != nil {
+			return err
+		}
+
+		err = op(c.sftp)
+		if err == nil || !broken(err) {
+			return err
+		}
+
+		s.discard(c)
+		if attempt > 0 || (canRetry != nil && !canRetry()) {
+			return err
+		}
+	}
+}
+
+// Close closes the pooled connections
+func (s *SFTP) Close() error {
+	s.mutex.Lock()
+	pool := s.pool
+	s.pool = nil
+	s.mutex.Unlock()
+
+	for _, c := range pool {
+		if c != nil {
+			c.close()
+		}
+	}
+
+	return nil
+}
+
+// Setup sets up the storage
+func (s *SFTP) Setup() error {
+	return s.do(func(client *sftp.Client) error {
+		return client.MkdirAll(s.Root)
+	}, nil)
+}
+
+// GetChunk stores the contents of a reader and returns the built chunk
+func (s *SFTP) GetChunk(reader io.Reader) (*storage.Chunk, error) {
+	r := &storage.ReaderWithSize{Reader: reader}
+
+	filename, err := storage.Key()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.do(func(client *sftp.Client) error {
+		return s.write(client, filename, r)
+	}, func() bool {
+		// Contents already sent can't be read again
+		return r.Size == 0
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &storage.Chunk{
+		Storage:      s.Storage,
+		Key:          filename,
+		ObjectOffset: 0,
+		Size:         r.Size,
+	}, nil
+}
+
+// write stores the contents of the reader in a temporary file which is then
+// renamed to its final location, so that an interrupted upload never leaves
+// a partial chunk
+func (s *SFTP) write(client *sftp.Client, key string, reader io.Reader) error {
+	p := s.path(key)
+	dir := path.Dir(p)
+	tmp := path.Join(dir, "."+key+".tmp")
+
+	file, err := client.Create(tmp)
+	if errors.Is(err, os.ErrNotExist) {
+		if err = client.MkdirAll(dir); err != nil {
+			return err
+		}
+
+		file, err = client.Create(tmp)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, reader)
+
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = client.Rename(tmp, p)
+	}
+
+	if err != nil {
+		client.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+type fileReadCloser struct {
+	io.Reader
+	file *sftp.File
+}
+
+func (frc *fileReadCloser) Close() error {
+	return frc.file.Close()
+}
+
+// GetReadCloser retrieves the contents of a chunk
+func (s *SFTP) GetReadCloser(chunk storage.Chunk) (io.ReadCloser, error) {
+	var file *sftp.File
+
+	err := s.do(func(client *sftp.Client) (err error) {
+		file, err = client.Open(s.path(chunk.Key))
+		if err != nil {
+			return err
+		}
+
+		if _, err = file.Seek(int64(chunk.ObjectOffset), io.SeekStart); err != nil {
+			file.Close()
+			return err
+		}
+
+		return nil
+	}, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileReadCloser{
+		Reader: io.LimitReader(file, int64(chunk.Size)),
+		file:   file,
+	}, nil
+}
+
+// Exists tells whether the object of a chunk is stored
+func (s *SFTP) Exists(chunk storage.Chunk) (bool, error) {
+	err := s.do(func(client *sftp.Client) error {
+		_, err := client.Stat(s.path(chunk.Key))
+		return err
+	}, nil)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Remove removes a chunk from the storage
+func (s *SFTP) Remove(chunk storage.Chunk) error {
+	err := s.do(func(client *sftp.Client) error {
+		return client.Remove(s.path(chunk.Key))
+	}, nil)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
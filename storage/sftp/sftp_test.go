@@ -0,0 +1,269 @@
+package sftp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/manvalls/titan/storage"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is a local SSH server exposing its file system through SFTP
+type testServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+
+	mutex    sync.Mutex
+	conns    []net.Conn
+	accepted int
+}
+
+func newTestServer(t *testing.T) (*testServer, *ssh.ClientConfig) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "titan" && string(password) == "secret" {
+				return nil, nil
+			}
+
+			return nil, errors.New("wrong credentials")
+		},
+	}
+
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := &testServer{listener: listener, config: config}
+	go ts.serve()
+
+	return ts, &ssh.ClientConfig{
+		User:            "titan",
+		Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: ssh.FixedHostKey(signer.PublicKey()),
+	}
+}
+
+func (ts *testServer) serve() {
+	for {
+		conn, err := ts.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		ts.mutex.Lock()
+		ts.conns = append(ts.conns, conn)
+		ts.accepted++
+		ts.mutex.Unlock()
+
+		go ts.handle(conn)
+	}
+}
+
+func (ts *testServer) handle(conn net.Conn) {
+	_, channels, requests, err := ssh.NewServerConn(conn, ts.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		go func(requests <-chan *ssh.Request) {
+			for req := range requests {
+				// The payload holds the length prefixed subsystem name
+				req.Reply(req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp", nil)
+			}
+		}(requests)
+
+		server, err := sftp.NewServer(channel)
+		if err != nil {
+			channel.Close()
+			continue
+		}
+
+		go func() {
+			server.Serve()
+			server.Close()
+		}()
+	}
+}
+
+// drop abruptly closes every open connection
+func (ts *testServer) drop() {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	for _, conn := range ts.conns {
+		conn.Close()
+	}
+
+	ts.conns = nil
+}
+
+func (ts *testServer) close() {
+	ts.listener.Close()
+	ts.drop()
+}
+
+func getTestStorage(t *testing.T) (*SFTP, *testServer, func()) {
+	dir, err := ioutil.TempDir("", "titan")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts, config := newTestServer(t)
+
+	s := &SFTP{
+		Storage: "sftp",
+		Addr:    ts.listener.Addr().String(),
+		Config:  config,
+		Root:    filepath.ToSlash(filepath.Join(dir, "chunks")),
+	}
+
+	if err := s.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	return s, ts, func() {
+		s.Close()
+		ts.close()
+		os.RemoveAll(dir)
+	}
+}
+
+func read(t *testing.T, s *SFTP, chunk storage.Chunk) []byte {
+	rc, err := s.GetReadCloser(chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestSFTP(t *testing.T) {
+	s, _, cleanup := getTestStorage(t)
+	defer cleanup()
+
+	data := []byte("0123456789")
+	chunk, err := s.GetChunk(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "sftp", chunk.Storage)
+	assert.Equal(t, uint64(len(data)), chunk.Size)
+
+	_, err = os.Stat(filepath.Join(s.Root, chunk.Key[0:2], chunk.Key[2:4], chunk.Key))
+	assert.Nil(t, err, "chunks should be sharded by the prefix of their keys")
+
+	temporary, err := filepath.Glob(filepath.Join(s.Root, "*", "*", ".*"))
+	assert.Nil(t, err)
+	assert.Empty(t, temporary)
+
+	for _, c := range []storage.Chunk{
+		*chunk,
+		{Storage: "sftp", Key: chunk.Key, ObjectOffset: 2, Size: 5},
+		{Storage: "sftp", Key: chunk.Key, ObjectOffset: 9, Size: 1},
+		{Storage: "sftp", Key: chunk.Key, ObjectOffset: 4, Size: 0},
+	} {
+		assert.Equal(t, data[c.ObjectOffset:c.ObjectOffset+c.Size], read(t, s, c))
+	}
+
+	assert.Nil(t, s.Remove(*chunk))
+	assert.Nil(t, s.Remove(*chunk), "removing a missing chunk should succeed")
+
+	_, err = s.GetReadCloser(*chunk)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+func TestPool(t *testing.T) {
+	s, ts, cleanup := getTestStorage(t)
+	defer cleanup()
+
+	s.Close()
+	s.Connections = 2
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			chunk, err := s.GetChunk(bytes.NewReader([]byte("data")))
+			if assert.Nil(t, err) {
+				assert.Equal(t, []byte("data"), read(t, s, *chunk))
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	assert.Equal(t, 3, ts.accepted, "connections should be reused")
+}
+
+func TestReconnect(t *testing.T) {
+	s, ts, cleanup := getTestStorage(t)
+	defer cleanup()
+
+	chunk, err := s.GetChunk(bytes.NewReader([]byte("hello world")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts.drop()
+	assert.Equal(t, []byte("hello world"), read(t, s, *chunk))
+
+	ts.drop()
+	chunk, err = s.GetChunk(bytes.NewReader([]byte("hello again")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []byte("hello again"), read(t, s, *chunk))
+
+	ts.drop()
+	assert.Nil(t, s.Remove(*chunk))
+}
@@ -1,8 +1,10 @@
 package storage
 
 import (
+	"errors"
 	"io"
 	"math/rand"
+	"os"
 	"sync"
 	"time"
 
@@ -42,6 +44,104 @@ type Storage interface {
 	Remove(Chunk) error
 }
 
+// BatchRemover is implemented by storages able to remove several chunks
+// at once
+type BatchRemover interface {
+	RemoveBatch([]Chunk) error
+}
+
+// RemoveBatch removes the given chunks from the storage, at once if it
+// implements BatchRemover or one by one otherwise, returning the first error
+func RemoveBatch(st Storage, chunks []Chunk) error {
+	if br, ok := st.(BatchRemover); ok {
+		return br.RemoveBatch(chunks)
+	}
+
+	var result error
+	for _, chunk := range chunks {
+		if err := st.Remove(chunk); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	return result
+}
+
+// Checker is implemented by storages able to tell whether the object of a
+// chunk exists without retrieving it, e.g with a HEAD request
+type Checker interface {
+	Exists(Chunk) (bool, error)
+}
+
+// Exists tells whether the object of the given chunk is still stored, asking
+// the storage if it implements Checker or opening the chunk otherwise, in
+// which case os.ErrNotExist errors report it as missing
+func Exists(st Storage, chunk Chunk) (bool, error) {
+	if c, ok := st.(Checker); ok {
+		return c.Exists(chunk)
+	}
+
+	rc, err := st.GetReadCloser(chunk)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, rc.Close()
+}
+
+// ErrNotTiered is returned by GetChunkAt when the storage can't store objects
+// at the requested one
+var ErrNotTiered = errors.New("Storage can't store objects at other storages")
+
+// Tiered is implemented by storages made of several named ones, able to store
+// objects at any of them
+type Tiered interface {
+	GetChunkAt(storage string, reader io.Reader) (*Chunk, error)
+}
+
+// GetChunkAt stores the contents of a reader at the named storage, asking the
+// given one to do so if it implements Tiered, or storing them as usual
+// otherwise, in which case the name must match the one of the storage
+func GetChunkAt(st Storage, name string, reader io.Reader) (*Chunk, error) {
+	if t, ok := st.(Tiered); ok {
+		return t.GetChunkAt(name, reader)
+	}
+
+	chunk, err := st.GetChunk(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if chunk.Storage != name {
+		st.Remove(*chunk)
+		return nil, ErrNotTiered
+	}
+
+	return chunk, nil
+}
+
+// Tagger is implemented by storages able to tell the current ETag of the
+// object of a chunk without retrieving it, e.g with a HEAD request
+type Tagger interface {
+	ETag(Chunk) (string, bool, error)
+}
+
+// ETag returns the current ETag of the object of the given chunk along with
+// whether it exists, the ETag being empty if the storage doesn't implement
+// Tagger, in which case it's only checked to exist
+func ETag(st Storage, chunk Chunk) (string, bool, error) {
+	if t, ok := st.(Tagger); ok {
+		return t.ETag(chunk)
+	}
+
+	exists, err := Exists(st, chunk)
+	return "", exists, err
+}
+
 // Chunk contains information about the location of a particular piece
 // of binary data
 type Chunk struct {
@@ -57,6 +157,11 @@ type Chunk struct {
 
 	// Size represents the size of this chunk
 	Size uint64
+
+	// ETag and Version are reported by the storage when storing the object,
+	// if it supports them, telling whether it was overwritten since
+	ETag    string
+	Version string
 }
 
 // ReaderWithSize is a Reader which holds the amount of read bytes
@@ -70,6 +70,12 @@ func (z *Zero) GetReadCloser(chunk storage.Chunk) (io.ReadCloser, error) {
 	return &zeroReadCloser{remainingBytes: chunk.Size}, nil
 }
 
+// Exists tells whether the object of a chunk is stored, which is always the
+// case as chunks are made of zeros
+func (z *Zero) Exists(chunk storage.Chunk) (bool, error) {
+	return true, nil
+}
+
 // Remove removes a chunk from the storage
 func (z *Zero) Remove(chunk storage.Chunk) error {
 	return nil
@@ -0,0 +1,306 @@
+// Package writeback coalesces small writes into larger storage objects.
+//
+// Writes are kept in memory until the inode is flushed, either explicitly
+// through Flush, because the buffered data reached MaxSize or because the
+// oldest buffered write is older than MaxAge. Buffered data is not visible
+// to readers and is lost if the process crashes before it's flushed, so
+// Flush must be called whenever durability is required, e.g on fsync.
+// Once an object has been stored, a chunk is added for every run of
+// contiguous writes: a crash in between leaves only some of them applied,
+// but never a chunk pointing to missing data.
+package writeback
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database"
+	"github.com/manvalls/titan/storage"
+)
+
+var errNotInited = errors.New("This write back buffer has not been initialized")
+var errAlreadyInited = errors.New("This write back buffer has already been initialized")
+
+type write struct {
+	offset uint64
+	data   []byte
+}
+
+type buffer struct {
+	flags   uint32
+	size    uint64
+	started time.Time
+	writes  []write
+}
+
+// WriteBack buffers writes to several inodes, storing each inode's pending
+// writes as a single object when flushed
+type WriteBack struct {
+	database.Db
+	storage.Storage
+	MaxSize       uint64
+	MaxAge        time.Duration
+	FlushInterval time.Duration
+
+	stopChannel chan bool
+	inited      bool
+	mutex       sync.Mutex
+	pending     map[fuseops.InodeID]*buffer
+	flushing    map[fuseops.InodeID]chan struct{}
+	errors      map[fuseops.InodeID]error
+}
+
+// NewWriteBack returns a new write back buffer
+func NewWriteBack() *WriteBack {
+	return &WriteBack{
+		MaxSize:       8 * 1024 * 1024,
+		MaxAge:        5 * time.Second,
+		FlushInterval: 1 * time.Second,
+		stopChannel:   make(chan bool),
+		inited:        false,
+		mutex:         sync.Mutex{},
+		pending:       make(map[fuseops.InodeID]*buffer),
+		flushing:      make(map[fuseops.InodeID]chan struct{}),
+		errors:        make(map[fuseops.InodeID]error),
+	}
+}
+
+// Init starts flushing buffers older than MaxAge in the background
+func (w *WriteBack) Init() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.inited {
+		return errAlreadyInited
+	}
+
+	go func() {
+
+		for {
+			select {
+			case <-w.stopChannel:
+				return
+			case <-time.After(w.FlushInterval):
+				w.flushExpired()
+			}
+		}
+
+	}()
+
+	w.inited = true
+	return nil
+}
+
+// Destroy stops the background flush and flushes every pending write
+func (w *WriteBack) Destroy(ctx context.Context) error {
+	w.mutex.Lock()
+
+	if !w.inited {
+		w.mutex.Unlock()
+		return errNotInited
+	}
+
+	w.inited = false
+	w.mutex.Unlock()
+
+	w.stopChannel <- true
+
+	w.mutex.Lock()
+	inodes := make([]fuseops.InodeID, 0, len(w.pending))
+	for inode := range w.pending {
+		inodes = append(inodes, inode)
+	}
+
+	w.mutex.Unlock()
+
+	var result error
+	for _, inode := range inodes {
+		if err := w.Flush(ctx, inode); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	return result
+}
+
+// Write buffers the given data to be written to the inode at the provided
+// offset. Errors of previous background flushes of the inode are reported here.
+func (w *WriteBack) Write(ctx context.Context, inode fuseops.InodeID, flags uint32, offset uint64, data []byte) error {
+	w.mutex.Lock()
+
+	if err, ok := w.errors[inode]; ok {
+		delete(w.errors, inode)
+		w.mutex.Unlock()
+		return err
+	}
+
+	buf, ok := w.pending[inode]
+	if ok && buf.flags != flags {
+		w.mutex.Unlock()
+
+		if err := w.flush(ctx, inode); err != nil {
+			return err
+		}
+
+		w.mutex.Lock()
+		buf, ok = w.pending[inode]
+	}
+
+	if !ok {
+		buf = &buffer{flags: flags, started: time.Now()}
+		w.pending[inode] = buf
+	}
+
+	buf.writes = append(buf.writes, write{offset, append([]byte(nil), data...)})
+	buf.size += uint64(len(data))
+	full := buf.size >= w.MaxSize
+
+	w.mutex.Unlock()
+
+	if full {
+		return w.flush(ctx, inode)
+	}
+
+	return nil
+}
+
+// Flush stores the pending writes of the given inode, waiting for any
+// flush already in progress. Errors of previous background flushes of
+// the inode are reported here.
+func (w *WriteBack) Flush(ctx context.Context, inode fuseops.InodeID) error {
+	err := w.flush(ctx, inode)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if previous, ok := w.errors[inode]; ok {
+		delete(w.errors, inode)
+		if err == nil {
+			err = previous
+		}
+	}
+
+	return err
+}
+
+// flushExpired flushes in the background the inodes whose oldest buffered
+// write is older than MaxAge
+func (w *WriteBack) flushExpired() {
+	w.mutex.Lock()
+
+	inodes := make([]fuseops.InodeID, 0)
+	for inode, buf := range w.pending {
+		if time.Since(buf.started) >= w.MaxAge {
+			inodes = append(inodes, inode)
+		}
+	}
+
+	w.mutex.Unlock()
+
+	for _, inode := range inodes {
+		if err := w.flush(context.Background(), inode); err != nil {
+			w.mutex.Lock()
+			w.errors[inode] = err
+			w.mutex.Unlock()
+		}
+	}
+}
+
+func (w *WriteBack) flush(ctx context.Context, inode fuseops.InodeID) error {
+	w.mutex.Lock()
+
+	for {
+		ch, ok := w.flushing[inode]
+		if !ok {
+			break
+		}
+
+		w.mutex.Unlock()
+		<-ch
+		w.mutex.Lock()
+	}
+
+	buf, ok := w.pending[inode]
+	if !ok {
+		w.mutex.Unlock()
+		return nil
+	}
+
+	ch := make(chan struct{})
+	delete(w.pending, inode)
+	w.flushing[inode] = ch
+	w.mutex.Unlock()
+
+	err := w.store(ctx, inode, buf)
+
+	w.mutex.Lock()
+	delete(w.flushing, inode)
+	close(ch)
+	w.mutex.Unlock()
+
+	return err
+}
+
+// store saves the buffered writes as a single object and adds a chunk for
+// every run of contiguous writes, appends being always contiguous
+func (w *WriteBack) store(ctx context.Context, inode fuseops.InodeID, buf *buffer) error {
+	data := make([]byte, 0, buf.size)
+	chunks := make([]database.Chunk, 0, len(buf.writes))
+	appending := buf.flags&syscall.O_APPEND != 0
+
+	for _, wr := range buf.writes {
+		if len(wr.data) == 0 {
+			continue
+		}
+
+		last := len(chunks) - 1
+		if last >= 0 && (appending || chunks[last].InodeOffset+chunks[last].Size == wr.offset) {
+			chunks[last].Size += uint64(len(wr.data))
+		} else {
+			chunks = append(chunks, database.Chunk{
+				Inode:       inode,
+				InodeOffset: wr.offset,
+				Chunk: storage.Chunk{
+					ObjectOffset: uint64(len(data)),
+					Size:         uint64(len(wr.data)),
+				},
+			})
+		}
+
+		data = append(data, wr.data...)
+	}
+
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	object, err := w.GetChunk(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	for _, chunk := range chunks {
+		chunk.Storage = object.Storage
+		chunk.Key = object.Key
+		chunk.ETag = object.ETag
+		chunk.Version = object.Version
+
+		piece := data[chunk.ObjectOffset : chunk.ObjectOffset+chunk.Size]
+		hash := sha256.Sum256(piece)
+		chunk.Hash = hex.EncodeToString(hash[:])
+		chunk.Checksum = database.Checksum(piece)
+
+		if err = w.AddChunk(ctx, inode, buf.flags, chunk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
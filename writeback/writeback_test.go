@@ -0,0 +1,317 @@
+package writeback
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database/dbtest"
+	"github.com/manvalls/titan/database/sqlite"
+	"github.com/manvalls/titan/storage"
+	"github.com/manvalls/titan/storage/file"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingStorage struct {
+	storage.Storage
+	mutex   sync.Mutex
+	objects int
+	removed int
+}
+
+func (c *countingStorage) GetChunk(reader io.Reader) (*storage.Chunk, error) {
+	c.mutex.Lock()
+	c.objects++
+	c.mutex.Unlock()
+
+	return c.Storage.GetChunk(reader)
+}
+
+// versionedStorage reports an ETag and a version for every object it stores
+type versionedStorage struct {
+	storage.Storage
+}
+
+func (v versionedStorage) GetChunk(reader io.Reader) (*storage.Chunk, error) {
+	chunk, err := v.Storage.GetChunk(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	chunk.ETag = "etag-" + chunk.Key
+	chunk.Version = "version-" + chunk.Key
+	return chunk, nil
+}
+
+func (c *countingStorage) Remove(chunk storage.Chunk) error {
+	c.mutex.Lock()
+	c.removed++
+	c.mutex.Unlock()
+
+	return c.Storage.Remove(chunk)
+}
+
+func (c *countingStorage) count() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.objects
+}
+
+func (c *countingStorage) live() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.objects - c.removed
+}
+
+func getTestWriteBack(t testing.TB) (*WriteBack, *countingStorage, func()) {
+	dir, err := ioutil.TempDir("", "titan")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &sqlite.Driver{DbURI: filepath.Join(dir, "titan.db"), BusyRetries: 10, ForeignKeys: true}
+	if err := d.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Setup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	st := &countingStorage{Storage: &file.File{Storage: "file", Root: filepath.Join(dir, "chunks")}}
+
+	w := NewWriteBack()
+	w.Db = d
+	w.Storage = st
+
+	return w, st, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func contents(t testing.TB, w *WriteBack, inode fuseops.InodeID) []byte {
+	chunks, err := w.Chunks(context.Background(), inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := make([]byte, 0)
+	for _, chunk := range *chunks {
+		if chunk.Storage == "zero" {
+			result = append(result, make([]byte, chunk.Size)...)
+			continue
+		}
+
+		rc, err := w.GetReadCloser(chunk.Chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result = append(result, data...)
+	}
+
+	return result
+}
+
+func TestCoalesceAppends(t *testing.T) {
+	ctx := context.Background()
+	w, st, cleanup := getTestWriteBack(t)
+	defer cleanup()
+
+	inode := dbtest.Mkfile(t, w.Db, fuseops.RootInodeID).ID
+	expected := make([]byte, 0)
+
+	for i := 0; i < 3; i++ {
+		data := bytes.Repeat([]byte{byte('a' + i)}, 4096)
+		expected = append(expected, data...)
+		assert.Nil(t, w.Write(ctx, inode, syscall.O_APPEND, 0, data))
+	}
+
+	assert.Equal(t, 0, st.count())
+
+	i, err := w.Get(ctx, inode)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), i.Size, "buffered writes should not be visible before flushing")
+
+	assert.Nil(t, w.Flush(ctx, inode))
+	assert.Equal(t, 1, st.count())
+
+	i, err = w.Get(ctx, inode)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3*4096), i.Size)
+
+	chunks, err := w.Chunks(ctx, inode)
+	assert.Nil(t, err)
+	assert.Len(t, *chunks, 1)
+	assert.Equal(t, uint64(3*4096), (*chunks)[0].Size)
+
+	assert.Equal(t, expected, contents(t, w, inode))
+
+	assert.Nil(t, w.Flush(ctx, inode))
+	assert.Equal(t, 1, st.count(), "flushing without pending writes should not store anything")
+}
+
+func TestCoalesceScattered(t *testing.T) {
+	ctx := context.Background()
+	w, st, cleanup := getTestWriteBack(t)
+	defer cleanup()
+
+	inode := dbtest.Mkfile(t, w.Db, fuseops.RootInodeID).ID
+
+	assert.Nil(t, w.Write(ctx, inode, 0, 0, []byte("aaaa")))
+	assert.Nil(t, w.Write(ctx, inode, 0, 4, []byte("bbbb")))
+	assert.Nil(t, w.Write(ctx, inode, 0, 12, []byte("cccc")))
+	assert.Nil(t, w.Write(ctx, inode, 0, 2, []byte("dd")))
+	assert.Nil(t, w.Flush(ctx, inode))
+
+	assert.Equal(t, 1, st.count())
+
+	chunks, err := w.Chunks(ctx, inode)
+	assert.Nil(t, err)
+
+	keys := make(map[string]bool)
+	for _, chunk := range *chunks {
+		if chunk.Storage != "zero" {
+			keys[chunk.Key] = true
+		}
+	}
+
+	assert.Len(t, keys, 1, "every write should reference the same object")
+	assert.Equal(t, []byte("aaddbbbb\x00\x00\x00\x00cccc"), contents(t, w, inode))
+}
+
+func TestMaxSize(t *testing.T) {
+	ctx := context.Background()
+	w, st, cleanup := getTestWriteBack(t)
+	defer cleanup()
+
+	w.MaxSize = 8192
+	inode := dbtest.Mkfile(t, w.Db, fuseops.RootInodeID).ID
+
+	assert.Nil(t, w.Write(ctx, inode, 0, 0, make([]byte, 4096)))
+	assert.Equal(t, 0, st.count())
+
+	assert.Nil(t, w.Write(ctx, inode, 0, 4096, make([]byte, 4096)))
+	assert.Equal(t, 1, st.count())
+
+	i, err := w.Get(ctx, inode)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(8192), i.Size)
+}
+
+func TestBackgroundFlush(t *testing.T) {
+	ctx := context.Background()
+	w, st, cleanup := getTestWriteBack(t)
+	defer cleanup()
+
+	w.MaxAge = 50 * time.Millisecond
+	w.FlushInterval = 10 * time.Millisecond
+	assert.Nil(t, w.Init())
+	assert.Equal(t, errAlreadyInited, w.Init())
+
+	first := dbtest.Mkfile(t, w.Db, fuseops.RootInodeID).ID
+	second := dbtest.Mkfile(t, w.Db, fuseops.RootInodeID).ID
+
+	assert.Nil(t, w.Write(ctx, first, 0, 0, []byte("first")))
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 1, st.count())
+	assert.Equal(t, []byte("first"), contents(t, w, first))
+
+	assert.Nil(t, w.Write(ctx, second, 0, 0, []byte("second")))
+	assert.Nil(t, w.Destroy(ctx))
+	assert.Equal(t, 2, st.count())
+	assert.Equal(t, []byte("second"), contents(t, w, second))
+
+	assert.Equal(t, errNotInited, w.Destroy(ctx))
+}
+
+func TestFlushError(t *testing.T) {
+	ctx := context.Background()
+	w, _, cleanup := getTestWriteBack(t)
+	defer cleanup()
+
+	w.MaxAge = 0
+	w.FlushInterval = 10 * time.Millisecond
+	assert.Nil(t, w.Init())
+	defer w.Destroy(ctx)
+
+	missing := fuseops.InodeID(1 << 40)
+
+	assert.Nil(t, w.Write(ctx, missing, 0, 0, []byte("data")))
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, syscall.ENOENT, w.Flush(ctx, missing), "errors of background flushes should be reported")
+	assert.Nil(t, w.Flush(ctx, missing))
+}
+
+func TestDedup(t *testing.T) {
+	ctx := context.Background()
+	w, st, cleanup := getTestWriteBack(t)
+	defer cleanup()
+
+	w.Db.(*sqlite.Driver).Dedup = true
+	block := bytes.Repeat([]byte("titan"), 64*1024/5)
+
+	first := dbtest.Mkfile(t, w.Db, fuseops.RootInodeID).ID
+	second := dbtest.Mkfile(t, w.Db, fuseops.RootInodeID).ID
+
+	assert.Nil(t, w.Write(ctx, first, 0, 0, block))
+	assert.Nil(t, w.Flush(ctx, first))
+	assert.Nil(t, w.Write(ctx, second, 0, 0, block))
+	assert.Nil(t, w.Flush(ctx, second))
+
+	firstChunks, err := w.Chunks(ctx, first)
+	assert.Nil(t, err)
+
+	secondChunks, err := w.Chunks(ctx, second)
+	assert.Nil(t, err)
+
+	assert.Equal(t, (*firstChunks)[0].Key, (*secondChunks)[0].Key)
+	assert.Equal(t, block, contents(t, w, second))
+
+	assert.Nil(t, w.CleanOrphanChunks(ctx, time.Now().Add(time.Hour), st, 1))
+	assert.Equal(t, 1, st.live(), "identical data should be stored once")
+	assert.Equal(t, block, contents(t, w, second))
+}
+
+func TestVersions(t *testing.T) {
+	ctx := context.Background()
+	w, st, cleanup := getTestWriteBack(t)
+	defer cleanup()
+
+	w.Storage = versionedStorage{st}
+	inode := dbtest.Mkfile(t, w.Db, fuseops.RootInodeID).ID
+
+	assert.Nil(t, w.Write(ctx, inode, 0, 0, []byte("data")))
+	assert.Nil(t, w.Write(ctx, inode, 0, 8, []byte("more")))
+	assert.Nil(t, w.Flush(ctx, inode))
+
+	chunks, err := w.Chunks(ctx, inode)
+	assert.Nil(t, err)
+	assert.Len(t, *chunks, 3)
+
+	for _, chunk := range *chunks {
+		if chunk.Storage == "zero" {
+			continue
+		}
+
+		assert.Equal(t, "etag-"+chunk.Key, chunk.ETag, "the ETag of stored objects should be kept")
+		assert.Equal(t, "version-"+chunk.Key, chunk.Version, "the version of stored objects should be kept")
+	}
+}
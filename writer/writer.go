@@ -2,6 +2,8 @@ package writer
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"io"
 	"sync"
@@ -31,6 +33,10 @@ type Writer struct {
 	size       int64
 	mutex      *sync.Mutex
 	closed     bool
+
+	inflight   sync.WaitGroup
+	asyncMutex sync.Mutex
+	asyncError error
 }
 
 // NewWriter builds a writer
@@ -68,6 +74,28 @@ func (w *Writer) flush() error {
 	return nil
 }
 
+// Sync flushes the current open writer, if any, and waits for every
+// asynchronous flush to be done, so that all data written so far is stored
+// and its chunks committed. Errors of previous asynchronous flushes are
+// reported here.
+func (w *Writer) Sync() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	err := w.flush()
+	w.inflight.Wait()
+
+	w.asyncMutex.Lock()
+	defer w.asyncMutex.Unlock()
+
+	if err == nil {
+		err = w.asyncError
+	}
+
+	w.asyncError = nil
+	return err
+}
+
 // Close closes the current open writer, if any, and marks the writer as closed
 func (w *Writer) Close() {
 	w.mutex.Lock()
@@ -95,14 +123,22 @@ func (w *Writer) WriteAt(p []byte, off int64) (n int, err error) {
 
 	if w.writer == nil {
 		reader, writer := io.Pipe()
+		hash := sha256.New()
+		checksum := database.NewChecksum()
+
+		w.inflight.Add(1)
 
 		go func() {
-			chunk, gcErr := w.GetChunk(reader)
+			defer w.inflight.Done()
+
+			chunk, gcErr := w.GetChunk(io.TeeReader(reader, io.MultiWriter(hash, checksum)))
 			if gcErr != nil {
 				reader.CloseWithError(gcErr)
 
 				if !w.AsyncFlush {
 					w.flushError <- gcErr
+				} else {
+					w.setAsyncError(gcErr)
 				}
 
 				return
@@ -112,10 +148,14 @@ func (w *Writer) WriteAt(p []byte, off int64) (n int, err error) {
 				Inode:       w.InodeID,
 				InodeOffset: uint64(off),
 				Chunk:       *chunk,
+				Hash:        hex.EncodeToString(hash.Sum(nil)),
+				Checksum:    hex.EncodeToString(checksum.Sum(nil)),
 			})
 
 			if !w.AsyncFlush {
 				w.flushError <- acErr
+			} else if acErr != nil {
+				w.setAsyncError(acErr)
 			}
 		}()
 
@@ -134,3 +174,13 @@ func (w *Writer) WriteAt(p []byte, off int64) (n int, err error) {
 
 	return n, err
 }
+
+// setAsyncError keeps the first error of asynchronous flushes until reported
+func (w *Writer) setAsyncError(err error) {
+	w.asyncMutex.Lock()
+	defer w.asyncMutex.Unlock()
+
+	if w.asyncError == nil {
+		w.asyncError = err
+	}
+}
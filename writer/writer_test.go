@@ -0,0 +1,117 @@
+package writer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/manvalls/fuse/fuseops"
+	"github.com/manvalls/titan/database/dbtest"
+	"github.com/manvalls/titan/database/sqlite"
+	"github.com/manvalls/titan/storage"
+	"github.com/manvalls/titan/storage/file"
+	"github.com/stretchr/testify/assert"
+)
+
+type slowStorage struct {
+	storage.Storage
+}
+
+func (s slowStorage) GetChunk(reader io.Reader) (*storage.Chunk, error) {
+	time.Sleep(100 * time.Millisecond)
+	return s.Storage.GetChunk(reader)
+}
+
+func openTestDriver(t testing.TB, path string) *sqlite.Driver {
+	d := &sqlite.Driver{DbURI: path, BusyRetries: 10, ForeignKeys: true}
+	if err := d.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	return d
+}
+
+func TestSync(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "titan")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "titan.db")
+	st := &file.File{Storage: "file", Root: filepath.Join(dir, "chunks")}
+
+	d := openTestDriver(t, path)
+	if err = d.Setup(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	inode := dbtest.Mkfile(t, d, fuseops.RootInodeID).ID
+
+	w := NewWriter()
+	w.Db = d
+	w.Storage = slowStorage{st}
+	w.InodeID = inode
+	w.AsyncFlush = true
+
+	data := bytes.Repeat([]byte("titan"), 1000)
+	_, err = w.WriteAt(data, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Flush())
+
+	assert.Nil(t, w.Sync())
+	assert.Nil(t, w.Sync(), "syncing without pending writes should succeed")
+
+	// The writer is never closed, as if the process crashed right after syncing
+	d.Close()
+	d = openTestDriver(t, path)
+	defer d.Close()
+
+	i, err := d.Get(ctx, inode)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(len(data)), i.Size)
+
+	chunks, err := d.Chunks(ctx, inode)
+	assert.Nil(t, err)
+	assert.Len(t, *chunks, 1)
+
+	rc, err := st.GetReadCloser((*chunks)[0].Chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rc.Close()
+
+	stored, err := ioutil.ReadAll(rc)
+	assert.Nil(t, err)
+	assert.Equal(t, data, stored)
+}
+
+type failingStorage struct {
+	storage.Storage
+}
+
+func (failingStorage) GetChunk(reader io.Reader) (*storage.Chunk, error) {
+	return nil, syscall.EIO
+}
+
+func TestSyncError(t *testing.T) {
+	w := NewWriter()
+	w.Storage = failingStorage{}
+	w.AsyncFlush = true
+
+	_, err := w.WriteAt([]byte("data"), 0)
+	assert.Equal(t, syscall.EIO, err)
+
+	assert.Equal(t, syscall.EIO, w.Sync(), "errors of asynchronous flushes should be reported")
+	assert.Nil(t, w.Sync())
+}